@@ -0,0 +1,238 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package ads1x15 drives the ADS1115 16 bit and ADS1015 12 bit analog to
+// digital converters over the I2C mode of package bp. They measure far
+// more precisely than the ADC of the bus pirate.
+//
+// A Config selects the inputs, the full scale range and the data rate of
+// a measurement. Single does one conversion and waits for it to be
+// ready, polling the converter. StartContinuous makes the converter
+// convert over and over, Read returns the latest result.
+package ads1x15
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// BaseAddr is the address of the converter with ADDR tied to ground.
+// Tied to VDD, SDA or SCL, it adds 1, 2 or 3.
+const BaseAddr = 0x48
+
+// Registers.
+const (
+	regConversion = 0x00
+	regConfig     = 0x01
+)
+
+// Bits of the config register.
+const (
+	configOS       = 0x8000 // start a conversion, reads 1 when ready
+	configSingle   = 0x0100 // single shot mode, continuous otherwise
+	configCompQueu = 0x0003 // comparator off
+)
+
+// readyMargin is added to the time Single waits for a conversion, for the
+// tolerance of the oscillator of the converter and the round trips of
+// polling it.
+const readyMargin = 100 * time.Millisecond
+
+// Mux selects the inputs a conversion measures.
+type Mux uint16
+
+const (
+	Diff01 Mux = 0x0000 // AIN0 - AIN1
+	Diff03 Mux = 0x1000 // AIN0 - AIN3
+	Diff13 Mux = 0x2000 // AIN1 - AIN3
+	Diff23 Mux = 0x3000 // AIN2 - AIN3
+	AIN0   Mux = 0x4000 // AIN0 - GND
+	AIN1   Mux = 0x5000
+	AIN2   Mux = 0x6000
+	AIN3   Mux = 0x7000
+)
+
+// Gain selects the full scale range of a conversion. The inputs must not
+// exceed VDD, whatever the range.
+type Gain uint16
+
+const (
+	FS6144 Gain = 0x0000 // ±6.144 V
+	FS4096 Gain = 0x0200 // ±4.096 V
+	FS2048 Gain = 0x0400 // ±2.048 V
+	FS1024 Gain = 0x0600 // ±1.024 V
+	FS512  Gain = 0x0800 // ±0.512 V
+	FS256  Gain = 0x0a00 // ±0.256 V
+)
+
+// FullScale returns the full scale range of g in volts.
+func (g Gain) FullScale() float64 {
+	switch g {
+	case FS6144:
+		return 6.144
+	case FS4096:
+		return 4.096
+	case FS2048:
+		return 2.048
+	case FS1024:
+		return 1.024
+	case FS512:
+		return 0.512
+	}
+	return 0.256
+}
+
+// data rates in samples per second, by the value of the DR bits
+var (
+	rates1115 = []int{8, 16, 32, 64, 128, 250, 475, 860}
+	rates1015 = []int{128, 250, 490, 920, 1600, 2400, 3300}
+)
+
+// Config is the configuration of a conversion. The zero Config measures
+// AIN0 - AIN1 with a range of ±6.144 V at the default data rate.
+type Config struct {
+	Mux  Mux
+	Gain Gain
+
+	// Rate is the data rate in samples per second, one of 8, 16, 32,
+	// 64, 128, 250, 475 and 860 on the ADS1115 and of 128, 250, 490,
+	// 920, 1600, 2400 and 3300 on the ADS1015. 0 means the default, 128
+	// and 1600.
+	Rate int
+}
+
+// Dev is an ADS1115 or ADS1015.
+type Dev struct {
+	t     bp.I2CTransactor8x8
+	addr  bp.Addr7
+	rates []int
+	shift uint // of the result in the conversion register
+
+	gain Gain // of the conversions started last
+}
+
+// New1115 returns the ADS1115 at the 7 bit address addr.
+func New1115(t bp.I2CTransactor8x8, addr uint8) *Dev {
+	return &Dev{t: t, addr: bp.Addr7(addr), rates: rates1115, gain: FS2048}
+}
+
+// New1015 returns the ADS1015 at the 7 bit address addr.
+func New1015(t bp.I2CTransactor8x8, addr uint8) *Dev {
+	return &Dev{t: t, addr: bp.Addr7(addr), rates: rates1015, shift: 4, gain: FS2048}
+}
+
+// config returns the value of the config register for c, without the OS
+// and mode bits, and the time a conversion takes.
+func (d *Dev) config(c Config) (uint16, time.Duration, error) {
+	dr := -1
+	if c.Rate == 0 {
+		dr = 4
+	}
+	for i, r := range d.rates {
+		if r == c.Rate {
+			dr = i
+		}
+	}
+	if dr < 0 {
+		return 0, 0, d.err("config", fmt.Errorf("unsupported data rate %d", c.Rate))
+	}
+	if c.Gain > FS256 || c.Gain&^0x0e00 != 0 || c.Mux&^0x7000 != 0 {
+		return 0, 0, d.err("config", fmt.Errorf("invalid config %+v", c))
+	}
+	v := uint16(c.Mux) | uint16(c.Gain) | uint16(dr)<<5 | configCompQueu
+	return v, time.Second / time.Duration(d.rates[dr]), nil
+}
+
+func (d *Dev) writeReg(op string, reg uint8, v uint16) error {
+	if _, _, err := d.t.Transact8x8(d.addr, reg, []byte{byte(v >> 8), byte(v)}, nil); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+func (d *Dev) readReg(op string, reg uint8) (uint16, error) {
+	r := make([]byte, 2)
+	if _, _, err := d.t.Transact8x8(d.addr, reg, nil, r); err != nil {
+		return 0, d.err(op, err)
+	}
+	return uint16(r[0])<<8 | uint16(r[1]), nil
+}
+
+// Single does a conversion with configuration c and returns the voltage
+// measured. It waits for the conversion to be ready by polling the
+// converter, giving up after four conversion times and readyMargin.
+func (d *Dev) Single(c Config) (float64, error) {
+	v, period, err := d.config(c)
+	if err != nil {
+		return 0, err
+	}
+	if err := d.writeReg("single", regConfig, v|configOS|configSingle); err != nil {
+		return 0, err
+	}
+	d.gain = c.Gain
+
+	time.Sleep(period)
+	deadline := time.Now().Add(3*period + readyMargin)
+	for {
+		conf, err := d.readReg("single", regConfig)
+		if err != nil {
+			return 0, err
+		}
+		if conf&configOS != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return 0, d.err("single", fmt.Errorf("conversion not ready after %v", 4*period+readyMargin))
+		}
+	}
+	return d.Read()
+}
+
+// StartContinuous makes the converter convert continuously with
+// configuration c.
+func (d *Dev) StartContinuous(c Config) error {
+	v, _, err := d.config(c)
+	if err != nil {
+		return err
+	}
+	if err := d.writeReg("start continuous", regConfig, v); err != nil {
+		return err
+	}
+	d.gain = c.Gain
+	return nil
+}
+
+// Stop ends continuous conversion, the converter powers down.
+func (d *Dev) Stop() error {
+	v, _, err := d.config(Config{Gain: d.gain})
+	if err != nil {
+		return err
+	}
+	return d.writeReg("stop", regConfig, v|configSingle)
+}
+
+// Read returns the voltage of the latest conversion.
+func (d *Dev) Read() (float64, error) {
+	raw, err := d.ReadRaw()
+	if err != nil {
+		return 0, err
+	}
+	return float64(raw) * d.gain.FullScale() / float64(int(0x8000)>>d.shift), nil
+}
+
+// ReadRaw returns the latest conversion result in counts, -32768 to
+// 32767 on the ADS1115 and -2048 to 2047 on the ADS1015.
+func (d *Dev) ReadRaw() (int16, error) {
+	v, err := d.readReg("read", regConversion)
+	if err != nil {
+		return 0, err
+	}
+	return int16(v) >> d.shift, nil
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("ads1x15 %v: %s: %w", d.addr, op, err)
+}
@@ -0,0 +1,102 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+// All traffic with the bus pirate happens on one goroutine, the I/O
+// goroutine, which runs the queued jobs one after the other in the order
+// they were queued. Calls hand their work to it with do and wait for it,
+// SubmitTransact queues work without waiting and the sniffer queues its
+// reads, so control traffic takes turns with them. The I/O goroutine is
+// started when work is queued and exits when the queue is empty, there is
+// never more than one.
+//
+// Jobs take the lock themselves when they touch the state of the bus
+// pirate, which is shared with calls that don't talk to the device.
+
+// Result is the outcome of a transaction submitted with SubmitTransact.
+type Result struct {
+	NW, NR int // bytes written and read, as returned by Transact8x8
+	Err    error
+}
+
+// SubmitTransact queues Transact8x8(addr, regaddr, w, r) and returns
+// right away. The returned channel receives the result once the
+// transaction is done, r is filled then. w and r must not be touched
+// until the result is in.
+//
+// Queued work of a bus pirate runs in the order it was queued. This keeps
+// the link busy while the results are processed elsewhere. Calls on the
+// bus pirate wait for the transactions submitted before them. The channel
+// is buffered, a result nobody waits for is not leaked.
+func (nsi NonStrictI2C) SubmitTransact(addr Addr, regaddr uint8, w []byte, r []byte) <-chan Result {
+	ch := make(chan Result, 1)
+	nsi.bp.submit(func() {
+		var res Result
+		res.Err = nsi.bp.retryDirect("i2c.Transact8x8", func() (err error) {
+			res.NW, res.NR, err = nsi.transact8x8(addr, regaddr, w, r)
+			return err
+		})
+		ch <- res
+	})
+	return ch
+}
+
+// do runs fn on the I/O goroutine, waits for it and returns its error. A
+// panic of fn is passed on to the caller. do must not be called from the
+// I/O goroutine.
+func (bp *BusPirate) do(fn func() error) error {
+	var (
+		err error
+		p   interface{}
+	)
+	done := make(chan struct{})
+	bp.submit(func() {
+		defer close(done)
+		defer func() { p = recover() }()
+		err = fn()
+	})
+	<-done
+	if p != nil {
+		panic(p)
+	}
+	return err
+}
+
+// submit queues job, starting the I/O goroutine if it isn't running.
+func (bp *BusPirate) submit(job func()) {
+	bp.qmu.Lock()
+	defer bp.qmu.Unlock()
+	bp.queue = append(bp.queue, job)
+	if !bp.qrunning {
+		bp.qrunning = true
+		go bp.serve()
+	}
+}
+
+// serve runs the queued jobs until the queue is empty.
+func (bp *BusPirate) serve() {
+	for {
+		bp.qmu.Lock()
+		if len(bp.queue) == 0 {
+			bp.qrunning = false
+			bp.qmu.Unlock()
+			return
+		}
+		job := bp.queue[0]
+		bp.queue[0] = nil
+		bp.queue = bp.queue[1:]
+		bp.qmu.Unlock()
+
+		job()
+	}
+}
+
+// Pending returns the number of queued jobs that have not started yet,
+// submitted transactions and waiting calls.
+func (bp *BusPirate) Pending() int {
+	bp.qmu.Lock()
+	defer bp.qmu.Unlock()
+	return len(bp.queue)
+}
@@ -0,0 +1,170 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/distributed/bp/sim"
+)
+
+// logDevice is a register file logging the first data byte written in
+// every transaction, the register address.
+type logDevice struct {
+	sim.Registers
+
+	mu    sync.Mutex
+	regs  []byte
+	first bool
+}
+
+func (d *logDevice) Start(read bool) {
+	d.first = !read
+	d.Registers.Start(read)
+}
+
+func (d *logDevice) Write(b byte) bool {
+	if d.first {
+		d.mu.Lock()
+		d.regs = append(d.regs, b)
+		d.mu.Unlock()
+		d.first = false
+	}
+	return d.Registers.Write(b)
+}
+
+func (d *logDevice) log() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]byte(nil), d.regs...)
+}
+
+func simI2C(t *testing.T, addr uint8, dev sim.Device) (*BusPirate, NonStrictI2C) {
+	t.Helper()
+	s := sim.New()
+	s.StartInBinary()
+	s.Attach(addr, dev)
+	b := NewBusPirate(s)
+	if err := b.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	nsi, err := b.EnterNonStrictI2CMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, nsi
+}
+
+func TestSubmitTransactOrder(t *testing.T) {
+	dev := &logDevice{}
+	b, nsi := simI2C(t, 0x50, dev)
+
+	// the submitted transactions are carried out before the direct
+	// call, which waits for them
+	var chans []<-chan Result
+	for reg := byte(0); reg < 8; reg++ {
+		chans = append(chans, nsi.SubmitTransact(Addr7(0x50), reg, []byte{reg + 0x10}, nil))
+	}
+	r := make([]byte, 8)
+	if _, _, err := nsi.Transact8x8(Addr7(0x50), 0x40, nil, r); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.Pending(); n != 0 {
+		t.Errorf("%d jobs pending after a direct call", n)
+	}
+	for i, ch := range chans {
+		select {
+		case res := <-ch:
+			if res.Err != nil || res.NW != 1 {
+				t.Errorf("transaction %d: %+v", i, res)
+			}
+		default:
+			t.Fatalf("result of transaction %d not in after the direct call", i)
+		}
+	}
+
+	// and submitted after it, they follow it
+	ch := nsi.SubmitTransact(Addr7(0x50), 0x80, nil, r)
+	if err := nsi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := nsi.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-ch; res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	want := []byte{0, 1, 2, 3, 4, 5, 6, 7, 0x40, 0x80}
+	if got := dev.log(); string(got) != string(want) {
+		t.Errorf("transactions for registers % x, want % x", got, want)
+	}
+	for reg := 0; reg < 8; reg++ {
+		if v := dev.Regs[reg]; v != byte(reg)+0x10 {
+			t.Errorf("register %d is %#02x, want %#02x", reg, v, reg+0x10)
+		}
+	}
+}
+
+func TestDoPanic(t *testing.T) {
+	b := NewBusPirate(sim.New())
+
+	func() {
+		defer func() {
+			if p := recover(); p != "job panicked" {
+				t.Errorf("recovered %v, want the panic of the job", p)
+			}
+		}()
+		b.do(func() error { panic("job panicked") })
+		t.Error("do returned after a panic")
+	}()
+
+	// the I/O goroutine survives the panic and runs the next jobs in
+	// order
+	var got []int
+	done := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		i := i
+		b.submit(func() { got = append(got, i) })
+	}
+	b.submit(func() { close(done) })
+	<-done
+	if err := b.do(func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0] != 0 || got[1] != 1 || got[2] != 2 {
+		t.Errorf("jobs ran as %v, want [0 1 2]", got)
+	}
+	if n := b.Pending(); n != 0 {
+		t.Errorf("%d jobs pending", n)
+	}
+}
+
+func TestDoPanicUnlocks(t *testing.T) {
+	_, nsi := simI2C(t, 0x50, &sim.Registers{})
+
+	// an operation panicking must not leave the lock held
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("no panic")
+			}
+		}()
+		nsi.bp.do(func() (err error) {
+			nsi.bp.mu.Lock()
+			defer nsi.bp.unlock(&err)
+			panic("in an operation")
+		})
+	}()
+
+	if err := nsi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := nsi.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
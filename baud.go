@@ -0,0 +1,248 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distributed/bp/wire"
+	"github.com/distributed/sers"
+)
+
+// The bus pirate v3 talks to the host through an FTDI chip, the UART
+// between the two runs at 115200 baud after every reset. At that rate,
+// the link and not the bus limits large reads and busy sniffers. The
+// terminal's 'b' menu switches the UART to another rate until the next
+// reset, the FTDI chip follows the rate set on the host. The v4 is a USB
+// device of its own, its rate is meaningless.
+
+// DefaultBaudRate is the rate of the serial link after a reset of the
+// bus pirate.
+const DefaultBaudRate = 115200
+
+// BaudConn is a Conn whose baud rate can be changed, like sers.SerialPort.
+// Pass a BaudConn to NewBusPirate to make SetBaudRate work.
+type BaudConn interface {
+	Conn
+	SetMode(baudrate, databits, parity, stopbits, handshake int) error
+}
+
+// ErrNoBaudControl is returned by SetBaudRate if the Conn is not a
+// BaudConn.
+var ErrNoBaudControl = errors.New("connection can't change its baud rate")
+
+// baudclock is the rate the UART of the bus pirate v3 divides down, the
+// raw BRG value of the 'b' menu is baudclock/rate - 1.
+const baudclock = 4000000
+
+// SetBaudRate switches the serial link to baud, which has to be
+// DefaultBaudRate or one of Capabilities.HostBaudRates. The bus pirate is
+// reset into its terminal to change the rate, then binary mode and the
+// mode that was active before are entered again, like Resync. Mode
+// handles remain usable. The versions printed on the reset replace those
+// cached by Version.
+//
+// If the bus pirate doesn't answer at the new rate, it is reset and the
+// link falls back to DefaultBaudRate. Every reset of the bus pirate, by
+// Close, ResetHardware and the like, returns the link to DefaultBaudRate.
+// The Conn passed to NewBusPirate has to be a BaudConn.
+func (bp *BusPirate) SetBaudRate(baud int) error {
+	return bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		return bp.report(bp.setBaudRate(baud))
+	})
+}
+
+func (bp *BusPirate) setBaudRate(baud int) error {
+	mode := bp.mode
+	switch mode {
+	case MODE_CLOSED:
+		return &OpError{"SetBaudRate", mode, nil, ErrNotOpen}
+	case MODE_UNKNOWN, MODE_I2C_SNIFF:
+		return &OpError{"SetBaudRate", mode, nil, ModeError("can't change the baud rate in " + mode.String() + " mode")}
+	}
+
+	if _, ok := bp.link.Conn.(BaudConn); !ok {
+		return &OpError{"SetBaudRate", mode, nil, ErrNoBaudControl}
+	}
+	if bp.version != nil && !hostBaudSupported(CapabilitiesFor(*bp.version), baud) {
+		return &OpError{"SetBaudRate", mode, nil, ErrNotSupported}
+	}
+
+	prevgen := bp.gen
+	if err := bp.settle(); err != nil {
+		return err
+	}
+	if mode != MODE_BITBANG {
+		if err := bp.enterBitbangMode(); err != nil {
+			return &OpError{"SetBaudRate", mode, nil, err}
+		}
+	}
+
+	// resets the bus pirate into its terminal at the default rate, it
+	// prints its versions on the way
+	if err := bp.exchangeByteAndExpect(wire.ResetTerminal, wire.OK); err != nil {
+		bp.clearMode()
+		return &OpError{"SetBaudRate", mode, nil, err}
+	}
+	bp.clearMode()
+	if err := bp.resetBaud(); err != nil {
+		return &OpError{"SetBaudRate", mode, nil, err}
+	}
+
+	if err := bp.c.SetReadParams(0, 0.5); err != nil {
+		return &OpError{"SetBaudRate", mode, nil, err}
+	}
+	text, err := readQuiet(bp.c)
+	if err != nil {
+		return &OpError{"SetBaudRate", mode, nil, err}
+	}
+	if v := parseInfo(string(text)); v.Hardware != "" {
+		bp.version = &v
+	}
+
+	var serr error
+	switch {
+	case bp.version == nil:
+		serr = fmt.Errorf("%w: no boot banner after reset", ErrNoBusPirate)
+	case !hostBaudSupported(CapabilitiesFor(*bp.version), baud):
+		serr = ErrNotSupported
+	case baud != DefaultBaudRate:
+		serr = bp.switchBaud(baud)
+	}
+
+	if err := bp.enterBinary(); err != nil {
+		return err
+	}
+	if err := bp.restore(mode, prevgen); err != nil {
+		return err
+	}
+	if serr != nil {
+		return &OpError{"SetBaudRate", mode, nil, serr}
+	}
+	return nil
+}
+
+// hostBaudSupported reports whether a bus pirate with the capabilities c
+// can talk to the host at baud.
+func hostBaudSupported(c Capabilities, baud int) bool {
+	if baud == DefaultBaudRate {
+		return true
+	}
+	for _, b := range c.HostBaudRates {
+		if b == baud {
+			return true
+		}
+	}
+	return false
+}
+
+// switchBaud goes through the 'b' menu of the terminal to switch the
+// link to baud. If the bus pirate doesn't answer at the new rate, it is
+// reset and the link returns to the default rate. The bus pirate is left
+// in its terminal.
+func (bp *BusPirate) switchBaud(baud int) error {
+	bp.logf(SubsysOpen, LogInfo, "switching the serial link to %d baud", baud)
+
+	// menu choice 10 takes a raw value for the baud rate generator
+	brg := baudclock/baud - 1
+	if err := bp.terminal("b\n", ">"); err != nil {
+		return err
+	}
+	if err := bp.terminal("10\n", ">"); err != nil {
+		return err
+	}
+	if err := bp.terminal(strconv.Itoa(brg)+"\n", "Space to continue"); err != nil {
+		return err
+	}
+
+	// the bus pirate runs at the new rate now and waits for a space
+	// sent at it
+	if err := bp.link.flush(); err != nil {
+		return err
+	}
+	bc := bp.link.Conn.(BaudConn)
+	if err := bc.SetMode(baud, 8, sers.N, 1, sers.NO_HANDSHAKE); err != nil {
+		return err
+	}
+	bp.baud = baud
+	if err := bp.terminal(" ", ">"); err != nil {
+		bp.logf(SubsysOpen, LogError, "no answer at %d baud, falling back to %d baud", baud, DefaultBaudRate)
+		if _, err := bp.c.Write([]byte("#\n")); err == nil {
+			bp.link.flush()
+		}
+		time.Sleep(hardresetboot)
+		if err := bp.resetBaud(); err != nil {
+			bp.logf(SubsysOpen, LogError, "falling back: %v", err)
+		}
+		return fmt.Errorf("%w: no answer at %d baud", ErrUnexpectedResponse, baud)
+	}
+
+	bp.logf(SubsysOpen, LogInfo, "serial link at %d baud", baud)
+	return nil
+}
+
+// terminal sends cmd to the terminal of the bus pirate and reads its
+// output until it contains want.
+func (bp *BusPirate) terminal(cmd, want string) error {
+	if _, err := bp.c.Write([]byte(cmd)); err != nil {
+		return err
+	}
+	if err := bp.c.SetReadParams(0, 0.1); err != nil {
+		return err
+	}
+
+	var (
+		text []byte
+		buf  [64]byte
+	)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		n, err := bp.c.Read(buf[:])
+		text = append(text, buf[:n]...)
+		if strings.Contains(string(text), want) {
+			return nil
+		}
+		if err != nil && !isTimeout(err) {
+			return err
+		}
+	}
+	bp.logf(SubsysOpen, LogDebug, "terminal: sent %q, got %q", cmd, text)
+	return fmt.Errorf("%w: terminal didn't answer %q with %q", ErrUnexpectedResponse, strings.TrimSpace(cmd), want)
+}
+
+// resetBaud returns the host side of the link to the default rate after
+// the bus pirate was reset. Bytes sent before are flushed at the old
+// rate. The caller has to hold the lock.
+func (bp *BusPirate) resetBaud() error {
+	if bp.baud == 0 {
+		return nil
+	}
+	bp.baud = 0
+	if err := bp.link.flush(); err != nil {
+		return err
+	}
+	bc, ok := bp.link.Conn.(BaudConn)
+	if !ok {
+		return nil
+	}
+	bp.logf(SubsysOpen, LogInfo, "serial link back at %d baud", DefaultBaudRate)
+	return bc.SetMode(DefaultBaudRate, 8, sers.N, 1, sers.NO_HANDSHAKE)
+}
+
+// BaudRate returns the rate of the serial link as set by SetBaudRate.
+func (bp *BusPirate) BaudRate() int {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.baud == 0 {
+		return DefaultBaudRate
+	}
+	return bp.baud
+}
@@ -0,0 +1,449 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package bench benchmarks the transport layer of package bp: start and
+// stop conditions, bulk writes, write then read and sniffer throughput.
+//
+// A Benchmark prepares an Op on a Target, which is then carried out over
+// and over. Run does so for a list of benchmarks, as the bp bench command
+// does, and prints the results in the format of go test -bench, so
+// benchstat can compare them between releases. The tests of this package
+// run the same benchmarks on the simulator as Go benchmarks.
+//
+// A Target is the bus pirate the benchmarks run against. NewSim returns
+// one on the simulator of package sim whose link takes a fixed time for
+// every round trip. Its results don't depend on the machine, they follow
+// the number of round trips and bytes on the wire, which is what a
+// regression of the transport layer changes.
+//
+// On hardware, the benchmarks need a device with 256 bytes of registers
+// or memory at Target.Addr, a 24C02 EEPROM does, which they write to. The
+// sniffer benchmark needs a loopback: a second bus pirate whose I2C lines
+// are wired to those of the first, it sniffs the traffic the first one
+// drives.
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distributed/bp"
+	"github.com/distributed/bp/sim"
+)
+
+// Target is a bus pirate to run the benchmarks against, in binary mode.
+type Target struct {
+	BP *bp.BusPirate
+
+	// Addr is the 7 bit address of the device the benchmarks talk to.
+	Addr uint8
+
+	// Sniffer is a second bus pirate on the same bus, for the sniffer
+	// benchmark. It is skipped if Sniffer is nil.
+	Sniffer *bp.BusPirate
+}
+
+// DefaultAddr is the address of the device of the simulated target, and
+// that of a 24C02 EEPROM with its address pins tied low.
+const DefaultAddr = 0x50
+
+// DefaultLatency is the time a round trip takes on the link of the
+// simulated target, about that of a USB full speed serial adapter.
+const DefaultLatency = 2 * time.Millisecond
+
+// NewSim returns a target on a simulated bus pirate with a register file
+// at DefaultAddr, and a second simulator tapping its bus as the sniffer.
+// Every write to the simulators takes latency, so a round trip costs
+// about that much, values below 0 mean DefaultLatency.
+func NewSim(latency time.Duration) (Target, error) {
+	if latency < 0 {
+		latency = DefaultLatency
+	}
+	s := sim.New()
+	s.StartInBinary()
+	s.Attach(DefaultAddr, &sim.Registers{})
+	ss := sim.New()
+	ss.StartInBinary()
+	s.Tap(ss)
+
+	b := bp.NewBusPirate(&slowConn{Sim: s, latency: latency})
+	if err := b.Open(); err != nil {
+		return Target{}, err
+	}
+	sb := bp.NewBusPirate(&slowConn{Sim: ss, latency: latency})
+	if err := sb.Open(); err != nil {
+		b.Close()
+		return Target{}, err
+	}
+	return Target{BP: b, Addr: DefaultAddr, Sniffer: sb}, nil
+}
+
+// slowConn delays the writes to a simulator by latency.
+type slowConn struct {
+	*sim.Sim
+	latency time.Duration
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.latency)
+	return c.Sim.Write(b)
+}
+
+// ErrSkip is returned by the setup of a benchmark that can't run against
+// a target.
+var ErrSkip = errors.New("bench: skipped")
+
+// Op is the operation a benchmark measures.
+type Op struct {
+	// Do carries out the operation once.
+	Do func() error
+
+	// Bytes is the payload Do moves, for the throughput, 0 if there is
+	// none.
+	Bytes int64
+
+	// Done, if not nil, is called after the last Do. It checks the
+	// outcome and undoes the setup.
+	Done func() error
+}
+
+// Benchmark is a benchmark, run by Run.
+type Benchmark struct {
+	Name string
+
+	// Setup prepares the benchmark on t and returns its operation, or
+	// an error matching ErrSkip if the benchmark doesn't apply to t.
+	Setup func(t Target) (*Op, error)
+}
+
+// All are the benchmarks of this package.
+var All = []Benchmark{
+	{"StartStop", StartStop},
+	{"WriteByte", WriteByte},
+	{"BulkWrite", BulkWrite},
+	{"WriteThenRead", WriteThenRead},
+	{"ReadMem", ReadMem},
+	{"Sniffer", Sniffer},
+}
+
+// BenchTime is how long each benchmark runs: for D, the number of
+// operations is raised until they take that long, unless N is set, which
+// fixes the number of operations.
+type BenchTime struct {
+	D time.Duration
+	N int
+}
+
+// ParseBenchTime parses a benchmark time like go test -benchtime does,
+// "1s" or "100x".
+func ParseBenchTime(s string) (BenchTime, error) {
+	if strings.HasSuffix(s, "x") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "x"))
+		if err != nil || n <= 0 {
+			return BenchTime{}, fmt.Errorf("bench: invalid count %q", s)
+		}
+		return BenchTime{N: n}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return BenchTime{}, fmt.Errorf("bench: invalid duration %q", s)
+	}
+	return BenchTime{D: d}, nil
+}
+
+// Result is the result of a benchmark run by Run.
+type Result struct {
+	Name string
+	N    int           // number of operations
+	T    time.Duration // time they took
+	B    int64         // payload of an operation
+
+	// WireBytes is the number of bytes sent to the bus pirate by the N
+	// operations, which tells about the framing overhead.
+	WireBytes int64
+}
+
+// NsPerOp returns the time an operation took in nanoseconds.
+func (r Result) NsPerOp() int64 {
+	if r.N <= 0 {
+		return 0
+	}
+	return r.T.Nanoseconds() / int64(r.N)
+}
+
+// String returns the result like go test -bench prints it, without the
+// name.
+func (r Result) String() string {
+	s := fmt.Sprintf("%8d\t%10d ns/op", r.N, r.NsPerOp())
+	if r.B > 0 && r.T > 0 {
+		mb := float64(r.B) * float64(r.N) / 1e6 / r.T.Seconds()
+		s += fmt.Sprintf("\t%7.2f MB/s", mb)
+	}
+	if r.N > 0 {
+		s += fmt.Sprintf("\t%.1f wire-B/op", float64(r.WireBytes)/float64(r.N))
+	}
+	return s
+}
+
+// Run runs the benchmarks whose names match pattern, all of them if it is
+// empty, against t for bt each and prints their results to w.
+func Run(w io.Writer, t Target, pattern string, bt BenchTime, benchmarks []Benchmark) ([]Result, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	header(w, t)
+	var results []Result
+	for _, bm := range benchmarks {
+		if !re.MatchString(bm.Name) {
+			continue
+		}
+		r, err := measure(t, bm, bt)
+		if errors.Is(err, ErrSkip) {
+			fmt.Fprintf(w, "--- SKIP: Benchmark%s\n\t%v\n", bm.Name, err)
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(w, "--- FAIL: Benchmark%s\n\t%v\n", bm.Name, err)
+			continue
+		}
+		fmt.Fprintf(w, "Benchmark%s\t%s\n", bm.Name, r)
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// measure runs bm against t for bt. Like go test, it raises the number of
+// operations until they take bt.D.
+func measure(t Target, bm Benchmark, bt BenchTime) (r Result, err error) {
+	op, err := bm.Setup(t)
+	if err != nil {
+		return Result{}, err
+	}
+	if op.Done != nil {
+		defer func() {
+			if derr := op.Done(); err == nil {
+				err = derr
+			}
+		}()
+	}
+
+	r = Result{Name: bm.Name, B: op.Bytes}
+	n := 1
+	if bt.N > 0 {
+		n = bt.N
+	}
+	for {
+		written := t.BP.Stats().BytesWritten
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if err := op.Do(); err != nil {
+				return Result{}, err
+			}
+		}
+		r.N, r.T = n, time.Since(start)
+		r.WireBytes = int64(t.BP.Stats().BytesWritten - written)
+		if bt.N > 0 || r.T >= bt.D || n >= 1e9 {
+			return r, nil
+		}
+
+		// aim 20% beyond the time, growing at most 100 fold
+		next := 100 * n
+		if r.T > 0 {
+			if p := int(int64(n) * int64(bt.D) * 6 / 5 / int64(r.T)); p < next {
+				next = p
+			}
+		}
+		if next <= n {
+			next = n + 1
+		}
+		n = next
+	}
+}
+
+// header prints the configuration of t in the format of benchmark
+// results.
+func header(w io.Writer, t Target) {
+	st := t.BP.Status()
+	if st.Version != nil {
+		fmt.Fprintf(w, "hardware: %s\n", st.Version.Hardware)
+		fmt.Fprintf(w, "firmware: %s\n", st.Version.Firmware)
+	}
+	fmt.Fprintf(w, "baud: %d\n", st.BaudRate)
+}
+
+// i2c returns the I2C handle of the bus pirate of t, entering I2C mode if
+// needed.
+func i2c(t Target) (bp.NonStrictI2C, error) {
+	h, err := t.BP.EnterMode(bp.MODE_I2C)
+	if err != nil {
+		return bp.NonStrictI2C{}, fmt.Errorf("bench: enter I2C mode: %w", err)
+	}
+	return bp.NonStrictI2C{BusPirateI2C: h.(bp.BusPirateI2C)}, nil
+}
+
+// StartStop measures a start condition followed by a stop condition.
+func StartStop(t Target) (*Op, error) {
+	h, err := i2c(t)
+	if err != nil {
+		return nil, err
+	}
+	return &Op{Do: func() error {
+		if err := h.Start(); err != nil {
+			return err
+		}
+		return h.Stop()
+	}}, nil
+}
+
+// WriteByte measures writing 16 bytes to the device byte by byte, each
+// an operation of its own.
+func WriteByte(t Target) (*Op, error) {
+	h, err := i2c(t)
+	if err != nil {
+		return nil, err
+	}
+	data := pattern(16)
+	return &Op{Bytes: int64(len(data)), Do: func() error {
+		if err := h.Start(); err != nil {
+			return err
+		}
+		for _, c := range append([]byte{t.Addr << 1, 0}, data...) {
+			if err := h.WriteByte(c); err != nil {
+				return err
+			}
+		}
+		return h.Stop()
+	}}, nil
+}
+
+// BulkWrite measures writing 64 bytes to the device in a pipeline, sent
+// as bulk write commands.
+func BulkWrite(t Target) (*Op, error) {
+	h, err := i2c(t)
+	if err != nil {
+		return nil, err
+	}
+	data := pattern(64)
+	return &Op{Bytes: int64(len(data)), Do: func() error {
+		p := h.Pipeline()
+		p.Start()
+		p.Write(t.Addr<<1, 0)
+		p.Write(data...)
+		p.Stop()
+		return p.Flush()
+	}}, nil
+}
+
+// WriteThenRead measures reading 32 registers with Transact8x8.
+func WriteThenRead(t Target) (*Op, error) {
+	h, err := i2c(t)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]byte, 32)
+	return &Op{Bytes: int64(len(r)), Do: func() error {
+		_, _, err := h.Transact8x8(bp.Addr7(t.Addr), 0, nil, r)
+		return err
+	}}, nil
+}
+
+// ReadMem measures reading the 256 bytes of the device with ReadMem.
+func ReadMem(t Target) (*Op, error) {
+	h, err := i2c(t)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]byte, 256)
+	return &Op{Bytes: int64(len(r)), Do: func() error {
+		_, err := h.ReadMem(bp.Addr7(t.Addr), 0, 1, r, nil)
+		return err
+	}}, nil
+}
+
+// Sniffer measures how fast the sniffer of t.Sniffer delivers the events
+// of 16 byte writes driven by the bus pirate of t. Every operation waits
+// for the stop condition of its write to be delivered.
+func Sniffer(t Target) (*Op, error) {
+	if t.Sniffer == nil {
+		return nil, fmt.Errorf("%w: no second bus pirate to sniff with", ErrSkip)
+	}
+	h, err := i2c(t)
+	if err != nil {
+		return nil, err
+	}
+
+	sh, err := t.Sniffer.EnterMode(bp.MODE_I2C)
+	if err != nil {
+		return nil, fmt.Errorf("bench: enter I2C mode on the sniffer: %w", err)
+	}
+
+	var (
+		mu    sync.Mutex
+		stops = make(chan struct{}, 1)
+		bytes int64
+		ops   int64
+	)
+	s, err := sh.(bp.BusPirateI2C).SniffFunc(func(ev bp.SniffEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		switch ev.Type {
+		case bp.SniffByte:
+			bytes++
+		case bp.SniffStop:
+			select {
+			case stops <- struct{}{}:
+			default:
+			}
+		}
+		return nil
+	}, t.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("bench: start sniffer: %w", err)
+	}
+
+	data := pattern(16)
+	return &Op{
+		Bytes: int64(len(data) + 2),
+		Do: func() error {
+			if _, _, err := h.Transact8x8(bp.Addr7(t.Addr), 0, data, nil); err != nil {
+				return err
+			}
+			select {
+			case <-stops:
+			case <-time.After(time.Second):
+				return errors.New("bench: sniffer missed a transaction")
+			}
+			ops++
+			return nil
+		},
+		Done: func() error {
+			if err := s.Stop(); err != nil {
+				return fmt.Errorf("bench: stop sniffer: %w", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if want := ops * int64(len(data)+2); bytes < want {
+				return fmt.Errorf("bench: sniffed %d bytes, want %d", bytes, want)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// pattern returns n bytes of test data.
+func pattern(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i*7 + 1)
+	}
+	return p
+}
@@ -0,0 +1,116 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bench
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// simTarget returns a simulated target without link latency, closed when
+// b ends.
+func simTarget(tb testing.TB) Target {
+	tb.Helper()
+	t, err := NewSim(0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		t.BP.Close()
+		t.Sniffer.Close()
+	})
+	return t
+}
+
+func benchmark(b *testing.B, setup func(Target) (*Op, error)) {
+	t := simTarget(b)
+	op, err := setup(t)
+	if errors.Is(err, ErrSkip) {
+		b.Skip(err)
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	written := t.BP.Stats().BytesWritten
+	b.SetBytes(op.Bytes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := op.Do(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(t.BP.Stats().BytesWritten-written)/float64(b.N), "wire-B/op")
+
+	if op.Done != nil {
+		if err := op.Done(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStartStop(b *testing.B)     { benchmark(b, StartStop) }
+func BenchmarkWriteByte(b *testing.B)     { benchmark(b, WriteByte) }
+func BenchmarkBulkWrite(b *testing.B)     { benchmark(b, BulkWrite) }
+func BenchmarkWriteThenRead(b *testing.B) { benchmark(b, WriteThenRead) }
+func BenchmarkReadMem(b *testing.B)       { benchmark(b, ReadMem) }
+func BenchmarkSniffer(b *testing.B)       { benchmark(b, Sniffer) }
+
+func TestRun(t *testing.T) {
+	target := simTarget(t)
+	var out bytes.Buffer
+	results, err := Run(&out, target, "", BenchTime{N: 3}, All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(All) {
+		t.Fatalf("%d results, want %d:\n%s", len(results), len(All), out.String())
+	}
+	for i, r := range results {
+		if r.Name != All[i].Name || r.N != 3 || r.WireBytes == 0 {
+			t.Errorf("bad result %+v", r)
+		}
+		if !strings.Contains(out.String(), "Benchmark"+r.Name+"\t       3\t") {
+			t.Errorf("result of %s missing from output:\n%s", r.Name, out.String())
+		}
+	}
+}
+
+func TestRunSkip(t *testing.T) {
+	target := simTarget(t)
+	target.Sniffer = nil
+	var out bytes.Buffer
+	results, err := Run(&out, target, "^Sniffer$", BenchTime{N: 1}, All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 || !strings.Contains(out.String(), "--- SKIP: BenchmarkSniffer") {
+		t.Fatalf("sniffer not skipped, results %v, output:\n%s", results, out.String())
+	}
+}
+
+func TestParseBenchTime(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want BenchTime
+		ok   bool
+	}{
+		{"1s", BenchTime{D: 1e9}, true},
+		{"250ms", BenchTime{D: 250e6}, true},
+		{"100x", BenchTime{N: 100}, true},
+		{"0x", BenchTime{}, false},
+		{"x", BenchTime{}, false},
+		{"-1s", BenchTime{}, false},
+		{"1", BenchTime{}, false},
+	} {
+		got, err := ParseBenchTime(c.s)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("ParseBenchTime(%q) = %+v, %v", c.s, got, err)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package bme280 drives the BME280 temperature, pressure and humidity
+// sensor and the BMP280, the same part without humidity, over the I2C
+// mode of package bp.
+//
+// The sensors return raw readings which have to be compensated with
+// calibration coefficients stored in every part. New reads them, Measure
+// does a measurement in forced mode and returns the compensated values.
+package bme280
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// Addresses of the sensor, with SDO tied low or high.
+const (
+	Addr    = 0x76
+	AddrAlt = 0x77
+)
+
+// Chip IDs.
+const (
+	ChipIDBME280 = 0x60
+	ChipIDBMP280 = 0x58
+)
+
+// Registers.
+const (
+	regCalib00  = 0x88
+	regID       = 0xd0
+	regReset    = 0xe0
+	regCalib26  = 0xe1
+	regCtrlHum  = 0xf2
+	regStatus   = 0xf3
+	regCtrlMeas = 0xf4
+	regData     = 0xf7
+)
+
+const (
+	statusMeasuring = 0x08
+	modeForced      = 0x01
+	resetWord       = 0xb6
+)
+
+// Oversampling is the number of samples averaged for a value of a
+// measurement.
+type Oversampling byte
+
+const (
+	X1 Oversampling = iota + 1
+	X2
+	X4
+	X8
+	X16
+)
+
+// samples returns the number of samples o takes.
+func (o Oversampling) samples() int {
+	return 1 << uint(o-1)
+}
+
+// Measurement is a compensated measurement.
+type Measurement struct {
+	Temperature float64 // °C
+	Pressure    float64 // Pa
+	Humidity    float64 // % relative humidity, 0 on the BMP280
+}
+
+func (m Measurement) String() string {
+	return fmt.Sprintf("%.2f °C, %.0f Pa, %.1f %%RH", m.Temperature, m.Pressure, m.Humidity)
+}
+
+// Calibration are the calibration coefficients of a sensor, named as in
+// the data sheet.
+type Calibration struct {
+	T1         uint16
+	T2, T3     int16
+	P1         uint16
+	P2, P3, P4 int16
+	P5, P6, P7 int16
+	P8, P9     int16
+	H1         uint8
+	H2         int16
+	H3         uint8
+	H4, H5     int16
+	H6         int8
+}
+
+// Compensate returns the measurement for the raw 20 bit temperature and
+// pressure readings and the 16 bit humidity reading, with the floating
+// point formulas of the data sheet. Humidity is left 0 if its
+// coefficients are, as on the BMP280.
+func (c *Calibration) Compensate(adcT, adcP, adcH int32) Measurement {
+	var m Measurement
+
+	var1 := (float64(adcT)/16384 - float64(c.T1)/1024) * float64(c.T2)
+	var2 := float64(adcT)/131072 - float64(c.T1)/8192
+	var2 = var2 * var2 * float64(c.T3)
+	tfine := var1 + var2
+	m.Temperature = tfine / 5120
+
+	var1 = tfine/2 - 64000
+	var2 = var1 * var1 * float64(c.P6) / 32768
+	var2 += var1 * float64(c.P5) * 2
+	var2 = var2/4 + float64(c.P4)*65536
+	var1 = (float64(c.P3)*var1*var1/524288 + float64(c.P2)*var1) / 524288
+	var1 = (1 + var1/32768) * float64(c.P1)
+	if var1 != 0 {
+		p := 1048576 - float64(adcP)
+		p = (p - var2/4096) * 6250 / var1
+		var1 = float64(c.P9) * p * p / 2147483648
+		var2 = p * float64(c.P8) / 32768
+		m.Pressure = p + (var1+var2+float64(c.P7))/16
+	}
+
+	if c.H1 != 0 || c.H2 != 0 {
+		h := tfine - 76800
+		h = (float64(adcH) - (float64(c.H4)*64 + float64(c.H5)/16384*h)) *
+			(float64(c.H2) / 65536 * (1 + float64(c.H6)/67108864*h*(1+float64(c.H3)/67108864*h)))
+		h *= 1 - float64(c.H1)*h/524288
+		switch {
+		case h > 100:
+			h = 100
+		case h < 0:
+			h = 0
+		}
+		m.Humidity = h
+	}
+	return m
+}
+
+// Dev is a BME280 or BMP280.
+type Dev struct {
+	t        bp.I2CTransactor8x8
+	addr     bp.Addr7
+	id       byte
+	humidity bool
+	cal      Calibration
+}
+
+// New returns the sensor at the 7 bit address addr. It checks the chip
+// ID and reads the calibration coefficients.
+func New(t bp.I2CTransactor8x8, addr uint8) (*Dev, error) {
+	d := &Dev{t: t, addr: bp.Addr7(addr)}
+
+	id := make([]byte, 1)
+	if err := d.read("read chip ID", regID, id); err != nil {
+		return nil, err
+	}
+	d.id = id[0]
+	switch d.id {
+	case ChipIDBME280:
+		d.humidity = true
+	case ChipIDBMP280, 0x56, 0x57: // 0x56 and 0x57 are BMP280 samples
+	default:
+		return nil, d.err("read chip ID", fmt.Errorf("unknown chip ID %#02x", d.id))
+	}
+
+	if err := d.readCalibration(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Dev) readCalibration() error {
+	b := make([]byte, 26)
+	if err := d.read("read calibration", regCalib00, b); err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	c := &d.cal
+	c.T1 = le.Uint16(b[0:])
+	c.T2 = int16(le.Uint16(b[2:]))
+	c.T3 = int16(le.Uint16(b[4:]))
+	c.P1 = le.Uint16(b[6:])
+	for i, p := range []*int16{&c.P2, &c.P3, &c.P4, &c.P5, &c.P6, &c.P7, &c.P8, &c.P9} {
+		*p = int16(le.Uint16(b[8+2*i:]))
+	}
+	if !d.humidity {
+		return nil
+	}
+	c.H1 = b[25]
+
+	b = b[:7]
+	if err := d.read("read calibration", regCalib26, b); err != nil {
+		return err
+	}
+	c.H2 = int16(le.Uint16(b[0:]))
+	c.H3 = b[2]
+	// H4 and H5 are 12 bit values sharing the nibbles of 0xe5
+	c.H4 = int16(int8(b[3]))<<4 | int16(b[4]&0x0f)
+	c.H5 = int16(int8(b[5]))<<4 | int16(b[4]>>4)
+	c.H6 = int8(b[6])
+	return nil
+}
+
+func (d *Dev) read(op string, reg uint8, r []byte) error {
+	if _, _, err := d.t.Transact8x8(d.addr, reg, nil, r); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+func (d *Dev) write(op string, reg uint8, v byte) error {
+	if _, _, err := d.t.Transact8x8(d.addr, reg, []byte{v}, nil); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+// ChipID returns the chip ID of the sensor.
+func (d *Dev) ChipID() byte {
+	return d.id
+}
+
+// HasHumidity reports whether the sensor measures humidity, whether it
+// is a BME280.
+func (d *Dev) HasHumidity() bool {
+	return d.humidity
+}
+
+// Calibration returns the calibration coefficients of the sensor.
+func (d *Dev) Calibration() Calibration {
+	return d.cal
+}
+
+// Reset resets the sensor to its power on state.
+func (d *Dev) Reset() error {
+	if err := d.write("reset", regReset, resetWord); err != nil {
+		return err
+	}
+	// the sensor copies its calibration after a reset
+	time.Sleep(2 * time.Millisecond)
+	return nil
+}
+
+// Measure does a measurement in forced mode, oversampling temperature,
+// pressure and humidity by osrs, and returns the compensated values.
+// Humidity is ignored on the BMP280.
+func (d *Dev) Measure(osrs Oversampling) (Measurement, error) {
+	if osrs < X1 || osrs > X16 {
+		return Measurement{}, d.err("measure", fmt.Errorf("invalid oversampling %d", osrs))
+	}
+	// ctrl_hum only takes effect with the following write of ctrl_meas
+	if d.humidity {
+		if err := d.write("measure", regCtrlHum, byte(osrs)); err != nil {
+			return Measurement{}, err
+		}
+	}
+	if err := d.write("measure", regCtrlMeas, byte(osrs)<<5|byte(osrs)<<2|modeForced); err != nil {
+		return Measurement{}, err
+	}
+
+	// maximum measurement time from the data sheet
+	n := osrs.samples()
+	wait := 1250 + 2300*n + 2300*n + 575
+	if d.humidity {
+		wait += 2300*n + 575
+	}
+	time.Sleep(time.Duration(wait) * time.Microsecond)
+
+	deadline := time.Now().Add(100 * time.Millisecond)
+	status := make([]byte, 1)
+	for {
+		if err := d.read("measure", regStatus, status); err != nil {
+			return Measurement{}, err
+		}
+		if status[0]&statusMeasuring == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return Measurement{}, d.err("measure", fmt.Errorf("measurement not done"))
+		}
+	}
+
+	data := make([]byte, 8)
+	if !d.humidity {
+		data = data[:6]
+	}
+	if err := d.read("measure", regData, data); err != nil {
+		return Measurement{}, err
+	}
+	adcP := int32(data[0])<<12 | int32(data[1])<<4 | int32(data[2])>>4
+	adcT := int32(data[3])<<12 | int32(data[4])<<4 | int32(data[5])>>4
+	var adcH int32
+	if d.humidity {
+		adcH = int32(data[6])<<8 | int32(data[7])
+	}
+	return d.cal.Compensate(adcT, adcP, adcH), nil
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("bme280 %v: %s: %w", d.addr, op, err)
+}
@@ -2,15 +2,26 @@
 // Use of this source code is governed by an MIT-style
 // license that can be found in the LICENSE file.
 
-// Package bp enables access to a bus pirate. Currently only I2C mode
-// is implemented.
+// Package bp enables access to a bus pirate. I2C and SPI mode are
+// implemented.
+//
+// Supported are the bus pirate v3 and v4, which speak the binary protocol
+// documented by Dangerous Prototypes. There is no backend for the binmode
+// protocol of the RP2040 based bus pirate 5 and 6. They are recognized by
+// Probe and Version, and can only be used in their "legacy binary mode",
+// which has to be selected with the binmode command in their terminal.
+// It emulates the protocol of the v3 firmware, and this package drives it
+// like a v3, see CapabilitiesFor.
 package bp
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
+
+	"github.com/distributed/bp/wire"
 )
 
 type timeoutError interface {
@@ -19,7 +30,8 @@ type timeoutError interface {
 }
 
 func isTimeout(err error) bool {
-	if terr, ok := err.(timeoutError); ok {
+	var terr timeoutError
+	if errors.As(err, &terr) {
 		return terr.Timeout()
 	}
 	return false
@@ -40,10 +52,93 @@ type Conn interface {
 // the device in binary mode. Before using a BusPirate object, the user
 // has to put the bus pirate into a known state via a call to
 // BusPirate.Open().
+//
+// A BusPirate and the mode handles obtained from it are safe for
+// concurrent use: the traffic with the device happens on one goroutine,
+// which carries out the calls one after the other. Hooks, loggers and
+// other callbacks run on that goroutine and must not call the BusPirate
+// they were called for. Note that this only makes single calls atomic.
+// A transaction built from primitives like Start, WriteByte and Stop
+// must not be interleaved with other traffic by the caller, use
+// Transact8x8 or external locking for that. While a sniffer is running,
+// the device only accepts the command stopping it, all other calls fail
+// with a mode error.
 type BusPirate struct {
+	mu sync.Mutex
+
 	c           Conn
-	mode        int
+	link        *linkConn
+	mode        Mode
 	modeversion int
+	gen         uint64
+
+	// guards the logging configuration, which is also used by the
+	// sniffer goroutine
+	logmu     sync.Mutex
+	log       Logger
+	loglevel  LogLevel
+	sublevels map[Subsystem]LogLevel
+
+	autoresync bool
+	resyncing  bool
+	dial       Dialer
+
+	retrypolicy RetryPolicy
+
+	sniffer *I2CSniffer
+
+	openopts OpenOptions
+
+	// the connection was opened by OpenPath and is closed by Close,
+	// which also releases the lock on the port
+	owned      bool
+	unlockport func()
+
+	version *VersionInfo
+
+	watchdog *watchdog
+	wedged   error
+
+	hooks hooks
+
+	stats   Stats
+	metrics MetricsSink
+	fed     Stats // counters last fed to metrics
+
+	latencies map[string]*LatencyHistogram
+	latencyfn func(op string, d time.Duration)
+	txstart   time.Time // start condition of the running transaction
+
+	pacing Pacing
+	lasttx time.Time // end of the last transaction
+
+	// for TrackSessions
+	session   uint64
+	finalized bool
+
+	dryrun bool
+
+	lenient bool              // see SetLenientBanners
+	banners map[string]string // last banner received by prefix
+
+	window   int     // see SetPipelineWindow
+	xferrate float64 // bytes per second of large transfers, see ChunkTime
+	baud     int     // rate of the serial link set by SetBaudRate, 0 for the default
+
+	coalesce bool   // see SetWriteCoalescing
+	wpending []byte // bytes of WriteByte not sent yet
+
+	unchecked bool   // see SetUnchecked
+	deferred  []exch // commands not sent yet in unchecked mode
+
+	// jobs of the I/O goroutine, guarded by qmu as they are queued
+	// without holding mu
+	qmu      sync.Mutex
+	queue    []func()
+	qrunning bool
+
+	i2cconf i2cconfig
+	spiconf spiconfig
 }
 
 // NewBusPirate generates a new BusPirate objected that uses c as its
@@ -53,116 +148,252 @@ type BusPirate struct {
 // is not ready to use, you need to call the Open() method to put the device
 // into a known state.
 func NewBusPirate(c Conn) *BusPirate {
-	return &BusPirate{c: c}
+	link := &linkConn{Conn: c, last: time.Now()}
+	return &BusPirate{c: link, link: link, loglevel: LogInfo}
 }
 
 // Open puts the bus pirate into binary bit bang mode. The user needs
 // to call this method as the bus pirate cannot be assumed to be in
 // any specific mode when the connection to it is opened.
 func (bp *BusPirate) Open() error {
-	err := bp.c.SetReadParams(0, 100e-3)
+	return bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		bp.link.failed()
+		return bp.report(bp.enterBinary())
+	})
+}
+
+// terminalreset gets the bus pirate out of interactive states of its
+// terminal in which it ignores 0x00 bytes: ESC stops a running macro or
+// script, the newlines leave menus and prompts and '#' resets the device.
+var terminalreset = []byte("\x1b\n\n\n\n\n\n\n\n\n\n#\n")
+
+// enterBinary sends 0x00 bytes until the bus pirate answers with the
+// binary bitbang mode banner and discards any further output. If the bus
+// pirate doesn't answer, it is reset from the terminal and the 0x00
+// bytes are sent again.
+func (bp *BusPirate) enterBinary() error {
+	mode := bp.mode
+
+	ver, err := bp.tryBinary()
 	if err != nil {
-		return err
+		return &OpError{"Open", mode, nil, err}
 	}
 
-	var bbuf [1]byte
-	for i := 0; i < 20; i++ {
-		fmt.Printf("try % 2d: sending 0x00...\n", i)
-		bbuf[0] = 0x00
-		_, err := bp.c.Write(bbuf[0:])
+	if ver == 0 && bp.baud != 0 {
+		// the bus pirate may have been reset behind our back
+		bp.logf(SubsysOpen, LogInfo, "no answer at %d baud, trying %d baud", bp.baud, DefaultBaudRate)
+		if err := bp.resetBaud(); err != nil {
+			return &OpError{"Open", mode, nil, err}
+		}
+		ver, err = bp.tryBinary()
 		if err != nil {
-			return err
+			return &OpError{"Open", mode, nil, err}
 		}
+	}
 
-		rbuf := make([]byte, 2048)
-		//n, err := bp.c.Read(rbuf)
-		_, err = io.ReadFull(bp.c, rbuf[0:5])
+	if ver == 0 && !bp.openOptions().NoTerminalReset {
+		bp.logf(SubsysOpen, LogInfo, "no answer, resetting from the terminal")
+		if _, err := bp.c.Write(terminalreset); err != nil {
+			return &OpError{"Open", mode, nil, err}
+		}
+		if err := bp.resetBaud(); err != nil {
+			return &OpError{"Open", mode, nil, err}
+		}
+		n, err := bp.drain()
 		if err != nil {
-			if isTimeout(err) {
-				fmt.Printf("\ttimeout!\n")
-				continue
-			}
-			return err
+			return &OpError{"Open", mode, nil, err}
 		}
+		bp.logf(SubsysOpen, LogDebug, "reset, %d bytes of terminal output discarded", n)
 
-		fmt.Printf("buf %q\n", rbuf[0:5])
-		if !bytes.HasPrefix(rbuf, []byte("BBIO")) {
-			return fmt.Errorf("response does not start with 'BBIO'")
+		ver, err = bp.tryBinary()
+		if err != nil {
+			return &OpError{"Open", mode, nil, err}
 		}
+	}
 
-		if rbuf[4] != '1' {
-			return fmt.Errorf("protocol mismatch: only support protocol '1', bus pirate uses protocol %q", rbuf[4])
-		}
+	if ver == 0 {
+		return &OpError{"Open", mode, nil, fmt.Errorf("%w: no suitable response after maximum number of trials", ErrUnexpectedResponse)}
+	}
 
-		// parsed BBIO1
+	n, err := bp.drain()
+	if err != nil {
+		return &OpError{"Open", mode, nil, err}
+	}
+	bp.logf(SubsysOpen, LogInfo, "drained buffer, %d excess bytes discarded", n)
+
+	bp.setMode(MODE_BITBANG, ver)
+	return nil
+}
 
-		// drain buffer
+// tryBinary sends up to OpenOptions.Tries 0x00 bytes and returns the
+// protocol version if the bus pirate answered with the BBIO banner, 0 if
+// it didn't answer.
+func (bp *BusPirate) tryBinary() (int, error) {
+	o := bp.openOptions()
+	err := bp.c.SetReadParams(0, o.Interval.Seconds())
+	if err != nil {
+		return 0, err
+	}
 
-		err = bp.c.SetReadParams(0, 0.3)
+	var bbuf [1]byte
+	for i := 0; i < o.Tries; i++ {
+		bp.logf(SubsysOpen, LogDebug, "try % 2d: sending 0x00...", i)
+		bbuf[0] = wire.Reset
+		_, err := bp.c.Write(bbuf[0:])
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		n, err := io.ReadFull(bp.c, rbuf)
-		if !isTimeout(err) {
-			return err
+		v, err := bp.readBanner(wire.Reset, wire.BitbangBanner)
+		if err != nil {
+			if isTimeout(err) {
+				bp.logf(SubsysOpen, LogDebug, "timeout")
+				continue
+			}
+			if errors.Is(err, ErrUnexpectedResponse) {
+				bp.logf(SubsysOpen, LogDebug, "%v", err)
+				continue
+			}
+			return 0, err
 		}
-		fmt.Printf("drained buffer, %d excess bytes discarded\n", n)
 
-		bp.mode = MODE_BITBANG
-		bp.modeversion = 1
-		return nil
+		return bp.checkVersion("BBIO", v)
+	}
+
+	return 0, nil
+}
+
+// drain discards the output of the bus pirate until it has been quiet for
+// OpenOptions.Drain. It gives up after DrainMax bytes or DrainDeadline.
+func (bp *BusPirate) drain() (int, error) {
+	o := bp.openOptions()
+	err := bp.c.SetReadParams(0, o.Drain.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(o.DrainDeadline)
+	rbuf := make([]byte, 256)
+	n := 0
+	for n < o.DrainMax && time.Now().Before(deadline) {
+		if len(rbuf) > o.DrainMax-n {
+			rbuf = rbuf[:o.DrainMax-n]
+		}
+		rn, err := bp.c.Read(rbuf)
+		n += rn
+		if err != nil {
+			if isTimeout(err) {
+				return n, nil
+			}
+			return n, err
+		}
 	}
 
-	return fmt.Errorf("bp: no suitable response after maximum number of trials\n")
+	bp.logf(SubsysOpen, LogDebug, "bus pirate keeps talking, stopped draining")
+	return n, nil
 }
 
-// Close leaves binary mode. If the bus pirate is currently not in
-// binary bit bang mode, it first enters binary bit bang mode. If the
-// user does not call Close, the device might be unresponsive in text
-// mode.
+// Close leaves binary mode like ExitBinaryMode and stops the watchdog. If
+// the user does not call Close, the device might be unresponsive in text
+// mode. For BusPirates returned by OpenPath, Close also closes the serial
+// port.
 func (bp *BusPirate) Close() error {
-	if bp.mode == MODE_UNKNOWN {
-		return fmt.Errorf("cannot leave unknown mode")
+	return bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+
+		bp.stopWatchdog()
+		if bp.owned {
+			defer bp.closePort()
+		}
+		return bp.report(bp.exitBinaryMode("Close"))
+	})
+}
+
+// ExitBinaryMode returns the bus pirate to its text terminal. If the bus
+// pirate is currently not in binary bit bang mode, it first enters binary
+// bit bang mode. The firmware restarts and prints its versions, which are
+// not waited for, use ResetHardware for that. Unlike Close, the serial
+// port stays open, Open enters binary mode again.
+func (bp *BusPirate) ExitBinaryMode() error {
+	return bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		return bp.report(bp.exitBinaryMode("ExitBinaryMode"))
+	})
+}
+
+func (bp *BusPirate) exitBinaryMode(op string) error {
+	mode := bp.mode
+	if mode == MODE_CLOSED {
+		return &OpError{op, mode, nil, ErrNotOpen}
+	}
+	if mode == MODE_UNKNOWN {
+		return &OpError{op, mode, nil, ModeError("cannot leave unknown mode")}
 	}
 
-	if bp.mode != MODE_BITBANG {
-		fmt.Printf("need to go to bitbang mode before closing\n")
-		err := bp.EnterBitbangMode()
+	if mode != MODE_BITBANG {
+		bp.logf(SubsysOpen, LogInfo, "need to go to bitbang mode before closing")
+		err := bp.enterBitbangMode()
 		if err != nil {
-			return fmt.Errorf("could not enter bitbang mode to close connection: %v", err)
+			return &OpError{op, mode, nil, err}
 		}
 	}
 
-	r, err := bp.exchangeByte(0x0f)
+	bp.stats.Commands++
+	r, err := bp.exchangeByte(wire.ResetTerminal)
 	if err != nil {
-		return err
+		return &OpError{op, mode, nil, err}
 	}
 
-	if r != 0x01 {
-		return fmt.Errorf("*BusPirate.Close(): expected response 0x01, got %#02x\n", r)
+	if r != wire.OK {
+		return &OpError{op, mode, nil, &ResponseError{Got: r, Want: wire.OK, Sent: []byte{wire.ResetTerminal}, Received: []byte{r}}}
 	}
 
-	fmt.Printf("bp closed\n")
+	bp.setMode(MODE_CLOSED, 0)
+	if err := bp.resetBaud(); err != nil {
+		return &OpError{op, mode, nil, err}
+	}
+	bp.logf(SubsysOpen, LogInfo, "bp closed")
 
 	return nil
 }
 
+func (bp *BusPirate) closePort() {
+	bp.link.discard()
+	if err := bp.link.Conn.Close(); err != nil {
+		bp.logf(SubsysOpen, LogDebug, "closing serial port: %v", err)
+	}
+	if bp.unlockport != nil {
+		bp.unlockport()
+		bp.unlockport = nil
+	}
+	bp.owned = false
+}
+
 func (bp *BusPirate) writeByte(b byte) error {
 	sl := []byte{b}
 	if _, err := bp.c.Write(sl); err != nil {
-		errors.New("write byte to bus pirate: " + err.Error())
+		return fmt.Errorf("write byte to bus pirate: %w", err)
 	}
 	return nil
 }
 
 func (bp *BusPirate) readByte() (byte, error) {
 	sl := make([]byte, 1)
-	n, err := bp.c.Read(sl)
-	if n != 1 || err != nil {
-		return 0, errors.New("read from bus pirate: " + err.Error())
+	for {
+		n, err := bp.c.Read(sl)
+		if n == 1 {
+			return sl[0], nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("read from bus pirate: %w", err)
+		}
+		// empty reads are retried, the link reports a disconnect after
+		// too many of them
 	}
-	return sl[0], nil
 }
 
 func (bp *BusPirate) exchangeByte(in byte) (byte, error) {
@@ -180,39 +411,61 @@ func (bp *BusPirate) exchangeByteAndExpect(in byte, exp byte) error {
 	}
 
 	if rb != exp {
-		return fmt.Errorf("unexpected response from bus pirate, got %#02x, want %#02x", rb, exp)
+		bp.suspicious()
+		return &ResponseError{Got: rb, Want: exp, Sent: []byte{in}, Received: []byte{rb}}
 	}
 
 	return nil
 }
 
+// EnterBitbangMode puts the bus pirate back into binary bitbang mode.
+// Mode handles obtained before become stale.
 func (bp *BusPirate) EnterBitbangMode() error {
-	if bp.mode == MODE_UNKNOWN {
-		return fmt.Errorf("cannot enter bitbang mode from unknown mode")
-	}
+	return bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		return bp.report(bp.enterBitbangMode())
+	})
+}
 
-	err := bp.writeByte(0x00)
-	if err != nil {
-		bp.clearMode()
+func (bp *BusPirate) enterBitbangMode() error {
+	mode := bp.mode
+	switch mode {
+	case MODE_CLOSED:
+		return &OpError{"EnterBitbangMode", mode, nil, ErrNotOpen}
+	case MODE_UNKNOWN:
+		return &OpError{"EnterBitbangMode", mode, nil, ModeError("cannot enter bitbang mode from unknown mode")}
+	case MODE_I2C_SNIFF:
+		return &OpError{"EnterBitbangMode", mode, nil, ModeError("cannot enter bitbang mode while the sniffer is running")}
+	}
+	if err := bp.settle(); err != nil {
 		return err
 	}
 
-	var rb [5]byte
-	_, err = io.ReadFull(bp.c, rb[0:])
+	bp.stats.Commands++
+	err := bp.writeByte(wire.Reset)
 	if err != nil {
 		bp.clearMode()
-		return fmt.Errorf("error reading response: %v", err)
+		return &OpError{"EnterBitbangMode", mode, nil, err}
 	}
 
-	if !bytes.HasPrefix(rb[0:], []byte("BBIO")) {
+	v, err := bp.readBanner(wire.Reset, wire.BitbangBanner)
+	if err != nil {
 		bp.clearMode()
-		return fmt.Errorf("expected version string \"BBIOx\", got %q", rb)
+		if isProtocolError(err) {
+			bp.suspicious()
+		}
+		return &OpError{"EnterBitbangMode", mode, nil, err}
 	}
 
-	if rb[4] != '1' {
+	ver, err := bp.checkVersion("BBIO", v)
+	if err != nil {
 		bp.clearMode()
-		return fmt.Errorf("only BBIO version 1 is supported, bus pirate uses version %q", rb[4])
+		bp.suspicious()
+		return &OpError{"EnterBitbangMode", mode, nil, err}
 	}
 
+	bp.setMode(MODE_BITBANG, ver)
+
 	return nil
 }
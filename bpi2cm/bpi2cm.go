@@ -0,0 +1,109 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package bpi2cm adapts the I2C mode handles of package bp to the
+// interfaces of github.com/distributed/i2cm. Package bp itself does not
+// depend on i2cm.
+//
+// Besides the method sets, the adapters translate errors: NACKs match
+// i2cm.NACKReceived and missing devices i2cm.NoSuchDevice with
+// errors.Is, in addition to the errors of package bp.
+package bpi2cm
+
+import (
+	"errors"
+
+	"github.com/distributed/bp"
+	"github.com/distributed/i2cm"
+)
+
+// Master is an i2cm.I2CMaster and a bp.I2CMaster.
+type Master struct {
+	i bp.BusPirateI2C
+}
+
+// New returns an i2cm.I2CMaster using i.
+func New(i bp.BusPirateI2C) *Master {
+	return &Master{i}
+}
+
+func (m *Master) Start() error {
+	return convert(m.i.Start())
+}
+
+func (m *Master) Stop() error {
+	return convert(m.i.Stop())
+}
+
+// ReadByte reads a byte and acknowledges it if ack is set. Its errors
+// are converted like those of the other methods, NACKs of writes queued
+// in unchecked mode or by write coalescing match i2cm.NACKReceived, see
+// bp.SetUnchecked. go vet takes the method for a broken io.ByteReader,
+// but it is the signature of i2cm.
+func (m *Master) ReadByte(ack bool) (byte, error) {
+	b, err := m.i.ReadByteAck(ack)
+	return b, convert(err)
+}
+
+// ReadByteAck is ReadByte, for bp.I2CMaster.
+func (m *Master) ReadByteAck(ack bool) (byte, error) {
+	return m.ReadByte(ack)
+}
+
+func (m *Master) WriteByte(b byte) error {
+	return convert(m.i.WriteByte(b))
+}
+
+// Transactor is an i2cm.I2CMaster and i2cm.I2CTransactor8x8.
+type Transactor struct {
+	Master
+	nsi bp.NonStrictI2C
+}
+
+// NewNonStrict returns an i2cm.I2CMaster and i2cm.I2CTransactor8x8
+// using nsi.
+func NewNonStrict(nsi bp.NonStrictI2C) *Transactor {
+	return &Transactor{Master{nsi.BusPirateI2C}, nsi}
+}
+
+func (t *Transactor) Transact8x8(addr i2cm.Addr, regaddr uint8, w []byte, r []byte) (nw, nr int, err error) {
+	nw, nr, err = t.nsi.Transact8x8(addr, regaddr, w, r)
+	return nw, nr, convert(err)
+}
+
+var (
+	_ i2cm.I2CMaster        = (*Master)(nil)
+	_ i2cm.I2CTransactor8x8 = (*Transactor)(nil)
+	_ bp.I2CMaster          = (*Master)(nil)
+)
+
+// i2cmError makes an error of package bp match an error of package i2cm.
+type i2cmError struct {
+	err    error
+	target error
+}
+
+func (e *i2cmError) Error() string {
+	return e.err.Error()
+}
+
+func (e *i2cmError) Unwrap() error {
+	return e.err
+}
+
+func (e *i2cmError) Is(target error) bool {
+	return target == e.target
+}
+
+func convert(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, bp.ErrNoSuchDevice):
+		return &i2cmError{err, i2cm.NoSuchDevice}
+	case errors.Is(err, bp.ErrNACK):
+		return &i2cmError{err, i2cm.NACKReceived}
+	}
+	return err
+}
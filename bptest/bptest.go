@@ -0,0 +1,194 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package bptest helps testing code built on package bp against golden
+// transcripts: the exact sequence of bytes the code is expected to send
+// to the bus pirate, interleaved with the responses the simulated device
+// gives. See package transcript for the format.
+package bptest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/distributed/bp"
+	"github.com/distributed/bp/transcript"
+)
+
+// Conn is a bp.Conn playing back a golden transcript. It records the
+// traffic that actually happened, so mismatches can be shown as a diff.
+type Conn struct {
+	r *transcript.Replay
+
+	mu     sync.Mutex
+	actual bytes.Buffer
+}
+
+// Golden returns a Conn playing back the transcript golden. When the test
+// finishes, it fails t if the code under test deviated from the
+// transcript or did not play it back completely, with a diff between the
+// transcript and the actual traffic.
+func Golden(t testing.TB, golden string) *Conn {
+	t.Helper()
+
+	r, err := transcript.NewReplay(strings.NewReader(golden))
+	if err != nil {
+		t.Fatalf("bptest: %v", err)
+	}
+
+	c := &Conn{r: r}
+	t.Cleanup(func() {
+		if err := c.Check(golden); err != nil {
+			t.Error(err)
+		}
+	})
+	return c
+}
+
+// GoldenFile is like Golden, but reads the transcript from the file fn,
+// typically in the testdata directory.
+func GoldenFile(t testing.TB, fn string) *Conn {
+	t.Helper()
+
+	golden, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("bptest: %v", err)
+	}
+	return Golden(t, string(golden))
+}
+
+// NewBusPirate returns a BusPirate talking to the golden transcript. The
+// BusPirate is not opened, the transcript has to start with the open
+// sequence if the code under test calls Open.
+func NewBusPirate(t testing.TB, golden string) *bp.BusPirate {
+	t.Helper()
+	return bp.NewBusPirate(Golden(t, golden))
+}
+
+func (c *Conn) record(dir string, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(&c.actual, "%s % x\n", dir, b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.record(">", b)
+	return c.r.Write(b)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		c.record("<", b[:n])
+	}
+	if n == 0 && err == transcript.ErrTimeout {
+		c.mu.Lock()
+		c.actual.WriteString("< timeout\n")
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *Conn) SetReadParams(minread int, timeout float64) error {
+	return c.r.SetReadParams(minread, timeout)
+}
+
+func (c *Conn) Close() error {
+	return c.r.Close()
+}
+
+// Actual returns the traffic that happened so far as a transcript.
+func (c *Conn) Actual() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.actual.String()
+}
+
+// Check returns nil if golden was played back completely and without
+// mismatch. Otherwise it returns an error including a diff between the
+// canonical forms of golden and the actual traffic.
+func (c *Conn) Check(golden string) error {
+	err := c.r.Done()
+	if err == nil {
+		return nil
+	}
+
+	want, perr := transcript.Canonical(strings.NewReader(golden))
+	if perr != nil {
+		return perr
+	}
+	got, perr := transcript.Canonical(strings.NewReader(c.Actual()))
+	if perr != nil {
+		return perr
+	}
+
+	return fmt.Errorf("bptest: %v\n--- golden\n+++ actual\n%s", err, Diff(want, got))
+}
+
+// Diff returns a line based diff of want and got. Lines only in want are
+// prefixed with -, lines only in got with + and common lines with a
+// space.
+func Diff(want, got []string) string {
+	// longest common subsequence, transcripts are short enough
+	lcs := make([][]int, len(want)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(got)+1)
+	}
+	for i := len(want) - 1; i >= 0; i-- {
+		for j := len(got) - 1; j >= 0; j-- {
+			if want[i] == got[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(want) || j < len(got) {
+		switch {
+		case i < len(want) && j < len(got) && want[i] == got[j]:
+			fmt.Fprintf(&sb, "  %s\n", want[i])
+			i++
+			j++
+		case i < len(want) && (j == len(got) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&sb, "- %s\n", want[i])
+			i++
+		default:
+			fmt.Fprintf(&sb, "+ %s\n", got[j])
+			j++
+		}
+	}
+	return sb.String()
+}
+
+// VerifyClosed fails t if a BusPirate opened during the test is still
+// open when the test finishes, showing where it was opened and where its
+// current mode was entered. It turns on bp.TrackSessions, call it before
+// opening. BusPirates opened by parallel tests are reported as well.
+func VerifyClosed(t testing.TB) {
+	t.Helper()
+
+	bp.TrackSessions(nil)
+	before := make(map[uint64]bool)
+	for _, s := range bp.OpenSessions() {
+		before[s.ID] = true
+	}
+
+	t.Cleanup(func() {
+		for _, s := range bp.OpenSessions() {
+			if before[s.ID] {
+				continue
+			}
+			t.Errorf("bptest: bus pirate left open in %v mode, opened at\n%s\n%v mode entered at\n%s", s.Mode, s.Opened, s.Mode, s.Entered)
+		}
+	})
+}
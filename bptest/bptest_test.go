@@ -0,0 +1,148 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bptest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/distributed/bp"
+)
+
+// fakeTB collects the failures and cleanups of the helpers under test.
+type fakeTB struct {
+	testing.TB
+	errs     []string
+	fatal    bool
+	cleanups []func()
+}
+
+func (tb *fakeTB) Helper()                {}
+func (tb *fakeTB) Cleanup(f func())       { tb.cleanups = append(tb.cleanups, f) }
+func (tb *fakeTB) Error(v ...interface{}) { tb.errs = append(tb.errs, fmt.Sprint(v...)) }
+func (tb *fakeTB) Errorf(f string, v ...interface{}) {
+	tb.errs = append(tb.errs, fmt.Sprintf(f, v...))
+}
+
+func (tb *fakeTB) Fatalf(f string, v ...interface{}) {
+	tb.Errorf(f, v...)
+	tb.fatal = true
+}
+
+func (tb *fakeTB) finish() {
+	for i := len(tb.cleanups) - 1; i >= 0; i-- {
+		tb.cleanups[i]()
+	}
+}
+
+func TestDiff(t *testing.T) {
+	for _, c := range []struct {
+		want, got []string
+		diff      string
+	}{
+		{nil, nil, ""},
+		{[]string{"a", "b"}, []string{"a", "b"}, "  a\n  b\n"},
+		{[]string{"a", "b", "c"}, []string{"a", "c"}, "  a\n- b\n  c\n"},
+		{[]string{"a", "c"}, []string{"a", "b", "c"}, "  a\n+ b\n  c\n"},
+		{[]string{"a", "b"}, []string{"a", "x"}, "  a\n- b\n+ x\n"},
+		{[]string{"a"}, nil, "- a\n"},
+		{nil, []string{"a"}, "+ a\n"},
+		{[]string{"x", "a", "b"}, []string{"a", "b", "y"}, "- x\n  a\n  b\n+ y\n"},
+	} {
+		if d := Diff(c.want, c.got); d != c.diff {
+			t.Errorf("Diff(%q, %q) =\n%s\nwant\n%s", c.want, c.got, d, c.diff)
+		}
+	}
+}
+
+func startStop(c *Conn) error {
+	b := bp.NewBusPirate(c)
+	if err := b.Open(); err != nil {
+		return err
+	}
+	i, err := b.EnterI2CMode()
+	if err != nil {
+		return err
+	}
+	if err := i.Start(); err != nil {
+		return err
+	}
+	return i.Stop()
+}
+
+func TestGoldenFile(t *testing.T) {
+	if err := startStop(GoldenFile(t, "testdata/start_stop.txt")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoldenMismatch(t *testing.T) {
+	tb := &fakeTB{}
+	c := Golden(tb, `
+		> 00
+		< 42 42 49 4f 31
+		< timeout
+		> 02
+		< 49 32 43 31
+		# a stop is expected where the code starts
+		> 03
+		< 01
+	`)
+	if err := startStop(c); err == nil {
+		t.Fatal("no error for a deviation from the transcript")
+	}
+	if len(tb.errs) != 0 {
+		t.Fatalf("failed before the test finished: %q", tb.errs)
+	}
+
+	tb.finish()
+	if len(tb.errs) != 1 {
+		t.Fatalf("got failures %q, want one", tb.errs)
+	}
+	for _, want := range []string{"transcript:8: wrote 02, want 03", "- > 03\n", "+ > 02\n", "  < 49 32 43 31\n"} {
+		if !strings.Contains(tb.errs[0], want) {
+			t.Errorf("failure lacks %q:\n%s", want, tb.errs[0])
+		}
+	}
+}
+
+func TestGoldenIncomplete(t *testing.T) {
+	tb := &fakeTB{}
+	c := Golden(tb, "> 00\n< 42 42 49 4f 31\n< timeout\n> 0f\n")
+	if err := bp.NewBusPirate(c).Open(); err != nil {
+		t.Fatal(err)
+	}
+	tb.finish()
+	if len(tb.errs) != 1 || !strings.Contains(tb.errs[0], "expected write of 0f was not performed") {
+		t.Errorf("got failures %q, want the write left", tb.errs)
+	}
+}
+
+func TestGoldenErrors(t *testing.T) {
+	tb := &fakeTB{}
+	Golden(tb, "01 02\n")
+	if !tb.fatal {
+		t.Error("invalid transcript accepted")
+	}
+
+	tb = &fakeTB{}
+	GoldenFile(tb, "testdata/missing.txt")
+	if !tb.fatal {
+		t.Error("missing file accepted")
+	}
+}
+
+func TestActual(t *testing.T) {
+	c := Golden(t, "> 00 01\n< 02\n< timeout\n")
+	c.Write([]byte{0x00})
+	c.Write([]byte{0x01})
+	c.Read(make([]byte, 4))
+	c.Read(make([]byte, 4))
+	want := "> 00\n> 01\n< 02\n< timeout\n"
+	if got := c.Actual(); got != want {
+		t.Errorf("Actual() = %q, want %q", got, want)
+	}
+}
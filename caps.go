@@ -0,0 +1,100 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import "github.com/distributed/bp/wire"
+
+// Capabilities tells which features the firmware of a bus pirate
+// supports, so callers can avoid what it can't do instead of failing
+// halfway through.
+type Capabilities struct {
+	// I2C write then read command, used by NonStrictI2C.Transact8x8,
+	// and the most bytes it writes or reads at a time
+	WriteThenRead    bool
+	MaxWriteThenRead int
+
+	// binary I2C sniffer, used by Sniff
+	Sniffer bool
+
+	// selectable pull-up voltage, v4 hardware only
+	PullupVoltage bool
+
+	// reading the AUX pin in I2C mode, used by ReadAUX
+	AUXRead bool
+
+	// binary OpenOCD JTAG mode, v3 hardware only
+	OpenOCD bool
+
+	// I2C bus speeds in Hz
+	I2CSpeeds []int
+
+	// rates of the serial link besides DefaultBaudRate, see
+	// SetBaudRate, v3 hardware only
+	HostBaudRates []int
+}
+
+// CapabilitiesFor returns the capabilities of a bus pirate with the
+// versions v. Firmware older than v5.10, the first release with the
+// binary I2C commands used by this package, or with an unrecognized
+// version supports nothing but the basics.
+//
+// A bus pirate 5 or 6 is talked to in its legacy binary mode, which
+// emulates the protocol of the v3 firmware, see legacyFirmware. Its own
+// firmware versions count in a different series, so the emulated version
+// stands in for them. The features of the v3 hardware, like the rates of
+// its serial link and OpenOCD mode, are not emulated.
+func CapabilitiesFor(v VersionInfo) Capabilities {
+	c := Capabilities{
+		I2CSpeeds: []int{5000, 50000, 100000, 400000},
+	}
+
+	legacy := v.HardwareMajor() >= 5
+	if legacy {
+		v.FirmwareMajor, v.FirmwareMinor = legacyFirmware[0], legacyFirmware[1]
+	}
+
+	v4 := v.HardwareMajor() == 4
+	if v.FirmwareAtLeast(5, 10) {
+		c.WriteThenRead = true
+		c.MaxWriteThenRead = wire.MaxWriteThenRead
+		c.Sniffer = true
+		c.OpenOCD = !v4 && !legacy
+	}
+	if v.FirmwareAtLeast(6, 1) {
+		c.AUXRead = true
+	}
+	if v.HardwareMajor() == 3 {
+		c.HostBaudRates = []int{250000, 500000, 1000000}
+	}
+	if v4 && v.FirmwareAtLeast(6, 0) {
+		c.PullupVoltage = true
+	}
+
+	return c
+}
+
+// legacyFirmware is the version of the v3 firmware whose binary protocol
+// the legacy binary mode of the bus pirate 5 and 6 emulates.
+var legacyFirmware = [2]int{6, 1}
+
+// Capabilities returns the capabilities of the bus pirate. It needs the
+// versions, see Version.
+func (bp *BusPirate) Capabilities() (Capabilities, error) {
+	v, err := bp.Version()
+	if err != nil {
+		return Capabilities{}, err
+	}
+	return CapabilitiesFor(v), nil
+}
+
+// supports returns an error if the bus pirate is known to lack the
+// capability checked by has. If the versions haven't been queried, the
+// bus pirate is assumed to support it. The caller has to hold the lock.
+func (bp *BusPirate) supports(op string, has func(Capabilities) bool) error {
+	if bp.version == nil || has(CapabilitiesFor(*bp.version)) {
+		return nil
+	}
+	return &OpError{op, bp.mode, nil, ErrNotSupported}
+}
@@ -0,0 +1,89 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// CSVWriter writes sniffer events as CSV in the spirit of Saleae's I2C
+// export. There is one row per event with the columns
+//
+//	timestamp, event, address, data, ack
+//
+// The timestamp is in seconds relative to the first event. Events are
+// start, stop, address for the first byte after a start and read or write
+// for data bytes. The address column holds the 7 bit address of the
+// current transaction, data and ack are empty for start and stop.
+type CSVWriter struct {
+	w     *csv.Writer
+	t0    time.Time
+	any   bool
+	addr  string
+	read  bool
+	first bool
+}
+
+// NewCSVWriter writes the header row to w and returns a CSVWriter.
+func NewCSVWriter(w io.Writer) (*CSVWriter, error) {
+	cw := &CSVWriter{w: csv.NewWriter(w)}
+	if err := cw.w.Write([]string{"timestamp", "event", "address", "data", "ack"}); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// WriteEvent writes one row for ev.
+func (cw *CSVWriter) WriteEvent(ev bp.SniffEvent) error {
+	if !cw.any {
+		cw.t0 = ev.Time
+		cw.any = true
+	}
+	ts := fmt.Sprintf("%.9f", ev.Time.Sub(cw.t0).Seconds())
+
+	var rec []string
+	switch ev.Type {
+	case bp.SniffStart:
+		cw.first = true
+		cw.addr = ""
+		rec = []string{ts, "start", "", "", ""}
+	case bp.SniffStop:
+		rec = []string{ts, "stop", cw.addr, "", ""}
+		cw.first = false
+	case bp.SniffByte:
+		ack := "NACK"
+		if ev.ACK {
+			ack = "ACK"
+		}
+		data := fmt.Sprintf("%#02x", ev.Byte)
+		if cw.first {
+			cw.addr = fmt.Sprintf("%#02x", ev.Byte>>1)
+			cw.read = ev.Byte&1 == 1
+			cw.first = false
+			rec = []string{ts, "address", cw.addr, data, ack}
+		} else {
+			event := "write"
+			if cw.read {
+				event = "read"
+			}
+			rec = []string{ts, event, cw.addr, data, ack}
+		}
+	default:
+		return fmt.Errorf("capture: unknown event type %v", ev.Type)
+	}
+
+	return cw.w.Write(rec)
+}
+
+// Flush writes buffered rows to the underlying writer.
+func (cw *CSVWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
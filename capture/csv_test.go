@@ -0,0 +1,73 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+func TestCSVGolden(t *testing.T) {
+	var buf bytes.Buffer
+	cw, err := NewCSVWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a register read with a repeated start, timestamps relative to
+	// the first event
+	t0 := time.Unix(1000, 0)
+	us := func(n int) time.Time { return t0.Add(time.Duration(n) * time.Microsecond) }
+	for _, ev := range []bp.SniffEvent{
+		{Type: bp.SniffStart, Time: t0},
+		{Type: bp.SniffByte, Byte: 0xa0, ACK: true, Time: us(90)},
+		{Type: bp.SniffByte, Byte: 0x10, ACK: true, Time: us(180)},
+		{Type: bp.SniffStart, Time: us(200)},
+		{Type: bp.SniffByte, Byte: 0xa1, ACK: true, Time: us(290)},
+		{Type: bp.SniffByte, Byte: 0x42, ACK: true, Time: us(380)},
+		{Type: bp.SniffByte, Byte: 0x00, ACK: false, Time: us(470)},
+		{Type: bp.SniffStop, Time: us(500)},
+		{Type: bp.SniffStart, Time: t0.Add(2 * time.Second)},
+		{Type: bp.SniffByte, Byte: 0x20, ACK: false, Time: t0.Add(2*time.Second + 90*time.Microsecond)},
+		{Type: bp.SniffStop, Time: t0.Add(2*time.Second + 100*time.Microsecond)},
+	} {
+		if err := cw.WriteEvent(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `timestamp,event,address,data,ack
+0.000000000,start,,,
+0.000090000,address,0x50,0xa0,ACK
+0.000180000,write,0x50,0x10,ACK
+0.000200000,start,,,
+0.000290000,address,0x50,0xa1,ACK
+0.000380000,read,0x50,0x42,ACK
+0.000470000,read,0x50,0x00,NACK
+0.000500000,stop,0x50,,
+2.000000000,start,,,
+2.000090000,address,0x10,0x20,NACK
+2.000100000,stop,0x10,,
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCSVUnknownEvent(t *testing.T) {
+	cw, err := NewCSVWriter(&bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.WriteEvent(bp.SniffEvent{Type: bp.SniffByte + 1}); err == nil {
+		t.Error("no error for an unknown event type")
+	}
+}
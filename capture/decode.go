@@ -0,0 +1,89 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// PinSample is the state of the I2C lines at Time, as sampled by a logic
+// analyzer. The bus pirate's I2C mode doesn't sample the lines.
+type PinSample struct {
+	Time time.Time
+	SCL  bool
+	SDA  bool
+}
+
+// I2CDecoder reconstructs I2C events from sampled SCL and SDA levels. It
+// produces the same events as the bus pirate's sniffer and is useful when
+// the firmware sniffer drops events on fast buses. The sample rate has to
+// be high enough to see every SCL level, ideally four or more samples
+// per bit.
+type I2CDecoder struct {
+	prev    PinSample
+	started bool
+	inframe bool
+	nbits   int
+	cur     byte
+}
+
+// Add feeds one sample into the decoder and returns the events it
+// completes, if any.
+func (d *I2CDecoder) Add(s PinSample) []bp.SniffEvent {
+	if !d.started {
+		d.prev = s
+		d.started = true
+		return nil
+	}
+
+	p := d.prev
+	d.prev = s
+
+	var evs []bp.SniffEvent
+
+	switch {
+	case p.SCL && s.SCL && p.SDA && !s.SDA:
+		// SDA falling while SCL is high: (repeated) start
+		evs = append(evs, bp.SniffEvent{Type: bp.SniffStart, Time: s.Time})
+		d.inframe = true
+		d.nbits = 0
+		d.cur = 0
+	case p.SCL && s.SCL && !p.SDA && s.SDA:
+		// SDA rising while SCL is high: stop
+		if d.inframe {
+			evs = append(evs, bp.SniffEvent{Type: bp.SniffStop, Time: s.Time})
+		}
+		d.inframe = false
+	case !p.SCL && s.SCL && d.inframe:
+		// data is valid on the rising edge of SCL
+		if d.nbits < 8 {
+			d.cur <<= 1
+			if s.SDA {
+				d.cur |= 1
+			}
+			d.nbits++
+		} else {
+			evs = append(evs, bp.SniffEvent{Type: bp.SniffByte, Byte: d.cur, ACK: !s.SDA, Time: s.Time})
+			d.nbits = 0
+			d.cur = 0
+		}
+	}
+
+	return evs
+}
+
+// DecodeI2C decodes a complete capture.
+func DecodeI2C(samples []PinSample) []bp.SniffEvent {
+	var (
+		d   I2CDecoder
+		evs []bp.SniffEvent
+	)
+	for _, s := range samples {
+		evs = append(evs, d.Add(s)...)
+	}
+	return evs
+}
@@ -0,0 +1,143 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// wave builds the samples of an I2C bus, one per level change, starting
+// idle with both lines high.
+type wave struct {
+	samples  []PinSample
+	scl, sda bool
+}
+
+func newWave() *wave {
+	w := &wave{scl: true, sda: true}
+	w.set(true, true)
+	return w
+}
+
+func (w *wave) set(scl, sda bool) *wave {
+	w.scl, w.sda = scl, sda
+	t := time.Unix(0, 0).Add(time.Duration(len(w.samples)) * time.Microsecond)
+	w.samples = append(w.samples, PinSample{Time: t, SCL: scl, SDA: sda})
+	return w
+}
+
+func (w *wave) start() *wave {
+	if !w.scl {
+		// release SDA, then SCL, for a repeated start
+		w.set(false, true).set(true, true)
+	}
+	return w.set(true, false).set(false, false)
+}
+
+func (w *wave) stop() *wave {
+	return w.set(false, false).set(true, false).set(true, true)
+}
+
+func (w *wave) bit(b bool) *wave {
+	return w.set(false, b).set(true, b).set(false, b)
+}
+
+// byte clocks out v and the acknowledge bit.
+func (w *wave) byte(v byte, ack bool) *wave {
+	for i := 7; i >= 0; i-- {
+		w.bit(v>>uint(i)&1 != 0)
+	}
+	return w.bit(!ack)
+}
+
+// events formats events like "[ 0xa0+ 0x01- ]", + for ACK and - for NACK.
+func events(evs []bp.SniffEvent) string {
+	var s []string
+	for _, e := range evs {
+		switch e.Type {
+		case bp.SniffStart:
+			s = append(s, "[")
+		case bp.SniffStop:
+			s = append(s, "]")
+		case bp.SniffByte:
+			a := "-"
+			if e.ACK {
+				a = "+"
+			}
+			s = append(s, fmt.Sprintf("%#02x%s", e.Byte, a))
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+func TestDecodeI2C(t *testing.T) {
+	// a register read, its first 12 samples are the start and the first
+	// three bits of the address
+	read := newWave().start().byte(0xa0, true).byte(0x10, true).
+		start().byte(0xa1, true).byte(0x42, true).byte(0x43, false).stop()
+
+	for _, c := range []struct {
+		name    string
+		samples []PinSample
+		want    string
+	}{
+		{"start and stop", newWave().start().stop().samples, "[ ]"},
+		{"write", newWave().start().byte(0xa0, true).byte(0x00, true).byte(0xff, true).stop().samples,
+			"[ 0xa0+ 0x00+ 0xff+ ]"},
+		{"NACK", newWave().start().byte(0x90, false).stop().samples, "[ 0x90- ]"},
+		{"repeated start", read.samples, "[ 0xa0+ 0x10+ [ 0xa1+ 0x42+ 0x43- ]"},
+		{"idle", newWave().set(true, true).set(true, true).samples, ""},
+		{"stop without start", []PinSample{{SCL: true, SDA: false}, {SCL: true, SDA: true}}, ""},
+		{"SCL glitch while idle", newWave().set(false, true).set(true, true).samples, ""},
+		{"capture beginning mid-transaction", append(read.samples[12:], newWave().start().byte(0x30, true).stop().samples[1:]...),
+			"[ 0xa1+ 0x42+ 0x43- ] [ 0x30+ ]"},
+		{"capture beginning with the lines low", append([]PinSample{{SCL: false, SDA: false}}, newWave().start().byte(0x30, true).stop().samples...),
+			"[ 0x30+ ]"},
+	} {
+		if got := events(DecodeI2C(c.samples)); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDecodeI2CGlitches(t *testing.T) {
+	// SDA glitches while SCL is low, where SDA may change, don't matter
+	w := newWave().start()
+	for _, b := range []bool{true, false, true, false, false, false, false, false, false} {
+		w.set(false, !b).set(false, b).bit(b)
+	}
+	w.stop()
+	if got, want := events(DecodeI2C(w.samples)), "[ 0xa0+ ]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// but SDA changing while SCL is high is a start or stop
+	w = newWave().start().bit(true).set(true, true).set(true, false).byte(0x12, true).stop()
+	if got, want := events(DecodeI2C(w.samples)), "[ [ 0x12+ ]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestI2CDecoderTime(t *testing.T) {
+	w := newWave().start().byte(0xa0, true).stop()
+	var d I2CDecoder
+	var evs []bp.SniffEvent
+	for i, s := range w.samples {
+		for _, e := range d.Add(s) {
+			if e.Time != s.Time {
+				t.Errorf("event %v of sample %d at %v, want %v", e.Type, i, e.Time, s.Time)
+			}
+			evs = append(evs, e)
+		}
+	}
+	if len(evs) != 3 {
+		t.Errorf("got %s", events(evs))
+	}
+}
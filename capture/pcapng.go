@@ -0,0 +1,122 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/distributed/bp"
+)
+
+// LinkTypeI2C is the pcapng link type used for I2C transactions. It is
+// LINKTYPE_USER0, configure Wireshark's DLT_USER table to attach a
+// dissector to it.
+//
+// Every packet is one transaction as produced by bp.TransactionAssembler:
+//
+//	byte 0:    address byte as seen on the bus (address << 1 | R/W)
+//	byte 1:    1 if the address byte was ACKed, 0 otherwise
+//	byte 2n+2: data byte n
+//	byte 2n+3: 1 if data byte n was ACKed, 0 otherwise
+const LinkTypeI2C = 147
+
+const (
+	pcapng_SHB = 0x0a0d0d0a
+	pcapng_IDB = 0x00000001
+	pcapng_EPB = 0x00000006
+
+	pcapng_BYTEORDER = 0x1a2b3c4d
+)
+
+// PcapngWriter writes sniffed I2C transactions to a pcapng file. Packet
+// timestamps are the host times of the start conditions, in microseconds.
+type PcapngWriter struct {
+	w   io.Writer
+	asm bp.TransactionAssembler
+}
+
+// NewPcapngWriter writes the pcapng section and interface headers to w
+// and returns a writer for the packets.
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	pw := &PcapngWriter{w: w}
+
+	// section header block, no options
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapng_BYTEORDER)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0) // minor version
+	binary.LittleEndian.PutUint64(shb[8:], 0xffffffffffffffff)
+	if err := pw.block(pcapng_SHB, shb); err != nil {
+		return nil, err
+	}
+
+	// interface description block, no options
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], LinkTypeI2C)
+	binary.LittleEndian.PutUint32(idb[4:], 0) // no snap length limit
+	if err := pw.block(pcapng_IDB, idb); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+// WriteEvent feeds ev into the writer's transaction assembler and writes
+// a packet whenever a transaction is complete.
+func (pw *PcapngWriter) WriteEvent(ev bp.SniffEvent) error {
+	if tr := pw.asm.Add(ev); tr != nil {
+		return pw.WriteTransaction(tr)
+	}
+	return nil
+}
+
+// WriteTransaction writes tr as one packet.
+func (pw *PcapngWriter) WriteTransaction(tr *bp.I2CTransaction) error {
+	data := make([]byte, 0, 2+2*len(tr.Data))
+	ab := tr.Addr << 1
+	if tr.Read {
+		ab |= 1
+	}
+	data = append(data, ab, b2byte(tr.AddrACK))
+	for i, d := range tr.Data {
+		data = append(data, d, b2byte(tr.ACKs[i]))
+	}
+
+	ts := uint64(tr.Start.UnixNano() / 1000)
+
+	epb := make([]byte, 20, 20+len(data)+3)
+	binary.LittleEndian.PutUint32(epb[0:], 0) // interface id
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(data)))
+	epb = append(epb, data...)
+	for len(epb)%4 != 0 {
+		epb = append(epb, 0)
+	}
+
+	return pw.block(pcapng_EPB, epb)
+}
+
+// block writes a block of type typ with the given body, which has to be
+// padded to 32 bits already.
+func (pw *PcapngWriter) block(typ uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	buf := make([]byte, 0, total)
+	buf = binary.LittleEndian.AppendUint32(buf, typ)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+	buf = append(buf, body...)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+	_, err := pw.w.Write(buf)
+	return err
+}
+
+func b2byte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
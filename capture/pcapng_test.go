@@ -0,0 +1,116 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+func TestPcapngGolden(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapngWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a register write, at 0x0000_0001_0000_0002 µs, and a one byte
+	// read
+	t0 := time.Unix(0, (1<<32+2)*1000)
+	for _, ev := range []bp.SniffEvent{
+		{Type: bp.SniffStart, Time: t0},
+		{Type: bp.SniffByte, Byte: 0xa0, ACK: true},
+		{Type: bp.SniffByte, Byte: 0x10, ACK: true},
+		{Type: bp.SniffStop},
+		{Type: bp.SniffStart, Time: t0.Add(time.Microsecond)},
+		{Type: bp.SniffByte, Byte: 0xa1, ACK: true},
+		{Type: bp.SniffByte, Byte: 0x42, ACK: false},
+		{Type: bp.SniffStop},
+	} {
+		if err := pw.WriteEvent(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []byte{
+		// section header block: type, length, byte order magic,
+		// version 1.0, unknown section length, length
+		0x0a, 0x0d, 0x0d, 0x0a, 0x1c, 0x00, 0x00, 0x00,
+		0x4d, 0x3c, 0x2b, 0x1a, 0x01, 0x00, 0x00, 0x00,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x1c, 0x00, 0x00, 0x00,
+
+		// interface description block: LINKTYPE_USER0, no snap
+		// length
+		0x01, 0x00, 0x00, 0x00, 0x14, 0x00, 0x00, 0x00,
+		0x93, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x14, 0x00, 0x00, 0x00,
+
+		// enhanced packet block: interface 0, timestamp high and
+		// low, captured and original length 4, no padding
+		0x06, 0x00, 0x00, 0x00, 0x24, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00,
+		0x04, 0x00, 0x00, 0x00,
+		0xa0, 0x01, 0x10, 0x01,
+		0x24, 0x00, 0x00, 0x00,
+
+		// the same for the read, again 4 bytes
+		0x06, 0x00, 0x00, 0x00, 0x24, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x03, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00,
+		0x04, 0x00, 0x00, 0x00,
+		0xa1, 0x01, 0x42, 0x00,
+		0x24, 0x00, 0x00, 0x00,
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("got\n% x\nwant\n% x", buf.Bytes(), want)
+	}
+}
+
+func TestPcapngPadding(t *testing.T) {
+	for _, c := range []struct {
+		data    int // data bytes of the transaction
+		padding int
+	}{
+		{0, 2}, // the address and its ACK only
+		{1, 0},
+		{2, 2},
+		{3, 0},
+	} {
+		var buf bytes.Buffer
+		pw, err := NewPcapngWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := buf.Len()
+		tr := &bp.I2CTransaction{Addr: 0x50, AddrACK: true, Data: make([]byte, c.data), ACKs: make([]bool, c.data)}
+		if err := pw.WriteTransaction(tr); err != nil {
+			t.Fatal(err)
+		}
+		epb := buf.Bytes()[hdr:]
+
+		n := 2 + 2*c.data
+		total := 12 + 20 + n + c.padding
+		if len(epb) != total {
+			t.Errorf("%d data bytes: block of %d bytes, want %d", c.data, len(epb), total)
+			continue
+		}
+		for _, off := range []int{4, total - 4} {
+			if got := int(epb[off]) | int(epb[off+1])<<8; got != total {
+				t.Errorf("%d data bytes: length %d at %d, want %d", c.data, got, off, total)
+			}
+		}
+		if got := int(epb[20]); got != n {
+			t.Errorf("%d data bytes: captured length %d, want %d", c.data, got, n)
+		}
+		if pad := epb[28+n : total-4]; !bytes.Equal(pad, make([]byte, c.padding)) {
+			t.Errorf("%d data bytes: padding % x", c.data, pad)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// WriteSigrok writes events as a sigrok session file (.sr) to w. The file
+// contains the two logic channels SCL and SDA reconstructed from the
+// events as described at WaveOptions and can be opened in PulseView,
+// where the I2C protocol decoder recovers the transactions. The quarter
+// of the bit time is the sample period, it has to divide a second.
+func WriteSigrok(w io.Writer, events []bp.SniffEvent, opts *WaveOptions) error {
+	if opts == nil {
+		opts = &DefaultWaveOptions
+	}
+
+	// four samples per bit are enough for the synthetic waveform
+	period := opts.BitTime / 4
+	if period <= 0 {
+		return fmt.Errorf("capture: bit time %v too short", opts.BitTime)
+	}
+	levels, _, total := synthesize(events, opts)
+	return writeSigrok(w, levels, total, period)
+}
+
+// WriteSigrokSamples writes a logic capture of the I2C lines as a sigrok
+// session file (.sr) to w, like WriteSigrok. The lines keep the levels of
+// a sample until the time of the next one, they are sampled every period
+// for the file, usually the sample period of the capture. period has to
+// divide a second, sigrok stores the sample rate in Hz.
+func WriteSigrokSamples(w io.Writer, samples []PinSample, period time.Duration) error {
+	if period <= 0 {
+		return fmt.Errorf("capture: sample period %v too short", period)
+	}
+	levels, total := sampleLevels(samples, period)
+	return writeSigrok(w, levels, total, period)
+}
+
+// writeSigrok writes the levels up to total, sampled every period.
+func writeSigrok(w io.Writer, levels []level, total, period time.Duration) error {
+	if period > time.Second || time.Second%period != 0 {
+		return fmt.Errorf("capture: sample period %v doesn't divide a second", period)
+	}
+	samplerate := int64(time.Second / period)
+
+	zw := zip.NewWriter(w)
+
+	f, err := zw.Create("version")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, "2"); err != nil {
+		return err
+	}
+
+	f, err = zw.Create("metadata")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "[global]\n"+
+		"sigrok version=0.5.1\n"+
+		"\n"+
+		"[device 1]\n"+
+		"capturefile=logic-1\n"+
+		"total probes=2\n"+
+		"samplerate=%d\n"+
+		"total analog=0\n"+
+		"probe1=SCL\n"+
+		"probe2=SDA\n"+
+		"unitsize=1\n", samplerate)
+	if err != nil {
+		return err
+	}
+
+	f, err = zw.Create("logic-1-1")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+
+	nsamples := int64(total / period)
+	li := 0
+	var cur byte
+	for i := int64(0); i < nsamples; i++ {
+		t := time.Duration(i) * period
+		for li < len(levels) && levels[li].T <= t {
+			cur = 0
+			if levels[li].SCL {
+				cur |= 1
+			}
+			if levels[li].SDA {
+				cur |= 2
+			}
+			li++
+		}
+		if err := bw.WriteByte(cur); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
@@ -0,0 +1,70 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSigrok returns the metadata and the samples of a session file.
+func readSigrok(t *testing.T, b []byte) (string, []byte) {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return string(files["metadata"]), files["logic-1-1"]
+}
+
+func TestSigrokSamples(t *testing.T) {
+	var buf bytes.Buffer
+	samples := newWave().start().stop().samples
+	if err := WriteSigrokSamples(&buf, samples, 500*time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	meta, logic := readSigrok(t, buf.Bytes())
+	if !strings.Contains(meta, "\nsamplerate=2000000\n") {
+		t.Errorf("metadata\n%s", meta)
+	}
+	// two samples per µs, SCL in bit 0 and SDA in bit 1, the last
+	// sample lasting one period
+	want := []byte{3, 3, 1, 1, 0, 0, 0, 0, 1, 1, 3}
+	if !bytes.Equal(logic, want) {
+		t.Errorf("samples % x, want % x", logic, want)
+	}
+}
+
+func TestSigrokPeriod(t *testing.T) {
+	samples := newWave().start().stop().samples
+	for _, period := range []time.Duration{0, -time.Microsecond, 3 * time.Microsecond, 2 * time.Second} {
+		if err := WriteSigrokSamples(io.Discard, samples, period); err == nil {
+			t.Errorf("no error for a sample period of %v", period)
+		}
+	}
+	// a quarter of 6 µs is 1.5 µs, which doesn't divide a second
+	if err := WriteSigrok(io.Discard, nil, &WaveOptions{BitTime: 6 * time.Microsecond}); err == nil {
+		t.Error("no error for a bit time of 6 µs")
+	}
+	if err := WriteSigrok(io.Discard, nil, nil); err != nil {
+		t.Errorf("default options: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// WriteVCD writes events as a value change dump to w, for example for
+// viewing in GTKWave. SCL and SDA are reconstructed as described at
+// WaveOptions. A string signal named "i2c" annotates each event with its
+// meaning: S and P for start and stop, the address and direction for the
+// first byte after a start and the data byte and ACK/NACK otherwise.
+func WriteVCD(w io.Writer, events []bp.SniffEvent, opts *WaveOptions) error {
+	levels, marks, total := synthesize(events, opts)
+	return writeVCD(w, levels, marks, annotate(events), total)
+}
+
+// WriteVCDSamples writes a logic capture of the I2C lines as a value
+// change dump to w, like WriteVCD, with the real timing of the capture.
+// The "i2c" signal annotates the events decoded from the capture by
+// DecodeI2C.
+func WriteVCDSamples(w io.Writer, samples []PinSample) error {
+	levels, total := sampleLevels(samples, 0)
+	events := DecodeI2C(samples)
+	marks := make([]time.Duration, len(events))
+	for i, ev := range events {
+		marks[i] = ev.Time.Sub(samples[0].Time)
+	}
+	return writeVCD(w, levels, marks, annotate(events), total)
+}
+
+// writeVCD writes the levels up to total and the notes at their marks.
+func writeVCD(w io.Writer, levels []level, marks []time.Duration, notes []string, total time.Duration) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "$date %s $end\n", time.Now().Format(time.RFC1123))
+	fmt.Fprintf(bw, "$version github.com/distributed/bp $end\n")
+	fmt.Fprintf(bw, "$timescale 1ns $end\n")
+	fmt.Fprintf(bw, "$scope module bus $end\n")
+	fmt.Fprintf(bw, "$var wire 1 c SCL $end\n")
+	fmt.Fprintf(bw, "$var wire 1 d SDA $end\n")
+	fmt.Fprintf(bw, "$var string 1 a i2c $end\n")
+	fmt.Fprintf(bw, "$upscope $end\n")
+	fmt.Fprintf(bw, "$enddefinitions $end\n")
+
+	var (
+		li, ni   int
+		scl, sda = -1, -1
+	)
+	for li < len(levels) || ni < len(notes) {
+		var t time.Duration
+		switch {
+		case ni >= len(notes):
+			t = levels[li].T
+		case li >= len(levels):
+			t = marks[ni]
+		default:
+			t = levels[li].T
+			if marks[ni] < t {
+				t = marks[ni]
+			}
+		}
+
+		fmt.Fprintf(bw, "#%d\n", t.Nanoseconds())
+
+		for ; li < len(levels) && levels[li].T == t; li++ {
+			if v := b2i(levels[li].SCL); v != scl {
+				fmt.Fprintf(bw, "%dc\n", v)
+				scl = v
+			}
+			if v := b2i(levels[li].SDA); v != sda {
+				fmt.Fprintf(bw, "%dd\n", v)
+				sda = v
+			}
+		}
+
+		for ; ni < len(notes) && marks[ni] == t; ni++ {
+			fmt.Fprintf(bw, "s%s a\n", notes[ni])
+		}
+	}
+
+	fmt.Fprintf(bw, "#%d\n", total.Nanoseconds())
+
+	return bw.Flush()
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// annotate returns a short, space free description of every event.
+func annotate(events []bp.SniffEvent) []string {
+	notes := make([]string, len(events))
+	addrnext := false
+	for i, ev := range events {
+		switch ev.Type {
+		case bp.SniffStart:
+			notes[i] = "S"
+			addrnext = true
+		case bp.SniffStop:
+			notes[i] = "P"
+			addrnext = false
+		case bp.SniffByte:
+			ack := "ACK"
+			if !ev.ACK {
+				ack = "NACK"
+			}
+			if addrnext {
+				dir := "W"
+				if ev.Byte&1 == 1 {
+					dir = "R"
+				}
+				notes[i] = fmt.Sprintf("%#02x_%s_%s", ev.Byte>>1, dir, ack)
+				addrnext = false
+			} else {
+				notes[i] = fmt.Sprintf("%02x_%s", ev.Byte, ack)
+			}
+		}
+	}
+	return notes
+}
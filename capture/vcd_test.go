@@ -0,0 +1,162 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+const vcdHeader = `$version github.com/distributed/bp $end
+$timescale 1ns $end
+$scope module bus $end
+$var wire 1 c SCL $end
+$var wire 1 d SDA $end
+$var string 1 a i2c $end
+$upscope $end
+$enddefinitions $end
+`
+
+// checkVCD compares a dump with want, after the header and the $date line,
+// which holds the time of writing.
+func checkVCD(t *testing.T, got, want string) {
+	t.Helper()
+	date, rest, _ := strings.Cut(got, "\n")
+	if !strings.HasPrefix(date, "$date ") || !strings.HasSuffix(date, " $end") {
+		t.Errorf("first line %q", date)
+	}
+	if rest != vcdHeader+want {
+		t.Errorf("got\n%s\nwant\n%s", rest, vcdHeader+want)
+	}
+}
+
+func TestVCDGolden(t *testing.T) {
+	// an address byte with a 1 s gap to the stop, shortened to MaxGap
+	t0 := time.Unix(0, 0)
+	events := []bp.SniffEvent{
+		{Type: bp.SniffStart, Time: t0},
+		{Type: bp.SniffByte, Byte: 0xa1, ACK: true, Time: t0},
+		{Type: bp.SniffStop, Time: t0.Add(time.Second)},
+	}
+	var buf bytes.Buffer
+	opts := &WaveOptions{BitTime: 4 * time.Microsecond, MaxGap: 2 * time.Microsecond}
+	if err := WriteVCD(&buf, events, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1 µs per quarter bit, SCL high for the middle half of every bit,
+	// bits 1 0 1 0 0 0 0 1 and the ACK
+	checkVCD(t, buf.String(), `#0
+1c
+1d
+#1000
+0d
+sS a
+#2000
+0c
+#3000
+1d
+s0x50_R_ACK a
+#4000
+1c
+#6000
+0c
+#7000
+0d
+#8000
+1c
+#10000
+0c
+#11000
+1d
+#12000
+1c
+#14000
+0c
+#15000
+0d
+#16000
+1c
+#18000
+0c
+#19000
+#20000
+1c
+#22000
+0c
+#23000
+#24000
+1c
+#26000
+0c
+#27000
+#28000
+1c
+#30000
+0c
+#31000
+1d
+#32000
+1c
+#34000
+0c
+#35000
+0d
+#36000
+1c
+#38000
+0c
+#41000
+sP a
+#42000
+1c
+#43000
+1d
+#45000
+`)
+}
+
+func TestVCDSamplesGolden(t *testing.T) {
+	// a start and a stop, one sample per µs, the repeated sample of
+	// both lines low dropped
+	var buf bytes.Buffer
+	if err := WriteVCDSamples(&buf, newWave().start().stop().samples); err != nil {
+		t.Fatal(err)
+	}
+	checkVCD(t, buf.String(), `#0
+1c
+1d
+#1000
+0d
+sS a
+#2000
+0c
+#4000
+1c
+#5000
+1d
+sP a
+#5000
+`)
+}
+
+func TestAnnotate(t *testing.T) {
+	got := annotate([]bp.SniffEvent{
+		{Type: bp.SniffStart},
+		{Type: bp.SniffByte, Byte: 0x90, ACK: true},
+		{Type: bp.SniffByte, Byte: 0x0a, ACK: false},
+		{Type: bp.SniffStart},
+		{Type: bp.SniffByte, Byte: 0x91, ACK: false},
+		{Type: bp.SniffStop},
+	})
+	want := []string{"S", "0x48_W_ACK", "0a_NACK", "S", "0x48_R_NACK", "P"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package capture writes sniffed bus traffic in formats understood by
+// external analysis tools, as well as logic captures of the I2C lines,
+// which it also decodes.
+package capture
+
+import (
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// WaveOptions controls how SCL and SDA waveforms are reconstructed from
+// sniffer events. The bus pirate's sniffer only reports decoded events,
+// so bit timing is synthetic: every bit takes BitTime and gaps between
+// events are taken from the host timestamps, but shortened to at most
+// MaxGap so long idle periods don't produce huge files.
+type WaveOptions struct {
+	BitTime time.Duration
+	MaxGap  time.Duration
+}
+
+// DefaultWaveOptions are used when nil options are passed.
+var DefaultWaveOptions = WaveOptions{
+	BitTime: 10 * time.Microsecond,
+	MaxGap:  time.Millisecond,
+}
+
+// level is the state of the bus lines from T on.
+type level struct {
+	T   time.Duration
+	SCL bool
+	SDA bool
+}
+
+type synth struct {
+	levels []level
+	t      time.Duration
+	q      time.Duration
+	scl    bool
+	sda    bool
+}
+
+func (s *synth) set(scl, sda bool) {
+	s.scl, s.sda = scl, sda
+	if n := len(s.levels); n > 0 && s.levels[n-1].T == s.t {
+		s.levels[n-1] = level{s.t, scl, sda}
+		return
+	}
+	s.levels = append(s.levels, level{s.t, scl, sda})
+}
+
+func (s *synth) bit(b bool) {
+	s.set(false, b)
+	s.t += s.q
+	s.set(true, b)
+	s.t += 2 * s.q
+	s.set(false, b)
+	s.t += s.q
+}
+
+// synthesize turns events into the sequence of line levels they imply.
+// It returns the levels, the offset at which each event begins and the
+// duration of the whole waveform.
+func synthesize(events []bp.SniffEvent, opts *WaveOptions) ([]level, []time.Duration, time.Duration) {
+	if opts == nil {
+		opts = &DefaultWaveOptions
+	}
+
+	s := &synth{q: opts.BitTime / 4, scl: true, sda: true}
+	s.set(true, true)
+	s.t += s.q
+
+	marks := make([]time.Duration, len(events))
+
+	var last time.Time
+	for i, ev := range events {
+		if i > 0 {
+			gap := ev.Time.Sub(last)
+			if gap > opts.MaxGap {
+				gap = opts.MaxGap
+			}
+			if gap > 0 {
+				s.t += gap
+			}
+		}
+		last = ev.Time
+		marks[i] = s.t
+
+		switch ev.Type {
+		case bp.SniffStart:
+			if !s.scl || !s.sda {
+				// repeated start
+				s.set(false, true)
+				s.t += s.q
+				s.set(true, true)
+				s.t += s.q
+			}
+			s.set(true, false)
+			s.t += s.q
+			s.set(false, false)
+			s.t += s.q
+		case bp.SniffStop:
+			s.set(false, false)
+			s.t += s.q
+			s.set(true, false)
+			s.t += s.q
+			s.set(true, true)
+			s.t += s.q
+		case bp.SniffByte:
+			for m := byte(0x80); m != 0; m >>= 1 {
+				s.bit(ev.Byte&m != 0)
+			}
+			// an ACK pulls SDA low
+			s.bit(!ev.ACK)
+		}
+	}
+
+	if s.scl && s.sda {
+		s.t += s.q
+	}
+
+	return s.levels, marks, s.t
+}
+
+// sampleLevels turns a logic capture into the sequence of line levels,
+// with times relative to the first sample. The last sample lasts one
+// period. Samples repeating the levels before them are dropped.
+func sampleLevels(samples []PinSample, period time.Duration) ([]level, time.Duration) {
+	if len(samples) == 0 {
+		return nil, 0
+	}
+	start := samples[0].Time
+	var levels []level
+	for i, sm := range samples {
+		if n := len(levels); i > 0 && levels[n-1].SCL == sm.SCL && levels[n-1].SDA == sm.SDA {
+			continue
+		}
+		levels = append(levels, level{sm.Time.Sub(start), sm.SCL, sm.SDA})
+	}
+	return levels, samples[len(samples)-1].Time.Sub(start) + period
+}
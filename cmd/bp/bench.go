@@ -0,0 +1,70 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/distributed/bp"
+	"github.com/distributed/bp/bench"
+)
+
+func benchCmd(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	cf := addConnFlags(fs)
+	addrs := fs.String("addr", "0x50", "7 bit address of the device to write to and read from")
+	simulate := fs.Bool("sim", false, "run against the simulator, with a second one as the sniffer, instead of a bus pirate")
+	latency := fs.Duration("latency", bench.DefaultLatency, "round trip time of the simulator")
+	sniffer := fs.String("sniffer", "", "serial port of a second bus pirate on the same bus, for the sniffer benchmark")
+	run := fs.String("run", "", "regular expression selecting the benchmarks")
+	benchtime := fs.String("benchtime", "1s", "run time or, like 100x, iterations of each benchmark")
+	fs.Parse(args)
+
+	addr, err := strconv.ParseUint(*addrs, 0, 7)
+	if err != nil {
+		return fmt.Errorf("invalid address %q", *addrs)
+	}
+
+	bt, err := bench.ParseBenchTime(*benchtime)
+	if err != nil {
+		return err
+	}
+
+	var t bench.Target
+	if *simulate {
+		t, err = bench.NewSim(*latency)
+		if err != nil {
+			return err
+		}
+	} else {
+		b, _, err := cf.open()
+		if err != nil {
+			return err
+		}
+		t = bench.Target{BP: b, Addr: uint8(addr)}
+		if *sniffer != "" {
+			s, err := bp.OpenPath(*sniffer)
+			if err != nil {
+				b.Close()
+				return err
+			}
+			defer s.Close()
+			t.Sniffer = s
+		}
+	}
+	defer t.BP.Close()
+
+	start := time.Now()
+	_, err = bench.Run(os.Stdout, t, *run, bt, bench.All)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ok\t%v\n", time.Since(start).Round(time.Millisecond))
+	return nil
+}
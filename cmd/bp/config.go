@@ -0,0 +1,236 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/distributed/bp"
+)
+
+// config holds the settings for talking to a bus pirate. It is read from
+// config files and overridden by the environment and flags. Zero values
+// and nil pointers mean not set, so they don't override anything.
+type config struct {
+	Port    string      `toml:"port" json:"port"`
+	Serial  string      `toml:"serial" json:"serial"`
+	Speed   bp.I2CSpeed `toml:"speed" json:"speed"`
+	Pullups *bool       `toml:"pullups" json:"pullups"`
+	Power   *bool       `toml:"power" json:"power"`
+	Baud    bp.UARTBaud `toml:"baud" json:"baud"` // of the serial link
+}
+
+// merge sets the settings set in o.
+func (c *config) merge(o config) {
+	if o.Port != "" || o.Serial != "" {
+		// either selects the bus pirate, replacing both
+		c.Port, c.Serial = o.Port, o.Serial
+	}
+	if o.Speed != 0 {
+		c.Speed = o.Speed
+	}
+	if o.Pullups != nil {
+		c.Pullups = o.Pullups
+	}
+	if o.Power != nil {
+		c.Power = o.Power
+	}
+	if o.Baud != 0 {
+		c.Baud = o.Baud
+	}
+}
+
+// configNames are the names of project config files, in the order they
+// are applied.
+var configNames = []string{".bp.toml", ".bp.json"}
+
+// configFiles returns the existing config files in the order they are
+// applied: the user's config file first, then the project config files
+// from the root directory down to the working directory, so that the
+// file closest to the working directory wins.
+func configFiles() []string {
+	var files []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		for _, name := range []string{"config.toml", "config.json"} {
+			files = append(files, filepath.Join(dir, "bp", name))
+		}
+	}
+
+	var project []string
+	if dir, err := os.Getwd(); err == nil {
+		for {
+			for i := len(configNames) - 1; i >= 0; i-- {
+				project = append(project, filepath.Join(dir, configNames[i]))
+			}
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	for i := len(project) - 1; i >= 0; i-- {
+		files = append(files, project[i])
+	}
+
+	var existing []string
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		}
+	}
+	return existing
+}
+
+// readConfig reads the config file at path, which is JSON if its name
+// ends in .json and TOML otherwise. Unknown keys are an error, they are
+// most likely typos.
+func readConfig(path string) (config, error) {
+	var c config
+	if strings.HasSuffix(path, ".json") {
+		f, err := os.Open(path)
+		if err != nil {
+			return c, err
+		}
+		defer f.Close()
+
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			return c, fmt.Errorf("%s: %v", path, err)
+		}
+		return c, nil
+	}
+
+	md, err := toml.DecodeFile(path, &c)
+	if err != nil {
+		return c, fmt.Errorf("%s: %v", path, err)
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return c, fmt.Errorf("%s: unknown key %q", path, keys[0].String())
+	}
+	return c, nil
+}
+
+// connFlags are the flags of the subcommands that talk to a bus pirate.
+type connFlags struct {
+	config string
+	flags  config
+}
+
+// addConnFlags defines the connection flags on fs.
+func addConnFlags(fs *flag.FlagSet) *connFlags {
+	cf := &connFlags{}
+	fs.StringVar(&cf.config, "config", "", "config file to read instead of searching for them")
+	fs.StringVar(&cf.flags.Port, "port", "", "serial port of the bus pirate, searched for if empty")
+	fs.StringVar(&cf.flags.Serial, "serial", "", "USB serial number of the bus pirate")
+	fs.Var(&cf.flags.Speed, "speed", "I2C speed, 5k, 50k, 100k or 400k")
+	fs.Var(boolFlag{&cf.flags.Pullups}, "pullups", "switch the pull-up resistors on or off")
+	fs.Var(boolFlag{&cf.flags.Power}, "power", "switch the power supplies on or off")
+	fs.Var(&cf.flags.Baud, "baud", "baud rate of the serial link, 250000, 500000 or 1000000 on a v3")
+	return cf
+}
+
+// load returns the settings of the config files, overridden by the
+// environment, overridden by the flags.
+func (cf *connFlags) load() (config, error) {
+	files := []string{cf.config}
+	if cf.config == "" {
+		files = configFiles()
+	}
+
+	var c config
+	for _, f := range files {
+		fc, err := readConfig(f)
+		if err != nil {
+			return c, err
+		}
+		c.merge(fc)
+	}
+	c.merge(config{Port: os.Getenv(bp.EnvPort), Serial: os.Getenv(bp.EnvSerial)})
+	c.merge(cf.flags)
+	return c, nil
+}
+
+// open opens the bus pirate and enters I2C mode with the configured
+// speed and peripherals. A port takes precedence over a serial number, if
+// neither is set, the first bus pirate found is used. If a baud rate is
+// configured, the serial link is switched to it, if that fails, it stays
+// at the default rate.
+func (cf *connFlags) open() (*bp.BusPirate, bp.BusPirateI2C, error) {
+	c, err := cf.load()
+	if err != nil {
+		return nil, bp.BusPirateI2C{}, err
+	}
+
+	var b *bp.BusPirate
+	switch {
+	case c.Port != "":
+		b, err = bp.OpenPath(c.Port)
+	case c.Serial != "":
+		b, err = bp.OpenSerial(c.Serial)
+	default:
+		b, err = bp.OpenFirst()
+	}
+	if err != nil {
+		return nil, bp.BusPirateI2C{}, err
+	}
+
+	if c.Baud != 0 {
+		if err := b.SetBaudRate(int(c.Baud)); err != nil {
+			fmt.Fprintf(os.Stderr, "staying at %d baud: %v\n", b.BaudRate(), err)
+		}
+	}
+
+	i2c, err := b.EnterI2CMode()
+	if err == nil && c.Speed != 0 {
+		err = i2c.SetSpeed(int(c.Speed))
+	}
+	if err == nil && (c.Pullups != nil || c.Power != nil) {
+		var p bp.Peripherals
+		if c.Pullups != nil && *c.Pullups {
+			p |= bp.PeriphPullups
+		}
+		if c.Power != nil && *c.Power {
+			p |= bp.PeriphPower
+		}
+		err = i2c.SetPeripherals(p)
+	}
+	if err != nil {
+		b.Close()
+		return nil, bp.BusPirateI2C{}, err
+	}
+	return b, i2c, nil
+}
+
+// boolFlag is a boolean flag that is nil unless given.
+type boolFlag struct {
+	p **bool
+}
+
+func (f boolFlag) IsBoolFlag() bool { return true }
+
+func (f boolFlag) String() string {
+	if f.p == nil || *f.p == nil {
+		return ""
+	}
+	return strconv.FormatBool(**f.p)
+}
+
+func (f boolFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*f.p = &v
+	return nil
+}
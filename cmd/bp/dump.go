@@ -0,0 +1,115 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/distributed/bp"
+)
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	cf := addConnFlags(fs)
+	addrs := fs.String("addr", "", "7 bit address of the device to dump")
+	format := fs.String("format", "i2cdump", "output format, i2cdump or raw")
+	length := fs.Int("length", 0, "bytes of memory to stream in raw format, instead of the 256 registers")
+	alen := fs.Int("alen", 1, "length of the memory addresses in bytes, 1 or 2, with -length")
+	progress := fs.Bool("progress", false, "show the progress of -length on the standard error")
+	fs.Parse(args)
+
+	addr, err := strconv.ParseUint(*addrs, 0, 7)
+	if err != nil {
+		return fmt.Errorf("invalid address %q", *addrs)
+	}
+
+	if *format != "i2cdump" && *format != "raw" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if *length > 0 && *format != "raw" {
+		return fmt.Errorf("-length needs -format raw")
+	}
+
+	b, i2c, err := cf.open()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	if *length > 0 {
+		return dumpMem(i2c, uint8(addr), *alen, *length, *progress)
+	}
+
+	regs, err := readRegs(i2c, uint8(addr), 256)
+	if err != nil {
+		return err
+	}
+
+	if *format == "raw" {
+		_, err = os.Stdout.Write(regs)
+		return err
+	}
+	return bp.WriteI2CDump(os.Stdout, regs)
+}
+
+// dumpMem streams n bytes of the memory of the device at addr to the
+// standard output, showing the progress on the standard error if
+// progress is set.
+func dumpMem(i2c bp.BusPirateI2C, addr uint8, alen, n int, progress bool) error {
+	var pf bp.ProgressFunc
+	if progress {
+		pf = func(p bp.Progress) error {
+			fmt.Fprintf(os.Stderr, "\r%v\x1b[K", p)
+			return nil
+		}
+		defer fmt.Fprintln(os.Stderr)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	nsi := bp.NonStrictI2C{BusPirateI2C: i2c}
+	if _, err := nsi.DumpRange(w, bp.Addr7(addr), 0, alen, n, pf); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// readRegs reads n registers starting at register 0 in a single
+// transaction.
+func readRegs(i2c bp.BusPirateI2C, addr uint8, n int) ([]byte, error) {
+	if err := i2c.Start(); err != nil {
+		return nil, err
+	}
+	if err := i2c.WriteByte(addr << 1); err != nil {
+		i2c.Stop()
+		return nil, err
+	}
+	if err := i2c.WriteByte(0x00); err != nil {
+		i2c.Stop()
+		return nil, err
+	}
+	if err := i2c.Start(); err != nil {
+		return nil, err
+	}
+	if err := i2c.WriteByte(addr<<1 | 1); err != nil {
+		i2c.Stop()
+		return nil, err
+	}
+
+	regs := make([]byte, n)
+	for i := range regs {
+		b, err := i2c.ReadByteAck(i < n-1)
+		if err != nil {
+			i2c.Stop()
+			return nil, err
+		}
+		regs[i] = b
+	}
+
+	return regs, i2c.Stop()
+}
@@ -0,0 +1,97 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Command bp talks to a bus pirate from the command line.
+//
+// Usage:
+//
+//	bp bench [connection flags] [-addr 0x50] [-sniffer /dev/ttyUSB1] [-sim] [-run regexp] [-benchtime 1s]
+//	bp dump [connection flags] -addr 0x50 [-format i2cdump|raw] [-length 32768 -alen 2 -progress]
+//	bp monitor [connection flags] [-names file] [-only 0x50,0x68]
+//	bp soak [connection flags] -addr 0x50 [-ops transact=10,read,modecycle,resync] [-duration 8h] [-interval 1m]
+//
+// The dump subcommand reads the 256 registers of an I2C device and prints
+// them like i2cdump does. With -length, it streams that many bytes of the
+// memory of the device, like an EEPROM image, in raw format instead. The
+// monitor subcommand runs the I2C sniffer and prints the transactions seen
+// on the bus as they happen. The soak subcommand reads from an I2C device
+// over and over with a mix of operations, for hours if need be, and prints
+// error rates, resyncs, reconnects and latency percentiles for every
+// interval and for the whole run, see package soak. Note that modecycle
+// resets the peripherals. The bench subcommand runs the benchmarks of
+// package bench and prints the results in the format of go test -bench,
+// against the simulator with -sim. It writes to the device at -addr.
+//
+// The connection flags are
+//
+//	-port /dev/ttyUSB0   serial port of the bus pirate
+//	-serial A10KZP45     USB serial number of the bus pirate (Linux only)
+//	-speed 400k          I2C speed, 5k, 50k, 100k or 400k
+//	-pullups=true|false  on-board pull-up resistors
+//	-power=true|false    on-board power supplies
+//	-baud 1M             baud rate of the serial link, see SetBaudRate
+//	-config file         config file to read instead of the searched ones
+//
+// The environment variables BP_PORT and BP_SERIAL select the bus pirate
+// like -port and -serial do. Without any of them, the first bus pirate
+// found on the USB serial ports is used. Speed and peripherals are left
+// alone unless given.
+//
+// Defaults for the connection flags are read from config files in TOML
+// or, if their name ends in .json, JSON format, with keys named like the
+// flags:
+//
+//	port = "/dev/ttyUSB0"
+//	speed = "400k"
+//	pullups = true
+//
+// The user's config file, bp/config.toml or bp/config.json in the user
+// config directory (~/.config on Linux), is read first. Project config
+// files named .bp.toml or .bp.json in the working directory and its
+// parents override it, the closer to the working directory the higher
+// their precedence. The environment variables override all config files,
+// flags override everything.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+var commands = map[string]func(args []string) error{
+	"bench":   benchCmd,
+	"dump":    dump,
+	"monitor": monitor,
+	"soak":    soakCmd,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: bp <command> [flags]\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "\t%s\n", name)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	if err := cmd(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "bp %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/distributed/bp"
+)
+
+func monitor(args []string) error {
+	fs := flag.NewFlagSet("monitor", flag.ExitOnError)
+	cf := addConnFlags(fs)
+	namefile := fs.String("names", "", "file mapping 7 bit addresses to device names")
+	only := fs.String("only", "", "comma separated 7 bit addresses to show, default all")
+	fs.Parse(args)
+
+	var addrs []uint8
+	if *only != "" {
+		for _, f := range strings.Split(*only, ",") {
+			a, err := strconv.ParseUint(strings.TrimSpace(f), 0, 7)
+			if err != nil {
+				return fmt.Errorf("invalid address %q", f)
+			}
+			addrs = append(addrs, uint8(a))
+		}
+	}
+
+	names := map[uint8]string{}
+	if *namefile != "" {
+		var err error
+		names, err = readNames(*namefile)
+		if err != nil {
+			return err
+		}
+	}
+
+	b, i2c, err := cf.open()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	sn, err := i2c.Sniff(addrs...)
+	if err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+
+	var asm bp.TransactionAssembler
+	for {
+		select {
+		case <-sig:
+			return sn.Stop()
+		case ev, ok := <-sn.Events():
+			if !ok {
+				return sn.Err()
+			}
+			if tr := asm.Add(ev); tr != nil {
+				printTransaction(tr, names)
+			}
+		}
+	}
+}
+
+func printTransaction(tr *bp.I2CTransaction, names map[uint8]string) {
+	dir := "W"
+	if tr.Read {
+		dir = "R"
+	}
+
+	var sb strings.Builder
+	if !tr.AddrACK {
+		sb.WriteString(" NACK")
+	}
+	for i, d := range tr.Data {
+		fmt.Fprintf(&sb, " %02x", d)
+		if !tr.ACKs[i] {
+			sb.WriteByte('-')
+		}
+	}
+
+	fmt.Printf("%s %#02x %-12s %s%s\n", tr.Start.Format("15:04:05.000000"),
+		tr.Addr, names[tr.Addr], dir, sb.String())
+}
+
+// readNames reads a file of lines of the form "0x50 eeprom". Empty lines
+// and lines starting with # are ignored.
+func readNames(fn string) (map[uint8]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := map[uint8]string{}
+	sc := bufio.NewScanner(f)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected address and name", fn, lineno)
+		}
+
+		addr, err := strconv.ParseUint(fields[0], 0, 7)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fn, lineno, err)
+		}
+		names[uint8(addr)] = strings.Join(fields[1:], " ")
+	}
+
+	return names, sc.Err()
+}
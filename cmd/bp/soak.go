@@ -0,0 +1,131 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distributed/bp/soak"
+)
+
+func soakCmd(args []string) error {
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	cf := addConnFlags(fs)
+	addrs := fs.String("addr", "", "7 bit address of the device to read from")
+	reg := fs.Uint("reg", 0, "first register to read")
+	n := fs.Int("n", 16, "number of registers to read")
+	mix := fs.String("ops", "transact", "comma separated operations with optional weights, like transact=10,read,modecycle,resync")
+	duration := fs.Duration("duration", 0, "length of the run, until interrupted if 0")
+	interval := fs.Duration("interval", time.Minute, "reporting interval")
+	pause := fs.Duration("pause", 0, "pause between operations")
+	seed := fs.Int64("seed", 0, "seed for the choice of operations, random if 0")
+	autoresync := fs.Bool("autoresync", true, "resync automatically after protocol errors")
+	fs.Parse(args)
+
+	addr, err := strconv.ParseUint(*addrs, 0, 7)
+	if err != nil {
+		return fmt.Errorf("invalid address %q", *addrs)
+	}
+	if *reg > 0xff {
+		return fmt.Errorf("invalid register %#x", *reg)
+	}
+
+	ops, err := parseOps(*mix, uint8(addr), uint8(*reg), *n)
+	if err != nil {
+		return err
+	}
+
+	b, _, err := cf.open()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	b.SetAutoResync(*autoresync)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("%-8s %8s %8s %8s %7s %6s %8s %8s %8s %8s\n",
+		"time", "ops", "errors", "rate", "resyncs", "recon", "p50", "p90", "p99", "max")
+	total, err := soak.Run(ctx, b, soak.Config{
+		Ops:      ops,
+		Duration: *duration,
+		Interval: *interval,
+		Pause:    *pause,
+		Seed:     *seed,
+		Report: func(r soak.Report) {
+			printReportLine(r.End.Format("15:04:05"), r.Total, r.Stats.Resyncs, r.Stats.Reconnects)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%s from %s to %s\n", total.End.Sub(total.Start).Round(time.Second),
+		total.Start.Format("15:04:05"), total.End.Format("15:04:05"))
+	var names []string
+	for name := range total.Ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		printReportLine(name, total.Ops[name], 0, 0)
+	}
+	printReportLine("total", total.Total, total.Stats.Resyncs, total.Stats.Reconnects)
+	for _, name := range names {
+		if err := total.Ops[name].LastError; err != nil {
+			fmt.Printf("last error of %s: %v\n", name, err)
+		}
+	}
+	return nil
+}
+
+func printReportLine(label string, r soak.OpReport, resyncs, reconnects uint64) {
+	h := r.Latency
+	fmt.Printf("%-8s %8d %8d %7.3f%% %7d %6d %8v %8v %8v %8v\n",
+		label, r.Runs, r.Errors, 100*r.ErrorRate(), resyncs, reconnects,
+		h.Quantile(0.5), h.Quantile(0.9), h.Quantile(0.99), h.Max)
+}
+
+// parseOps parses an operation mix like "transact=10,read,resync".
+func parseOps(s string, addr, reg uint8, n int) ([]soak.Op, error) {
+	var ops []soak.Op
+	for _, f := range strings.Split(s, ",") {
+		name, ws, hasw := strings.Cut(strings.TrimSpace(f), "=")
+		w := 1
+		if hasw {
+			var err error
+			w, err = strconv.Atoi(ws)
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight %q for %s", ws, name)
+			}
+		}
+
+		var op soak.Op
+		switch name {
+		case "transact":
+			op = soak.Transact(addr, reg, n)
+		case "read":
+			op = soak.ReadRegs(addr, reg, n)
+		case "modecycle":
+			op = soak.ModeCycle()
+		case "resync":
+			op = soak.Resync()
+		default:
+			return nil, fmt.Errorf("unknown operation %q", name)
+		}
+		op.Weight = w
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+// SetWriteCoalescing turns write coalescing on or off. With coalescing,
+// WriteByte on the I2C handles of bp queues the byte instead of sending
+// it. Consecutive bytes are sent as one bulk write command of up to 16
+// bytes along with the next operation, which saves a command and a round
+// trip per byte.
+//
+// The price is that WriteByte can't tell whether a queued byte was
+// acknowledged. A NACK is returned by the operation that sends the byte:
+// the WriteByte filling the queue, Start, Stop, ReadByteAck and
+// I2CPipeline.Flush, which are carried out nonetheless. Any other
+// operation sends the queue first and is not carried out if that fails.
+// Don't turn coalescing on for code that looks for a NACK right after
+// writing an address, like scanning the bus.
+//
+// Queued bytes are dropped when the bus pirate changes modes or is reset.
+// Turning coalescing off sends the queue.
+func (bp *BusPirate) SetWriteCoalescing(on bool) error {
+	return bp.do(func() error { return bp.setWriteCoalescing(on) })
+}
+
+func (bp *BusPirate) setWriteCoalescing(on bool) (err error) {
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+	defer func() { bp.report(err) }()
+
+	bp.coalesce = on
+	if !on {
+		return bp.settle()
+	}
+	return nil
+}
+
+// pendingWrites returns the commands queued by unchecked mode, see
+// SetUnchecked, followed by the commands sending the queued bytes, if
+// any, and empties the queues.
+func (bp *BusPirate) pendingWrites() []exch {
+	cmds, w := bp.deferred, bp.wpending
+	bp.deferred, bp.wpending = nil, nil
+	return append(cmds, bp.writeExchs(w)...)
+}
+
+// settle sends the queued commands and bytes. The caller has to hold the
+// lock.
+func (bp *BusPirate) settle() error {
+	if len(bp.deferred) == 0 && len(bp.wpending) == 0 {
+		return nil
+	}
+	return bp.pipe(bp.pendingWrites())
+}
@@ -0,0 +1,64 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+	"time"
+)
+
+// Correlator maps the host timestamps of sniffer events onto other time
+// bases, like the clock of an oscilloscope, a remote machine's logs or
+// the elapsed time of a test run. Every time base is known by name and by
+// its offset: host time t corresponds to t+offset in that time base.
+//
+// Note that event timestamps are taken when the bytes arrive at the host,
+// which is after the fact by the USB and serial latency.
+type Correlator struct {
+	base    time.Time
+	offsets map[string]time.Duration
+}
+
+// NewCorrelator returns a Correlator measuring elapsed time from base,
+// usually *I2CSniffer.Started().
+func NewCorrelator(base time.Time) *Correlator {
+	return &Correlator{
+		base:    base,
+		offsets: make(map[string]time.Duration),
+	}
+}
+
+// SetOffset sets the offset of the time base name relative to host time.
+func (c *Correlator) SetOffset(name string, offset time.Duration) {
+	c.offsets[name] = offset
+}
+
+// Mark derives the offset of the time base name from a single moment
+// observed on both clocks, host on the host clock and other on the
+// other one.
+func (c *Correlator) Mark(name string, host, other time.Time) {
+	c.offsets[name] = other.Sub(host)
+}
+
+// Offset returns the offset of the time base name.
+func (c *Correlator) Offset(name string) (time.Duration, bool) {
+	off, ok := c.offsets[name]
+	return off, ok
+}
+
+// Elapsed returns the time between base and ev. It uses the monotonic
+// clock and is not affected by changes to the wall clock.
+func (c *Correlator) Elapsed(ev SniffEvent) time.Duration {
+	return ev.Time.Sub(c.base)
+}
+
+// In returns the time of ev in the time base name.
+func (c *Correlator) In(name string, ev SniffEvent) (time.Time, error) {
+	off, ok := c.offsets[name]
+	if !ok {
+		return time.Time{}, fmt.Errorf("bp: unknown time base %q", name)
+	}
+	return ev.Time.Add(off), nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+	"io"
+	"syscall"
+)
+
+// ErrDisconnected is matched by errors caused by the bus pirate
+// disappearing from the host, for example because it was unplugged.
+var ErrDisconnected = errors.New("bus pirate disconnected")
+
+// maxzeroreads is the number of reads in a row returning neither data
+// nor an error after which the device is considered gone.
+const maxzeroreads = 16
+
+type disconnectError struct {
+	err error
+}
+
+func (e *disconnectError) Error() string {
+	return ErrDisconnected.Error() + ": " + e.err.Error()
+}
+
+func (e *disconnectError) Unwrap() error {
+	return e.err
+}
+
+func (e *disconnectError) Is(target error) bool {
+	return target == ErrDisconnected
+}
+
+func (e *disconnectError) Timeout() bool   { return false }
+func (e *disconnectError) Temporary() bool { return false }
+
+// isDisconnect reports whether err from the Conn means that the device
+// is gone.
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ENODEV) ||
+		errors.Is(err, syscall.ENXIO) ||
+		errors.Is(err, syscall.EIO)
+}
+
+// NotifyDisconnect makes bp send the error describing the disconnect on
+// ch whenever it detects that the bus pirate disappeared. bp does not
+// block sending on ch, the caller has to make sure it has enough buffer
+// space. NotifyDisconnect may be called with the same channel again to
+// stop sending on it.
+func (bp *BusPirate) NotifyDisconnect(ch chan<- error) {
+	lc := bp.link
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	for i, c := range lc.notify {
+		if c == ch {
+			lc.notify = append(lc.notify[:i], lc.notify[i+1:]...)
+			return
+		}
+	}
+	lc.notify = append(lc.notify, ch)
+}
+
+// disconnected is called by the link with its lock held.
+func (lc *linkConn) disconnected(err error) {
+	for _, ch := range lc.notify {
+		select {
+		case ch <- err:
+		default:
+		}
+	}
+}
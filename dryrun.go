@@ -0,0 +1,69 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"strings"
+
+	"github.com/distributed/bp/sim"
+)
+
+// SubsysDryRun is the subsystem of the messages of a dry run.
+const SubsysDryRun Subsystem = "dryrun"
+
+// errNoTransaction is returned in a dry run by byte transfers outside of
+// a transaction.
+var errNoTransaction = ModeError("byte transfer without a start condition")
+
+// NewDryRun returns a BusPirate which validates and logs all operations,
+// but sends nothing to hardware, for checking programs before they touch
+// a real board, for example in CI. It talks to a simulated bus pirate,
+// see package sim, on which every I2C address acknowledges and behaves
+// like a register device. All checks of this package, like those of the
+// mode, of buffer sizes and of addressing, apply as they do with
+// hardware. In addition, I2C byte reads and writes fail if no transaction
+// was started with Start.
+//
+// Operations and mode changes are logged at LogInfo, the bytes that
+// would have been sent to the bus pirate at LogDebug, to the logger set
+// with SetLogger, in subsystem SubsysDryRun. Use the BusPirate like one
+// talking to hardware, starting with Open.
+func NewDryRun() *BusPirate {
+	s := sim.New()
+	s.StartInBinary()
+	s.AttachDefault(&sim.Registers{})
+
+	bp := NewBusPirate(s)
+	bp.dryrun = true
+	bp.c = &traceConn{Conn: bp.c, w: dryRunWriter{bp}}
+	bp.AddHook(func(ev Event) {
+		bp.logf(SubsysDryRun, LogInfo, "%v", ev)
+	})
+	return bp
+}
+
+// IsDryRun reports whether bp was created by NewDryRun.
+func (bp *BusPirate) IsDryRun() bool {
+	return bp.dryrun
+}
+
+// dryRunWriter logs the lines of the traffic trace.
+type dryRunWriter struct {
+	bp *BusPirate
+}
+
+func (w dryRunWriter) Write(b []byte) (int, error) {
+	w.bp.logf(SubsysDryRun, LogDebug, "%s", strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+// checkDryRun returns an error in a dry run if a byte transfer happens
+// outside of a transaction. The caller has to hold the lock.
+func (inf BusPirateI2C) checkDryRun(op string) error {
+	if inf.bp.dryrun && inf.bp.txstart.IsZero() {
+		return &OpError{op, MODE_I2C, nil, errNoTransaction}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package ds30 flashes firmware into a bus pirate v3 through its
+// bootloader, which speaks a variant of the ds30 Loader protocol, like
+// the pirate-loader tool from Dangerous Prototypes does.
+//
+// The bootloader understands a hello byte and packets of the form
+//
+//	addr[3] cmd len payload[len-1] crc
+//
+// where addr is a big endian program memory address, len counts the
+// payload and the crc, and crc makes the sum of all bytes of the packet
+// zero. Every packet is acknowledged with 'K'.
+package ds30
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	cmd_HELLO = 0xc1
+	cmd_ERASE = 0x01
+	cmd_WRITE = 0x02
+
+	ans_OK = 'K'
+
+	// device id of the PIC24FJ64GA002
+	DevicePIC24FJ64GA002 = 0xd4
+)
+
+// Conn is the connection to the bootloader, it is satisfied by bp.Conn.
+type Conn interface {
+	io.ReadWriter
+	SetReadParams(int, float64) error
+}
+
+// ErrNoBootloader is returned by Hello if the bootloader doesn't answer.
+var ErrNoBootloader = errors.New("ds30: bootloader does not answer")
+
+// NAKError is returned when the bootloader refuses a packet.
+type NAKError struct {
+	Cmd  byte
+	Addr uint32
+	Got  byte
+}
+
+func (e *NAKError) Error() string {
+	return fmt.Sprintf("ds30: command %#02x at address %#06x answered with %#02x instead of 'K'", e.Cmd, e.Addr, e.Got)
+}
+
+// Info describes the bootloader.
+type Info struct {
+	DeviceID byte
+	Major    int
+	Minor    int
+}
+
+// Loader talks to the bootloader.
+type Loader struct {
+	c    Conn
+	info Info
+}
+
+// Hello greets the bootloader and returns a Loader for it. Only
+// bootloaders on a PIC24FJ64GA002 are supported.
+func Hello(c Conn) (*Loader, error) {
+	if err := c.SetReadParams(0, 1); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write([]byte{cmd_HELLO}); err != nil {
+		return nil, err
+	}
+
+	var ans [4]byte
+	if _, err := io.ReadFull(c, ans[:]); err != nil {
+		return nil, ErrNoBootloader
+	}
+	if ans[3] != ans_OK {
+		return nil, ErrNoBootloader
+	}
+
+	l := &Loader{c: c, info: Info{DeviceID: ans[0], Major: int(ans[1]), Minor: int(ans[2])}}
+	if l.info.DeviceID != DevicePIC24FJ64GA002 {
+		return nil, fmt.Errorf("ds30: unsupported device id %#02x", l.info.DeviceID)
+	}
+	return l, nil
+}
+
+// Info returns what the bootloader said about itself.
+func (l *Loader) Info() Info {
+	return l.info
+}
+
+// ErasePage erases page p of the flash.
+func (l *Loader) ErasePage(p int) error {
+	if err := checkPage(p); err != nil {
+		return err
+	}
+	return l.packet(cmd_ERASE, uint32(p*pageAddrs), nil)
+}
+
+// WriteRow writes RowSize bytes of data to row r of page p. The page has
+// to be erased.
+func (l *Loader) WriteRow(p, r int, data []byte) error {
+	if err := checkPage(p); err != nil {
+		return err
+	}
+	if r < 0 || r >= PageRows {
+		return fmt.Errorf("ds30: row %d out of range", r)
+	}
+	if len(data) != RowSize {
+		return fmt.Errorf("ds30: row data has %d bytes, want %d", len(data), RowSize)
+	}
+	return l.packet(cmd_WRITE, uint32(p*pageAddrs+r*rowAddrs), data)
+}
+
+func checkPage(p int) error {
+	if p < 0 || p >= Pages {
+		return fmt.Errorf("ds30: page %d out of range", p)
+	}
+	if p == BootloaderPage || p == ConfigPage {
+		return fmt.Errorf("ds30: page %d is reserved", p)
+	}
+	return nil
+}
+
+func (l *Loader) packet(cmd byte, addr uint32, payload []byte) error {
+	pkt := make([]byte, 0, 6+len(payload))
+	pkt = append(pkt, byte(addr>>16), byte(addr>>8), byte(addr), cmd, byte(len(payload)+1))
+	pkt = append(pkt, payload...)
+	pkt = append(pkt, crc(pkt))
+
+	if _, err := l.c.Write(pkt); err != nil {
+		return err
+	}
+
+	var ans [1]byte
+	if _, err := io.ReadFull(l.c, ans[:]); err != nil {
+		return err
+	}
+	if ans[0] != ans_OK {
+		return &NAKError{cmd, addr, ans[0]}
+	}
+	return nil
+}
+
+// crc returns the byte making the sum of b and itself zero.
+func crc(b []byte) byte {
+	var c byte
+	for _, x := range b {
+		c -= x
+	}
+	return c
+}
+
+// Write erases and writes all pages used by im. progress, if not nil, is
+// called after every row with the number of rows written and the total.
+// If it returns an error, Write stops and returns it. The bootloader
+// acknowledges every row only after checking its crc.
+func (l *Loader) Write(im *Image, progress func(done, total int) error) error {
+	var pages []int
+	for p := 0; p < Pages; p++ {
+		if im.Used(p) {
+			pages = append(pages, p)
+		}
+	}
+
+	total := len(pages) * PageRows
+	done := 0
+	for _, p := range pages {
+		if err := l.ErasePage(p); err != nil {
+			return err
+		}
+		for r := 0; r < PageRows; r++ {
+			if err := l.WriteRow(p, r, im.Row(p, r)); err != nil {
+				return err
+			}
+			done++
+			if progress != nil {
+				if err := progress(done, total); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
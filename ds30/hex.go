@@ -0,0 +1,174 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package ds30
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Flash layout of the PIC24FJ64GA002 of the bus pirate v3. The flash
+// holds 24 bit instruction words, each taking up two program memory
+// address units. Hex files store them as 4 bytes with a phantom byte,
+// images and the bootloader use 3 bytes per word.
+const (
+	WordSize  = 3
+	RowWords  = 64
+	RowSize   = RowWords * WordSize // 192
+	PageRows  = 8
+	PageSize  = PageRows * RowSize // 1536
+	Pages     = 43                 // 0xac00 address units
+	FlashSize = Pages * PageSize
+
+	// BootloaderPage holds the bootloader, ConfigPage the configuration
+	// words. They are never written.
+	BootloaderPage = 1
+	ConfigPage     = Pages - 1
+
+	// configuration words at the end of ConfigPage, in bytes
+	configSize = 2 * WordSize
+
+	// address units per row and page
+	rowAddrs  = RowWords * 2
+	pageAddrs = PageRows * rowAddrs
+)
+
+// bootloaderJump is the reset vector, GOTO 0x400, which starts the
+// bootloader. It replaces the reset vector of the image, the bootloader
+// starts the firmware.
+var bootloaderJump = [2 * WordSize]byte{0x00, 0x04, 0x04, 0x00, 0x00, 0x00}
+
+// Image is a firmware image laid out like the flash.
+type Image struct {
+	Data [FlashSize]byte
+	used [Pages]bool
+}
+
+// Used reports whether the image has data for page p.
+func (im *Image) Used(p int) bool {
+	return im.used[p]
+}
+
+// Row returns the data of row r of page p.
+func (im *Image) Row(p, r int) []byte {
+	off := p*PageSize + r*RowSize
+	return im.Data[off : off+RowSize]
+}
+
+// HexError is returned by ParseHex for malformed hex files.
+type HexError struct {
+	Line int
+	Msg  string
+}
+
+func (e *HexError) Error() string {
+	return fmt.Sprintf("ds30: hex line %d: %s", e.Line, e.Msg)
+}
+
+// ParseHex reads a firmware image in Intel HEX format, as produced by the
+// Microchip tool chain for the bus pirate. The checksum of every record
+// is verified. Data for the bootloader page or the configuration page is
+// an error, except for the configuration words, which are ignored. The
+// reset vector is replaced by a jump to the bootloader.
+func ParseHex(r io.Reader) (*Image, error) {
+	im := &Image{}
+	for i := range im.Data {
+		im.Data[i] = 0xff
+	}
+
+	var (
+		base uint32
+		line int
+		eof  bool
+	)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line++
+		l := strings.TrimSpace(sc.Text())
+		if l == "" {
+			continue
+		}
+		if eof {
+			return nil, &HexError{line, "data after end of file record"}
+		}
+		if l[0] != ':' {
+			return nil, &HexError{line, "missing ':'"}
+		}
+		rec, err := hex.DecodeString(l[1:])
+		if err != nil {
+			return nil, &HexError{line, err.Error()}
+		}
+		if len(rec) < 5 || len(rec) != int(rec[0])+5 {
+			return nil, &HexError{line, "bad record length"}
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, &HexError{line, "checksum mismatch"}
+		}
+
+		addr := uint32(rec[1])<<8 | uint32(rec[2])
+		data := rec[4 : len(rec)-1]
+		switch rec[3] {
+		case 0x00:
+			for i, b := range data {
+				if err := im.set(base+addr+uint32(i), b); err != nil {
+					return nil, &HexError{line, err.Error()}
+				}
+			}
+		case 0x01:
+			eof = true
+		case 0x04:
+			if len(data) != 2 {
+				return nil, &HexError{line, "bad extended linear address record"}
+			}
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 16
+		case 0x02, 0x03, 0x05:
+			// segment addresses and start address, meaningless here
+		default:
+			return nil, &HexError{line, fmt.Sprintf("unknown record type %#02x", rec[3])}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if !eof {
+		return nil, &HexError{line, "missing end of file record"}
+	}
+
+	copy(im.Data[:], bootloaderJump[:])
+	im.used[0] = true
+
+	return im, nil
+}
+
+// set stores the byte at hex file address a, which is twice the program
+// memory address.
+func (im *Image) set(a uint32, b byte) error {
+	if a%4 == 3 {
+		// phantom byte
+		return nil
+	}
+	// configuration words and memory beyond the flash, like the
+	// configuration registers, are not written by the bootloader
+	off := int(a/4)*WordSize + int(a%4)
+	if off >= FlashSize-configSize {
+		return nil
+	}
+	p := off / PageSize
+	if (p == BootloaderPage || p == ConfigPage) && b != 0xff {
+		return fmt.Errorf("image overlaps page %d, which is reserved, at address %#x", p, a/2)
+	}
+	im.Data[off] = b
+	if b != 0xff {
+		im.used[p] = true
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package ds30
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// record returns a hex record of type typ with a valid checksum.
+func record(typ byte, addr uint16, data ...byte) string {
+	rec := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), typ}, data...)
+	var sum byte
+	for _, b := range rec {
+		sum += b
+	}
+	return fmt.Sprintf(":%X%02X", rec, -sum)
+}
+
+// words returns the hex file bytes of instruction words, with phantom
+// bytes.
+func words(w ...uint32) []byte {
+	var b []byte
+	for _, v := range w {
+		b = append(b, byte(v), byte(v>>8), byte(v>>16), 0)
+	}
+	return b
+}
+
+func parse(lines ...string) (*Image, error) {
+	return ParseHex(strings.NewReader(strings.Join(lines, "\n")))
+}
+
+var eof = record(0x01, 0)
+
+func TestParseHex(t *testing.T) {
+	im, err := parse(
+		// the reset vector of the image, replaced
+		record(0x00, 0x0000, words(0x040200, 0)...),
+		// page 2, program address 0x800
+		record(0x00, 0x1000, words(0x123456, 0xabcdef)...),
+		// configuration words, behind an extended linear address
+		record(0x04, 0, 0x00, 0x01),
+		record(0x00, 0x57f8, words(0x00f9df, 0x003f7f)...),
+		record(0x04, 0, 0x00, 0x00),
+		// page 3, after the extended linear address is reset
+		record(0x00, 0x1800, words(0x000001)...),
+		eof,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(im.Data[:6], bootloaderJump[:]) {
+		t.Errorf("reset vector % x", im.Data[:6])
+	}
+	if got := im.Row(2, 0)[:7]; !bytes.Equal(got, []byte{0x56, 0x34, 0x12, 0xef, 0xcd, 0xab, 0xff}) {
+		t.Errorf("page 2 % x", got)
+	}
+	if got := im.Row(3, 0)[:3]; !bytes.Equal(got, []byte{0x01, 0x00, 0x00}) {
+		t.Errorf("page 3 % x", got)
+	}
+	for p := 0; p < Pages; p++ {
+		if want := p == 0 || p == 2 || p == 3; im.Used(p) != want {
+			t.Errorf("page %d used %v", p, im.Used(p))
+		}
+	}
+	if got := im.Data[FlashSize-configSize:]; !bytes.Equal(got, bytes.Repeat([]byte{0xff}, configSize)) {
+		t.Errorf("configuration words % x written", got)
+	}
+}
+
+func TestParseHexRowBoundary(t *testing.T) {
+	// four words from the last two of row 0 of page 2 on
+	im, err := parse(record(0x00, 0x10f8, words(1, 2, 3, 4)...), eof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := im.Row(2, 0)[RowSize-6:]; !bytes.Equal(got, []byte{1, 0, 0, 2, 0, 0}) {
+		t.Errorf("end of row 0 % x", got)
+	}
+	if got := im.Row(2, 1)[:7]; !bytes.Equal(got, []byte{3, 0, 0, 4, 0, 0, 0xff}) {
+		t.Errorf("start of row 1 % x", got)
+	}
+}
+
+func TestParseHexErrors(t *testing.T) {
+	data := record(0x00, 0x1000, words(0x123456)...)
+	badsum := data[:len(data)-2] + "00"
+
+	for _, c := range []struct {
+		name  string
+		lines []string
+		line  int
+	}{
+		{"checksum", []string{data, badsum, eof}, 2},
+		{"checksum of the end of file record", []string{data, ":00000001FE"}, 2},
+		{"missing colon", []string{data[1:], eof}, 1},
+		{"not hex", []string{":0g", eof}, 1},
+		{"record length", []string{":0400000000", eof}, 1},
+		{"unknown record type", []string{record(0x06, 0), eof}, 1},
+		{"extended linear address length", []string{record(0x04, 0, 0x01), eof}, 1},
+		{"bootloader page", []string{record(0x00, 0x0800, words(0x000000)...), eof}, 1},
+		// the configuration page before the configuration words, at
+		// program address 0xabf8
+		{"configuration page", []string{record(0x04, 0, 0x00, 0x01), record(0x00, 0x57f0, words(0x000000)...), eof}, 2},
+		{"missing end of file record", []string{data}, 1},
+		{"data after end of file record", []string{eof, data}, 2},
+	} {
+		_, err := parse(c.lines...)
+		var he *HexError
+		if !errors.As(err, &he) {
+			t.Errorf("%s: got %v, want a HexError", c.name, err)
+			continue
+		}
+		if he.Line != c.line {
+			t.Errorf("%s: error %v on line %d, want %d", c.name, err, he.Line, c.line)
+		}
+	}
+
+	// erased words may go anywhere
+	if _, err := parse(record(0x00, 0x0800, words(0xffffff)...), eof); err != nil {
+		t.Errorf("erased bootloader page: %v", err)
+	}
+}
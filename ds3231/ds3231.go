@@ -0,0 +1,257 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package ds3231 drives the DS3231 and DS1307 real time clocks over the
+// I2C mode of package bp, for example to set the clock of a board when
+// provisioning it.
+//
+// Both clocks keep the time in BCD without a time zone, Dev converts it
+// from and to time.Time in Dev.Location. The DS3231 additionally has a
+// temperature sensor and an aging offset trimming its oscillator.
+package ds3231
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// Addr is the address of both clocks.
+const Addr = 0x68
+
+// Registers.
+const (
+	regTime    = 0x00
+	regControl = 0x0e // DS3231
+	regStatus  = 0x0f
+	regAging   = 0x10
+	regTemp    = 0x11
+)
+
+const (
+	secHalt   = 0x80 // DS1307 clock halt
+	hour12    = 0x40
+	hourPM    = 0x20
+	century   = 0x80 // in the month register, DS3231
+	ctrlConv  = 0x20
+	statusOSF = 0x80
+	statusBSY = 0x04
+)
+
+// ErrUnsupported is returned for DS3231 features used on a DS1307.
+var ErrUnsupported = errors.New("not supported by the DS1307")
+
+// Dev is a DS3231 or DS1307.
+type Dev struct {
+	t      bp.I2CTransactor8x8
+	addr   bp.Addr7
+	ds1307 bool
+
+	// Location is the time zone the clock keeps, UTC if nil.
+	Location *time.Location
+}
+
+// New returns the DS3231 at the 7 bit address addr.
+func New(t bp.I2CTransactor8x8, addr uint8) *Dev {
+	return &Dev{t: t, addr: bp.Addr7(addr)}
+}
+
+// New1307 returns the DS1307 at the 7 bit address addr.
+func New1307(t bp.I2CTransactor8x8, addr uint8) *Dev {
+	return &Dev{t: t, addr: bp.Addr7(addr), ds1307: true}
+}
+
+func (d *Dev) loc() *time.Location {
+	if d.Location == nil {
+		return time.UTC
+	}
+	return d.Location
+}
+
+func (d *Dev) read(op string, reg uint8, r []byte) error {
+	if _, _, err := d.t.Transact8x8(d.addr, reg, nil, r); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+func (d *Dev) write(op string, reg uint8, w ...byte) error {
+	if _, _, err := d.t.Transact8x8(d.addr, reg, w, nil); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+// bcd returns v, 0 to 99, in BCD.
+func bcd(v int) byte {
+	return byte(v/10<<4 | v%10)
+}
+
+// unbcd returns the value of the BCD byte b.
+func unbcd(b byte) int {
+	return int(b>>4)*10 + int(b&0x0f)
+}
+
+// Time returns the time of the clock.
+func (d *Dev) Time() (time.Time, error) {
+	b := make([]byte, 7)
+	if err := d.read("read time", regTime, b); err != nil {
+		return time.Time{}, err
+	}
+
+	sec := unbcd(b[0] &^ secHalt)
+	min := unbcd(b[1])
+	var hour int
+	if b[2]&hour12 != 0 {
+		hour = unbcd(b[2]&0x1f) % 12
+		if b[2]&hourPM != 0 {
+			hour += 12
+		}
+	} else {
+		hour = unbcd(b[2] & 0x3f)
+	}
+	day := unbcd(b[4])
+	month := unbcd(b[5] &^ century)
+	year := 2000 + unbcd(b[6])
+	if !d.ds1307 && b[5]&century != 0 {
+		year += 100
+	}
+
+	if sec > 59 || min > 59 || hour > 23 || day < 1 || day > 31 || month < 1 || month > 12 {
+		return time.Time{}, d.err("read time", fmt.Errorf("invalid time registers % x", b))
+	}
+	return time.Date(year, time.Month(month), day, hour, min, sec, 0, d.loc()), nil
+}
+
+// SetTime sets the clock to t, in Dev.Location, truncated to the second.
+// It starts the clock of a DS1307 and clears the oscillator stop flag of
+// a DS3231.
+func (d *Dev) SetTime(t time.Time) error {
+	t = t.In(d.loc())
+	maxYear := 2199
+	if d.ds1307 {
+		maxYear = 2099
+	}
+	if t.Year() < 2000 || t.Year() > maxYear {
+		return d.err("set time", fmt.Errorf("year %d out of range 2000 to %d", t.Year(), maxYear))
+	}
+
+	month := bcd(int(t.Month()))
+	if t.Year() >= 2100 {
+		month |= century
+	}
+	err := d.write("set time", regTime,
+		bcd(t.Second()),
+		bcd(t.Minute()),
+		bcd(t.Hour()), // 24 hour mode
+		byte(t.Weekday())+1,
+		bcd(t.Day()),
+		month,
+		bcd(t.Year()%100),
+	)
+	if err != nil || d.ds1307 {
+		return err
+	}
+
+	st := make([]byte, 1)
+	if err := d.read("set time", regStatus, st); err != nil {
+		return err
+	}
+	return d.write("set time", regStatus, st[0]&^statusOSF)
+}
+
+// Valid reports whether the time of the clock can be trusted: whether
+// the clock of a DS1307 runs, or the oscillator of a DS3231 didn't stop
+// since SetTime.
+func (d *Dev) Valid() (bool, error) {
+	b := make([]byte, 1)
+	if d.ds1307 {
+		if err := d.read("check", regTime, b); err != nil {
+			return false, err
+		}
+		return b[0]&secHalt == 0, nil
+	}
+	if err := d.read("check", regStatus, b); err != nil {
+		return false, err
+	}
+	return b[0]&statusOSF == 0, nil
+}
+
+// Temperature returns the temperature of a DS3231 in °C, with a
+// resolution of 0.25 °C. The DS3231 measures it every 64 seconds, or
+// right away if convert is true.
+func (d *Dev) Temperature(convert bool) (float64, error) {
+	if d.ds1307 {
+		return 0, d.err("read temperature", ErrUnsupported)
+	}
+	if convert {
+		if err := d.convert(); err != nil {
+			return 0, err
+		}
+	}
+	b := make([]byte, 2)
+	if err := d.read("read temperature", regTemp, b); err != nil {
+		return 0, err
+	}
+	return float64(int16(uint16(b[0])<<8|uint16(b[1]))>>6) / 4, nil
+}
+
+// convert starts a temperature conversion and waits for it to be done.
+func (d *Dev) convert() error {
+	b := make([]byte, 2)
+	if err := d.read("convert temperature", regControl, b); err != nil {
+		return err
+	}
+	// a conversion the DS3231 started on its own has to end first
+	if b[1]&statusBSY == 0 {
+		if err := d.write("convert temperature", regControl, b[0]|ctrlConv); err != nil {
+			return err
+		}
+	}
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for {
+		if err := d.read("convert temperature", regControl, b[:1]); err != nil {
+			return err
+		}
+		if b[0]&ctrlConv == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return d.err("convert temperature", errors.New("conversion not done"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// AgingOffset returns the aging offset of a DS3231.
+func (d *Dev) AgingOffset() (int8, error) {
+	if d.ds1307 {
+		return 0, d.err("read aging offset", ErrUnsupported)
+	}
+	b := make([]byte, 1)
+	if err := d.read("read aging offset", regAging, b); err != nil {
+		return 0, err
+	}
+	return int8(b[0]), nil
+}
+
+// SetAgingOffset sets the aging offset of a DS3231. A positive offset
+// slows the oscillator down, by about 0.1 ppm per step at 25 °C. It
+// takes effect with the next temperature conversion, which is started
+// right away.
+func (d *Dev) SetAgingOffset(off int8) error {
+	if d.ds1307 {
+		return d.err("set aging offset", ErrUnsupported)
+	}
+	if err := d.write("set aging offset", regAging, byte(off)); err != nil {
+		return err
+	}
+	return d.convert()
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("ds3231 %v: %s: %w", d.addr, op, err)
+}
@@ -0,0 +1,56 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// WriteI2CDump renders a register dump in the format used by i2cdump from
+// Linux' i2c-tools: 16 registers per row in hex followed by their ASCII
+// representation. regs[0] is register 0x00, at most 256 registers are
+// printed. Rows are filled up with XX, like i2cdump does for registers
+// it failed to read.
+func WriteI2CDump(w io.Writer, regs []byte) error {
+	if len(regs) > 256 {
+		regs = regs[:256]
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "     0  1  2  3  4  5  6  7  8  9  a  b  c  d  e  f    0123456789abcdef\n")
+
+	for row := 0; row < len(regs); row += 16 {
+		fmt.Fprintf(bw, "%02x: ", row)
+		for i := row; i < row+16; i++ {
+			if i < len(regs) {
+				fmt.Fprintf(bw, "%02x ", regs[i])
+			} else {
+				fmt.Fprintf(bw, "XX ")
+			}
+		}
+
+		fmt.Fprintf(bw, "   ")
+		for i := row; i < row+16; i++ {
+			if i >= len(regs) {
+				bw.WriteByte('X')
+				continue
+			}
+			b := regs[i]
+			switch {
+			case b == 0x00 || b == 0xff:
+				bw.WriteByte('.')
+			case b < 32 || b >= 127:
+				bw.WriteByte('?')
+			default:
+				bw.WriteByte(b)
+			}
+		}
+		bw.WriteByte('\n')
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,261 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+)
+
+// Handle is a mode handle, like BusPirateI2C. It is only valid while the
+// bus pirate stays in the mode it was obtained for. Close leaves the mode
+// for bitbang mode, closing a handle that is not valid any more does
+// nothing.
+type Handle interface {
+	Mode() Mode
+	Close() error
+}
+
+// Mode returns MODE_I2C.
+func (inf BusPirateI2C) Mode() Mode {
+	return MODE_I2C
+}
+
+// Close leaves I2C mode for bitbang mode. The firmware resets the
+// peripherals, like the power supplies and pull-ups, on the way. The
+// handle becomes stale. Close does nothing if the handle is stale
+// already, so it is safe to defer right after obtaining the handle.
+func (inf BusPirateI2C) Close() error {
+	return inf.bp.do(inf.close)
+}
+
+func (inf BusPirateI2C) close() (err error) {
+	bp := inf.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+	defer func() { bp.report(err) }()
+
+	if inf.gen != bp.gen {
+		return nil
+	}
+	if bp.mode == MODE_I2C_SNIFF {
+		return &OpError{"i2c.Close", bp.mode, nil, ModeError("cannot leave I2C mode while the sniffer is running")}
+	}
+
+	if err := bp.enterBitbangMode(); err != nil {
+		return &OpError{"i2c.Close", MODE_I2C, nil, err}
+	}
+	return nil
+}
+
+// Mode returns MODE_SPI.
+func (sp BusPirateSPI) Mode() Mode {
+	return MODE_SPI
+}
+
+// Close leaves SPI mode for bitbang mode, like BusPirateI2C.Close. The
+// firmware resets the peripherals on the way.
+func (sp BusPirateSPI) Close() error {
+	return sp.bp.do(sp.close)
+}
+
+func (sp BusPirateSPI) close() (err error) {
+	bp := sp.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+	defer func() { bp.report(err) }()
+
+	if sp.gen != bp.gen {
+		return nil
+	}
+	if err := bp.enterBitbangMode(); err != nil {
+		return &OpError{"spi.Close", MODE_SPI, nil, err}
+	}
+	return nil
+}
+
+// transitions is the graph of mode changes the firmware allows. The
+// protocol modes are only reachable from bitbang mode and lead back there.
+var transitions = map[Mode][]Mode{
+	MODE_CLOSED:  {MODE_BITBANG},
+	MODE_UNKNOWN: {MODE_BITBANG},
+	MODE_BITBANG: {MODE_I2C, MODE_SPI, MODE_CLOSED},
+	MODE_I2C:     {MODE_BITBANG},
+	MODE_SPI:     {MODE_BITBANG},
+}
+
+// planMode returns the modes to pass through to get from one mode to
+// another, excluding from and including to.
+func planMode(from, to Mode) ([]Mode, bool) {
+	prev := map[Mode]Mode{from: from}
+	queue := []Mode{from}
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		if m == to {
+			var path []Mode
+			for ; m != from; m = prev[m] {
+				path = append([]Mode{m}, path...)
+			}
+			return path, true
+		}
+		for _, n := range transitions[m] {
+			if _, seen := prev[n]; !seen {
+				prev[n] = m
+				queue = append(queue, n)
+			}
+		}
+	}
+	return nil, false
+}
+
+// EnterMode brings the bus pirate into mode m, passing through the modes
+// in between as the firmware requires, for example from I2C mode through
+// bitbang mode into another protocol mode. It returns the handle for m,
+// or nil for modes without a handle, like bitbang mode. If the bus pirate
+// is already in m, the handle for the current mode is returned and
+// nothing is sent. Stop a running sniffer first.
+func (bp *BusPirate) EnterMode(m Mode) (h Handle, err error) {
+	err = bp.do(func() error {
+		h, err = bp.enterMode(m)
+		return err
+	})
+	return h, err
+}
+
+func (bp *BusPirate) enterMode(m Mode) (_ Handle, err error) {
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+	defer func() { bp.report(err) }()
+
+	from := bp.mode
+	if from == MODE_I2C_SNIFF {
+		return nil, &OpError{"EnterMode", from, nil, ModeError("cannot change modes while the sniffer is running")}
+	}
+
+	if from == m {
+		return bp.handle(), nil
+	}
+
+	path, ok := planMode(from, m)
+	if !ok {
+		return nil, &OpError{"EnterMode", from, nil, fmt.Errorf("%w: no way to enter %v mode from %v mode", ErrNotSupported, m, from)}
+	}
+	bp.logf(SubsysOpen, LogDebug, "entering %v mode from %v mode via %v", m, from, path)
+
+	for _, step := range path {
+		if err := bp.step(step); err != nil {
+			return nil, err
+		}
+	}
+	return bp.handle(), nil
+}
+
+// step enters mode m, which has to be adjacent to the current mode.
+func (bp *BusPirate) step(m Mode) error {
+	switch m {
+	case MODE_BITBANG:
+		if bp.mode == MODE_CLOSED || bp.mode == MODE_UNKNOWN {
+			return bp.enterBinary()
+		}
+		return bp.enterBitbangMode()
+	case MODE_I2C:
+		_, err := bp.enterI2CMode()
+		return err
+	case MODE_SPI:
+		_, err := bp.enterSPIMode()
+		return err
+	case MODE_CLOSED:
+		return bp.exitBinaryMode("EnterMode")
+	}
+	panic("bp: no step into " + m.String())
+}
+
+// handle returns the handle for the current mode. The caller has to hold
+// the lock.
+func (bp *BusPirate) handle() Handle {
+	switch bp.mode {
+	case MODE_I2C:
+		return BusPirateI2C{bp: bp, gen: bp.gen}
+	case MODE_SPI:
+		return BusPirateSPI{bp: bp, gen: bp.gen}
+	}
+	return nil
+}
+
+// WithI2C enters I2C mode, from whatever mode the bus pirate is in, calls
+// fn with the handle and returns to bitbang mode, even if fn fails or
+// panics. Before leaving I2C mode, the peripherals fn found are switched
+// back on and those it switched on are switched off, so power supplies
+// and pull-ups don't depend on how leaving the mode goes. The firmware
+// forgets the speed on the way, so the next user finds the bus pirate in
+// a known state. fn must stop any sniffer it starts. The error of fn is
+// returned, or the first of restoring the peripherals and returning to
+// bitbang mode. WithSPI is the same for SPI mode.
+func (bp *BusPirate) WithI2C(fn func(inf BusPirateI2C) error) (err error) {
+	h, err := bp.EnterMode(MODE_I2C)
+	if err != nil {
+		return err
+	}
+	inf := h.(BusPirateI2C)
+	defer bp.leaveSession(MODE_I2C, inf.gen, inf.SetPeripherals, &err)()
+	return fn(inf)
+}
+
+// WithSPI enters SPI mode, calls fn with the handle and returns to bitbang
+// mode with the peripherals restored, like WithI2C. The speed and the
+// configuration are forgotten on the way.
+func (bp *BusPirate) WithSPI(fn func(sp BusPirateSPI) error) (err error) {
+	h, err := bp.EnterMode(MODE_SPI)
+	if err != nil {
+		return err
+	}
+	sp := h.(BusPirateSPI)
+	defer bp.leaveSession(MODE_SPI, sp.gen, sp.SetPeripherals, &err)()
+	return fn(sp)
+}
+
+// leaveSession returns the function ending a session in mode m with the
+// handle of generation gen: it restores the peripherals found now with
+// set and returns to bitbang mode, storing the first error in *err unless
+// it holds one.
+func (bp *BusPirate) leaveSession(m Mode, gen uint64, set func(Peripherals) error, err *error) func() {
+	periph := bp.Status().Peripherals
+	return func() {
+		perr := bp.restorePeripherals(m, gen, set, periph)
+		lerr := bp.leaveTo(MODE_BITBANG)
+		if *err == nil {
+			*err = perr
+		}
+		if *err == nil {
+			*err = lerr
+		}
+	}
+}
+
+// restorePeripherals switches the peripherals back to p with set, unless
+// the handle of mode m and generation gen is stale by now or they are set
+// like that.
+func (bp *BusPirate) restorePeripherals(m Mode, gen uint64, set func(Peripherals) error, p Peripherals) error {
+	bp.mu.Lock()
+	cur := bp.i2cconf.periph
+	if m == MODE_SPI {
+		cur = bp.spiconf.periph
+	}
+	done := gen != bp.gen || bp.mode != m || cur == p
+	bp.mu.Unlock()
+	if done {
+		return nil
+	}
+	return set(p)
+}
+
+// leaveTo enters mode m, unless the bus pirate was closed meanwhile.
+func (bp *BusPirate) leaveTo(m Mode) error {
+	if mode, _ := bp.GetMode(); mode == MODE_CLOSED {
+		return nil
+	}
+	_, err := bp.EnterMode(m)
+	return err
+}
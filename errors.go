@@ -0,0 +1,169 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by this package. Methods usually return them wrapped in
+// an *OpError, use errors.Is to test for them.
+var (
+	// ErrNotOpen is returned when the connection to the bus pirate has
+	// not been opened or was closed.
+	ErrNotOpen = ModeError("connection not open")
+
+	// ErrNotI2CMode is returned by I2C operations when the bus pirate is
+	// not in I2C mode, for example while a sniffer is running.
+	ErrNotI2CMode = ModeError("not in I2C mode")
+
+	// ErrNotSPIMode is returned by SPI operations when the bus pirate is
+	// not in SPI mode.
+	ErrNotSPIMode = ModeError("not in SPI mode")
+
+	// ErrUnexpectedResponse is matched by all errors caused by the bus
+	// pirate answering something the protocol does not allow for, like
+	// *ResponseError and *BannerError.
+	ErrUnexpectedResponse = errors.New("unexpected response from bus pirate")
+
+	// ErrNotSupported is returned when the hardware or firmware of the
+	// bus pirate lacks a feature, see Capabilities.
+	ErrNotSupported = errors.New("not supported by this bus pirate")
+
+	// ErrNACK is returned when a slave did not acknowledge a byte. Errors
+	// carrying ErrNoSuchDevice match it as well.
+	ErrNACK = errors.New("NACK received")
+
+	// ErrNoSuchDevice is returned by Transact8x8 when a transaction was
+	// not acknowledged. The bus pirate doesn't tell which byte was
+	// NACKed, it is usually the address byte.
+	ErrNoSuchDevice = errors.New("no such device")
+)
+
+// OpError describes a failed operation. Err is the underlying cause.
+type OpError struct {
+	Op   string // operation, like "i2c.Start"
+	Mode Mode   // mode the bus pirate was in when the operation started
+	Addr Addr   // slave address, nil if the operation is not addressed
+	Err  error
+}
+
+func (e *OpError) Error() string {
+	s := e.Op
+	if e.Addr != nil {
+		s += fmt.Sprintf(" addr %#02x", e.Addr.GetBaseAddr())
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes a missing slave match ErrNACK, a missing slave is just a NACK
+// on the address byte.
+func (e *OpError) Is(target error) bool {
+	return target == ErrNACK && e.Err == ErrNoSuchDevice
+}
+
+// Timeout reports whether the bus pirate did not answer in time.
+func (e *OpError) Timeout() bool {
+	return isTimeout(e.Err)
+}
+
+// Temporary reports whether the operation failed because of a transient
+// problem of the link, like a timeout, so that retrying it makes sense.
+// Protocol failures and NACKs are not temporary.
+func (e *OpError) Temporary() bool {
+	return isTemporary(e.Err)
+}
+
+// ResponseError is returned when the bus pirate answers a command with a
+// byte other than the expected one.
+type ResponseError struct {
+	Got  byte
+	Want byte
+
+	// Sent and Received are the last bytes sent to and received from
+	// the bus pirate up to the unexpected answer, at most
+	// maxexchange each, see Exchange.
+	Sent     []byte
+	Received []byte
+}
+
+func (e *ResponseError) Error() string {
+	s := fmt.Sprintf("unexpected response from bus pirate, got %#02x, want %#02x", e.Got, e.Want)
+	return s + exchangeString(e.Sent, e.Received)
+}
+
+// Exchange returns the last bytes sent to and received from the bus
+// pirate up to the unexpected answer.
+func (e *ResponseError) Exchange() (sent, received []byte) {
+	return e.Sent, e.Received
+}
+
+func (e *ResponseError) Is(target error) bool {
+	return target == ErrUnexpectedResponse
+}
+
+func (e *ResponseError) Timeout() bool   { return false }
+func (e *ResponseError) Temporary() bool { return false }
+
+// maxexchange is the number of bytes sent and received kept in errors
+// about unexpected responses.
+const maxexchange = 32
+
+// exchangeTail returns a copy of the last maxexchange bytes of b.
+func exchangeTail(b []byte) []byte {
+	if len(b) > maxexchange {
+		b = b[len(b)-maxexchange:]
+	}
+	return append([]byte(nil), b...)
+}
+
+// exchangeString formats the bytes of an exchange for an error message.
+func exchangeString(sent, received []byte) string {
+	if sent == nil && received == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (sent [% x], received [% x])", sent, received)
+}
+
+// Exchange returns the bytes sent to and received from the bus pirate
+// leading up to the unexpected response err is caused by, the last 32 of
+// each, for bug reports. ok is false if err was not caused by an
+// unexpected response or the bytes are not known.
+func Exchange(err error) (sent, received []byte, ok bool) {
+	var xerr interface {
+		Exchange() (sent, received []byte)
+	}
+	if !errors.As(err, &xerr) {
+		return nil, nil, false
+	}
+	sent, received = xerr.Exchange()
+	return sent, received, sent != nil || received != nil
+}
+
+type temporaryError interface {
+	error
+	Temporary() bool
+}
+
+// isTemporary reports whether err is a transient failure. Errors that
+// don't say so themselves are temporary if they are timeouts.
+func isTemporary(err error) bool {
+	var terr temporaryError
+	if errors.As(err, &terr) {
+		return terr.Temporary()
+	}
+	return isTimeout(err)
+}
+
+// isProtocolError reports whether err means that the bus pirate and bp
+// got out of step.
+func isProtocolError(err error) bool {
+	return errors.Is(err, ErrUnexpectedResponse) || isTimeout(err)
+}
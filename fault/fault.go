@@ -0,0 +1,149 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package fault wraps a bp.Conn to inject faults into the data read from
+// it, so error handling can be tested deterministically.
+package fault
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// ErrTimeout is the error of injected timeouts. Its Timeout method
+// returns true.
+var ErrTimeout error = timeout{}
+
+type timeout struct{}
+
+func (timeout) Error() string   { return "fault: injected read timeout" }
+func (timeout) Timeout() bool   { return true }
+func (timeout) Temporary() bool { return true }
+
+// Kind is the kind of a fault.
+type Kind int
+
+const (
+	// Delay sleeps for Fault.Delay before reading.
+	Delay Kind = iota
+	// Truncate drops the last byte of the data read.
+	Truncate
+	// Corrupt XORs the first byte read with Fault.Mask.
+	Corrupt
+	// Timeout fails the read with ErrTimeout without reading.
+	Timeout
+)
+
+var kindstrings = map[Kind]string{
+	Delay:    "delay",
+	Truncate: "truncate",
+	Corrupt:  "corrupt",
+	Timeout:  "timeout",
+}
+
+func (k Kind) String() string {
+	if s, ok := kindstrings[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Fault describes when and how to disturb reads. Reads are counted from
+// 0. A fault fires on read At and, if Every is positive, on every
+// Every-th read after that. Additionally, if Prob is positive, it fires
+// on any read with probability Prob, drawn from the Conn's seeded random
+// source.
+type Fault struct {
+	Kind  Kind
+	At    int
+	Every int
+	Prob  float64
+
+	Delay time.Duration // for Delay
+	Mask  byte          // for Corrupt, 0 means 0xff
+}
+
+func (f *Fault) fires(n int, rng *rand.Rand) bool {
+	if n == f.At || (f.Every > 0 && n > f.At && (n-f.At)%f.Every == 0) {
+		return true
+	}
+	return f.Prob > 0 && rng.Float64() < f.Prob
+}
+
+// Conn is a bp.Conn injecting faults into reads from the Conn it wraps.
+// Writes are passed through unchanged.
+type Conn struct {
+	bp.Conn
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	faults   []Fault
+	reads    int
+	injected int
+}
+
+// New wraps c. The random source for probabilistic faults is seeded with
+// seed, so runs are reproducible.
+func New(c bp.Conn, seed int64, faults ...Fault) *Conn {
+	return &Conn{
+		Conn:   c,
+		rng:    rand.New(rand.NewSource(seed)),
+		faults: faults,
+	}
+}
+
+// Injected returns the number of faults injected so far.
+func (fc *Conn) Injected() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.injected
+}
+
+func (fc *Conn) Read(b []byte) (int, error) {
+	fc.mu.Lock()
+	n := fc.reads
+	fc.reads++
+	var firing []Fault
+	for i := range fc.faults {
+		if fc.faults[i].fires(n, fc.rng) {
+			firing = append(firing, fc.faults[i])
+		}
+	}
+	fc.injected += len(firing)
+	fc.mu.Unlock()
+
+	for _, f := range firing {
+		switch f.Kind {
+		case Delay:
+			time.Sleep(f.Delay)
+		case Timeout:
+			return 0, ErrTimeout
+		}
+	}
+
+	rn, err := fc.Conn.Read(b)
+
+	for _, f := range firing {
+		switch f.Kind {
+		case Truncate:
+			if rn > 0 {
+				rn--
+			}
+		case Corrupt:
+			if rn > 0 {
+				mask := f.Mask
+				if mask == 0 {
+					mask = 0xff
+				}
+				b[0] ^= mask
+			}
+		}
+	}
+
+	return rn, err
+}
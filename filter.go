@@ -0,0 +1,77 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+// AddrFilter passes only the sniffer events belonging to transactions
+// with one of a set of 7 bit addresses. Start conditions are held back
+// until the address byte following them is known.
+type AddrFilter struct {
+	addrs map[uint8]bool
+	held  *SniffEvent
+	await bool
+	pass  bool
+	open  bool
+}
+
+// NewAddrFilter returns a filter passing transactions to the given
+// addresses.
+func NewAddrFilter(addrs ...uint8) *AddrFilter {
+	f := &AddrFilter{addrs: make(map[uint8]bool)}
+	for _, a := range addrs {
+		f.addrs[a] = true
+	}
+	return f
+}
+
+// Add feeds ev into the filter and returns the events to deliver, which
+// may be none, ev or ev preceded by a held back start condition.
+func (f *AddrFilter) Add(ev SniffEvent) []SniffEvent {
+	switch ev.Type {
+	case SniffStart:
+		held := ev
+		f.held = &held
+		f.await = true
+		f.pass = false
+		return nil
+	case SniffStop:
+		f.held = nil
+		f.await = false
+		f.pass = false
+		if f.open {
+			f.open = false
+			return []SniffEvent{ev}
+		}
+		return nil
+	case SniffByte:
+		if f.await {
+			f.await = false
+			f.pass = f.addrs[ev.Byte>>1]
+			if f.pass {
+				f.open = true
+				start := *f.held
+				f.held = nil
+				return []SniffEvent{start, ev}
+			}
+			f.held = nil
+			return nil
+		}
+		if f.pass {
+			return []SniffEvent{ev}
+		}
+	}
+	return nil
+}
+
+// FilterAddrs returns the events of evs belonging to transactions with
+// one of the given addresses, for example to restrict a capture before
+// exporting it.
+func FilterAddrs(evs []SniffEvent, addrs ...uint8) []SniffEvent {
+	f := NewAddrFilter(addrs...)
+	var out []SniffEvent
+	for _, ev := range evs {
+		out = append(out, f.Add(ev)...)
+	}
+	return out
+}
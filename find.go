@@ -0,0 +1,125 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/distributed/sers"
+)
+
+// Found is a bus pirate found by FindBusPirates.
+type Found struct {
+	Path  string
+	Probe *ProbeResult
+}
+
+// candidatePorts returns the serial ports a bus pirate might be connected
+// to on this OS. Its FTDI chip shows up as a USB serial port.
+func candidatePorts() []string {
+	var patterns []string
+	switch runtime.GOOS {
+	case "windows":
+		var ports []string
+		for i := 1; i <= 64; i++ {
+			ports = append(ports, fmt.Sprintf(`\\.\COM%d`, i))
+		}
+		return ports
+	case "darwin":
+		patterns = []string{"/dev/cu.usbserial*", "/dev/cu.usbmodem*"}
+	case "freebsd", "openbsd", "netbsd", "dragonfly":
+		patterns = []string{"/dev/cuaU*"}
+	default:
+		patterns = []string{"/dev/ttyUSB*", "/dev/ttyACM*"}
+	}
+
+	var ports []string
+	for _, p := range patterns {
+		m, _ := filepath.Glob(p)
+		ports = append(ports, m...)
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// openPort opens the serial port at path with the bus pirate's default
+// settings, 115200 baud 8N1 without handshake.
+func openPort(path string) (sers.SerialPort, error) {
+	c, err := sers.Open(path)
+	if err != nil {
+		if openBusy(err) {
+			err = &os.PathError{Op: "open", Path: path, Err: ErrDeviceBusy}
+		}
+		return nil, err
+	}
+
+	if err := c.SetMode(115200, 8, sers.N, 1, sers.NO_HANDSHAKE); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// FindBusPirates probes the USB serial ports of the host for bus pirates
+// and returns the ones found, ordered by path. If there are none,
+// ErrNoBusPirate is returned. A bus pirate 5 or 6 is only returned if it
+// is in legacy binary mode. Ports that can't be opened or locked, for
+// example because they are in use, are skipped. Note that probing sends a few
+// bytes to every port, see Probe.
+func FindBusPirates() ([]Found, error) {
+	ports := candidatePorts()
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		found []Found
+	)
+	for _, path := range ports {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+
+			// don't disturb sessions of other processes
+			unlock, err := lockPort(path)
+			if err != nil {
+				return
+			}
+			defer unlock()
+
+			c, err := openPort(path)
+			if err != nil {
+				return
+			}
+			defer c.Close()
+
+			r, err := Probe(c)
+			if err != nil {
+				return
+			}
+			if r.Terminal && r.HardwareMajor() >= 5 {
+				// can't enter the legacy binary mode from
+				// the terminal on its own
+				return
+			}
+
+			mu.Lock()
+			found = append(found, Found{path, r})
+			mu.Unlock()
+		}(path)
+	}
+	wg.Wait()
+
+	if len(found) == 0 {
+		return nil, ErrNoBusPirate
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Path < found[j].Path })
+	return found, nil
+}
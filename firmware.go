@@ -0,0 +1,116 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"io"
+	"time"
+
+	"github.com/distributed/bp/ds30"
+	"github.com/distributed/bp/wire"
+)
+
+// UpdateFirmware flashes the firmware image in Intel HEX format read from
+// r into a bus pirate v3. The image is checked before the bus pirate is
+// touched. Then the bus pirate is reset into its terminal, which is told
+// to start the bootloader, and the image is written page by page, every
+// row is checked by the bootloader. progress, if not nil, is called on the
+// I/O goroutine after every row, returning an error cancels the update.
+//
+// Afterwards the bus pirate is closed and stays in the bootloader, reset
+// it, for example with HardReset or by unplugging it, to start the new
+// firmware and call Open again. If writing failed half way, the firmware
+// is broken, but the bootloader remains usable and UpdateFirmware can be
+// retried after a reset.
+func (bp *BusPirate) UpdateFirmware(r io.Reader, progress ProgressFunc) error {
+	im, err := ds30.ParseHex(r)
+	if err != nil {
+		return &OpError{"UpdateFirmware", MODE_UNKNOWN, nil, err}
+	}
+
+	return bp.do(func() error { return bp.updateFirmware(im, progress) })
+}
+
+func (bp *BusPirate) updateFirmware(im *ds30.Image, progress ProgressFunc) (err error) {
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+	defer func() { bp.report(err) }()
+
+	mode := bp.mode
+	if bp.version != nil && bp.version.HardwareMajor() != 3 {
+		return &OpError{"UpdateFirmware", mode, nil, ErrNotSupported}
+	}
+
+	if err := bp.enterBootloader(); err != nil {
+		bp.clearMode()
+		return &OpError{"UpdateFirmware", mode, nil, err}
+	}
+	// the bus pirate is gone until it is reset
+	bp.setMode(MODE_CLOSED, 0)
+	bp.version = nil
+
+	l, err := ds30.Hello(bp.c)
+	if err != nil {
+		return &OpError{"UpdateFirmware", mode, nil, err}
+	}
+	info := l.Info()
+	bp.logf(SubsysOpen, LogInfo, "bootloader v%d.%d, device id %#02x", info.Major, info.Minor, info.DeviceID)
+
+	var rows func(done, total int) error
+	if progress != nil {
+		pm := newProgressMeter(progress, 0)
+		rows = func(done, total int) error {
+			pm.total = int64(total * ds30.RowSize)
+			return pm.report(int64(done * ds30.RowSize))
+		}
+	}
+	if err := l.Write(im, rows); err != nil {
+		return &OpError{"UpdateFirmware", mode, nil, err}
+	}
+	bp.logf(SubsysOpen, LogInfo, "firmware written")
+	return nil
+}
+
+// enterBootloader resets the bus pirate into its terminal and starts the
+// bootloader with the '$' command. The caller has to hold the lock.
+func (bp *BusPirate) enterBootloader() error {
+	switch bp.mode {
+	case MODE_CLOSED, MODE_UNKNOWN:
+		if err := bp.enterBinary(); err != nil {
+			return err
+		}
+	case MODE_BITBANG:
+	default:
+		if err := bp.enterBitbangMode(); err != nil {
+			return err
+		}
+	}
+
+	// reset into the terminal
+	if err := bp.exchangeByteAndExpect(wire.ResetTerminal, wire.OK); err != nil {
+		return err
+	}
+	bp.clearMode()
+	if err := bp.resetBaud(); err != nil {
+		return err
+	}
+	time.Sleep(hardresetboot)
+	if _, err := bp.drain(); err != nil {
+		return err
+	}
+
+	// '$' asks "Are you sure?", which is answered with 'y'
+	if _, err := bp.c.Write([]byte("$\n")); err != nil {
+		return err
+	}
+	if _, err := bp.drain(); err != nil {
+		return err
+	}
+	if _, err := bp.c.Write([]byte("y")); err != nil {
+		return err
+	}
+	_, err := bp.drain()
+	return err
+}
@@ -0,0 +1,15 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+// Pin is a general purpose I/O pin, like one of an I/O expander on the
+// bus. Fixture code written against Pin doesn't care which part the pin
+// belongs to.
+type Pin interface {
+	// Out makes the pin an output and drives it to level, high if true.
+	Out(level bool) error
+	// In makes the pin an input and reads its level.
+	In() (bool, error)
+}
@@ -0,0 +1,154 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp/wire"
+)
+
+// ModemConn is a Conn that can drive the modem control lines of the
+// serial port. Pass a ModemConn to NewBusPirate to make HardReset work.
+type ModemConn interface {
+	Conn
+	SetDTR(on bool) error
+	SetRTS(on bool) error
+}
+
+// ErrNoModemControl is returned by HardReset if the Conn is not a
+// ModemConn.
+var ErrNoModemControl = errors.New("connection can't drive modem control lines")
+
+const (
+	hardresetpulse = 100 * time.Millisecond // time the lines are asserted
+	hardresetboot  = 200 * time.Millisecond // time given to the firmware to boot
+)
+
+// HardReset resets the bus pirate hardware by pulsing DTR and RTS, which
+// works even if the firmware is stuck, for example in sniffer mode. It
+// then enters binary mode and re-enters the mode that was active before,
+// like Resync. A running sniffer is ended, Stop returns an error for it.
+// The Conn passed to NewBusPirate has to be a ModemConn.
+func (bp *BusPirate) HardReset() error {
+	return bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		return bp.report(bp.hardReset())
+	})
+}
+
+func (bp *BusPirate) hardReset() error {
+	mode := bp.mode
+	if mode == MODE_CLOSED {
+		return &OpError{"HardReset", mode, nil, ErrNotOpen}
+	}
+
+	mc, ok := bp.link.Conn.(ModemConn)
+	if !ok {
+		return &OpError{"HardReset", mode, nil, ErrNoModemControl}
+	}
+
+	prevgen := bp.gen
+	bp.logf(SubsysOpen, LogInfo, "hard reset, was in %s mode", mode)
+
+	bp.abortSniffer()
+	bp.clearMode()
+
+	if err := bp.pulseReset(mc); err != nil {
+		return &OpError{"HardReset", mode, nil, err}
+	}
+	if err := bp.resetBaud(); err != nil {
+		return &OpError{"HardReset", mode, nil, err}
+	}
+	time.Sleep(hardresetboot)
+
+	if err := bp.enterBinary(); err != nil {
+		return err
+	}
+	return bp.restore(mode, prevgen)
+}
+
+func (bp *BusPirate) pulseReset(mc ModemConn) error {
+	if err := mc.SetDTR(true); err != nil {
+		return err
+	}
+	if err := mc.SetRTS(true); err != nil {
+		return err
+	}
+	time.Sleep(hardresetpulse)
+	if err := mc.SetDTR(false); err != nil {
+		return err
+	}
+	return mc.SetRTS(false)
+}
+
+// ResetHardware resets the microcontroller of the bus pirate and waits
+// until the firmware has booted and printed its banner. Unlike HardReset,
+// the mode is not restored: the bus pirate is left in its terminal like
+// after ExitBinaryMode and Open has to be called again. If the Conn is a
+// ModemConn, DTR and RTS are pulsed, which works even if the firmware is
+// stuck, otherwise the binary reset command is sent. The versions printed
+// in the banner replace those cached by Version. A running sniffer is
+// ended, Stop returns an error for it.
+func (bp *BusPirate) ResetHardware() error {
+	return bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		return bp.report(bp.resetHardware())
+	})
+}
+
+func (bp *BusPirate) resetHardware() error {
+	mode := bp.mode
+	bp.logf(SubsysOpen, LogInfo, "resetting hardware, was in %s mode", mode)
+	bp.abortSniffer()
+
+	if mc, ok := bp.link.Conn.(ModemConn); ok {
+		bp.clearMode()
+		if err := bp.pulseReset(mc); err != nil {
+			return &OpError{"ResetHardware", mode, nil, err}
+		}
+	} else {
+		switch bp.mode {
+		case MODE_CLOSED, MODE_UNKNOWN:
+			if err := bp.enterBinary(); err != nil {
+				return &OpError{"ResetHardware", mode, nil, err}
+			}
+		case MODE_BITBANG:
+		default:
+			if err := bp.enterBitbangMode(); err != nil {
+				return &OpError{"ResetHardware", mode, nil, err}
+			}
+		}
+		if err := bp.exchangeByteAndExpect(wire.ResetTerminal, wire.OK); err != nil {
+			bp.clearMode()
+			return &OpError{"ResetHardware", mode, nil, err}
+		}
+	}
+	bp.setMode(MODE_CLOSED, 0)
+	bp.version = nil
+	if err := bp.resetBaud(); err != nil {
+		return &OpError{"ResetHardware", mode, nil, err}
+	}
+
+	// give the firmware time to reboot
+	if err := bp.c.SetReadParams(0, 0.5); err != nil {
+		return &OpError{"ResetHardware", mode, nil, err}
+	}
+	text, err := readQuiet(bp.c)
+	if err != nil {
+		return &OpError{"ResetHardware", mode, nil, err}
+	}
+	v := parseInfo(string(text))
+	if v.Hardware == "" {
+		return &OpError{"ResetHardware", mode, nil, fmt.Errorf("%w: no boot banner after reset", ErrNoBusPirate)}
+	}
+	bp.logf(SubsysOpen, LogInfo, "reset, hardware %s firmware %s", v.Hardware, v.Firmware)
+	bp.version = &v
+	return nil
+}
@@ -0,0 +1,298 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package hd44780 drives HD44780 compatible character LCDs through an 8
+// bit I/O expander, like the I2C backpacks sold with the displays.
+//
+// The LCD adapter of the bus pirate is only supported by the terminal
+// interface of the firmware, the binary modes have no LCD mode. A
+// backpack on the I2C bus does the same job: the display runs in 4 bit
+// mode, its control lines, data lines and backlight on the pins of the
+// expander as given by a Wiring. Every nibble takes two writes to the
+// expander, to pulse E.
+package hd44780
+
+import (
+	"fmt"
+	"time"
+)
+
+// Port is the 8 bit port of an expander the display is wired to.
+// pcf8574.Dev is a Port, PortFunc makes other expanders one.
+type Port interface {
+	// Write sets the pins of the port to v, pin 0 in bit 0.
+	Write(v byte) error
+}
+
+// PortFunc is a function used as a Port, like the WritePort of port 0 of
+// an mcp230xx.Dev.
+type PortFunc func(v byte) error
+
+func (f PortFunc) Write(v byte) error { return f(v) }
+
+// Wiring tells which pins of the port the lines of the display are on.
+type Wiring struct {
+	RS, RW, E byte // masks of the control lines, RW 0 if tied low
+	Backlight byte // mask of the backlight, 0 if there is none
+
+	// DataShift is the pin D4 is on, D5 to D7 on the pins above.
+	DataShift uint
+}
+
+// Wirings of common backpacks.
+var (
+	// PCF8574Backpack is the ubiquitous backpack with a PCF8574.
+	PCF8574Backpack = Wiring{RS: 0x01, RW: 0x02, E: 0x04, Backlight: 0x08, DataShift: 4}
+	// AdafruitBackpack is the I2C backpack of Adafruit with an
+	// MCP23008, whose pins must be made outputs first.
+	AdafruitBackpack = Wiring{RS: 0x02, E: 0x04, Backlight: 0x80, DataShift: 3}
+)
+
+// Instructions.
+const (
+	cmdClear       = 0x01
+	cmdHome        = 0x02
+	cmdEntryMode   = 0x04
+	cmdDisplay     = 0x08
+	cmdFunctionSet = 0x20
+	cmdSetCGRAM    = 0x40
+	cmdSetDDRAM    = 0x80
+
+	entryIncrement = 0x02
+
+	displayOn     = 0x04
+	displayCursor = 0x02
+	displayBlink  = 0x01
+
+	functionTwoLines = 0x08
+)
+
+// Execution times of the instructions, with margin for slow clones.
+const (
+	clearDelay   = 2 * time.Millisecond
+	commandDelay = 50 * time.Microsecond
+)
+
+// Display is a character LCD.
+type Display struct {
+	p    Port
+	w    Wiring
+	cols int
+	rows int
+
+	backlight byte
+	display   byte // the bits of the display instruction
+	row       int  // cursor row, for newlines
+}
+
+// New returns the display with cols columns and rows rows, 1 to 4, on p
+// wired as w. It must be initialized with Init.
+func New(p Port, w Wiring, cols, rows int) *Display {
+	return &Display{p: p, w: w, cols: cols, rows: rows, backlight: w.Backlight}
+}
+
+// nibble clocks the 4 bits of v into the display, as data if rs is true.
+func (d *Display) nibble(v byte, rs bool) error {
+	b := (v&0x0f)<<d.w.DataShift | d.backlight
+	if rs {
+		b |= d.w.RS
+	}
+	// the display latches on the falling edge of E
+	if err := d.p.Write(b | d.w.E); err != nil {
+		return err
+	}
+	return d.p.Write(b)
+}
+
+// send sends the byte v as an instruction, or as data if rs is true.
+func (d *Display) send(op string, v byte, rs bool) error {
+	if err := d.nibble(v>>4, rs); err != nil {
+		return d.err(op, err)
+	}
+	if err := d.nibble(v, rs); err != nil {
+		return d.err(op, err)
+	}
+	// the round trips to the expander take longer than most
+	// instructions, but not all clones are that fast
+	time.Sleep(commandDelay)
+	return nil
+}
+
+func (d *Display) command(op string, c byte) error {
+	return d.send(op, c, false)
+}
+
+// Init brings the display from any state into 4 bit mode and clears it,
+// with the cursor hidden and the backlight on.
+func (d *Display) Init() error {
+	if d.rows < 1 || d.rows > 4 || d.cols < 1 || d.cols > 40 {
+		return d.err("init", fmt.Errorf("invalid size %dx%d", d.cols, d.rows))
+	}
+	if err := d.p.Write(d.backlight); err != nil {
+		return d.err("init", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// three times 8 bit mode, which the display takes whatever mode and
+	// nibble it was in, then 4 bit mode
+	for _, step := range []struct {
+		v     byte
+		delay time.Duration
+	}{
+		{0x3, 5 * time.Millisecond},
+		{0x3, 200 * time.Microsecond},
+		{0x3, 200 * time.Microsecond},
+		{0x2, 200 * time.Microsecond},
+	} {
+		if err := d.nibble(step.v, false); err != nil {
+			return d.err("init", err)
+		}
+		time.Sleep(step.delay)
+	}
+
+	var fn byte = cmdFunctionSet
+	if d.rows > 1 {
+		// 4 line displays are 2 line displays folded
+		fn |= functionTwoLines
+	}
+	if err := d.command("init", fn); err != nil {
+		return err
+	}
+	d.display = 0
+	if err := d.command("init", cmdDisplay); err != nil {
+		return err
+	}
+	if err := d.Clear(); err != nil {
+		return err
+	}
+	if err := d.command("init", cmdEntryMode|entryIncrement); err != nil {
+		return err
+	}
+	return d.SetDisplay(true)
+}
+
+// Clear clears the display and moves the cursor home.
+func (d *Display) Clear() error {
+	if err := d.command("clear", cmdClear); err != nil {
+		return err
+	}
+	time.Sleep(clearDelay)
+	d.row = 0
+	return nil
+}
+
+// Home moves the cursor to the top left.
+func (d *Display) Home() error {
+	if err := d.command("home", cmdHome); err != nil {
+		return err
+	}
+	time.Sleep(clearDelay)
+	d.row = 0
+	return nil
+}
+
+// setDisplay changes the bits of the display instruction selected by mask
+// to those of v.
+func (d *Display) setDisplay(op string, mask, v byte) error {
+	display := d.display&^mask | v&mask
+	if err := d.command(op, cmdDisplay|display); err != nil {
+		return err
+	}
+	d.display = display
+	return nil
+}
+
+// SetDisplay turns the display on or off. It keeps its contents while it
+// is off.
+func (d *Display) SetDisplay(on bool) error {
+	var v byte
+	if on {
+		v = displayOn
+	}
+	return d.setDisplay("set display", displayOn, v)
+}
+
+// SetCursor shows or hides the underline cursor and the blinking block
+// cursor.
+func (d *Display) SetCursor(underline, blink bool) error {
+	var v byte
+	if underline {
+		v |= displayCursor
+	}
+	if blink {
+		v |= displayBlink
+	}
+	return d.setDisplay("set cursor", displayCursor|displayBlink, v)
+}
+
+// SetBacklight turns the backlight on or off, if the wiring has one.
+func (d *Display) SetBacklight(on bool) error {
+	d.backlight = 0
+	if on {
+		d.backlight = d.w.Backlight
+	}
+	if err := d.p.Write(d.backlight); err != nil {
+		return d.err("set backlight", err)
+	}
+	return nil
+}
+
+// Move moves the cursor to column col and row row, from 0.
+func (d *Display) Move(col, row int) error {
+	if col < 0 || col >= d.cols || row < 0 || row >= d.rows {
+		return d.err("move", fmt.Errorf("position %d,%d outside of %dx%d", col, row, d.cols, d.rows))
+	}
+	// rows 2 and 3 continue rows 0 and 1 in memory
+	addr := []int{0x00, 0x40, d.cols, 0x40 + d.cols}[row] + col
+	if err := d.command("move", cmdSetDDRAM|byte(addr)); err != nil {
+		return err
+	}
+	d.row = row
+	return nil
+}
+
+// Write writes p at the cursor, which moves right. A newline moves it to
+// the start of the next row, or of the first after the last. Bytes are
+// characters of the character ROM of the display, ASCII from 0x20 to
+// 0x7d on most, 0 to 7 the custom characters.
+func (d *Display) Write(p []byte) (int, error) {
+	for i, c := range p {
+		if c == '\n' {
+			if err := d.Move(0, (d.row+1)%d.rows); err != nil {
+				return i, err
+			}
+			continue
+		}
+		if err := d.send("write", c, true); err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+// WriteString writes s like Write.
+func (d *Display) WriteString(s string) (int, error) {
+	return d.Write([]byte(s))
+}
+
+// SetChar defines custom character n, 0 to 7, as 8 rows of 5 pixels, the
+// top row first, the leftmost pixel in bit 4. It moves the cursor home.
+func (d *Display) SetChar(n int, rows [8]byte) error {
+	if n < 0 || n > 7 {
+		return d.err("set char", fmt.Errorf("no custom character %d", n))
+	}
+	if err := d.command("set char", cmdSetCGRAM|byte(n)<<3); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if err := d.send("set char", r&0x1f, true); err != nil {
+			return err
+		}
+	}
+	return d.Home()
+}
+
+func (d *Display) err(op string, err error) error {
+	return fmt.Errorf("hd44780: %s: %w", op, err)
+}
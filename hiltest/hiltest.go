@@ -0,0 +1,156 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package hiltest helps writing tests that run against a real bus pirate
+// (hardware in the loop).
+//
+// The serial port is taken from the environment variable BP_HIL_PORT.
+// Tests using this package are skipped if it is not set, so they can live
+// next to ordinary unit tests. If BP_HIL_ARTIFACTS names a directory, a
+// wire trace and the diagnostic log of every test are written there.
+//
+// Tests sharing one bus pirate must not run in parallel.
+package hiltest
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/distributed/bp"
+	"github.com/distributed/sers"
+)
+
+const (
+	// EnvPort names the environment variable holding the serial port.
+	EnvPort = "BP_HIL_PORT"
+	// EnvArtifacts names the environment variable holding the artifact
+	// directory.
+	EnvArtifacts = "BP_HIL_ARTIFACTS"
+)
+
+// Port returns the serial port configured for hardware tests and skips
+// the test if there is none.
+func Port(t testing.TB) string {
+	t.Helper()
+	port := os.Getenv(EnvPort)
+	if port == "" {
+		t.Skipf("no hardware: set %s to the serial port of a bus pirate", EnvPort)
+	}
+	return port
+}
+
+// Open opens the bus pirate configured for hardware tests and puts it
+// into binary mode. When the test finishes, the bus pirate is returned to
+// the text terminal and the serial port is closed. The test is skipped if
+// no hardware is configured.
+func Open(t testing.TB) *bp.BusPirate {
+	t.Helper()
+	port := Port(t)
+
+	c, err := sers.Open(port)
+	if err != nil {
+		t.Fatalf("hiltest: open %s: %v", port, err)
+	}
+	if err := c.SetMode(115200, 8, sers.N, 1, sers.NO_HANDSHAKE); err != nil {
+		c.Close()
+		t.Fatalf("hiltest: configure %s: %v", port, err)
+	}
+
+	b := bp.NewBusPirate(c)
+	closeArtifacts := capture(t, b)
+
+	if err := b.Open(); err != nil {
+		closeArtifacts()
+		c.Close()
+		t.Fatalf("hiltest: open bus pirate on %s: %v", port, err)
+	}
+
+	t.Cleanup(func() {
+		if err := b.Close(); err != nil {
+			t.Errorf("hiltest: close bus pirate: %v", err)
+		}
+		closeArtifacts()
+		c.Close()
+	})
+
+	return b
+}
+
+// capture directs the trace and log of b into the artifact directory, if
+// one is configured. It returns a function closing the artifact files.
+func capture(t testing.TB, b *bp.BusPirate) func() {
+	dir := os.Getenv(EnvArtifacts)
+	if dir == "" {
+		return func() {}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("hiltest: %v", err)
+	}
+
+	base := filepath.Join(dir, strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()))
+	trace, err := os.Create(base + ".trace")
+	if err != nil {
+		t.Fatalf("hiltest: %v", err)
+	}
+	logf, err := os.Create(base + ".log")
+	if err != nil {
+		trace.Close()
+		t.Fatalf("hiltest: %v", err)
+	}
+
+	b.SetTrace(trace)
+	b.SetLogger(log.New(logf, "", log.Lmicroseconds))
+	b.SetLogLevel("", bp.LogTrace)
+
+	return func() {
+		b.SetTrace(nil)
+		b.SetLogger(nil)
+		trace.Close()
+		logf.Close()
+	}
+}
+
+// ResetI2C returns b to bitbang mode, which releases the bus, and enters
+// I2C mode afresh. Use it to start every test case from a known state.
+func ResetI2C(t testing.TB, b *bp.BusPirate) bp.BusPirateI2C {
+	t.Helper()
+
+	if mode, _ := b.GetMode(); mode != bp.MODE_BITBANG {
+		if err := b.EnterBitbangMode(); err != nil {
+			t.Fatalf("hiltest: enter bitbang mode: %v", err)
+		}
+	}
+
+	i2c, err := b.EnterI2CMode()
+	if err != nil {
+		t.Fatalf("hiltest: enter I2C mode: %v", err)
+	}
+	return i2c
+}
+
+// I2CCase is a table driven hardware test case.
+type I2CCase struct {
+	Name string
+	Run  func(t *testing.T, i2c bp.BusPirateI2C)
+}
+
+// RunI2C runs every case as a subtest of t, each one with a freshly reset
+// I2C bus.
+func RunI2C(t *testing.T, b *bp.BusPirate, cases []I2CCase) {
+	for i, c := range cases {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("case%d", i)
+		}
+		run := c.Run
+		t.Run(name, func(t *testing.T) {
+			run(t, ResetI2C(t, b))
+		})
+	}
+}
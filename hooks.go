@@ -0,0 +1,118 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+	"sync"
+)
+
+// EventKind is the kind of an Event.
+type EventKind int
+
+const (
+	// EventModeChange is sent whenever the mode of the bus pirate
+	// changes, including changes to MODE_UNKNOWN after errors.
+	EventModeChange EventKind = iota
+	// EventResync is sent after a resync, whether automatic or through
+	// Resync. Err is set if it failed.
+	EventResync
+	// EventReconnect is sent after a reconnect, whether automatic or
+	// through Reconnect. Err is set if it failed.
+	EventReconnect
+	// EventError is sent when an operation returns an error. Retried
+	// operations send it only for the final failure.
+	EventError
+)
+
+var eventkindstrings = map[EventKind]string{
+	EventModeChange: "mode change",
+	EventResync:     "resync",
+	EventReconnect:  "reconnect",
+	EventError:      "error",
+}
+
+func (k EventKind) String() string {
+	if s, ok := eventkindstrings[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Event describes something that happened to a BusPirate.
+type Event struct {
+	Kind EventKind
+	Mode Mode  // mode after the event
+	Prev Mode  // mode before the event, for EventModeChange
+	Err  error // error of EventError, failure of EventResync and EventReconnect
+}
+
+func (e Event) String() string {
+	switch {
+	case e.Kind == EventModeChange:
+		return fmt.Sprintf("%v: %v -> %v", e.Kind, e.Prev, e.Mode)
+	case e.Err != nil:
+		return fmt.Sprintf("%v in %v mode: %v", e.Kind, e.Mode, e.Err)
+	}
+	return fmt.Sprintf("%v in %v mode", e.Kind, e.Mode)
+}
+
+// A Hook is called for every event of a BusPirate.
+type Hook func(Event)
+
+type hooks struct {
+	mu   sync.Mutex
+	next int
+	fns  map[int]Hook
+}
+
+// AddHook registers h to be called for every event and returns a function
+// removing it again. Hooks are called synchronously, in no particular
+// order, by the goroutine causing the event while it holds the lock of bp.
+// They must return quickly and must not call methods of bp or of its mode
+// handles.
+func (bp *BusPirate) AddHook(h Hook) (remove func()) {
+	hs := &bp.hooks
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if hs.fns == nil {
+		hs.fns = make(map[int]Hook)
+	}
+	id := hs.next
+	hs.next++
+	hs.fns[id] = h
+
+	return func() {
+		hs.mu.Lock()
+		defer hs.mu.Unlock()
+		delete(hs.fns, id)
+	}
+}
+
+// emit calls the hooks for ev.
+func (bp *BusPirate) emit(ev Event) {
+	hs := &bp.hooks
+	hs.mu.Lock()
+	fns := make([]Hook, 0, len(hs.fns))
+	for _, h := range hs.fns {
+		fns = append(fns, h)
+	}
+	hs.mu.Unlock()
+
+	for _, h := range fns {
+		h(ev)
+	}
+}
+
+// report sends EventError for err, if it is not nil, and returns it. The
+// caller has to hold the lock.
+func (bp *BusPirate) report(err error) error {
+	if err != nil {
+		bp.stats.Errors++
+		bp.emit(Event{Kind: EventError, Mode: bp.mode, Err: err})
+	}
+	return err
+}
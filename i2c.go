@@ -5,21 +5,25 @@
 package bp
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
-	"github.com/distributed/i2cm"
 	"io"
+	"time"
+
+	"github.com/distributed/bp/wire"
 )
 
-// BusPirateI2C represents a bus pirate in I2C mode. It offers an
-// interface consistent with i2cm.I2CMaster. Obtain a BusPirateI2C by switching
+// BusPirateI2C represents a bus pirate in I2C mode. It implements
+// I2CMaster, package bpi2cm adapts it to i2cm.I2CMaster from
+// github.com/distributed/i2cm. Obtain a BusPirateI2C by switching
 // the bus pirate into I2C mode with *BusPirate.EnterI2CMode().
 // When the user makes
 // the bus pirate switch into a different mode, the BusPirateI2C
 // object becomes invalid and must no be used any longer.
 type BusPirateI2C struct {
-	bp *BusPirate
+	bp     *BusPirate
+	gen    uint64
+	pacing *Pacing // nil to follow the pacing of bp
 }
 
 // NonStrictI2C offers the same functionality as BusPirateI2C, but also
@@ -37,154 +41,179 @@ type NonStrictI2C struct {
 	BusPirateI2C
 }
 
-const (
-	bpcmd_ENTER_I2C_MODE = 0x02
-)
-
-const (
-	bpans_OK = 0x01
-)
-
-type i2cerror struct {
-	Op  string
-	Err error
-}
-
-func (e *i2cerror) Error() string {
-	return e.Op + ": " + e.Err.Error()
-}
-
 // EnterI2CMode makes the bus pirate enter I2C mode and returns a
 // BusPirateI2C object offering the I2C functionality of the device. 
 // The I2CMode can only be entered from bitbang mode.
 // This might change.
-func (bp *BusPirate) EnterI2CMode() (BusPirateI2C, error) {
+func (bp *BusPirate) EnterI2CMode() (m BusPirateI2C, err error) {
+	err = bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		m, err = bp.enterI2CMode()
+		return bp.report(err)
+	})
+	return m, err
+}
+
+func (bp *BusPirate) enterI2CMode() (BusPirateI2C, error) {
 	var bpi2c BusPirateI2C
 
-	if bp.mode != MODE_BITBANG {
-		return bpi2c, ModeError("I2C mode can only be entered from raw bitbang mode")
+	mode := bp.mode
+	if mode != MODE_BITBANG {
+		return bpi2c, &OpError{"EnterI2CMode", mode, nil, ModeError("I2C mode can only be entered from raw bitbang mode")}
 	}
 
-	err := bp.writeByte(bpcmd_ENTER_I2C_MODE)
+	bp.stats.Commands++
+	err := bp.writeByte(wire.EnterI2C)
 	if err != nil {
 		bp.clearMode()
-		return bpi2c, err
+		return bpi2c, &OpError{"EnterI2CMode", mode, nil, err}
 	}
 
-	var rb [4]byte
-	_, err = io.ReadFull(bp.c, rb[0:])
+	v, err := bp.readBanner(wire.EnterI2C, wire.I2CBanner)
 	if err != nil {
 		bp.clearMode()
-		return bpi2c, fmt.Errorf("error reading response: %v", err)
-	}
-
-	if !bytes.HasPrefix(rb[0:], []byte("I2C")) {
-		bp.clearMode()
-		return bpi2c, fmt.Errorf("expected version string \"I2Cx\", got %q", rb)
+		if isProtocolError(err) {
+			bp.suspicious()
+		}
+		return bpi2c, &OpError{"EnterI2CMode", mode, nil, err}
 	}
 
-	if rb[3] != '1' {
+	ver, err := bp.checkVersion("I2C", v)
+	if err != nil {
 		bp.clearMode()
-		return bpi2c, fmt.Errorf("only I2C version 1 is supported, bus pirate uses version %q", rb[3])
+		bp.suspicious()
+		return bpi2c, &OpError{"EnterI2CMode", mode, nil, err}
 	}
 
-	bp.mode = MODE_I2C
-	bp.modeversion = 1
+	bp.setMode(MODE_I2C, ver)
+	bp.i2cconf = i2cconfig{}
 
 	bpi2c.bp = bp
+	bpi2c.gen = bp.gen
 
 	return bpi2c, nil
 }
 
-var notI2CMode = ModeError("not in I2C mode")
-
-const (
-	bpcmd_I2C_START      = 0x02
-	bpcmd_I2C_STOP       = 0x03
-	bpcmd_I2C_READ       = 0x04
-	bpcmd_I2C_ACK        = 0x06
-	bpcmd_I2C_NACK       = 0x07
-	bpcmd_I2C_WnR        = 0x08 // write then read
-	bpcmd_I2C_BULK_WRITE = 0x10
-)
-
-const (
-	i2c_RnW_MAXREAD  = 4096
-	i2c_RnW_MAXWRITE = 4096
-)
+// check returns an error if the handle can't be used right now. The
+// caller has to hold the lock.
+func (inf BusPirateI2C) check(op string) error {
+	if inf.gen != inf.bp.gen {
+		return &OpError{op, inf.bp.mode, nil, ErrStaleHandle}
+	}
+	if inf.bp.mode != MODE_I2C {
+		return &OpError{op, inf.bp.mode, nil, ErrNotI2CMode}
+	}
+	return nil
+}
 
 func (inf BusPirateI2C) Start() error {
+	return inf.bp.retry("i2c.Start", inf.start)
+}
+
+func (inf BusPirateI2C) start() (err error) {
 	bp := inf.bp
-	if bp.mode != MODE_I2C {
-		return notI2CMode
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+
+	if err := inf.check("i2c.Start"); err != nil {
+		return err
 	}
+	inf.pace(bp.txstart.IsZero())
+	bp.stats.Commands++
 
-	if err := bp.exchangeByteAndExpect(bpcmd_I2C_START, bpans_OK); err != nil {
-		return &i2cerror{"i2c.Start", err}
+	if bp.unchecked {
+		return bp.deferExch(bp.startExch())
 	}
-	return nil
+	return bp.pipe(append(bp.pendingWrites(), bp.startExch()))
 }
 
 func (inf BusPirateI2C) Stop() error {
+	return inf.bp.retry("i2c.Stop", inf.stop)
+}
+
+func (inf BusPirateI2C) stop() (err error) {
 	bp := inf.bp
-	if bp.mode != MODE_I2C {
-		return notI2CMode
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+
+	if err := inf.check("i2c.Stop"); err != nil {
+		return err
 	}
+	inf.pace(false)
+	bp.stats.Commands++
 
-	if err := bp.exchangeByteAndExpect(bpcmd_I2C_STOP, 0x01); err != nil {
-		return &i2cerror{"i2c.Stop", err}
+	if bp.unchecked {
+		return bp.deferExch(bp.stopExch())
 	}
-	return nil
+	return bp.pipe(append(bp.pendingWrites(), bp.stopExch()))
 }
 
-func (inf BusPirateI2C) ReadByte(ack bool) (byte, error) {
-	bp := inf.bp
-	if bp.mode != MODE_I2C {
-		return 0x00, notI2CMode
-	}
+// ReadByteAck reads a byte from the slave and acknowledges it if ack is
+// set. The last byte of a read is not acknowledged.
+func (inf BusPirateI2C) ReadByteAck(ack bool) (b byte, err error) {
+	err = inf.bp.retry("i2c.ReadByte", func() error {
+		b, err = inf.readByte(ack)
+		return err
+	})
+	return b, err
+}
 
-	b, err := bp.exchangeByte(bpcmd_I2C_READ)
-	if err != nil {
-		return 0, &i2cerror{"i2c.ReadByte", err}
-	}
+func (inf BusPirateI2C) readByte(ack bool) (_ byte, err error) {
+	bp := inf.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
 
-	if ack {
-		err = bp.exchangeByteAndExpect(bpcmd_I2C_ACK, bpans_OK)
-	} else {
-		err = bp.exchangeByteAndExpect(bpcmd_I2C_NACK, bpans_OK)
+	if err := inf.check("i2c.ReadByte"); err != nil {
+		return 0x00, err
 	}
-
-	if err != nil {
-		err = &i2cerror{"i2c.ReadByte", err}
+	if err := inf.checkDryRun("i2c.ReadByte"); err != nil {
+		return 0x00, err
 	}
+	inf.pace(false)
+	bp.stats.Commands++
 
-	return b, err
+	var b [1]byte
+	err = bp.pipe(append(bp.pendingWrites(), bp.readExchs(b[:], ack)...))
+	return b[0], err
 }
 
 func (inf BusPirateI2C) WriteByte(b byte) error {
-	bp := inf.bp
-	if bp.mode != MODE_I2C {
-		return notI2CMode
-	}
+	return inf.bp.retry("i2c.WriteByte", func() error {
+		return inf.writeByte(b)
+	})
+}
 
-	// TODO: factor into bulk write
+func (inf BusPirateI2C) writeByte(b byte) (err error) {
+	bp := inf.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
 
-	//  bulk write cmd | count-1
-	cmd := byte(bpcmd_I2C_BULK_WRITE | 0x00)
-	if err := bp.exchangeByteAndExpect(cmd, bpans_OK); err != nil {
-		return &i2cerror{"i2c.WriteByte", err}
+	if err := inf.check("i2c.WriteByte"); err != nil {
+		return err
 	}
-
-	ackb, err := bp.exchangeByte(b)
-	if err != nil {
-		return &i2cerror{"i2c.WriteByte", err}
+	if err := inf.checkDryRun("i2c.WriteByte"); err != nil {
+		return err
 	}
+	bp.stats.Commands++
 
-	if ackb != 0 {
-		return i2cm.NACKReceived
+	if bp.coalesce {
+		bp.wpending = append(bp.wpending, b)
+		if len(bp.wpending) < wire.MaxBulkWrite {
+			return nil
+		}
+		inf.pace(false)
+		if bp.unchecked {
+			return bp.deferExch()
+		}
+		return bp.pipe(bp.pendingWrites())
 	}
 
-	return nil
+	inf.pace(false)
+	if bp.unchecked {
+		return bp.deferExch(bp.writeExchs([]byte{b})...)
+	}
+	return bp.pipe(bp.writeExchs([]byte{b}))
 }
 
 func (bp *BusPirate) EnterNonStrictI2CMode() (NonStrictI2C, error) {
@@ -205,26 +234,18 @@ func (nsi NonStrictI2C) writeThenRead(w, r []byte) error {
 	// write count: 2 bytes, big endian
 	// read count: 2 bytes, big endian
 	// slice w: len(w) bytes
-	if len(w) > i2c_RnW_MAXWRITE {
-		return fmt.Errorf("bp.writeThenRead: cannot write more than %d bytes", i2c_RnW_MAXWRITE)
+	if len(w) > wire.MaxWriteThenRead {
+		return fmt.Errorf("bp.writeThenRead: cannot write more than %d bytes", wire.MaxWriteThenRead)
 	}
 
-	if len(r) > i2c_RnW_MAXREAD {
-		return fmt.Errorf("bp.writeThenRead: cannot write more than %d bytes", i2c_RnW_MAXREAD)
+	if len(r) > wire.MaxWriteThenRead {
+		return fmt.Errorf("bp.writeThenRead: cannot read more than %d bytes", wire.MaxWriteThenRead)
 	}
 
-	header := make([]byte, 5)
-	header[0] = bpcmd_I2C_WnR
-	header[1] = uint8(len(w) >> 8)
-	header[2] = uint8(len(w))
-	header[3] = uint8(len(r) >> 8)
-	header[4] = uint8(len(r))
-
-	fmt.Printf("header % x  ", header)
-
-	_, err := bp.c.Write(header)
+	header := wire.WriteThenRead(len(w), len(r))
+	_, err := bp.c.Write(header[:])
 	if err != nil {
-		return nil
+		return err
 	}
 
 	// the slave _would_, according to dangerous prototypes, answer with 0x00
@@ -237,7 +258,7 @@ func (nsi NonStrictI2C) writeThenRead(w, r []byte) error {
 	// would have to time out on a non-arriving 0x00 here - on every write then
 	// read operation. this bis bonkers and I'm not doing it.
 
-	fmt.Printf("write b % x    ", w)
+	bp.logf(SubsysI2C, LogTrace, "write then read header % x write % x", header[:], w)
 
 	_, err = bp.c.Write(w)
 	if err != nil {
@@ -245,7 +266,7 @@ func (nsi NonStrictI2C) writeThenRead(w, r []byte) error {
 	}
 
 	// the ack after the write bytes operation is poorly documented. i believe
-	// that the bp will answer bpans_OK if all bytes written have been acked
+	// that the bp will answer wire.OK if all bytes written have been acked
 	// and 0x00 if there was a NACK at some point
 	b, err := bp.readByte()
 	if err != nil {
@@ -254,12 +275,11 @@ func (nsi NonStrictI2C) writeThenRead(w, r []byte) error {
 
 	// we're aliasing all kinds of NACKs into NoSuchDevice - I'm not sure this
 	// is a good idea, but at this point I don't care any more.
-	if b != bpans_OK {
-		return i2cm.NoSuchDevice
+	if b != wire.OK {
+		bp.stats.NACKs++
+		return ErrNoSuchDevice
 	}
 
-	fmt.Printf("  ACK!   ")
-
 	if len(r) > 0 {
 		_, err = io.ReadFull(bp.c, r)
 		if err != nil {
@@ -267,35 +287,57 @@ func (nsi NonStrictI2C) writeThenRead(w, r []byte) error {
 		}
 	}
 
-	fmt.Printf("read b % x\n", r)
+	bp.logf(SubsysI2C, LogTrace, "write then read ACK, read % x", r)
 
 	return nil
 }
 
 // only supports 7 bit addressing
-func (nsi NonStrictI2C) Transact8x8(addr i2cm.Addr, regaddr uint8, w []byte, r []byte) (nw, nr int, err error) {
+func (nsi NonStrictI2C) Transact8x8(addr Addr, regaddr uint8, w []byte, r []byte) (nw, nr int, err error) {
+	err = nsi.bp.retry("i2c.Transact8x8", func() error {
+		nw, nr, err = nsi.transact8x8(addr, regaddr, w, r)
+		return err
+	})
+	return nw, nr, err
+}
+
+func (nsi NonStrictI2C) transact8x8(addr Addr, regaddr uint8, w []byte, r []byte) (nw, nr int, err error) {
 	bp := nsi.bp
-	if bp.mode != MODE_I2C {
-		return 0, 0, notI2CMode
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+
+	if err := nsi.check("i2c.Transact8x8"); err != nil {
+		return 0, 0, err
+	}
+	if err := bp.settle(); err != nil {
+		return 0, 0, err
+	}
+	if err := bp.supports("i2c.Transact8x8", func(c Capabilities) bool { return c.WriteThenRead }); err != nil {
+		return 0, 0, err
 	}
 
 	if addr.GetAddrLen() != 7 {
-		return 0, 0, errors.New("bp nonstrict I2C only supports 7 bit addressing")
+		return 0, 0, &OpError{"i2c.Transact8x8", MODE_I2C, addr, errors.New("nonstrict I2C only supports 7 bit addressing")}
 	}
 
-	fmt.Printf("nonstrict Transact8x8 addr %v regaddr %#02x len(w) %d len(r) %d\n", addr, regaddr, len(w), len(r))
+	bp.logf(SubsysI2C, LogDebug, "nonstrict Transact8x8 addr %v regaddr %#02x len(w) %d len(r) %d", addr, regaddr, len(w), len(r))
 
 	// we need one byte for the device address
-	maxwsize := i2c_RnW_MAXWRITE - 1
+	maxwsize := wire.MaxWriteThenRead - 1
 	if len(w) > maxwsize {
-		return 0, 0, fmt.Errorf("Transact8x8: write of %d bytes requested, maximum of %d supported", len(w), maxwsize)
+		return 0, 0, &OpError{"i2c.Transact8x8", MODE_I2C, addr, fmt.Errorf("write of %d bytes requested, maximum of %d supported", len(w), maxwsize)}
 	}
 
-	maxrsize := i2c_RnW_MAXREAD
+	maxrsize := wire.MaxWriteThenRead
 	if len(r) > maxrsize {
-		return 0, 0, fmt.Errorf("Transact8x8: read of %d bytes requested, maximum of %d supported", len(r), maxrsize)
+		return 0, 0, &OpError{"i2c.Transact8x8", MODE_I2C, addr, fmt.Errorf("read of %d bytes requested, maximum of %d supported", len(r), maxrsize)}
 	}
 
+	nsi.pace(true)
+	bp.stats.Commands++
+	bp.stats.Transactions++
+	defer func() { bp.lasttx = time.Now() }()
+
 	// prepend device and register address
 	wbuf := make([]byte, 0, len(w)+2)
 	wbuf = append(wbuf, uint8(addr.GetBaseAddr())<<1) // write addr
@@ -306,7 +348,7 @@ func (nsi NonStrictI2C) Transact8x8(addr i2cm.Addr, regaddr uint8, w []byte, r [
 	err = nsi.writeThenRead(wbuf, nil)
 	if err != nil {
 		// actually, we don't know anything about the number of bytes written
-		return 0, 0, err
+		return 0, 0, &OpError{"i2c.Transact8x8", MODE_I2C, addr, err}
 	}
 
 	if len(r) > 0 {
@@ -316,7 +358,7 @@ func (nsi NonStrictI2C) Transact8x8(addr i2cm.Addr, regaddr uint8, w []byte, r [
 		// the read part of the transaction
 		err = nsi.writeThenRead(wbuf, r)
 		if err != nil {
-			return 0, 0, err
+			return 0, 0, &OpError{"i2c.Transact8x8", MODE_I2C, addr, err}
 		}
 	}
 
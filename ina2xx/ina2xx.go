@@ -0,0 +1,218 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package ina2xx drives the INA219 and INA226 current shunt and power
+// monitors over the I2C mode of package bp, to log the power drawn by
+// the device under test through the tool driving it.
+//
+// The monitors measure the voltage across a shunt resistor and the bus
+// voltage. To compute current and power, they need a calibration for the
+// shunt resistor, set with Calibrate.
+package ina2xx
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/distributed/bp"
+)
+
+// BaseAddr is the address of the monitors with A0 and A1 tied to
+// ground.
+const BaseAddr = 0x40
+
+// Registers.
+const (
+	regConfig      = 0x00
+	regShunt       = 0x01
+	regBus         = 0x02
+	regPower       = 0x03
+	regCurrent     = 0x04
+	regCalibration = 0x05
+)
+
+const configReset = 0x8000
+
+// ErrNotCalibrated is returned when current or power are read before
+// Calibrate was called.
+var ErrNotCalibrated = errors.New("not calibrated")
+
+// chip are the properties that differ between the INA219 and the INA226.
+type chip struct {
+	name     string
+	shuntLSB float64 // V
+	busLSB   float64 // V
+	busShift uint    // of the bus voltage in its register
+	powerLSB float64 // in current LSBs
+	calScale float64 // internal constant of the calibration formula
+	maxCal   float64
+	calMask  uint16 // of the bits of the calibration register used
+}
+
+var (
+	ina219 = chip{
+		name:     "ina219",
+		shuntLSB: 10e-6,
+		busLSB:   4e-3,
+		busShift: 3,
+		powerLSB: 20,
+		calScale: 0.04096,
+		maxCal:   0xfffe,
+		calMask:  0xfffe,
+	}
+	ina226 = chip{
+		name:     "ina226",
+		shuntLSB: 2.5e-6,
+		busLSB:   1.25e-3,
+		powerLSB: 25,
+		calScale: 0.00512,
+		maxCal:   0x7fff,
+		calMask:  0x7fff,
+	}
+)
+
+// Measurement is a measurement of a monitor.
+type Measurement struct {
+	Bus     float64 // bus voltage in V
+	Shunt   float64 // shunt voltage in V
+	Current float64 // A
+	Power   float64 // W
+}
+
+func (m Measurement) String() string {
+	return fmt.Sprintf("%.3f V, %.6f A, %.6f W", m.Bus, m.Current, m.Power)
+}
+
+// Dev is an INA219 or INA226.
+type Dev struct {
+	t    bp.I2CTransactor8x8
+	addr bp.Addr7
+	c    *chip
+
+	currentLSB float64 // A, 0 if not calibrated
+}
+
+// New219 returns the INA219 at the 7 bit address addr.
+func New219(t bp.I2CTransactor8x8, addr uint8) *Dev {
+	return &Dev{t: t, addr: bp.Addr7(addr), c: &ina219}
+}
+
+// New226 returns the INA226 at the 7 bit address addr.
+func New226(t bp.I2CTransactor8x8, addr uint8) *Dev {
+	return &Dev{t: t, addr: bp.Addr7(addr), c: &ina226}
+}
+
+func (d *Dev) writeReg(op string, reg uint8, v uint16) error {
+	if _, _, err := d.t.Transact8x8(d.addr, reg, []byte{byte(v >> 8), byte(v)}, nil); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+func (d *Dev) readReg(op string, reg uint8) (uint16, error) {
+	r := make([]byte, 2)
+	if _, _, err := d.t.Transact8x8(d.addr, reg, nil, r); err != nil {
+		return 0, d.err(op, err)
+	}
+	return uint16(r[0])<<8 | uint16(r[1]), nil
+}
+
+// Reset resets the monitor to its power on configuration, which clears
+// the calibration.
+func (d *Dev) Reset() error {
+	if err := d.writeReg("reset", regConfig, configReset); err != nil {
+		return err
+	}
+	d.currentLSB = 0
+	return nil
+}
+
+// Calibrate calibrates the monitor for a shunt of rshunt ohms and
+// currents up to maxCurrent amperes. The resolution of the current is
+// maxCurrent/32768.
+func (d *Dev) Calibrate(rshunt, maxCurrent float64) error {
+	if rshunt <= 0 || maxCurrent <= 0 {
+		return d.err("calibrate", fmt.Errorf("invalid shunt %g Ω or current %g A", rshunt, maxCurrent))
+	}
+	lsb := maxCurrent / 32768
+	cal := d.c.calScale / (lsb * rshunt)
+	if cal < 1 || cal > d.c.maxCal {
+		return d.err("calibrate", fmt.Errorf("calibration %.0f for %g Ω and %g A out of range", cal, rshunt, maxCurrent))
+	}
+	v := uint16(cal) & d.c.calMask
+	if err := d.writeReg("calibrate", regCalibration, v); err != nil {
+		return err
+	}
+	d.currentLSB = lsb
+	return nil
+}
+
+// ShuntVoltage returns the voltage across the shunt.
+func (d *Dev) ShuntVoltage() (float64, error) {
+	v, err := d.readReg("read shunt voltage", regShunt)
+	if err != nil {
+		return 0, err
+	}
+	return float64(int16(v)) * d.c.shuntLSB, nil
+}
+
+// BusVoltage returns the bus voltage.
+func (d *Dev) BusVoltage() (float64, error) {
+	v, err := d.readReg("read bus voltage", regBus)
+	if err != nil {
+		return 0, err
+	}
+	return float64(v>>d.c.busShift) * d.c.busLSB, nil
+}
+
+// Current returns the current through the shunt. The monitor has to be
+// calibrated.
+func (d *Dev) Current() (float64, error) {
+	if d.currentLSB == 0 {
+		return 0, d.err("read current", ErrNotCalibrated)
+	}
+	v, err := d.readReg("read current", regCurrent)
+	if err != nil {
+		return 0, err
+	}
+	return float64(int16(v)) * d.currentLSB, nil
+}
+
+// Power returns the power drawn from the bus. The monitor has to be
+// calibrated.
+func (d *Dev) Power() (float64, error) {
+	if d.currentLSB == 0 {
+		return 0, d.err("read power", ErrNotCalibrated)
+	}
+	v, err := d.readReg("read power", regPower)
+	if err != nil {
+		return 0, err
+	}
+	return float64(v) * d.c.powerLSB * d.currentLSB, nil
+}
+
+// Read returns all values of the monitor, which has to be calibrated.
+func (d *Dev) Read() (Measurement, error) {
+	var (
+		m   Measurement
+		err error
+	)
+	if m.Bus, err = d.BusVoltage(); err != nil {
+		return Measurement{}, err
+	}
+	if m.Shunt, err = d.ShuntVoltage(); err != nil {
+		return Measurement{}, err
+	}
+	if m.Current, err = d.Current(); err != nil {
+		return Measurement{}, err
+	}
+	if m.Power, err = d.Power(); err != nil {
+		return Measurement{}, err
+	}
+	return m, nil
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("%s %v: %s: %w", d.c.name, d.addr, op, err)
+}
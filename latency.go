@@ -0,0 +1,125 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"sort"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of a
+// LatencyHistogram. A byte takes about 90µs at 115200 baud, a USB round
+// trip a millisecond or more.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	200 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+}
+
+// LatencyHistogram summarizes the durations of an operation.
+type LatencyHistogram struct {
+	Count    uint64
+	Total    time.Duration
+	Min, Max time.Duration
+
+	// Buckets[i] counts the durations up to LatencyBuckets[i] and above
+	// the previous bound, the extra last element those above all bounds.
+	Buckets []uint64
+}
+
+// Add records the duration d.
+func (h *LatencyHistogram) Add(d time.Duration) {
+	if h.Buckets == nil {
+		h.Buckets = make([]uint64, len(LatencyBuckets)+1)
+	}
+	if h.Count == 0 || d < h.Min {
+		h.Min = d
+	}
+	if d > h.Max {
+		h.Max = d
+	}
+	h.Count++
+	h.Total += d
+	h.Buckets[sort.Search(len(LatencyBuckets), func(i int) bool { return LatencyBuckets[i] >= d })]++
+}
+
+// Mean returns the average duration, 0 if there is none.
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+// Quantile returns an upper bound for the q quantile of the durations,
+// like 0.99, which is the bound of the bucket holding it, or Max if that
+// is less.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	want := uint64(q*float64(h.Count) + 0.5)
+	if want < 1 {
+		want = 1
+	}
+	var n uint64
+	for i, c := range h.Buckets {
+		n += c
+		if n < want {
+			continue
+		}
+		if i < len(LatencyBuckets) && LatencyBuckets[i] < h.Max {
+			return LatencyBuckets[i]
+		}
+		break
+	}
+	return h.Max
+}
+
+// Latencies returns histograms of the durations of the operations done
+// since bp was created or ResetLatencies was called, keyed by operation
+// like "i2c.WriteByte". Durations include retries. "i2c.Transaction" is
+// the time from a start condition to the following stop condition when
+// transactions are built from primitives.
+func (bp *BusPirate) Latencies() map[string]LatencyHistogram {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	m := make(map[string]LatencyHistogram, len(bp.latencies))
+	for op, h := range bp.latencies {
+		c := *h
+		c.Buckets = append([]uint64(nil), h.Buckets...)
+		m[op] = c
+	}
+	return m
+}
+
+// ResetLatencies forgets the durations recorded so far, for example to
+// compare settings.
+func (bp *BusPirate) ResetLatencies() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.latencies = nil
+}
+
+// SetLatencyFunc makes bp call fn with the duration of every operation it
+// records for Latencies. fn is called with the lock of bp held, it must
+// return quickly and must not call methods of bp or of its mode handles.
+// Passing nil turns the calls off.
+func (bp *BusPirate) SetLatencyFunc(fn func(op string, d time.Duration)) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.latencyfn = fn
+}
@@ -0,0 +1,218 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package lm75 drives the LM75 temperature sensor and the compatible
+// TMP75, DS75 and TMP102 over the I2C mode of package bp, in strict I2C
+// through bp.I2CTx or with a bp.NonStrictI2C.
+//
+// The sensors share their registers: temperature, configuration and the
+// two thresholds of the alert output, OS on the LM75. They differ in
+// resolution and in the width of the configuration register, the
+// Variant passed to New tells.
+package lm75
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/distributed/bp"
+)
+
+// BaseAddr is the address of the sensors with their address pins tied to
+// ground.
+const BaseAddr = 0x48
+
+// Registers.
+const (
+	regTemp   = 0x00
+	regConfig = 0x01
+	regTLow   = 0x02 // THYST on the LM75
+	regTHigh  = 0x03 // TOS on the LM75
+)
+
+// Bits of the first byte of the configuration register.
+const (
+	cfgShutdown   = 0x01
+	cfgInterrupt  = 0x02
+	cfgActiveHigh = 0x04
+	cfgFaults     = 0x18
+	cfgResolution = 0x60 // TMP75 and DS75
+)
+
+// Variant is a member of the family.
+type Variant int
+
+const (
+	// LM75 has a fixed resolution of 9 bits, 0.5 °C.
+	LM75 Variant = iota
+	// TMP75 is the TMP75, TMP275, DS75 and LM75A, with a resolution of
+	// 9 to 12 bits.
+	TMP75
+	// TMP102 has a fixed resolution of 12 bits, 0.0625 °C, and a two
+	// byte configuration register.
+	TMP102
+)
+
+func (v Variant) String() string {
+	switch v {
+	case LM75:
+		return "lm75"
+	case TMP75:
+		return "tmp75"
+	case TMP102:
+		return "tmp102"
+	}
+	return fmt.Sprintf("Variant(%d)", int(v))
+}
+
+// AlertConfig configures the alert output.
+type AlertConfig struct {
+	// Interrupt makes the output signal crossings of the thresholds
+	// until the sensor is read, instead of comparing with them.
+	Interrupt bool
+	// ActiveHigh makes the output active high instead of active low.
+	ActiveHigh bool
+	// Faults is the number of consecutive measurements beyond a
+	// threshold that trigger the output, 1, 2, 4 or 6. 0 means 1.
+	Faults int
+}
+
+// Dev is a sensor of the family.
+type Dev struct {
+	rw   bp.RegReadWriter
+	addr bp.Addr7
+	v    Variant
+}
+
+// New returns the sensor of variant v at the 7 bit address addr.
+func New(rw bp.RegReadWriter, addr uint8, v Variant) *Dev {
+	return &Dev{rw: rw, addr: bp.Addr7(addr), v: v}
+}
+
+func (d *Dev) read(op string, reg uint8, r []byte) error {
+	if err := d.rw.ReadReg(d.addr, reg, r); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+func (d *Dev) write(op string, reg uint8, w []byte) error {
+	if err := d.rw.WriteReg(d.addr, reg, w...); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+// readTemp reads a temperature register. The registers hold a two's
+// complement value in 1/256 °C, the bits below the resolution read 0.
+func (d *Dev) readTemp(op string, reg uint8) (float64, error) {
+	v, err := bp.ReadReg[uint16](d.rw, d.addr, reg, binary.BigEndian)
+	if err != nil {
+		return 0, d.err(op, err)
+	}
+	return float64(int16(v)) / 256, nil
+}
+
+func (d *Dev) writeTemp(op string, reg uint8, t float64) error {
+	if t < -128 || t >= 128 {
+		return d.err(op, fmt.Errorf("temperature %g °C out of range", t))
+	}
+	v := uint16(int16(math.Round(t * 256)))
+	if err := bp.WriteReg(d.rw, d.addr, reg, v, binary.BigEndian); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+// Temperature returns the temperature in °C.
+func (d *Dev) Temperature() (float64, error) {
+	return d.readTemp("read temperature", regTemp)
+}
+
+// config changes the first byte of the configuration register: it clears
+// the bits of mask and sets those of set.
+func (d *Dev) config(op string, mask, set byte) error {
+	b := make([]byte, 1)
+	if d.v == TMP102 {
+		b = make([]byte, 2)
+	}
+	if err := d.read(op, regConfig, b); err != nil {
+		return err
+	}
+	b[0] = b[0]&^mask | set
+	return d.write(op, regConfig, b)
+}
+
+// SetResolution sets the resolution to bits, 9 to 12 on the TMP75. The
+// LM75 only has 9 bits and the TMP102 12, setting those is a no-op.
+func (d *Dev) SetResolution(bits int) error {
+	switch {
+	case d.v == LM75 && bits == 9, d.v == TMP102 && bits == 12:
+		return nil
+	case d.v == TMP75 && bits >= 9 && bits <= 12:
+		return d.config("set resolution", cfgResolution, byte(bits-9)<<5)
+	}
+	return d.err("set resolution", fmt.Errorf("%d bits not supported by the %v", bits, d.v))
+}
+
+// SetShutdown puts the sensor into shutdown, where it doesn't measure, or
+// wakes it up.
+func (d *Dev) SetShutdown(on bool) error {
+	var set byte
+	if on {
+		set = cfgShutdown
+	}
+	return d.config("set shutdown", cfgShutdown, set)
+}
+
+// SetAlert sets the thresholds of the alert output in °C. The output
+// becomes active above high and inactive again below low, the hysteresis.
+func (d *Dev) SetAlert(low, high float64) error {
+	if low > high {
+		return d.err("set alert", fmt.Errorf("low threshold %g °C above high threshold %g °C", low, high))
+	}
+	if err := d.writeTemp("set alert", regTLow, low); err != nil {
+		return err
+	}
+	return d.writeTemp("set alert", regTHigh, high)
+}
+
+// Alert returns the thresholds of the alert output in °C.
+func (d *Dev) Alert() (low, high float64, err error) {
+	if low, err = d.readTemp("read alert", regTLow); err != nil {
+		return 0, 0, err
+	}
+	if high, err = d.readTemp("read alert", regTHigh); err != nil {
+		return 0, 0, err
+	}
+	return low, high, nil
+}
+
+// SetAlertConfig configures the alert output.
+func (d *Dev) SetAlertConfig(c AlertConfig) error {
+	var set byte
+	if c.Interrupt {
+		set |= cfgInterrupt
+	}
+	if c.ActiveHigh {
+		set |= cfgActiveHigh
+	}
+	switch c.Faults {
+	case 0, 1:
+	case 2:
+		set |= 1 << 3
+	case 4:
+		set |= 2 << 3
+	case 6:
+		set |= 3 << 3
+	default:
+		return d.err("set alert config", fmt.Errorf("invalid number of faults %d", c.Faults))
+	}
+	return d.config("set alert config", cfgInterrupt|cfgActiveHigh|cfgFaults, set)
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("%v %v: %s: %w", d.v, d.addr, op, err)
+}
@@ -0,0 +1,28 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrDeviceBusy is returned by OpenPath and OpenFirst if another process
+// holds the serial port. On Unix, processes using this package take an
+// advisory lock with flock, which other programs can take as well, for
+// example with flock(1). On Windows, serial ports can only be opened by
+// one process at a time anyway.
+var ErrDeviceBusy = errors.New("serial port is in use by another process")
+
+// lockPort takes the advisory lock on the serial port at path and returns
+// the function releasing it. If the lock is held elsewhere, the error is
+// an *os.PathError wrapping ErrDeviceBusy.
+func lockPort(path string) (func(), error) {
+	release, err := lockFile(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "lock", Path: path, Err: err}
+	}
+	return release, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package bp
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile flocks the device at path through a descriptor of its own,
+// which is kept open until the lock is released. O_NONBLOCK keeps the
+// open from waiting for carrier detect.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrDeviceBusy
+		}
+		return nil, err
+	}
+
+	return func() { f.Close() }, nil
+}
+
+// openBusy reports whether err from opening a serial port means that
+// another process has it open, which the lock already told.
+func openBusy(err error) bool {
+	return false
+}
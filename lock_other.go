@@ -0,0 +1,18 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly && !windows
+
+package bp
+
+// lockFile does nothing on systems without flock.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
+
+// openBusy reports whether err from opening a serial port means that
+// another process has it open, which the lock already told.
+func openBusy(err error) bool {
+	return false
+}
@@ -0,0 +1,23 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// lockFile does nothing, Windows opens serial ports exclusively. A port
+// in use fails to open with an access denied error instead, see
+// openBusy.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
+
+// openBusy reports whether err from opening a serial port means that
+// another process has it open.
+func openBusy(err error) bool {
+	return errors.Is(err, syscall.ERROR_ACCESS_DENIED)
+}
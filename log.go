@@ -0,0 +1,100 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+)
+
+// Logger receives diagnostic messages from a BusPirate. *log.Logger from
+// the standard library satisfies this interface.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LogLevel is the verbosity of diagnostic messages. A message is logged
+// if its level is at most the level configured for its subsystem.
+type LogLevel int
+
+const (
+	LogError LogLevel = iota
+	LogInfo
+	LogDebug
+	LogTrace
+)
+
+var levelstrings = map[LogLevel]string{
+	LogError: "error",
+	LogInfo:  "info",
+	LogDebug: "debug",
+	LogTrace: "trace",
+}
+
+func (l LogLevel) String() string {
+	if s, ok := levelstrings[l]; ok {
+		return s
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Subsystem names a part of the package for the purpose of log level
+// configuration.
+type Subsystem string
+
+const (
+	SubsysOpen    Subsystem = "open" // opening and closing the connection
+	SubsysI2C     Subsystem = "i2c"
+	SubsysSniffer Subsystem = "sniffer"
+)
+
+// SetLogger makes bp send its diagnostic messages to l. By default, and
+// after passing nil, messages are discarded. Unless configured otherwise
+// with SetLogLevel, messages up to LogInfo are logged.
+func (bp *BusPirate) SetLogger(l Logger) {
+	bp.logmu.Lock()
+	defer bp.logmu.Unlock()
+	bp.log = l
+}
+
+// SetLogLevel sets the verbosity for subsystem sub. The empty subsystem
+// sets the level for all subsystems without a level of their own.
+func (bp *BusPirate) SetLogLevel(sub Subsystem, level LogLevel) {
+	bp.logmu.Lock()
+	defer bp.logmu.Unlock()
+
+	if sub == "" {
+		bp.loglevel = level
+		return
+	}
+	if bp.sublevels == nil {
+		bp.sublevels = make(map[Subsystem]LogLevel)
+	}
+	bp.sublevels[sub] = level
+}
+
+// logger returns the logger to use for a message of the given subsystem
+// and level, nil if the message is to be discarded.
+func (bp *BusPirate) logger(sub Subsystem, level LogLevel) Logger {
+	bp.logmu.Lock()
+	defer bp.logmu.Unlock()
+
+	if bp.log == nil {
+		return nil
+	}
+	max, ok := bp.sublevels[sub]
+	if !ok {
+		max = bp.loglevel
+	}
+	if level > max {
+		return nil
+	}
+	return bp.log
+}
+
+func (bp *BusPirate) logf(sub Subsystem, level LogLevel, format string, v ...interface{}) {
+	if l := bp.logger(sub, level); l != nil {
+		l.Printf(string(sub)+": "+format, v...)
+	}
+}
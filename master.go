@@ -0,0 +1,87 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+)
+
+// Addr is the address of an I2C slave. Its method set is the one of
+// i2cm.Addr, so addresses from package i2cm can be used directly.
+type Addr interface {
+	// GetAddrLen returns the length of the address in bits, 7 or 10.
+	GetAddrLen() uint
+	// GetBaseAddr returns the address without the direction bit.
+	GetBaseAddr() uint16
+}
+
+// Addr7 is a 7 bit I2C address.
+type Addr7 uint8
+
+func (a Addr7) GetAddrLen() uint    { return 7 }
+func (a Addr7) GetBaseAddr() uint16 { return uint16(a) }
+
+func (a Addr7) String() string {
+	return fmt.Sprintf("%#02x", uint8(a))
+}
+
+// I2CMaster is a byte level I2C bus master, implemented by BusPirateI2C.
+// It is i2cm.I2CMaster with ReadByte named ReadByteAck, as a ReadByte
+// with an argument is mistaken for a broken io.ByteReader. NACKs are
+// reported with errors matching ErrNACK. Package bpi2cm adds the ReadByte
+// of i2cm.
+type I2CMaster interface {
+	Start() error
+	Stop() error
+	ReadByteAck(ack bool) (byte, error)
+	WriteByte(b byte) error
+}
+
+// I2CTransactor8x8 does complete transactions with devices using 8 bit
+// register addresses, implemented by NonStrictI2C.
+type I2CTransactor8x8 interface {
+	Transact8x8(addr Addr, regaddr uint8, w []byte, r []byte) (nw, nr int, err error)
+}
+
+// RegReadWriter reads and writes the registers of slaves using 8 bit
+// register addresses, implemented by I2CTx for strict I2C and by
+// NonStrictI2C. It is what ReadReg and WriteReg take.
+type RegReadWriter interface {
+	ReadReg(addr Addr, reg uint8, r []byte) error
+	WriteReg(addr Addr, reg uint8, w ...byte) error
+}
+
+// SPIMaster is a full duplex SPI bus master with the chip select of one
+// device, implemented by BusPirateSPI. It is the bus of all SPI device
+// drivers of this module.
+type SPIMaster interface {
+	// Select drives the chip select of the device, low if active.
+	Select(active bool) error
+	// Exchange clocks out w while clocking in as many bytes into r,
+	// unless r is nil, leaving the chip select as it is.
+	Exchange(w, r []byte) error
+}
+
+// SPITransfer selects the device on s, exchanges w and r like
+// SPIMaster.Exchange and deselects the device, also if the exchange
+// fails.
+func SPITransfer(s SPIMaster, w, r []byte) (err error) {
+	if err := s.Select(true); err != nil {
+		return err
+	}
+	defer func() {
+		if derr := s.Select(false); err == nil {
+			err = derr
+		}
+	}()
+	return s.Exchange(w, r)
+}
+
+var (
+	_ I2CMaster        = BusPirateI2C{}
+	_ I2CTransactor8x8 = NonStrictI2C{}
+	_ RegReadWriter    = NonStrictI2C{}
+	_ RegReadWriter    = I2CTx{}
+)
@@ -0,0 +1,211 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package max7219 drives MAX7219 and MAX7221 LED display drivers over an
+// SPI bus, 8 digit 7 segment displays or 8x8 LED matrices.
+//
+// The drivers can be cascaded, DOUT of one to DIN of the next, sharing
+// the chip select. A Dev is the whole chain: every write clocks a 16 bit
+// word through every chip, no-ops for those that aren't addressed. Chip 0
+// is the one on the bus master, further down the chain are higher
+// numbers.
+//
+// On a bus pirate, pass the bp.BusPirateSPI of SPI mode, with CS wired to
+// LOAD. The chips latch on the rising edge of LOAD, which Select gives
+// once a write has been clocked through the chain. Their inputs want 3.5
+// V for a high at 5 V, so run them through a level shifter or pull them
+// up to 5 V with the open drain outputs the firmware starts with.
+package max7219
+
+import (
+	"fmt"
+
+	"github.com/distributed/bp"
+)
+
+// Registers.
+const (
+	regNoOp        = 0x00
+	regDigit0      = 0x01 // to 0x08 for digit 7
+	regDecodeMode  = 0x09
+	regIntensity   = 0x0a
+	regScanLimit   = 0x0b
+	regShutdown    = 0x0c
+	regDisplayTest = 0x0f
+)
+
+// Digits is the number of digits, or matrix rows, per chip.
+const Digits = 8
+
+// Code B values of digits decoded by the chip, besides 0 to 9.
+const (
+	CodeMinus = 0x0a
+	CodeE     = 0x0b
+	CodeH     = 0x0c
+	CodeL     = 0x0d
+	CodeP     = 0x0e
+	CodeBlank = 0x0f
+
+	// DP lights the decimal point, in decoded and raw digits.
+	DP = 0x80
+)
+
+// Dev is a chain of MAX7219s.
+type Dev struct {
+	s      bp.SPIMaster
+	n      int
+	decode byte // last written decode mode
+}
+
+// New returns the chain of n chips on s.
+func New(s bp.SPIMaster, n int) *Dev {
+	return &Dev{s: s, n: n}
+}
+
+// Len returns the number of chips in the chain.
+func (d *Dev) Len() int {
+	return d.n
+}
+
+// write writes v to reg of the chips for which set returns true, the others
+// get no-ops.
+func (d *Dev) write(op string, reg byte, set func(chip int) (byte, bool)) error {
+	buf := make([]byte, 2*d.n)
+	for chip := 0; chip < d.n; chip++ {
+		// the first word clocked out ends up in the last chip
+		i := 2 * (d.n - 1 - chip)
+		if v, ok := set(chip); ok {
+			buf[i], buf[i+1] = reg, v
+		} else {
+			buf[i], buf[i+1] = regNoOp, 0
+		}
+	}
+	if err := bp.SPITransfer(d.s, buf, nil); err != nil {
+		return fmt.Errorf("max7219: %s: %w", op, err)
+	}
+	return nil
+}
+
+// writeAll writes v to reg of all chips.
+func (d *Dev) writeAll(op string, reg, v byte) error {
+	return d.write(op, reg, func(int) (byte, bool) { return v, true })
+}
+
+func (d *Dev) checkChip(op string, chip int) error {
+	if chip < 0 || chip >= d.n {
+		return fmt.Errorf("max7219: %s: no chip %d in a chain of %d", op, chip, d.n)
+	}
+	return nil
+}
+
+// Init leaves display test and shutdown and sets all chips to scan all
+// digits undecoded at intensity, 0 to 15, with the display cleared.
+func (d *Dev) Init(intensity int) error {
+	if err := d.SetTest(false); err != nil {
+		return err
+	}
+	if err := d.SetScanLimit(Digits); err != nil {
+		return err
+	}
+	if err := d.SetDecode(0); err != nil {
+		return err
+	}
+	if err := d.SetIntensity(intensity); err != nil {
+		return err
+	}
+	if err := d.Clear(); err != nil {
+		return err
+	}
+	return d.SetShutdown(false)
+}
+
+// SetShutdown blanks the displays of all chips, which keep their data, or
+// lights them again.
+func (d *Dev) SetShutdown(on bool) error {
+	var v byte = 1
+	if on {
+		v = 0
+	}
+	return d.writeAll("set shutdown", regShutdown, v)
+}
+
+// SetTest lights all segments of all chips, or returns to normal
+// operation.
+func (d *Dev) SetTest(on bool) error {
+	var v byte
+	if on {
+		v = 1
+	}
+	return d.writeAll("set test", regDisplayTest, v)
+}
+
+// SetScanLimit makes all chips scan digits 0 to n-1, n 1 to 8. Fewer
+// digits are brighter, the chips must be set to the number of digits
+// connected.
+func (d *Dev) SetScanLimit(n int) error {
+	if n < 1 || n > Digits {
+		return fmt.Errorf("max7219: set scan limit: invalid number of digits %d", n)
+	}
+	return d.writeAll("set scan limit", regScanLimit, byte(n-1))
+}
+
+// SetIntensity sets the brightness of all chips, 0 to 15.
+func (d *Dev) SetIntensity(v int) error {
+	if v < 0 || v > 15 {
+		return fmt.Errorf("max7219: set intensity: invalid intensity %d", v)
+	}
+	return d.writeAll("set intensity", regIntensity, byte(v))
+}
+
+// SetDecode makes the chips decode the digits whose bits are set in mask
+// as Code B, digit 0 in bit 0. The other digits are raw segments, bit 0
+// segment G to bit 6 segment A, or matrix columns.
+func (d *Dev) SetDecode(mask byte) error {
+	if err := d.writeAll("set decode", regDecodeMode, mask); err != nil {
+		return err
+	}
+	d.decode = mask
+	return nil
+}
+
+// SetDigit sets digit, 0 to 7, of chip to v, Code B or raw segments
+// depending on the decode mode.
+func (d *Dev) SetDigit(chip, digit int, v byte) error {
+	if err := d.checkChip("set digit", chip); err != nil {
+		return err
+	}
+	if digit < 0 || digit >= Digits {
+		return fmt.Errorf("max7219: set digit: no digit %d", digit)
+	}
+	return d.write("set digit", regDigit0+byte(digit), func(c int) (byte, bool) {
+		return v, c == chip
+	})
+}
+
+// SetDigits sets the same digit of all chips at once, v[i] for chip i.
+func (d *Dev) SetDigits(digit int, v []byte) error {
+	if digit < 0 || digit >= Digits {
+		return fmt.Errorf("max7219: set digits: no digit %d", digit)
+	}
+	if len(v) != d.n {
+		return fmt.Errorf("max7219: set digits: %d values for %d chips", len(v), d.n)
+	}
+	return d.write("set digits", regDigit0+byte(digit), func(c int) (byte, bool) {
+		return v[c], true
+	})
+}
+
+// Clear blanks all digits of all chips, in the decode mode last set.
+func (d *Dev) Clear() error {
+	for digit := 0; digit < Digits; digit++ {
+		var v byte
+		if d.decode&(1<<uint(digit)) != 0 {
+			v = CodeBlank
+		}
+		if err := d.writeAll("clear", regDigit0+byte(digit), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package mcp230xx drives the MCP23017 16 bit and MCP23008 8 bit I/O
+// expanders over the I2C mode of package bp.
+//
+// The pins are grouped into ports of 8, port A and B on the MCP23017,
+// a single port on the MCP23008. Direction, pull-ups and outputs are set
+// a port at a time or, through Pin, a pin at a time. Dev keeps copies of
+// the direction, pull-up and output latch registers to change single
+// pins, so it has to be the only one writing them, and the expander has
+// to be in its power on state, with IOCON.BANK clear, when New17 or New08
+// is called.
+package mcp230xx
+
+import (
+	"fmt"
+
+	"github.com/distributed/bp"
+)
+
+// BaseAddr is the address of the expanders with the address pins tied
+// low. The pins add 0 to 7 to it.
+const BaseAddr = 0x20
+
+// Registers of the MCP23008. On the MCP23017 with IOCON.BANK clear, the
+// register of port A is at twice the address, that of port B follows
+// it.
+const (
+	IODIR   = 0x00
+	IPOL    = 0x01
+	GPINTEN = 0x02
+	DEFVAL  = 0x03
+	INTCON  = 0x04
+	IOCON   = 0x05
+	GPPU    = 0x06
+	INTF    = 0x07
+	INTCAP  = 0x08
+	GPIO    = 0x09
+	OLAT    = 0x0a
+)
+
+// Ports of the MCP23017.
+const (
+	PortA = 0
+	PortB = 1
+)
+
+// Dev is an MCP23017 or MCP23008.
+type Dev struct {
+	t     bp.I2CTransactor8x8
+	addr  bp.Addr7
+	ports int
+
+	// copies of the registers, by port
+	iodir [2]byte
+	gppu  [2]byte
+	olat  [2]byte
+}
+
+// New17 returns the MCP23017 at the 7 bit address addr.
+func New17(t bp.I2CTransactor8x8, addr uint8) *Dev {
+	return newDev(t, addr, 2)
+}
+
+// New08 returns the MCP23008 at the 7 bit address addr.
+func New08(t bp.I2CTransactor8x8, addr uint8) *Dev {
+	return newDev(t, addr, 1)
+}
+
+func newDev(t bp.I2CTransactor8x8, addr uint8, ports int) *Dev {
+	return &Dev{
+		t:     t,
+		addr:  bp.Addr7(addr),
+		ports: ports,
+		iodir: [2]byte{0xff, 0xff},
+	}
+}
+
+// Ports returns the number of ports, 2 for the MCP23017, 1 for the
+// MCP23008.
+func (d *Dev) Ports() int {
+	return d.ports
+}
+
+// reg returns the address of the register r of port.
+func (d *Dev) reg(r uint8, port int) uint8 {
+	if d.ports == 1 {
+		return r
+	}
+	return r*2 + uint8(port)
+}
+
+func (d *Dev) checkPort(op string, port int) error {
+	if port < 0 || port >= d.ports {
+		return d.err(op, fmt.Errorf("no port %d", port))
+	}
+	return nil
+}
+
+func (d *Dev) write(op string, r uint8, port int, v byte) error {
+	if _, _, err := d.t.Transact8x8(d.addr, d.reg(r, port), []byte{v}, nil); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+// SetDirection sets the direction of the pins of port, a set bit makes
+// the pin an input.
+func (d *Dev) SetDirection(port int, inputs byte) error {
+	if err := d.checkPort("set direction", port); err != nil {
+		return err
+	}
+	if err := d.write("set direction", IODIR, port, inputs); err != nil {
+		return err
+	}
+	d.iodir[port] = inputs
+	return nil
+}
+
+// SetPullups turns the 100k pull-ups of the pins of port on, where the
+// bit is set, or off.
+func (d *Dev) SetPullups(port int, on byte) error {
+	if err := d.checkPort("set pull-ups", port); err != nil {
+		return err
+	}
+	if err := d.write("set pull-ups", GPPU, port, on); err != nil {
+		return err
+	}
+	d.gppu[port] = on
+	return nil
+}
+
+// WritePort sets the output latch of port to v. Only the pins that are
+// outputs are driven.
+func (d *Dev) WritePort(port int, v byte) error {
+	if err := d.checkPort("write", port); err != nil {
+		return err
+	}
+	if err := d.write("write", OLAT, port, v); err != nil {
+		return err
+	}
+	d.olat[port] = v
+	return nil
+}
+
+// ReadPort returns the levels of the pins of port, pin 0 in bit 0.
+func (d *Dev) ReadPort(port int) (byte, error) {
+	if err := d.checkPort("read", port); err != nil {
+		return 0, err
+	}
+	r := make([]byte, 1)
+	if _, _, err := d.t.Transact8x8(d.addr, d.reg(GPIO, port), nil, r); err != nil {
+		return 0, d.err("read", err)
+	}
+	return r[0], nil
+}
+
+// Pin returns pin n, 0 to 7 for port A, 8 to 15 for port B.
+func (d *Dev) Pin(n int) (*Pin, error) {
+	if n < 0 || n >= d.ports*8 {
+		return nil, d.err("pin", fmt.Errorf("no pin %d", n))
+	}
+	return &Pin{d: d, port: n / 8, mask: 1 << uint(n%8)}, nil
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("mcp230xx %v: %s: %w", d.addr, op, err)
+}
+
+// Pin is a pin of an expander. It implements bp.Pin.
+type Pin struct {
+	d    *Dev
+	port int
+	mask byte
+}
+
+var _ bp.Pin = (*Pin)(nil)
+
+// Out makes the pin an output driving level. The latch is set before the
+// direction, so the pin doesn't glitch to its old level.
+func (p *Pin) Out(level bool) error {
+	d := p.d
+	olat := d.olat[p.port] &^ p.mask
+	if level {
+		olat |= p.mask
+	}
+	if olat != d.olat[p.port] {
+		if err := d.WritePort(p.port, olat); err != nil {
+			return err
+		}
+	}
+	if d.iodir[p.port]&p.mask != 0 {
+		return d.SetDirection(p.port, d.iodir[p.port]&^p.mask)
+	}
+	return nil
+}
+
+// In makes the pin an input and reads its level.
+func (p *Pin) In() (bool, error) {
+	d := p.d
+	if d.iodir[p.port]&p.mask == 0 {
+		if err := d.SetDirection(p.port, d.iodir[p.port]|p.mask); err != nil {
+			return false, err
+		}
+	}
+	v, err := d.ReadPort(p.port)
+	if err != nil {
+		return false, err
+	}
+	return v&p.mask != 0, nil
+}
+
+// SetPullup turns the pull-up of the pin on or off.
+func (p *Pin) SetPullup(on bool) error {
+	d := p.d
+	gppu := d.gppu[p.port] &^ p.mask
+	if on {
+		gppu |= p.mask
+	}
+	return d.SetPullups(p.port, gppu)
+}
@@ -0,0 +1,99 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package mcp3008 drives the MCP3004 and MCP3008 10 bit analog to digital
+// converters over an SPI bus, with 4 and 8 inputs.
+//
+// The converters convert while they clock out the result, one full
+// duplex transfer of three bytes per conversion. An Input selects a
+// single ended input, measured against ground, or a pair of inputs
+// measured against each other.
+//
+// On a bus pirate, pass the bp.BusPirateSPI of SPI mode, with CS wired
+// to the chip select of the converter. SPI mode 0, which the firmware
+// starts with, suits it. The converters are specified up to 1.35 MHz at
+// 2.7 V, so stay at bp.SPI1MHz or below.
+package mcp3008
+
+import (
+	"fmt"
+
+	"github.com/distributed/bp"
+)
+
+// Max is the largest result of a conversion, a voltage just below VRef.
+const Max = 1<<10 - 1
+
+// Input is an input of a conversion. Single ended, Ch is measured against
+// ground. Differential, Ch is measured against its partner in the pairs
+// 0 and 1, 2 and 3 and so on, Ch being the positive side.
+type Input struct {
+	Ch   int
+	Diff bool
+}
+
+func (in Input) String() string {
+	if in.Diff {
+		return fmt.Sprintf("CH%d-CH%d", in.Ch, in.Ch^1)
+	}
+	return fmt.Sprintf("CH%d", in.Ch)
+}
+
+// Dev is an MCP3004 or MCP3008.
+type Dev struct {
+	s    bp.SPIMaster
+	name string
+	n    int
+
+	// VRef is the reference voltage of the converter in V. A result
+	// is 1024 * voltage / VRef.
+	VRef float64
+}
+
+// DefaultVRef is the VRef of a new Dev, the 3.3 V supply of the bus
+// pirate.
+const DefaultVRef = 3.3
+
+// New3008 returns the MCP3008 on s.
+func New3008(s bp.SPIMaster) *Dev {
+	return &Dev{s: s, name: "mcp3008", n: 8, VRef: DefaultVRef}
+}
+
+// New3004 returns the MCP3004 on s.
+func New3004(s bp.SPIMaster) *Dev {
+	return &Dev{s: s, name: "mcp3004", n: 4, VRef: DefaultVRef}
+}
+
+// ReadRaw does a conversion of in and returns the result, 0 to Max.
+// Differential conversions of a negative voltage read 0.
+func (d *Dev) ReadRaw(in Input) (uint16, error) {
+	if in.Ch < 0 || in.Ch >= d.n {
+		return 0, d.err("read", fmt.Errorf("no input %v", in))
+	}
+	// a start bit, then SGL/DIFF and D2 to D0. The converter samples
+	// during the next clock and clocks out a null bit and the result,
+	// most significant bit first.
+	ctl := byte(in.Ch) << 4
+	if !in.Diff {
+		ctl |= 0x80
+	}
+	b := []byte{0x01, ctl, 0x00}
+	if err := bp.SPITransfer(d.s, b, b); err != nil {
+		return 0, d.err("read "+in.String(), err)
+	}
+	return uint16(b[1]&0x03)<<8 | uint16(b[2]), nil
+}
+
+// Read does a conversion of in and returns the voltage in V.
+func (d *Dev) Read(in Input) (float64, error) {
+	v, err := d.ReadRaw(in)
+	if err != nil {
+		return 0, err
+	}
+	return float64(v) * d.VRef / (Max + 1), nil
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("%s: %s: %w", d.name, op, err)
+}
@@ -0,0 +1,63 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package memdev
+
+import (
+	"fmt"
+
+	"github.com/distributed/bp"
+)
+
+// reservedID is the reserved I2C address for reading the device ID of a
+// slave, without the direction bit.
+const reservedID = 0x7c
+
+// ManufacturerFujitsu is the manufacturer ID of the MB85RC FRAMs.
+const ManufacturerFujitsu = 0x00a
+
+// DeviceID is the device ID of an I2C FRAM.
+type DeviceID struct {
+	Manufacturer uint16 // 12 bits
+	Product      uint16 // 12 bits, the density in the upper 4
+}
+
+func (id DeviceID) String() string {
+	return fmt.Sprintf("manufacturer %#03x product %#03x", id.Manufacturer, id.Product)
+}
+
+// Size returns the capacity the density of the product ID stands for.
+func (id DeviceID) Size() int {
+	return 1024 << (id.Product >> 8)
+}
+
+// Geometry returns the geometry of a FRAM of the capacity of id.
+func (id DeviceID) Geometry() Geometry {
+	g := Geometry{Size: id.Size(), AddrLen: 2}
+	if g.Size <= 2048 {
+		g.AddrLen = 1
+	}
+	return g
+}
+
+// ReadFRAMID reads the device ID of the FRAM at the 7 bit address addr
+// through the reserved device ID address. Not all FRAMs have one, the
+// MB85RC04 and MB85RC16 don't, they don't acknowledge the read.
+func ReadFRAMID(inf bp.BusPirateI2C, addr uint8) (DeviceID, error) {
+	id := make([]byte, 3)
+	pl := inf.Pipeline()
+	pl.Start()
+	pl.Write(reservedID<<1, addr<<1)
+	pl.Start()
+	pl.Write(reservedID<<1 | 1)
+	pl.Read(id, false)
+	pl.Stop()
+	if err := pl.Flush(); err != nil {
+		return DeviceID{}, fmt.Errorf("memdev %v: read device ID: %w", bp.Addr7(addr), err)
+	}
+	return DeviceID{
+		Manufacturer: uint16(id[0])<<4 | uint16(id[1])>>4,
+		Product:      uint16(id[1]&0x0f)<<8 | uint16(id[2]),
+	}, nil
+}
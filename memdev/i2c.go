@@ -0,0 +1,96 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package memdev
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// i2cBus is the Bus of an I2C memory, like a 24Cxx EEPROM.
+type i2cBus struct {
+	nsi  bp.NonStrictI2C
+	addr uint8
+	g    Geometry
+}
+
+// NewI2C returns the memory with geometry g at the 7 bit address addr.
+// Reads use ReadMem, writes wait for the part by polling its address
+// until it is acknowledged.
+func NewI2C(nsi bp.NonStrictI2C, addr uint8, g Geometry) *Dev {
+	return New(&i2cBus{nsi: nsi, addr: addr, g: g}, g)
+}
+
+// split returns the device address and the memory address of off, and
+// the bytes left in the block of memory of that device address.
+func (b *i2cBus) split(off int) (bp.Addr7, int, int) {
+	block := 1 << (8 * uint(b.g.AddrLen))
+	return bp.Addr7(b.addr | uint8(off/block)), off % block, block - off%block
+}
+
+func (b *i2cBus) Read(off int, p []byte) error {
+	for len(p) > 0 {
+		addr, moff, rest := b.split(off)
+		n := len(p)
+		if n > rest {
+			n = rest
+		}
+		if _, err := b.nsi.ReadMem(addr, uint(moff), b.g.AddrLen, p[:n], nil); err != nil {
+			return err
+		}
+		off += n
+		p = p[n:]
+	}
+	return nil
+}
+
+// WritePage writes p, which may span blocks of memory of different device
+// addresses if the part has no pages, like a FRAM.
+func (b *i2cBus) WritePage(off int, p []byte) error {
+	pl := b.nsi.Pipeline()
+	for o, rest := off, p; len(rest) > 0; {
+		addr, moff, left := b.split(o)
+		n := len(rest)
+		if n > left {
+			n = left
+		}
+		pl.Start()
+		pl.Write(uint8(addr) << 1)
+		pl.Write(addrBytes(moff, b.g.AddrLen)...)
+		pl.Write(rest[:n]...)
+		pl.Stop()
+		o += n
+		rest = rest[n:]
+	}
+	if err := pl.Flush(); err != nil {
+		return fmt.Errorf("memdev %v: write page at %#x: %w", bp.Addr7(b.addr), off, err)
+	}
+	return nil
+}
+
+// WaitReady polls the part, which doesn't acknowledge its address while
+// it is writing.
+func (b *i2cBus) WaitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		pl := b.nsi.Pipeline()
+		pl.Start()
+		pl.Write(b.addr << 1)
+		pl.Stop()
+		err := pl.Flush()
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, bp.ErrNACK) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("memdev %v: %w", bp.Addr7(b.addr), ErrBusy)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package memdev reads and writes serial memories, like EEPROMs and FRAMs,
+// over the buses of package bp. Tools are written once against Dev, which
+// is an io.ReaderAt and io.WriterAt, instead of once per chip.
+//
+// A Geometry describes a part: its capacity, the page size writes must
+// not cross, the length of the memory address and the time a write takes.
+// A Bus carries the reads and page writes to the part, NewI2C and NewSPI
+// return a Dev on the I2C and SPI backends of this package. The SPI
+// backend takes a bp.SPIMaster, on a bus pirate the bp.BusPirateSPI of
+// SPI mode with CS wired to the chip select of the part. Dev splits
+// writes into pages and waits for each to be done before the next. FRAMs
+// have neither pages nor write cycles, their writes go out in one piece.
+package memdev
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Geometry describes a serial memory.
+type Geometry struct {
+	Size     int // capacity in bytes
+	PageSize int // writes must not cross a page boundary, 0 for no limit
+
+	// AddrLen is the number of bytes of the memory address sent to the
+	// part. I2C parts with more memory than that address, like the
+	// 24C04 to 24C16, take the upper address bits in the low bits of
+	// their device address.
+	AddrLen int
+
+	// WriteCycle is the time the part takes at most to finish a write,
+	// during which it doesn't accept commands. 0 if writes are done
+	// right away.
+	WriteCycle time.Duration
+}
+
+// Geometries of common parts.
+var (
+	EEPROM24C01  = Geometry{128, 8, 1, 5 * time.Millisecond}
+	EEPROM24C02  = Geometry{256, 8, 1, 5 * time.Millisecond}
+	EEPROM24C04  = Geometry{512, 16, 1, 5 * time.Millisecond}
+	EEPROM24C08  = Geometry{1024, 16, 1, 5 * time.Millisecond}
+	EEPROM24C16  = Geometry{2048, 16, 1, 5 * time.Millisecond}
+	EEPROM24C32  = Geometry{4096, 32, 2, 5 * time.Millisecond}
+	EEPROM24C64  = Geometry{8192, 32, 2, 5 * time.Millisecond}
+	EEPROM24C128 = Geometry{16384, 64, 2, 5 * time.Millisecond}
+	EEPROM24C256 = Geometry{32768, 64, 2, 5 * time.Millisecond}
+	EEPROM24C512 = Geometry{65536, 128, 2, 5 * time.Millisecond}
+
+	// The 25AA parts have the geometries of the 25LC parts.
+	EEPROM25LC010A = Geometry{128, 16, 1, 5 * time.Millisecond}
+	EEPROM25LC020A = Geometry{256, 16, 1, 5 * time.Millisecond}
+	EEPROM25LC040  = Geometry{512, 16, 1, 5 * time.Millisecond}
+	EEPROM25LC640  = Geometry{8192, 32, 2, 5 * time.Millisecond}
+	EEPROM25LC128  = Geometry{16384, 64, 2, 5 * time.Millisecond}
+	EEPROM25LC256  = Geometry{32768, 64, 2, 5 * time.Millisecond}
+	EEPROM25LC512  = Geometry{65536, 128, 2, 5 * time.Millisecond}
+	EEPROM25LC1024 = Geometry{131072, 256, 3, 6 * time.Millisecond}
+
+	FRAMMB85RC04  = Geometry{512, 0, 1, 0}
+	FRAMMB85RC16  = Geometry{2048, 0, 1, 0}
+	FRAMMB85RC64  = Geometry{8192, 0, 2, 0}
+	FRAMMB85RC128 = Geometry{16384, 0, 2, 0}
+	FRAMMB85RC256 = Geometry{32768, 0, 2, 0}
+	FRAMMB85RC512 = Geometry{65536, 0, 2, 0}
+	FRAMMB85RC1M  = Geometry{131072, 0, 2, 0}
+)
+
+// Parts are the geometries above by part name, for command line tools.
+var Parts = map[string]Geometry{
+	"24c01":     EEPROM24C01,
+	"24c02":     EEPROM24C02,
+	"24c04":     EEPROM24C04,
+	"24c08":     EEPROM24C08,
+	"24c16":     EEPROM24C16,
+	"24c32":     EEPROM24C32,
+	"24c64":     EEPROM24C64,
+	"24c128":    EEPROM24C128,
+	"24c256":    EEPROM24C256,
+	"24c512":    EEPROM24C512,
+	"25lc010a":  EEPROM25LC010A,
+	"25lc020a":  EEPROM25LC020A,
+	"25lc040":   EEPROM25LC040,
+	"25lc640":   EEPROM25LC640,
+	"25lc128":   EEPROM25LC128,
+	"25lc256":   EEPROM25LC256,
+	"25lc512":   EEPROM25LC512,
+	"25lc1024":  EEPROM25LC1024,
+	"mb85rc04":  FRAMMB85RC04,
+	"mb85rc16":  FRAMMB85RC16,
+	"mb85rc64":  FRAMMB85RC64,
+	"mb85rc128": FRAMMB85RC128,
+	"mb85rc256": FRAMMB85RC256,
+	"mb85rc512": FRAMMB85RC512,
+	"mb85rc1m":  FRAMMB85RC1M,
+}
+
+// readyMargin is added to the write cycle time when waiting for a write
+// to be done, for the round trips of polling the part.
+const readyMargin = 50 * time.Millisecond
+
+// ErrBusy is returned by Bus.WaitReady if the part is still busy when the
+// time is up.
+var ErrBusy = errors.New("memory busy")
+
+// Bus carries the accesses of a Dev to the part.
+type Bus interface {
+	// Read reads len(p) bytes from off on. The range is within the
+	// part.
+	Read(off int, p []byte) error
+	// WritePage writes p to off. The range is within a page, if the
+	// part has pages.
+	WritePage(off int, p []byte) error
+	// WaitReady waits up to timeout for the part to finish a write and
+	// returns ErrBusy if it doesn't.
+	WaitReady(timeout time.Duration) error
+}
+
+// Dev is a serial memory.
+type Dev struct {
+	bus Bus
+	g   Geometry
+}
+
+// New returns the memory with geometry g on bus.
+func New(bus Bus, g Geometry) *Dev {
+	return &Dev{bus: bus, g: g}
+}
+
+// Geometry returns the geometry of the memory.
+func (d *Dev) Geometry() Geometry {
+	return d.g
+}
+
+// Size returns the capacity of the memory in bytes.
+func (d *Dev) Size() int64 {
+	return int64(d.g.Size)
+}
+
+// ReadAt reads len(p) bytes from off on. Like any io.ReaderAt, it returns
+// io.EOF if the read goes beyond the end of the memory.
+func (d *Dev) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("memdev: invalid offset %d", off)
+	}
+	if off >= d.Size() {
+		return 0, io.EOF
+	}
+	var eof error
+	if rest := d.Size() - off; int64(len(p)) > rest {
+		p, eof = p[:rest], io.EOF
+	}
+	if len(p) == 0 {
+		return 0, eof
+	}
+	if err := d.bus.Read(int(off), p); err != nil {
+		return 0, err
+	}
+	return len(p), eof
+}
+
+// WriteAt writes p from off on, page by page, waiting for each page to be
+// written before the next. Writes beyond the end of the memory are an
+// error, nothing is written then.
+func (d *Dev) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > d.Size() {
+		return 0, fmt.Errorf("memdev: write of %d bytes at %#x beyond the %d bytes of memory", len(p), off, d.g.Size)
+	}
+
+	n := 0
+	for n < len(p) {
+		o := int(off) + n
+		size := len(p) - n
+		if d.g.PageSize > 0 {
+			if rest := d.g.PageSize - o%d.g.PageSize; size > rest {
+				size = rest
+			}
+		}
+		if err := d.bus.WritePage(o, p[n:n+size]); err != nil {
+			return n, err
+		}
+		if d.g.WriteCycle > 0 {
+			if err := d.bus.WaitReady(d.g.WriteCycle + readyMargin); err != nil {
+				return n, err
+			}
+		}
+		n += size
+	}
+	return n, nil
+}
+
+// addrBytes returns the memory address off in alen bytes, most
+// significant byte first.
+func addrBytes(off, alen int) []byte {
+	b := make([]byte, alen)
+	for i := range b {
+		b[i] = byte(off >> (8 * uint(alen-1-i)))
+	}
+	return b
+}
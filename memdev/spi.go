@@ -0,0 +1,169 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package memdev
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp"
+	"github.com/distributed/bp/wire"
+)
+
+// writeThenRead selects the memory on s, writes w, then reads len(r)
+// bytes into r and deselects the memory.
+func writeThenRead(s bp.SPIMaster, w, r []byte) (err error) {
+	if err := s.Select(true); err != nil {
+		return err
+	}
+	defer func() {
+		if derr := s.Select(false); err == nil {
+			err = derr
+		}
+	}()
+	if err := s.Exchange(w, nil); err != nil {
+		return err
+	}
+	if len(r) == 0 {
+		return nil
+	}
+	for i := range r {
+		r[i] = 0xff
+	}
+	return s.Exchange(r, r)
+}
+
+// Commands of the 25xx EEPROMs and most SPI memories.
+const (
+	spiWREN  = 0x06
+	spiRDSR  = 0x05
+	spiWRSR  = 0x01
+	spiREAD  = 0x03
+	spiWRITE = 0x02
+
+	// spiA8 is the ninth address bit in the READ and WRITE commands of
+	// the 25xx040, which take one address byte.
+	spiA8 = 0x08
+)
+
+// Bits of the status register of the 25xx EEPROMs.
+const (
+	StatusWIP  = 0x01 // write in progress
+	StatusWEL  = 0x02 // write enable latch
+	StatusBP0  = 0x04 // block protection
+	StatusBP1  = 0x08
+	StatusWPEN = 0x80 // WP pin enable, not on the 25xx010A to 25xx040
+)
+
+// ErrWriteProtected is returned when an SPI memory doesn't set its write
+// enable latch, with its WP pin held low.
+var ErrWriteProtected = errors.New("memory write protected")
+
+// spiBus is the Bus of an SPI memory, like a 25xx EEPROM.
+type spiBus struct {
+	s bp.SPIMaster
+	g Geometry
+}
+
+// NewSPI returns the memory with geometry g on s. It speaks the command
+// set of the 25xx EEPROMs and FRAMs, which write without erasing. NOR
+// flash parts, which must be erased before writing, share the commands
+// but are not memdev parts.
+func NewSPI(s bp.SPIMaster, g Geometry) *Dev {
+	return New(&spiBus{s: s, g: g}, g)
+}
+
+// command returns the command c with the memory address off. Address bits
+// beyond AddrLen bytes go into the command, like A8 of the 25xx040.
+func (b *spiBus) command(c byte, off int) []byte {
+	if off>>(8*uint(b.g.AddrLen))&1 != 0 {
+		c |= spiA8
+	}
+	return append([]byte{c}, addrBytes(off, b.g.AddrLen)...)
+}
+
+func (b *spiBus) Read(off int, p []byte) error {
+	for len(p) > 0 {
+		n := len(p)
+		if n > wire.MaxWriteThenRead {
+			n = wire.MaxWriteThenRead
+		}
+		if err := writeThenRead(b.s, b.command(spiREAD, off), p[:n]); err != nil {
+			return fmt.Errorf("memdev: read at %#x: %w", off, err)
+		}
+		off += n
+		p = p[n:]
+	}
+	return nil
+}
+
+func (b *spiBus) WritePage(off int, p []byte) error {
+	if err := b.writeEnable(); err != nil {
+		return err
+	}
+	if err := writeThenRead(b.s, append(b.command(spiWRITE, off), p...), nil); err != nil {
+		return fmt.Errorf("memdev: write page at %#x: %w", off, err)
+	}
+	return nil
+}
+
+// writeEnable sets the write enable latch, which the part clears after
+// every write, and checks that it is set.
+func (b *spiBus) writeEnable() error {
+	if err := writeThenRead(b.s, []byte{spiWREN}, nil); err != nil {
+		return fmt.Errorf("memdev: write enable: %w", err)
+	}
+	st, err := SPIStatus(b.s)
+	if err != nil {
+		return err
+	}
+	if st&StatusWEL == 0 {
+		return fmt.Errorf("memdev: write enable: %w", ErrWriteProtected)
+	}
+	return nil
+}
+
+// WaitReady polls the write in progress bit of the status register.
+func (b *spiBus) WaitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		st, err := SPIStatus(b.s)
+		if err != nil {
+			return err
+		}
+		if st&StatusWIP == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("memdev: %w", ErrBusy)
+		}
+	}
+}
+
+// SPIStatus reads the status register of the SPI memory on s, see the
+// Status constants.
+func SPIStatus(s bp.SPIMaster) (byte, error) {
+	st := make([]byte, 1)
+	if err := writeThenRead(s, []byte{spiRDSR}, st); err != nil {
+		return 0, fmt.Errorf("memdev: read status: %w", err)
+	}
+	return st[0], nil
+}
+
+// SetSPIStatus writes the status register of the SPI memory on s, whose
+// writable bits are the block protection bits and WPEN, and waits up to
+// timeout for the write to be done. The write is refused while WPEN is set
+// and the WP pin is low.
+func SetSPIStatus(s bp.SPIMaster, st byte, timeout time.Duration) error {
+	b := &spiBus{s: s}
+	if err := b.writeEnable(); err != nil {
+		return err
+	}
+	if err := writeThenRead(s, []byte{spiWRSR, st}, nil); err != nil {
+		return fmt.Errorf("memdev: write status: %w", err)
+	}
+	return b.WaitReady(timeout)
+}
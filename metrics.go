@@ -0,0 +1,141 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"expvar"
+	"time"
+)
+
+// Names of the counters fed to a MetricsSink. They correspond to the
+// fields of Stats.
+const (
+	MetricBytesWritten = "bytes_written"
+	MetricBytesRead    = "bytes_read"
+	MetricCommands     = "commands"
+	MetricTransactions = "transactions"
+	MetricNACKs        = "nacks"
+	MetricRetries      = "retries"
+	MetricResyncs      = "resyncs"
+	MetricReconnects   = "reconnects"
+	MetricErrors       = "errors"
+)
+
+// CounterNames lists the names of all counters fed to a MetricsSink.
+var CounterNames = []string{
+	MetricBytesWritten, MetricBytesRead, MetricCommands, MetricTransactions,
+	MetricNACKs, MetricRetries, MetricResyncs, MetricReconnects, MetricErrors,
+}
+
+// MetricsSink receives the counters and timings of a BusPirate. Package
+// prom has an implementation for Prometheus, NewExpvarMetrics one for
+// expvar.
+type MetricsSink interface {
+	// Count adds delta to the counter name, one of CounterNames.
+	Count(name string, delta uint64)
+	// Observe records that the operation op, like "i2c.Start", took d,
+	// including retries.
+	Observe(op string, d time.Duration)
+}
+
+// SetMetrics makes bp feed its counters and timings to m. The counters
+// are fed after every operation with their increase since the last
+// feeding, starting from the values at the time of the call. Sniffer
+// traffic is fed with the next operation. Passing nil turns feeding off.
+func (bp *BusPirate) SetMetrics(m MetricsSink) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	bp.metrics = m
+	bp.fed = bp.currentStats()
+}
+
+// currentStats returns the counters. The caller has to hold the lock.
+func (bp *BusPirate) currentStats() Stats {
+	st := bp.stats
+	st.BytesWritten, st.BytesRead = bp.link.counts()
+	return st
+}
+
+// feedMetrics feeds the increase of the counters since the last call to
+// the metrics sink. The caller has to hold the lock.
+func (bp *BusPirate) feedMetrics() {
+	if bp.metrics == nil {
+		return
+	}
+
+	st := bp.currentStats()
+	prev := bp.fed
+	bp.fed = st
+
+	for _, c := range []struct {
+		name      string
+		now, prev uint64
+	}{
+		{MetricBytesWritten, st.BytesWritten, prev.BytesWritten},
+		{MetricBytesRead, st.BytesRead, prev.BytesRead},
+		{MetricCommands, st.Commands, prev.Commands},
+		{MetricTransactions, st.Transactions, prev.Transactions},
+		{MetricNACKs, st.NACKs, prev.NACKs},
+		{MetricRetries, st.Retries, prev.Retries},
+		{MetricResyncs, st.Resyncs, prev.Resyncs},
+		{MetricReconnects, st.Reconnects, prev.Reconnects},
+		{MetricErrors, st.Errors, prev.Errors},
+	} {
+		if c.now > c.prev {
+			bp.metrics.Count(c.name, c.now-c.prev)
+		}
+	}
+}
+
+// observe records the duration of op, which started at start, for
+// Latencies and feeds it to the metrics sink. The caller has to hold the
+// lock.
+func (bp *BusPirate) observe(op string, start time.Time) {
+	d := time.Since(start)
+
+	if bp.latencies == nil {
+		bp.latencies = make(map[string]*LatencyHistogram)
+	}
+	h := bp.latencies[op]
+	if h == nil {
+		h = &LatencyHistogram{}
+		bp.latencies[op] = h
+	}
+	h.Add(d)
+
+	if bp.latencyfn != nil {
+		bp.latencyfn(op, d)
+	}
+	if bp.metrics != nil {
+		bp.metrics.Observe(op, d)
+	}
+}
+
+// ExpvarMetrics is a MetricsSink publishing to an expvar.Map. The map
+// holds the counters under their names and, for every operation op, the
+// number of times it was done under "op.count" and their total duration
+// in nanoseconds under "op.ns".
+type ExpvarMetrics struct {
+	m *expvar.Map
+}
+
+// NewExpvarMetrics publishes a new map under name and returns a
+// MetricsSink feeding it. Like expvar.Publish, it panics if name is
+// already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	return &ExpvarMetrics{expvar.NewMap(name)}
+}
+
+// Count implements MetricsSink.
+func (em *ExpvarMetrics) Count(name string, delta uint64) {
+	em.m.Add(name, int64(delta))
+}
+
+// Observe implements MetricsSink.
+func (em *ExpvarMetrics) Observe(op string, d time.Duration) {
+	em.m.Add(op+".count", 1)
+	em.m.Add(op+".ns", int64(d))
+}
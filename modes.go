@@ -5,12 +5,15 @@
 package bp
 
 import (
-	"errors"
 	"fmt"
+	"time"
 )
 
+// Mode is a mode of the bus pirate.
+type Mode int
+
 const (
-	MODE_CLOSED = iota
+	MODE_CLOSED Mode = iota
 	MODE_UNKNOWN
 	MODE_BITBANG
 	MODE_SPI
@@ -18,16 +21,47 @@ const (
 	MODE_UART
 	MODE_1WIRE
 	MODE_RAW
+	MODE_I2C_SNIFF
 )
 
-var modestrings = map[int]string{MODE_CLOSED: "closed",
-	MODE_UNKNOWN: "unknown",
-	MODE_BITBANG: "bitbang",
-	MODE_SPI:     "SPI",
-	MODE_I2C:     "I2C",
-	MODE_UART:    "UART",
-	MODE_1WIRE:   "1Wire",
-	MODE_RAW:     "raw",
+func (m Mode) String() string {
+	switch m {
+	case MODE_CLOSED:
+		return "closed"
+	case MODE_UNKNOWN:
+		return "unknown"
+	case MODE_BITBANG:
+		return "bitbang"
+	case MODE_SPI:
+		return "SPI"
+	case MODE_I2C:
+		return "I2C"
+	case MODE_UART:
+		return "UART"
+	case MODE_1WIRE:
+		return "1Wire"
+	case MODE_RAW:
+		return "raw"
+	case MODE_I2C_SNIFF:
+		return "I2C sniffer"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// IsOpen reports whether the connection is open and the mode known.
+func (m Mode) IsOpen() bool {
+	return m != MODE_CLOSED && m != MODE_UNKNOWN
+}
+
+// IsProtocolMode reports whether m is one of the bus protocol modes
+// entered from bitbang mode, like I2C. The I2C sniffer counts as part of
+// I2C mode.
+func (m Mode) IsProtocolMode() bool {
+	switch m {
+	case MODE_SPI, MODE_I2C, MODE_UART, MODE_1WIRE, MODE_RAW, MODE_I2C_SNIFF:
+		return true
+	}
+	return false
 }
 
 // ModeError is returned when the device is not in a suitable mode for
@@ -38,41 +72,52 @@ func (me ModeError) Error() string {
 	return string(me)
 }
 
+// ErrStaleHandle is returned when a mode handle is used after the bus
+// pirate changed modes since the handle was obtained.
+var ErrStaleHandle = ModeError("mode handle is stale, the bus pirate changed modes since it was obtained")
+
+// setMode records a change of mode. Every change starts a new generation,
+// mode handles from earlier generations become stale.
+func (bp *BusPirate) setMode(mode Mode, version int) {
+	prev := bp.mode
+	bp.mode = mode
+	bp.modeversion = version
+	bp.gen++
+	bp.txstart = time.Time{}
+	bp.wpending = nil
+	bp.deferred = nil
+	bp.modeChanged(prev)
+}
+
+// modeChanged sends EventModeChange if the mode differs from prev and
+// updates the session tracking.
+func (bp *BusPirate) modeChanged(prev Mode) {
+	if bp.mode != prev {
+		bp.trackSession()
+		bp.emit(Event{Kind: EventModeChange, Mode: bp.mode, Prev: prev})
+	}
+}
+
 func (bp *BusPirate) clearMode() {
-	bp.mode = MODE_UNKNOWN
-	bp.modeversion = 0
+	bp.setMode(MODE_UNKNOWN, 0)
 }
 
 // GetMode returns the active mode and the mode's version.
-func (bp *BusPirate) GetMode() (int, int) {
+func (bp *BusPirate) GetMode() (Mode, int) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
 	return bp.mode, bp.modeversion
 }
 
-func (bp *BusPirate) expectMode(mode int) error {
+func (bp *BusPirate) expectMode(mode Mode) error {
 	if bp.mode == MODE_CLOSED {
-		return errors.New("BusPirate: connection not open")
+		return ErrNotOpen
 	} else if bp.mode == MODE_UNKNOWN {
-		return errors.New("BusPirate: mode not known (did you forget to check for a communication error?)")
+		return ModeError("mode not known (did you forget to check for a communication error?)")
 	}
 
 	if mode != bp.mode {
-		expname, expok := modestrings[mode]
-		actname, actok := modestrings[bp.mode]
-		var expstring, actstring string
-
-		if expok {
-			expstring = expname + " mode"
-		} else {
-			expstring = fmt.Sprintf("mode %d", bp.mode)
-		}
-
-		if actok {
-			actstring = actname + " mode"
-		} else {
-			actstring = fmt.Sprintf("mode %d", bp.mode)
-		}
-
-		return fmt.Errorf("BusPirate: need to be in %s, currently in %s", expstring, actstring)
+		return ModeError(fmt.Sprintf("need to be in %v mode, currently in %v mode", mode, bp.mode))
 	}
 	return nil
 }
@@ -0,0 +1,298 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package mpu6050 drives the MPU6050 accelerometer and gyroscope over the
+// I2C mode of package bp.
+//
+// The sensor sleeps after power on, Wake starts it. Read returns the
+// latest sample, scaled to the ranges set: acceleration in g, angular
+// rate in degrees per second and temperature in °C. For sampling at a
+// steady rate, EnableFIFO makes the sensor queue samples at the sample
+// rate, DrainFIFO fetches and scales them.
+package mpu6050
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/distributed/bp"
+)
+
+// Addresses of the sensor, with AD0 tied low or high.
+const (
+	Addr    = 0x68
+	AddrAlt = 0x69
+)
+
+// Registers.
+const (
+	regSmplrtDiv   = 0x19
+	regConfig      = 0x1a
+	regGyroConfig  = 0x1b
+	regAccelConfig = 0x1c
+	regFIFOEn      = 0x23
+	regIntStatus   = 0x3a
+	regAccelXOutH  = 0x3b
+	regUserCtrl    = 0x6a
+	regPwrMgmt1    = 0x6b
+	regFIFOCountH  = 0x72
+	regFIFORW      = 0x74
+	regWhoAmI      = 0x75
+)
+
+const (
+	whoAmI = 0x68
+
+	pwrSleep  = 0x40
+	clkPLLX   = 0x01 // PLL with the X gyro as reference, steadier than the internal oscillator
+	intFIFOOv = 0x10
+
+	userFIFOEn    = 0x40
+	userFIFOReset = 0x04
+
+	// the size of the FIFO in bytes
+	fifoSize = 1024
+)
+
+// ErrFIFOOverflow is returned by DrainFIFO if the FIFO overflowed and
+// samples were lost. The FIFO is reset.
+var ErrFIFOOverflow = errors.New("FIFO overflow")
+
+// AccelRange is the full scale range of the accelerometer.
+type AccelRange byte
+
+const (
+	Accel2G AccelRange = iota
+	Accel4G
+	Accel8G
+	Accel16G
+)
+
+// GyroRange is the full scale range of the gyroscope.
+type GyroRange byte
+
+const (
+	Gyro250 GyroRange = iota // ±250 °/s
+	Gyro500
+	Gyro1000
+	Gyro2000
+)
+
+// FIFOSource selects the values queued in the FIFO.
+type FIFOSource byte
+
+const (
+	FIFOTemp  FIFOSource = 0x80
+	FIFOGyro  FIFOSource = 0x70 // all three axes
+	FIFOAccel FIFOSource = 0x08
+)
+
+// Sample is a sample of the sensor.
+type Sample struct {
+	Accel [3]float64 // x, y, z in g
+	Temp  float64    // °C
+	Gyro  [3]float64 // x, y, z in °/s
+}
+
+// Dev is an MPU6050.
+type Dev struct {
+	t    bp.I2CTransactor8x8
+	addr bp.Addr7
+
+	accel AccelRange
+	gyro  GyroRange
+	fifo  FIFOSource
+}
+
+// New returns the sensor at the 7 bit address addr. It checks the
+// WHO_AM_I register. The ranges are assumed to be the power on ones,
+// Accel2G and Gyro250.
+func New(t bp.I2CTransactor8x8, addr uint8) (*Dev, error) {
+	d := &Dev{t: t, addr: bp.Addr7(addr)}
+	id := make([]byte, 1)
+	if err := d.read("read WHO_AM_I", regWhoAmI, id); err != nil {
+		return nil, err
+	}
+	if id[0]&0x7e != whoAmI {
+		return nil, d.err("read WHO_AM_I", fmt.Errorf("unexpected %#02x", id[0]))
+	}
+	return d, nil
+}
+
+func (d *Dev) read(op string, reg uint8, r []byte) error {
+	if _, _, err := d.t.Transact8x8(d.addr, reg, nil, r); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+func (d *Dev) write(op string, reg uint8, v byte) error {
+	if _, _, err := d.t.Transact8x8(d.addr, reg, []byte{v}, nil); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+// Wake wakes the sensor up, clocked by its PLL.
+func (d *Dev) Wake() error {
+	return d.write("wake", regPwrMgmt1, clkPLLX)
+}
+
+// Sleep puts the sensor to sleep.
+func (d *Dev) Sleep() error {
+	return d.write("sleep", regPwrMgmt1, pwrSleep|clkPLLX)
+}
+
+// SetAccelRange sets the full scale range of the accelerometer.
+func (d *Dev) SetAccelRange(r AccelRange) error {
+	if r > Accel16G {
+		return d.err("set accel range", fmt.Errorf("invalid range %d", r))
+	}
+	if err := d.write("set accel range", regAccelConfig, byte(r)<<3); err != nil {
+		return err
+	}
+	d.accel = r
+	return nil
+}
+
+// SetGyroRange sets the full scale range of the gyroscope.
+func (d *Dev) SetGyroRange(r GyroRange) error {
+	if r > Gyro2000 {
+		return d.err("set gyro range", fmt.Errorf("invalid range %d", r))
+	}
+	if err := d.write("set gyro range", regGyroConfig, byte(r)<<3); err != nil {
+		return err
+	}
+	d.gyro = r
+	return nil
+}
+
+// SetSampleRate sets the low pass filter setting dlpf, 0 to 6, and the
+// sample rate divider div. The sample rate is 8 kHz with dlpf 0 and
+// 1 kHz otherwise, divided by 1+div.
+func (d *Dev) SetSampleRate(dlpf, div byte) error {
+	if dlpf > 6 {
+		return d.err("set sample rate", fmt.Errorf("invalid filter setting %d", dlpf))
+	}
+	if err := d.write("set sample rate", regConfig, dlpf); err != nil {
+		return err
+	}
+	return d.write("set sample rate", regSmplrtDiv, div)
+}
+
+// Read returns the latest sample.
+func (d *Dev) Read() (Sample, error) {
+	b := make([]byte, 14)
+	if err := d.read("read", regAccelXOutH, b); err != nil {
+		return Sample{}, err
+	}
+	var s Sample
+	d.scale(&s, b, FIFOAccel|FIFOTemp|FIFOGyro)
+	return s, nil
+}
+
+// scale fills s from the raw big endian values in b, which holds the
+// values of src in register order.
+func (d *Dev) scale(s *Sample, b []byte, src FIFOSource) {
+	word := func() float64 {
+		v := int16(uint16(b[0])<<8 | uint16(b[1]))
+		b = b[2:]
+		return float64(v)
+	}
+	if src&FIFOAccel != 0 {
+		lsb := float64(int(16384) >> uint(d.accel))
+		for i := range s.Accel {
+			s.Accel[i] = word() / lsb
+		}
+	}
+	if src&FIFOTemp != 0 {
+		s.Temp = word()/340 + 36.53
+	}
+	// 131 LSB per °/s at ±250 °/s, halved with every doubling of the range
+	lsb := 131 / float64(int(1)<<uint(d.gyro))
+	for i, bit := range []FIFOSource{0x40, 0x20, 0x10} {
+		if src&bit != 0 {
+			s.Gyro[i] = word() / lsb
+		}
+	}
+}
+
+// frameSize returns the bytes a sample of src takes in the FIFO.
+func frameSize(src FIFOSource) int {
+	n := 0
+	if src&FIFOAccel != 0 {
+		n += 6
+	}
+	for _, bit := range []FIFOSource{FIFOTemp, 0x40, 0x20, 0x10} {
+		if src&bit != 0 {
+			n += 2
+		}
+	}
+	return n
+}
+
+// EnableFIFO resets the FIFO and makes the sensor queue the values of src
+// at the sample rate, or stops the FIFO if src is 0.
+func (d *Dev) EnableFIFO(src FIFOSource) error {
+	if err := d.write("enable FIFO", regUserCtrl, userFIFOReset); err != nil {
+		return err
+	}
+	if err := d.write("enable FIFO", regFIFOEn, byte(src)); err != nil {
+		return err
+	}
+	d.fifo = src
+	if src == 0 {
+		return nil
+	}
+	return d.write("enable FIFO", regUserCtrl, userFIFOEn)
+}
+
+// DrainFIFO reads the complete samples queued in the FIFO. If the FIFO
+// overflowed, it is reset and DrainFIFO returns ErrFIFOOverflow.
+func (d *Dev) DrainFIFO() ([]Sample, error) {
+	if d.fifo == 0 {
+		return nil, d.err("drain FIFO", errors.New("FIFO not enabled"))
+	}
+
+	st := make([]byte, 1)
+	if err := d.read("drain FIFO", regIntStatus, st); err != nil {
+		return nil, err
+	}
+	if st[0]&intFIFOOv != 0 {
+		if err := d.EnableFIFO(d.fifo); err != nil {
+			return nil, err
+		}
+		return nil, d.err("drain FIFO", ErrFIFOOverflow)
+	}
+
+	cnt := make([]byte, 2)
+	if err := d.read("drain FIFO", regFIFOCountH, cnt); err != nil {
+		return nil, err
+	}
+	n := int(cnt[0])<<8 | int(cnt[1])
+	if n > fifoSize {
+		n = fifoSize
+	}
+	fs := frameSize(d.fifo)
+	n -= n % fs
+	if n == 0 {
+		return nil, nil
+	}
+
+	// reads of FIFO_R_W don't advance the register address, every byte
+	// read pops one off the FIFO
+	b := make([]byte, n)
+	if err := d.read("drain FIFO", regFIFORW, b); err != nil {
+		return nil, err
+	}
+	samples := make([]Sample, n/fs)
+	for i := range samples {
+		d.scale(&samples[i], b[i*fs:], d.fifo)
+	}
+	return samples, nil
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("mpu6050 %v: %s: %w", d.addr, op, err)
+}
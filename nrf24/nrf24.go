@@ -0,0 +1,586 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package nrf24 drives the nRF24L01 and nRF24L01+ 2.4 GHz radios over an
+// SPI bus, enough to exercise simple RF links from a bus pirate.
+//
+// The radio is reached through a bp.SPIMaster whose chip select is CSN,
+// usually the bus pirate in SPI mode with CSN on its CS pin, see
+// NewBusPirate. CE, which keys the transmitter and the receiver, is a
+// bp.Pin, or nil if it is tied high. The IRQ output of the radio goes low
+// when a payload was sent, received or given up on. Wired to the AUX pin
+// of the bus pirate and set as Dev.IRQ, it is polled instead of the
+// status register.
+package nrf24
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// Registers.
+const (
+	RegConfig     = 0x00
+	RegEnAA       = 0x01
+	RegEnRXAddr   = 0x02
+	RegSetupAW    = 0x03
+	RegSetupRetr  = 0x04
+	RegRFCh       = 0x05
+	RegRFSetup    = 0x06
+	RegStatus     = 0x07
+	RegObserveTX  = 0x08
+	RegRPD        = 0x09
+	RegRXAddrP0   = 0x0a // to 0x0f for pipe 5
+	RegTXAddr     = 0x10
+	RegRXPwP0     = 0x11 // to 0x16 for pipe 5
+	RegFIFOStatus = 0x17
+	RegDynPD      = 0x1c
+	RegFeature    = 0x1d
+)
+
+// Commands.
+const (
+	cmdRReg     = 0x00
+	cmdWReg     = 0x20
+	cmdRRXPlWid = 0x60
+	cmdRRXPay   = 0x61
+	cmdWTXPay   = 0xa0
+	cmdFlushTX  = 0xe1
+	cmdFlushRX  = 0xe2
+	cmdNOP      = 0xff
+
+	regMask = 0x1f
+)
+
+const (
+	maxPayload  = 32
+	pipeCount   = 6
+	rxPipeEmpty = 7 // RX_P_NO of an empty receive FIFO
+
+	// powerUpDelay is the time from power down to standby, with
+	// margin for crystals slower than the 1.5 ms of the datasheet.
+	powerUpDelay = 5 * time.Millisecond
+)
+
+// Bits of the CONFIG register.
+const (
+	cfgPrimRX = 0x01
+	cfgPwrUp  = 0x02
+	cfgCRCO   = 0x04
+	cfgEnCRC  = 0x08
+)
+
+// Bits of the STATUS register.
+const (
+	StatusRXDR   = 0x40
+	StatusTXDS   = 0x20
+	StatusMaxRT  = 0x10
+	StatusTXFull = 0x01
+
+	statusIRQs = StatusRXDR | StatusTXDS | StatusMaxRT
+)
+
+// Bits of the FEATURE register.
+const (
+	featEnDPL = 0x04
+)
+
+var (
+	// ErrMaxRetries is returned by Send when the receiver didn't
+	// acknowledge the payload in any of the retransmits.
+	ErrMaxRetries = errors.New("no acknowledgement after maximum retries")
+	// ErrTimeout is returned by Send when the radio doesn't report the
+	// payload sent or given up on within Timeout.
+	ErrTimeout = errors.New("timed out")
+)
+
+// DataRate is the air data rate of the radio.
+type DataRate int
+
+const (
+	Rate1M DataRate = iota
+	Rate2M
+	Rate250k // nRF24L01+ only
+)
+
+func (r DataRate) bits() (byte, bool) {
+	switch r {
+	case Rate1M:
+		return 0x00, true
+	case Rate2M:
+		return 0x08, true
+	case Rate250k:
+		return 0x20, true
+	}
+	return 0, false
+}
+
+// Power is the output power of the transmitter.
+type Power int
+
+const (
+	Power0dBm Power = iota
+	PowerMinus6dBm
+	PowerMinus12dBm
+	PowerMinus18dBm
+)
+
+// Config is the configuration of the radio, shared by transmitter and
+// receiver. The zero Config is channel 0 at 1 Mbps, 0 dBm, with 2 byte
+// CRCs, 5 byte addresses and no retransmits.
+type Config struct {
+	Channel   int // 0 to 125, 2400 MHz + Channel MHz
+	DataRate  DataRate
+	Power     Power
+	CRCBytes  int // 1 or 2, 0 means 2
+	AddrWidth int // 3 to 5, 0 means 5
+
+	// Retries is the number of retransmits of an unacknowledged
+	// payload, 0 to 15, RetryDelay the time between them, 250 µs to
+	// 4 ms in steps of 250 µs, 0 means 250 µs.
+	Retries    int
+	RetryDelay time.Duration
+
+	// DynamicPayload enables payloads of varying length on all pipes,
+	// instead of the fixed sizes given to OpenPipe.
+	DynamicPayload bool
+}
+
+// Dev is an nRF24L01 radio.
+type Dev struct {
+	s  bp.SPIMaster
+	ce bp.Pin
+
+	dynamic   bool
+	addrWidth int
+
+	// IRQ, if not nil, reads the level of the IRQ output of the radio.
+	IRQ AUXReader
+
+	// Timeout is the time Send waits for the radio to report the
+	// payload sent, DefaultTimeout unless set otherwise.
+	Timeout time.Duration
+}
+
+// DefaultTimeout is the Timeout of a new Dev. The longest possible
+// retransmit sequence takes about 60 ms.
+const DefaultTimeout = 100 * time.Millisecond
+
+// AUXReader reads the level of the AUX pin, implemented by
+// bp.BusPirateSPI and bp.BusPirateI2C.
+type AUXReader interface {
+	ReadAUX() (bool, error)
+}
+
+// New returns the radio on s, with CE on ce, nil if CE is tied high.
+func New(s bp.SPIMaster, ce bp.Pin) *Dev {
+	return &Dev{s: s, ce: ce, addrWidth: 5, Timeout: DefaultTimeout}
+}
+
+// NewBusPirate returns the radio on the bus pirate in SPI mode, with CSN
+// on CS, IRQ on AUX and CE on ce, nil if CE is tied high. The outputs of
+// the bus pirate are open drain until set up otherwise, see
+// bp.BusPirateSPI.SetConfig.
+func NewBusPirate(sp bp.BusPirateSPI, ce bp.Pin) *Dev {
+	d := New(sp, ce)
+	d.IRQ = sp
+	return d
+}
+
+// command sends the command c with the data w and returns the status
+// register, clocked out by the radio during the command byte, and as
+// many bytes as are in w.
+func (d *Dev) command(op string, c byte, w []byte) (byte, []byte, error) {
+	buf := make([]byte, 1+len(w))
+	buf[0] = c
+	copy(buf[1:], w)
+	if err := bp.SPITransfer(d.s, buf, buf); err != nil {
+		return 0, nil, d.err(op, err)
+	}
+	return buf[0], buf[1:], nil
+}
+
+// ReadReg reads len(p) bytes from register reg, multiple bytes from the
+// address registers.
+func (d *Dev) ReadReg(reg byte, p []byte) error {
+	_, r, err := d.command("read register", cmdRReg|reg&regMask, make([]byte, len(p)))
+	if err != nil {
+		return err
+	}
+	copy(p, r)
+	return nil
+}
+
+// WriteReg writes p to register reg. Registers should only be written
+// while the radio is in standby or powered down.
+func (d *Dev) WriteReg(reg byte, p ...byte) error {
+	_, _, err := d.command("write register", cmdWReg|reg&regMask, p)
+	return err
+}
+
+func (d *Dev) readReg(reg byte) (byte, error) {
+	b := make([]byte, 1)
+	err := d.ReadReg(reg, b)
+	return b[0], err
+}
+
+// modify clears the bits of mask in reg and sets those of set.
+func (d *Dev) modify(reg, mask, set byte) error {
+	v, err := d.readReg(reg)
+	if err != nil {
+		return err
+	}
+	return d.WriteReg(reg, v&^mask|set)
+}
+
+// Status returns the status register, see the Status constants.
+func (d *Dev) Status() (byte, error) {
+	s, _, err := d.command("read status", cmdNOP, nil)
+	return s, err
+}
+
+// clearIRQs clears the interrupt flags set in status.
+func (d *Dev) clearIRQs(status byte) error {
+	if status&statusIRQs == 0 {
+		return nil
+	}
+	return d.WriteReg(RegStatus, status&statusIRQs)
+}
+
+func (d *Dev) setCE(high bool) error {
+	if d.ce == nil {
+		return nil
+	}
+	if err := d.ce.Out(high); err != nil {
+		return d.err("set CE", err)
+	}
+	return nil
+}
+
+// Init configures the radio, flushes its FIFOs, clears its interrupts and
+// powers it up into standby. All pipes are closed.
+func (d *Dev) Init(c Config) error {
+	if c.Channel < 0 || c.Channel > 125 {
+		return d.err("init", fmt.Errorf("invalid channel %d", c.Channel))
+	}
+	rate, ok := c.DataRate.bits()
+	if !ok {
+		return d.err("init", fmt.Errorf("invalid data rate %d", c.DataRate))
+	}
+	if c.Power < Power0dBm || c.Power > PowerMinus18dBm {
+		return d.err("init", fmt.Errorf("invalid power %d", c.Power))
+	}
+	cfg := byte(cfgEnCRC | cfgCRCO)
+	switch c.CRCBytes {
+	case 0, 2:
+	case 1:
+		cfg &^= cfgCRCO
+	default:
+		return d.err("init", fmt.Errorf("invalid CRC length %d", c.CRCBytes))
+	}
+	aw := c.AddrWidth
+	if aw == 0 {
+		aw = 5
+	}
+	if aw < 3 || aw > 5 {
+		return d.err("init", fmt.Errorf("invalid address width %d", c.AddrWidth))
+	}
+	if c.Retries < 0 || c.Retries > 15 {
+		return d.err("init", fmt.Errorf("invalid number of retries %d", c.Retries))
+	}
+	delay := int(c.RetryDelay / (250 * time.Microsecond))
+	if delay > 0 {
+		delay--
+	}
+	if delay > 15 {
+		return d.err("init", fmt.Errorf("retry delay %v out of range", c.RetryDelay))
+	}
+
+	if err := d.setCE(false); err != nil {
+		return err
+	}
+	// the features are set while powered down
+	if err := d.WriteReg(RegConfig, cfg); err != nil {
+		return err
+	}
+	var feat, dynpd byte
+	if c.DynamicPayload {
+		feat, dynpd = featEnDPL, 0x3f
+	}
+	for _, rv := range [][2]byte{
+		{RegEnAA, 0},
+		{RegEnRXAddr, 0},
+		{RegSetupAW, byte(aw - 2)},
+		{RegSetupRetr, byte(delay)<<4 | byte(c.Retries)},
+		{RegRFCh, byte(c.Channel)},
+		{RegRFSetup, rate | byte(3-c.Power)<<1},
+		{RegFeature, feat},
+		{RegDynPD, dynpd},
+	} {
+		if err := d.WriteReg(rv[0], rv[1]); err != nil {
+			return err
+		}
+	}
+	d.dynamic, d.addrWidth = c.DynamicPayload, aw
+
+	if err := d.FlushTX(); err != nil {
+		return err
+	}
+	if err := d.FlushRX(); err != nil {
+		return err
+	}
+	if err := d.clearIRQs(statusIRQs); err != nil {
+		return err
+	}
+	if err := d.WriteReg(RegConfig, cfg|cfgPwrUp); err != nil {
+		return err
+	}
+	time.Sleep(powerUpDelay)
+	return nil
+}
+
+// PowerDown powers the radio down. Init powers it up again.
+func (d *Dev) PowerDown() error {
+	if err := d.setCE(false); err != nil {
+		return err
+	}
+	return d.modify(RegConfig, cfgPwrUp, 0)
+}
+
+// checkAddr checks that addr is an address for pipe, the full address
+// for pipes 0 and 1, the least significant byte for the others, which
+// share the upper bytes of pipe 1.
+func (d *Dev) checkAddr(op string, pipe int, addr []byte) error {
+	if pipe < 0 || pipe >= pipeCount {
+		return d.err(op, fmt.Errorf("no pipe %d", pipe))
+	}
+	want := d.addrWidth
+	if pipe > 1 {
+		want = 1
+	}
+	if len(addr) != want {
+		return d.err(op, fmt.Errorf("address % x of pipe %d is not %d bytes", addr, pipe, want))
+	}
+	return nil
+}
+
+// OpenPipe enables receive pipe pipe, 0 to 5, with auto acknowledgement,
+// on addr, the least significant byte first like the radio takes it.
+// size is the payload size of the pipe, 1 to 32, ignored with dynamic
+// payloads.
+func (d *Dev) OpenPipe(pipe int, addr []byte, size int) error {
+	if err := d.checkAddr("open pipe", pipe, addr); err != nil {
+		return err
+	}
+	if !d.dynamic && (size < 1 || size > maxPayload) {
+		return d.err("open pipe", fmt.Errorf("invalid payload size %d", size))
+	}
+	if err := d.WriteReg(RegRXAddrP0+byte(pipe), addr...); err != nil {
+		return err
+	}
+	if !d.dynamic {
+		if err := d.WriteReg(RegRXPwP0+byte(pipe), byte(size)); err != nil {
+			return err
+		}
+	}
+	bit := byte(1) << uint(pipe)
+	if err := d.modify(RegEnAA, bit, bit); err != nil {
+		return err
+	}
+	return d.modify(RegEnRXAddr, bit, bit)
+}
+
+// ClosePipe disables receive pipe pipe.
+func (d *Dev) ClosePipe(pipe int) error {
+	if pipe < 0 || pipe >= pipeCount {
+		return d.err("close pipe", fmt.Errorf("no pipe %d", pipe))
+	}
+	return d.modify(RegEnRXAddr, 1<<uint(pipe), 0)
+}
+
+// SetTXAddr sets the address payloads are sent to, the least significant
+// byte first. The acknowledgements come back on it, so it is the address
+// of pipe 0 too, which is opened with auto acknowledgement.
+func (d *Dev) SetTXAddr(addr []byte) error {
+	if err := d.checkAddr("set TX address", 0, addr); err != nil {
+		return err
+	}
+	if err := d.WriteReg(RegTXAddr, addr...); err != nil {
+		return err
+	}
+	return d.OpenPipe(0, addr, maxPayload)
+}
+
+// FlushTX drops the payloads in the transmit FIFO.
+func (d *Dev) FlushTX() error {
+	_, _, err := d.command("flush TX", cmdFlushTX, nil)
+	return err
+}
+
+// FlushRX drops the payloads in the receive FIFO.
+func (d *Dev) FlushRX() error {
+	_, _, err := d.command("flush RX", cmdFlushRX, nil)
+	return err
+}
+
+// Send sends payload, 1 to 32 bytes, to the TX address and waits for the
+// radio to report it sent, which includes the acknowledgement if the
+// receiver acknowledges. The radio must not be listening.
+func (d *Dev) Send(payload []byte) error {
+	if len(payload) < 1 || len(payload) > maxPayload {
+		return d.err("send", fmt.Errorf("invalid payload size %d", len(payload)))
+	}
+	if err := d.modify(RegConfig, cfgPrimRX, 0); err != nil {
+		return err
+	}
+	if _, _, err := d.command("send", cmdWTXPay, payload); err != nil {
+		return err
+	}
+	// a pulse of CE of at least 10 µs sends the payload, the round
+	// trips to the bus pirate are longer than that
+	if err := d.setCE(true); err != nil {
+		return err
+	}
+	if err := d.setCE(false); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(d.Timeout)
+	for {
+		irq, err := d.pending("send")
+		if err != nil {
+			return err
+		}
+		var st byte
+		if irq {
+			if st, err = d.Status(); err != nil {
+				return err
+			}
+		}
+		if st&(StatusTXDS|StatusMaxRT) != 0 {
+			if err := d.clearIRQs(st & (StatusTXDS | StatusMaxRT)); err != nil {
+				return err
+			}
+			if st&StatusMaxRT != 0 {
+				// the payload stays in the FIFO after giving up
+				if err := d.FlushTX(); err != nil {
+					return err
+				}
+				return d.err("send", ErrMaxRetries)
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return d.err("send", ErrTimeout)
+		}
+	}
+}
+
+// pending reports whether the radio may have raised an interrupt: always
+// without IRQ, else if IRQ is low.
+func (d *Dev) pending(op string) (bool, error) {
+	if d.IRQ == nil {
+		return true, nil
+	}
+	high, err := d.IRQ.ReadAUX()
+	if err != nil {
+		return false, d.err(op, err)
+	}
+	return !high, nil
+}
+
+// StartListening makes the radio a receiver on its open pipes.
+func (d *Dev) StartListening() error {
+	if err := d.modify(RegConfig, cfgPrimRX, cfgPrimRX); err != nil {
+		return err
+	}
+	return d.setCE(true)
+}
+
+// StopListening returns the radio to standby.
+func (d *Dev) StopListening() error {
+	if err := d.setCE(false); err != nil {
+		return err
+	}
+	return d.modify(RegConfig, cfgPrimRX, 0)
+}
+
+// Receive returns the next payload in the receive FIFO and the pipe it
+// arrived on. ok is false if the FIFO is empty.
+func (d *Dev) Receive() (pipe int, payload []byte, ok bool, err error) {
+	st, err := d.Status()
+	if err != nil {
+		return 0, nil, false, err
+	}
+	pipe = int(st>>1) & 7
+	if pipe == rxPipeEmpty {
+		return 0, nil, false, d.clearIRQs(st & StatusRXDR)
+	}
+
+	var size byte
+	if d.dynamic {
+		_, r, err := d.command("read payload width", cmdRRXPlWid, []byte{0})
+		if err != nil {
+			return 0, nil, false, err
+		}
+		size = r[0]
+	} else if size, err = d.readReg(RegRXPwP0 + byte(pipe)); err != nil {
+		return 0, nil, false, err
+	}
+	if size < 1 || size > maxPayload {
+		// a corrupt payload, the datasheet says to drop the FIFO
+		if err := d.FlushRX(); err != nil {
+			return 0, nil, false, err
+		}
+		return 0, nil, false, d.err("receive", fmt.Errorf("invalid payload width %d", size))
+	}
+	_, payload, err = d.command("receive", cmdRRXPay, make([]byte, size))
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if err := d.clearIRQs(StatusRXDR); err != nil {
+		return 0, nil, false, err
+	}
+	return pipe, payload, true, nil
+}
+
+// WaitReceive polls the radio every interval until a payload arrives and
+// returns it with its pipe. With IRQ set, the receive FIFO is checked
+// once, for payloads that arrived before, then only when IRQ goes low.
+// It returns early with the error of ctx if ctx is done.
+func (d *Dev) WaitReceive(ctx context.Context, interval time.Duration) (int, []byte, error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for first := true; ; first = false {
+		check := first
+		if !check {
+			var err error
+			if check, err = d.pending("wait for payload"); err != nil {
+				return 0, nil, err
+			}
+		}
+		if check {
+			pipe, payload, ok, err := d.Receive()
+			if err != nil {
+				return 0, nil, err
+			}
+			if ok {
+				return pipe, payload, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("nrf24: %s: %w", op, err)
+}
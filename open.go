@@ -0,0 +1,131 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"os"
+	"time"
+)
+
+// OpenOptions control how Open, Resync and friends get the bus pirate
+// into binary mode. Zero fields take the value from DefaultOpenOptions.
+type OpenOptions struct {
+	// Tries is the number of 0x00 bytes sent before giving up, or before
+	// resetting the terminal. The terminal needs 20 of them to enter
+	// binary mode, fewer only work if the device is in binary mode
+	// already.
+	Tries int
+
+	// Interval is the time waited for an answer after each 0x00.
+	Interval time.Duration
+
+	// Drain is the time the bus pirate has to be quiet before its
+	// remaining output is considered drained.
+	Drain time.Duration
+
+	// DrainMax is the maximum number of bytes discarded while draining.
+	DrainMax int
+
+	// DrainDeadline bounds the time spent draining, so a device that
+	// keeps talking, or a port that echoes, can't block Open.
+	DrainDeadline time.Duration
+
+	// NoTerminalReset disables resetting the device from the terminal
+	// when it doesn't answer the 0x00 bytes.
+	NoTerminalReset bool
+}
+
+// DefaultOpenOptions are the options used unless set otherwise.
+var DefaultOpenOptions = OpenOptions{
+	Tries:         20,
+	Interval:      100 * time.Millisecond,
+	Drain:         300 * time.Millisecond,
+	DrainMax:      2048,
+	DrainDeadline: 2 * time.Second,
+}
+
+// SetOpenOptions sets the options used when entering binary mode.
+func (bp *BusPirate) SetOpenOptions(o OpenOptions) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.openopts = o
+}
+
+// openOptions returns the options in effect, with defaults filled in.
+func (bp *BusPirate) openOptions() OpenOptions {
+	o := bp.openopts
+	d := DefaultOpenOptions
+	if o.Tries <= 0 {
+		o.Tries = d.Tries
+	}
+	if o.Interval <= 0 {
+		o.Interval = d.Interval
+	}
+	if o.Drain <= 0 {
+		o.Drain = d.Drain
+	}
+	if o.DrainMax <= 0 {
+		o.DrainMax = d.DrainMax
+	}
+	if o.DrainDeadline <= 0 {
+		o.DrainDeadline = d.DrainDeadline
+	}
+	return o
+}
+
+// OpenPath opens the serial port at path with the bus pirate's default
+// settings, 115200 baud 8N1, and puts the bus pirate into binary mode
+// with Open. The BusPirate owns the port, Close closes it. The port is
+// locked against other processes using this package until then, if it is
+// in use, the error matches ErrDeviceBusy.
+func OpenPath(path string) (*BusPirate, error) {
+	unlock, err := lockPort(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := openPort(path)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	bp := NewBusPirate(c)
+	bp.owned = true
+	bp.unlockport = unlock
+	if err := bp.Open(); err != nil {
+		c.Close()
+		unlock()
+		return nil, err
+	}
+
+	return bp, nil
+}
+
+// Environment variables selecting the bus pirate used by OpenFirst.
+const (
+	EnvPort   = "BP_PORT"   // serial port, see OpenPath
+	EnvSerial = "BP_SERIAL" // USB serial number, see OpenSerial
+)
+
+// OpenFirst opens the bus pirate selected by the environment, or the
+// first one found by FindBusPirates, with OpenPath. If BP_PORT is set,
+// the bus pirate on that port is opened. Otherwise, if BP_SERIAL is set,
+// the one with that USB serial number. Only if neither is set, the ports
+// are searched.
+func OpenFirst() (*BusPirate, error) {
+	if path := os.Getenv(EnvPort); path != "" {
+		return OpenPath(path)
+	}
+	if serial := os.Getenv(EnvSerial); serial != "" {
+		return OpenSerial(serial)
+	}
+
+	found, err := FindBusPirates()
+	if err != nil {
+		return nil, err
+	}
+	return OpenPath(found[0].Path)
+}
@@ -0,0 +1,64 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"time"
+)
+
+// Pacing slows down the traffic for fragile targets that fall over when
+// polled flat out. The zero value does not slow down anything.
+type Pacing struct {
+	// Command is the minimum time between the end of one command, like
+	// an I2C start condition or byte write, and the next.
+	Command time.Duration
+
+	// Transaction is the minimum time between the end of a transaction,
+	// the stop condition or Transact8x8, and the start of the next.
+	Transaction time.Duration
+}
+
+// SetPacing makes the mode handles of bp wait as p requires, unless they
+// have a pacing of their own, see BusPirateI2C.WithPacing. The waiting is
+// done while holding the lock of bp.
+func (bp *BusPirate) SetPacing(p Pacing) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.pacing = p
+}
+
+// WithPacing returns a copy of the handle which waits as p requires
+// instead of following the pacing set with SetPacing. The copy stays
+// valid as long as the original does.
+func (inf BusPirateI2C) WithPacing(p Pacing) BusPirateI2C {
+	inf.pacing = &p
+	return inf
+}
+
+// WithPacing is like BusPirateI2C.WithPacing.
+func (nsi NonStrictI2C) WithPacing(p Pacing) NonStrictI2C {
+	return NonStrictI2C{nsi.BusPirateI2C.WithPacing(p)}
+}
+
+// pace waits before a command as the pacing of inf requires. newtx tells
+// whether the command starts a transaction. The caller has to hold the
+// lock.
+func (inf BusPirateI2C) pace(newtx bool) {
+	bp := inf.bp
+	p := bp.pacing
+	if inf.pacing != nil {
+		p = *inf.pacing
+	}
+
+	wait := p.Command - bp.link.idle()
+	if newtx {
+		if w := p.Transaction - time.Since(bp.lasttx); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/distributed/bp/wire"
+)
+
+// The parsers in this file are pure state machines fed one byte at a
+// time. They never block and make no assumptions about how the bytes were
+// chunked by the serial port, which keeps them robust against partial
+// reads and makes them easy to fuzz.
+
+// bannerScanner finds a version banner like "BBIO1" in a byte stream. Any
+// bytes preceding the banner, like stale responses or text mode output,
+// are skipped.
+//
+// A lenient scanner also accepts the prefix in any case and up to
+// maxbannerseps of the bytes in bannerseps between the prefix and the
+// version, like "bbio1" or "I2C v1", as sent by some firmware builds. Its
+// version has to be a digit.
+type bannerScanner struct {
+	prefix  string
+	lenient bool
+	window  []byte
+	matched bool   // window holds the prefix
+	seps    []byte // separators seen after the prefix
+	banner  string // the banner found, as received
+}
+
+const (
+	bannerseps    = " -_vV"
+	maxbannerseps = 2
+)
+
+// feed consumes b. It returns the version character once the prefix
+// followed by a version character has been seen.
+func (s *bannerScanner) feed(b byte) (version byte, ok bool) {
+	if s.matched {
+		if !s.lenient || '0' <= b && b <= '9' {
+			s.banner = string(s.window) + string(s.seps) + string(b)
+			s.reset()
+			return b, true
+		}
+		if len(s.seps) < maxbannerseps && strings.IndexByte(bannerseps, b) >= 0 {
+			s.seps = append(s.seps, b)
+			return 0, false
+		}
+		// not a banner after all, b may start the next one
+		s.reset()
+	}
+
+	s.window = append(s.window, b)
+	if len(s.window) > len(s.prefix) {
+		s.window = s.window[1:]
+	}
+	if len(s.window) == len(s.prefix) {
+		if s.lenient {
+			s.matched = strings.EqualFold(string(s.window), s.prefix)
+		} else {
+			s.matched = string(s.window) == s.prefix
+		}
+	}
+	return 0, false
+}
+
+func (s *bannerScanner) reset() {
+	s.window = s.window[:0]
+	s.matched = false
+	s.seps = s.seps[:0]
+}
+
+// maxbannerscan is the number of bytes read while looking for a banner
+// before giving up.
+const maxbannerscan = 64
+
+// BannerError is returned when the bus pirate does not answer with the
+// expected version banner.
+type BannerError struct {
+	Want string // expected banner without the version character
+	Got  []byte // the last bytes received, at most 32
+	Sent []byte // the command answered with Got
+}
+
+func (e *BannerError) Error() string {
+	s := fmt.Sprintf("bp: expected version string \"%sx\", got %q", e.Want, e.Got)
+	if e.Sent != nil {
+		s += fmt.Sprintf(" for [% x]", e.Sent)
+	}
+	return s
+}
+
+// Exchange returns the command sent and the last bytes received in
+// answer, see the package function Exchange.
+func (e *BannerError) Exchange() (sent, received []byte) {
+	return e.Sent, e.Got
+}
+
+func (e *BannerError) Is(target error) bool {
+	return target == ErrUnexpectedResponse
+}
+
+func (e *BannerError) Timeout() bool   { return false }
+func (e *BannerError) Temporary() bool { return false }
+
+// SetLenientBanners makes bp accept variants of the version banners,
+// like "bbio1" or "I2C v1", and protocol versions other than 1, which it
+// treats like version 1. Accepted variants are logged, Status shows the
+// banners as they were received. Use this for firmware builds that alter
+// the banners but otherwise speak the protocol.
+func (bp *BusPirate) SetLenientBanners(on bool) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.lenient = on
+}
+
+// readBanner reads the answer to the command cmd from the bus pirate
+// until prefix and the following version character were received and
+// returns the version character.
+// Errors from the connection, including timeouts, are returned as they
+// are. If no banner was found within maxbannerscan bytes, a *BannerError
+// is returned.
+func (bp *BusPirate) readBanner(cmd byte, prefix string) (byte, error) {
+	s := bannerScanner{prefix: prefix, lenient: bp.lenient}
+
+	var (
+		b    [1]byte
+		seen []byte
+	)
+	for i := 0; i < maxbannerscan; i++ {
+		n, err := bp.c.Read(b[:])
+		if n == 1 {
+			if v, ok := s.feed(b[0]); ok {
+				if s.banner != prefix+"1" {
+					bp.logf(SubsysOpen, LogInfo, "received banner %q for %q", s.banner, prefix+"1")
+				}
+				if bp.banners == nil {
+					bp.banners = map[string]string{}
+				}
+				bp.banners[prefix] = s.banner
+				return v, nil
+			}
+			seen = append(seen, b[0])
+			if len(seen) > maxexchange {
+				seen = seen[1:]
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return 0, &BannerError{Want: prefix, Got: seen, Sent: []byte{cmd}}
+}
+
+// checkVersion checks the protocol version v received in a banner and
+// returns it as a number. Only version 1 is supported, unless banners are
+// lenient, which accepts any digit.
+func (bp *BusPirate) checkVersion(what string, v byte) (int, error) {
+	if v == '1' || bp.lenient && '1' <= v && v <= '9' {
+		return int(v - '0'), nil
+	}
+	return 0, fmt.Errorf("%w: only %s version 1 is supported, bus pirate uses version %q", ErrUnexpectedResponse, what, v)
+}
+
+// sniffDecoder decodes the sniffer's output. Data bytes are escaped with
+// a backslash and followed by + or - for ACK or NACK, start and stop
+// conditions are sent as [ and ]. A 0x01 outside of an escape is the
+// answer to the byte ending sniffer mode.
+type sniffDecoder struct {
+	escaped  bool
+	havebyte bool
+	b        byte
+}
+
+// feed consumes b. If b completes an event, it is returned with ok set,
+// its Time is left for the caller to fill in. exit is set if b is the
+// answer to leaving sniffer mode. Bytes not making sense at their
+// position are dropped and reported with bad set.
+func (d *sniffDecoder) feed(b byte) (ev SniffEvent, ok, exit, bad bool) {
+	if d.escaped {
+		d.escaped = false
+		d.havebyte = true
+		d.b = b
+		return ev, false, false, false
+	}
+
+	switch b {
+	case wire.SniffStart, wire.SniffStop:
+		// a byte without ACK/NACK was lost in transmission
+		bad = d.havebyte
+		d.havebyte = false
+		ev.Type = SniffStart
+		if b == wire.SniffStop {
+			ev.Type = SniffStop
+		}
+		return ev, true, false, bad
+	case wire.SniffEscape:
+		bad = d.havebyte
+		d.havebyte = false
+		d.escaped = true
+		return ev, false, false, bad
+	case wire.SniffACK, wire.SniffNACK:
+		if !d.havebyte {
+			return ev, false, false, true
+		}
+		d.havebyte = false
+		return SniffEvent{Type: SniffByte, Byte: d.b, ACK: b == wire.SniffACK}, true, false, false
+	case wire.OK:
+		return ev, false, true, false
+	}
+
+	return ev, false, false, true
+}
@@ -0,0 +1,172 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/distributed/bp/wire"
+)
+
+var errFakeTimeout = errors.New("fake read timeout")
+
+// streamConn answers reads from data, one byte at a time at most, and
+// times out when data runs out. Writes are discarded.
+type streamConn struct {
+	data  []byte
+	reads int
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	c.reads++
+	if len(c.data) == 0 {
+		return 0, errFakeTimeout
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = c.data[0]
+	c.data = c.data[1:]
+	return 1, nil
+}
+
+func (c *streamConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (c *streamConn) Close() error                     { return nil }
+func (c *streamConn) SetReadParams(int, float64) error { return nil }
+
+// hasBanner reports whether s holds prefix the way bannerScanner matches
+// it.
+func hasBanner(s []byte, prefix string, lenient bool) bool {
+	for i := 0; i+len(prefix) <= len(s); i++ {
+		w := string(s[i : i+len(prefix)])
+		if w == prefix || lenient && strings.EqualFold(w, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func FuzzReadBanner(f *testing.F) {
+	f.Add([]byte{}, 5, false)
+	f.Add([]byte{0x01, 0x01, 0x00}, 8, false)
+	f.Add([]byte("BBI"), 2, false)
+	f.Add([]byte("I2C1BBIO"), 100, false)
+	f.Add([]byte("HiZ>\r\n"), 3, true)
+	f.Add([]byte("bbio-"), 7, true)
+	f.Add([]byte(strings.Repeat("\x00", 70)), 75, false)
+
+	const prefix = wire.BitbangBanner
+	f.Fuzz(func(t *testing.T, stale []byte, cut int, lenient bool) {
+		stream := append(append([]byte(nil), stale...), prefix+"1"...)
+		if cut < 0 || cut > len(stream) {
+			cut = len(stream)
+		}
+		stream = stream[:cut]
+
+		c := &streamConn{data: stream}
+		bp := NewBusPirate(c)
+		bp.lenient = lenient
+		v, err := bp.readBanner(wire.Reset, prefix)
+
+		if c.reads > maxbannerscan {
+			t.Fatalf("%d reads, want at most %d", c.reads, maxbannerscan)
+		}
+		if err != nil {
+			var berr *BannerError
+			if !errors.Is(err, errFakeTimeout) && !errors.As(err, &berr) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if berr != nil && (berr.Want != prefix || len(berr.Got) > maxexchange) {
+				t.Fatalf("bad BannerError %+v", berr)
+			}
+		} else if bp.banners[prefix] == "" {
+			t.Fatalf("banner not recorded")
+		}
+
+		// a complete banner after stale bytes without one is found
+		complete := cut == len(stale)+len(prefix)+1
+		if complete && cut <= maxbannerscan && !hasBanner(stale, prefix, lenient) {
+			if err != nil {
+				t.Fatalf("banner after %q not found: %v", stale, err)
+			}
+			if v != '1' {
+				t.Fatalf("version %q after %q, want '1'", v, stale)
+			}
+		}
+		if err == nil && !lenient && v != stream[strings.Index(string(stream), prefix)+len(prefix)] {
+			t.Fatalf("version %q is not the one after the first banner in %q", v, stream)
+		}
+		if err == nil && !hasBanner(stream, prefix, lenient) {
+			t.Fatalf("version %q without a banner in %q", v, stream)
+		}
+	})
+}
+
+func FuzzSniffDecoder(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte(`\`))
+	f.Add([]byte(`\x`))
+	f.Add([]byte(`[\a+\b-]`))
+	f.Add([]byte{'+', '-', 0x01, '\\', 0x01})
+	f.Add([]byte(`[[\]]\[`))
+
+	// a frame decodes to its events once the decoder is in sync
+	frame := []byte{
+		wire.SniffStart,
+		wire.SniffEscape, 0xa0, wire.SniffACK,
+		wire.SniffEscape, wire.OK, wire.SniffNACK,
+		wire.SniffStop,
+	}
+	want := []SniffEvent{
+		{Type: SniffStart},
+		{Type: SniffByte, Byte: 0xa0, ACK: true},
+		{Type: SniffByte, Byte: wire.OK, ACK: false},
+		{Type: SniffStop},
+	}
+
+	f.Fuzz(func(t *testing.T, garbage []byte) {
+		var d sniffDecoder
+		for _, b := range garbage {
+			ev, ok, exit, _ := d.feed(b)
+			if ok && exit {
+				t.Fatalf("event and exit for %#02x", b)
+			}
+			if ok && ev.Type != SniffStart && ev.Type != SniffStop && ev.Type != SniffByte {
+				t.Fatalf("event of type %v", ev.Type)
+			}
+		}
+
+		// the first frame resyncs the decoder, the second decodes
+		// completely
+		for _, b := range frame {
+			d.feed(b)
+		}
+		var got []SniffEvent
+		for _, b := range frame {
+			ev, ok, exit, bad := d.feed(b)
+			if exit || bad {
+				t.Fatalf("after %q: byte %#02x of a frame gives exit %v bad %v", garbage, b, exit, bad)
+			}
+			if ok {
+				got = append(got, ev)
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("after %q: got events %v, want %v", garbage, got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("after %q: event %d is %+v, want %+v", garbage, i, got[i], want[i])
+			}
+		}
+
+		// and the answer to leaving the sniffer is seen
+		if _, _, exit, _ := d.feed(wire.OK); !exit {
+			t.Fatalf("after %q: exit not recognized", garbage)
+		}
+	})
+}
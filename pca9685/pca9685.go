@@ -0,0 +1,239 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package pca9685 drives the PCA9685 16 channel 12 bit PWM controller,
+// the part on most servo and LED driver boards, over the I2C mode of
+// package bp.
+//
+// A PWM period has 4096 counts. Every channel turns on at its on count
+// and off at its off count, so the duty cycle is (off-on)/4096 and the
+// on count staggers the channels. An on count of Full turns the channel
+// fully on, an off count of Full fully off.
+//
+// All PCA9685 on a bus answer to the all-call address, AllCallAddr
+// unless changed with SetAllCall. A Dev returned by New for that address
+// writes to all of them at once, it can't read.
+package pca9685
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// Addresses of the controller. The address pins add 0 to 63 to
+// BaseAddr.
+const (
+	BaseAddr    = 0x40
+	AllCallAddr = 0x70
+)
+
+// Registers.
+const (
+	MODE1      = 0x00
+	MODE2      = 0x01
+	ALLCALLADR = 0x05
+	LED0_ON_L  = 0x06
+	ALL_LED_ON = 0xfa
+	PRE_SCALE  = 0xfe
+)
+
+// Bits of MODE1 and MODE2.
+const (
+	Mode1Restart = 0x80
+	Mode1ExtClk  = 0x40
+	Mode1AI      = 0x20 // register auto increment
+	Mode1Sleep   = 0x10
+	Mode1AllCall = 0x01
+
+	Mode2Invert = 0x10
+	Mode2OutDrv = 0x04 // totem pole outputs, open drain otherwise
+)
+
+// Channels is the number of PWM channels.
+const Channels = 16
+
+// Full is the count turning a channel fully on or off.
+const Full = 0x1000
+
+// InternalOsc is the frequency of the internal oscillator in Hz.
+const InternalOsc = 25e6
+
+// Limits of the prescaler.
+const (
+	MinPrescale = 3
+	MaxPrescale = 255
+)
+
+// Prescale returns the prescaler value for a PWM frequency of freq Hz
+// with an oscillator of osc Hz, InternalOsc unless an external clock is
+// used.
+func Prescale(freq, osc float64) (byte, error) {
+	if freq <= 0 {
+		return 0, fmt.Errorf("pca9685: invalid frequency %g Hz", freq)
+	}
+	p := math.Round(osc/(4096*freq)) - 1
+	if p < MinPrescale || p > MaxPrescale {
+		return 0, fmt.Errorf("pca9685: frequency %g Hz out of range %g to %g Hz", freq, Frequency(MaxPrescale, osc), Frequency(MinPrescale, osc))
+	}
+	return byte(p), nil
+}
+
+// Frequency returns the PWM frequency in Hz for the prescaler value
+// prescale with an oscillator of osc Hz.
+func Frequency(prescale byte, osc float64) float64 {
+	return osc / (4096 * (float64(prescale) + 1))
+}
+
+// Dev is a PCA9685.
+type Dev struct {
+	t    bp.I2CTransactor8x8
+	addr bp.Addr7
+
+	// Osc is the frequency of the oscillator in Hz, InternalOsc unless
+	// set otherwise.
+	Osc float64
+}
+
+// New returns the controller at the 7 bit address addr.
+func New(t bp.I2CTransactor8x8, addr uint8) *Dev {
+	return &Dev{t: t, addr: bp.Addr7(addr), Osc: InternalOsc}
+}
+
+// Init wakes the controller up with register auto increment and all-call
+// on and totem pole outputs, as needed for LEDs without drivers and
+// servos.
+func (d *Dev) Init() error {
+	if err := d.write("init", MODE2, Mode2OutDrv); err != nil {
+		return err
+	}
+	return d.write("init", MODE1, Mode1AI|Mode1AllCall)
+}
+
+func (d *Dev) write(op string, reg uint8, w ...byte) error {
+	if _, _, err := d.t.Transact8x8(d.addr, reg, w, nil); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+func (d *Dev) read(op string, reg uint8, r []byte) error {
+	if _, _, err := d.t.Transact8x8(d.addr, reg, nil, r); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+// SetFrequency sets the PWM frequency to freq Hz, as close as the
+// prescaler gets. The prescaler can only be written while the oscillator
+// sleeps, so the outputs stop for about a millisecond.
+func (d *Dev) SetFrequency(freq float64) error {
+	p, err := Prescale(freq, d.Osc)
+	if err != nil {
+		return err
+	}
+
+	mode := make([]byte, 1)
+	if err := d.read("set frequency", MODE1, mode); err != nil {
+		return err
+	}
+	mode1 := mode[0] &^ Mode1Restart
+	if err := d.write("set frequency", MODE1, mode1|Mode1Sleep); err != nil {
+		return err
+	}
+	if err := d.write("set frequency", PRE_SCALE, p); err != nil {
+		return err
+	}
+	if err := d.write("set frequency", MODE1, mode1&^Mode1Sleep); err != nil {
+		return err
+	}
+	// the oscillator needs 500us to start
+	time.Sleep(500 * time.Microsecond)
+	return d.write("set frequency", MODE1, mode1&^Mode1Sleep|Mode1Restart)
+}
+
+// Frequency returns the PWM frequency in Hz set in the prescaler.
+func (d *Dev) Frequency() (float64, error) {
+	p := make([]byte, 1)
+	if err := d.read("frequency", PRE_SCALE, p); err != nil {
+		return 0, err
+	}
+	return Frequency(p[0], d.Osc), nil
+}
+
+// SetChannel sets the on and off counts of channel ch, 0 to 15. Counts
+// are 0 to 4095, or Full.
+func (d *Dev) SetChannel(ch int, on, off uint16) error {
+	if ch < 0 || ch >= Channels {
+		return d.err("set channel", fmt.Errorf("no channel %d", ch))
+	}
+	return d.setCounts("set channel", LED0_ON_L+4*uint8(ch), on, off)
+}
+
+// SetAll sets the on and off counts of all channels.
+func (d *Dev) SetAll(on, off uint16) error {
+	return d.setCounts("set all", ALL_LED_ON, on, off)
+}
+
+func (d *Dev) setCounts(op string, reg uint8, on, off uint16) error {
+	if on > Full || off > Full {
+		return d.err(op, fmt.Errorf("invalid counts %d, %d", on, off))
+	}
+	return d.write(op, reg, byte(on), byte(on>>8), byte(off), byte(off>>8))
+}
+
+// Channel returns the on and off counts of channel ch.
+func (d *Dev) Channel(ch int) (on, off uint16, err error) {
+	if ch < 0 || ch >= Channels {
+		return 0, 0, d.err("channel", fmt.Errorf("no channel %d", ch))
+	}
+	r := make([]byte, 4)
+	if err := d.read("channel", LED0_ON_L+4*uint8(ch), r); err != nil {
+		return 0, 0, err
+	}
+	return uint16(r[0]) | uint16(r[1]&0x1f)<<8, uint16(r[2]) | uint16(r[3]&0x1f)<<8, nil
+}
+
+// SetPulse sets channel ch to a pulse of width starting at the
+// beginning of the period, like servos want. A pulse as long as the
+// period turns the channel fully on, an empty one fully off.
+func (d *Dev) SetPulse(ch int, width time.Duration) error {
+	freq, err := d.Frequency()
+	if err != nil {
+		return err
+	}
+	counts := math.Round(width.Seconds() * freq * 4096)
+	switch {
+	case counts <= 0:
+		return d.SetChannel(ch, 0, Full)
+	case counts >= 4096:
+		return d.SetChannel(ch, Full, 0)
+	}
+	return d.SetChannel(ch, 0, uint16(counts))
+}
+
+// SetAllCall makes the controller answer to the 7 bit all-call address
+// addr, or not if enabled is false.
+func (d *Dev) SetAllCall(enabled bool, addr uint8) error {
+	if enabled {
+		if err := d.write("set all-call", ALLCALLADR, addr<<1); err != nil {
+			return err
+		}
+	}
+	mode := make([]byte, 1)
+	if err := d.read("set all-call", MODE1, mode); err != nil {
+		return err
+	}
+	mode1 := mode[0] &^ (Mode1Restart | Mode1AllCall)
+	if enabled {
+		mode1 |= Mode1AllCall
+	}
+	return d.write("set all-call", MODE1, mode1)
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("pca9685 %v: %s: %w", d.addr, op, err)
+}
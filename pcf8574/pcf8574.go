@@ -0,0 +1,168 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package pcf8574 drives the PCF8574 and PCF8574A 8 bit I/O expanders
+// over the I2C mode of package bp.
+//
+// The pins of the expanders are quasi-bidirectional: a pin written low
+// sinks current, a pin written high is pulled up weakly and can be
+// driven low from outside. To use a pin as an input, write it high and
+// read it. Dev keeps the value last written, so Set can change some
+// pins without touching the others.
+//
+// The INT output of the expander goes low when an input changes and
+// stays low until the port is read. Wired to the AUX pin of the bus
+// pirate, it is polled by WaitInterrupt.
+package pcf8574
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// Base addresses of the expanders, with the address pins A0 to A2 tied
+// low. The pins add 0 to 7 to them.
+const (
+	BaseAddr  = 0x20 // PCF8574
+	BaseAddrA = 0x38 // PCF8574A
+)
+
+// Dev is a PCF8574 or PCF8574A.
+type Dev struct {
+	m     bp.I2CMaster
+	addr  uint8
+	latch byte
+}
+
+// New returns the expander at the 7 bit address addr on m. The latch is
+// assumed to be in its power on state, all pins high.
+func New(m bp.I2CMaster, addr uint8) *Dev {
+	return &Dev{m: m, addr: addr, latch: 0xff}
+}
+
+// Write sets the pins to v, pin 0 in bit 0. Pins written high act as
+// inputs.
+func (d *Dev) Write(v byte) error {
+	if err := d.m.Start(); err != nil {
+		return d.err("write", err)
+	}
+	for _, b := range []byte{d.addr << 1, v} {
+		if err := d.m.WriteByte(b); err != nil {
+			d.m.Stop()
+			return d.err("write", err)
+		}
+	}
+	if err := d.m.Stop(); err != nil {
+		return d.err("write", err)
+	}
+	d.latch = v
+	return nil
+}
+
+// Read returns the levels of the pins, pin 0 in bit 0. Reading clears
+// the interrupt.
+func (d *Dev) Read() (byte, error) {
+	if err := d.m.Start(); err != nil {
+		return 0, d.err("read", err)
+	}
+	if err := d.m.WriteByte(d.addr<<1 | 1); err != nil {
+		d.m.Stop()
+		return 0, d.err("read", err)
+	}
+	v, err := d.m.ReadByteAck(false)
+	if err != nil {
+		d.m.Stop()
+		return 0, d.err("read", err)
+	}
+	if err := d.m.Stop(); err != nil {
+		return 0, d.err("read", err)
+	}
+	return v, nil
+}
+
+// Set sets the pins selected by mask to the bits of v and leaves the
+// others as they were last written.
+func (d *Dev) Set(mask, v byte) error {
+	return d.Write(d.latch&^mask | v&mask)
+}
+
+// Latch returns the value last written.
+func (d *Dev) Latch() byte {
+	return d.latch
+}
+
+// Pin returns pin n, 0 to 7.
+func (d *Dev) Pin(n int) (*Pin, error) {
+	if n < 0 || n > 7 {
+		return nil, d.err("pin", fmt.Errorf("no pin %d", n))
+	}
+	return &Pin{d: d, mask: 1 << uint(n)}, nil
+}
+
+// Pin is a pin of an expander. It implements bp.Pin.
+type Pin struct {
+	d    *Dev
+	mask byte
+}
+
+var _ bp.Pin = (*Pin)(nil)
+
+// Out drives the pin low or, if level is true, pulls it up weakly.
+func (p *Pin) Out(level bool) error {
+	var v byte
+	if level {
+		v = p.mask
+	}
+	return p.d.Set(p.mask, v)
+}
+
+// In releases the pin high and reads its level.
+func (p *Pin) In() (bool, error) {
+	if p.d.latch&p.mask == 0 {
+		if err := p.d.Set(p.mask, p.mask); err != nil {
+			return false, err
+		}
+	}
+	v, err := p.d.Read()
+	if err != nil {
+		return false, err
+	}
+	return v&p.mask != 0, nil
+}
+
+// AUXReader reads the level of the AUX pin, implemented by
+// bp.BusPirateI2C.
+type AUXReader interface {
+	ReadAUX() (bool, error)
+}
+
+// WaitInterrupt polls aux every interval until the INT output of the
+// expander wired to it goes low, then reads the port, which clears the
+// interrupt, and returns its value. It returns early with the error of
+// ctx if ctx is done.
+func (d *Dev) WaitInterrupt(ctx context.Context, aux AUXReader, interval time.Duration) (byte, error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		high, err := aux.ReadAUX()
+		if err != nil {
+			return 0, d.err("wait for interrupt", err)
+		}
+		if !high {
+			return d.Read()
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("pcf8574 %#02x: %s: %w", d.addr, op, err)
+}
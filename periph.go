@@ -0,0 +1,189 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/distributed/bp/wire"
+)
+
+// Peripherals are the on-board peripherals of the bus pirate, switched on
+// by setting their flag.
+type Peripherals byte
+
+const (
+	PeriphCS      Peripherals = wire.PeriphCS      // chip select pin high
+	PeriphAUX     Peripherals = wire.PeriphAUX     // auxiliary pin high
+	PeriphPullups Peripherals = wire.PeriphPullups // pull-up resistors
+	PeriphPower   Peripherals = wire.PeriphPower   // power supplies
+)
+
+var periphnames = []struct {
+	p    Peripherals
+	name string
+}{
+	{PeriphPower, "power"},
+	{PeriphPullups, "pullups"},
+	{PeriphAUX, "aux"},
+	{PeriphCS, "cs"},
+}
+
+// String returns the names of the peripherals switched on, like
+// "power|pullups", or "none".
+func (p Peripherals) String() string {
+	var names []string
+	for _, n := range periphnames {
+		if p&n.p != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// i2cconfig is the configuration of I2C mode set by the user. The
+// firmware forgets it when leaving the mode.
+type i2cconfig struct {
+	speed  int // Hz, 0 for the firmware default
+	periph Peripherals
+	pullup PullupVoltage // 0 if not set
+}
+
+// i2cspeeds maps bus speeds to their command bits.
+var i2cspeeds = map[int]byte{
+	5000:   wire.Speed5kHz,
+	50000:  wire.Speed50kHz,
+	100000: wire.Speed100kHz,
+	400000: wire.Speed400kHz,
+}
+
+// SetSpeed sets the I2C bus speed to hz, one of 5000, 50000, 100000 and
+// 400000, see Capabilities.I2CSpeeds. The speeds are approximate.
+func (inf BusPirateI2C) SetSpeed(hz int) error {
+	return inf.bp.do(func() error { return inf.setSpeed(hz) })
+}
+
+func (inf BusPirateI2C) setSpeed(hz int) (err error) {
+	bp := inf.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+	defer func() { bp.report(err) }()
+
+	if err := inf.check("i2c.SetSpeed"); err != nil {
+		return err
+	}
+	if err := bp.settle(); err != nil {
+		return err
+	}
+	bits, ok := i2cspeeds[hz]
+	if !ok {
+		return &OpError{"i2c.SetSpeed", MODE_I2C, nil, fmt.Errorf("unsupported speed %d Hz", hz)}
+	}
+
+	bp.stats.Commands++
+	if err := bp.exchangeByteAndExpect(wire.I2CSpeed|bits, wire.OK); err != nil {
+		return &OpError{"i2c.SetSpeed", MODE_I2C, nil, err}
+	}
+	bp.i2cconf.speed = hz
+	bp.xferrate = 0
+	return nil
+}
+
+// SetPeripherals switches the peripherals in p on and all others off.
+func (inf BusPirateI2C) SetPeripherals(p Peripherals) error {
+	return inf.bp.do(func() error { return inf.setPeripherals(p) })
+}
+
+func (inf BusPirateI2C) setPeripherals(p Peripherals) (err error) {
+	bp := inf.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+	defer func() { bp.report(err) }()
+
+	if err := inf.check("i2c.SetPeripherals"); err != nil {
+		return err
+	}
+	if err := bp.settle(); err != nil {
+		return err
+	}
+	if p&^(PeriphPower|PeriphPullups|PeriphAUX|PeriphCS) != 0 {
+		return &OpError{"i2c.SetPeripherals", MODE_I2C, nil, fmt.Errorf("invalid peripherals %#02x", byte(p))}
+	}
+
+	bp.stats.Commands++
+	if err := bp.exchangeByteAndExpect(wire.I2CPeripherals|byte(p), wire.OK); err != nil {
+		return &OpError{"i2c.SetPeripherals", MODE_I2C, nil, err}
+	}
+	bp.i2cconf.periph = p
+	return nil
+}
+
+// ReadAUX reads the level of the AUX pin, for example the interrupt
+// output of a device. The pin is floated for that, it stays floating
+// until SetPeripherals drives it again.
+func (inf BusPirateI2C) ReadAUX() (level bool, err error) {
+	err = inf.bp.retry("i2c.ReadAUX", func() error {
+		level, err = inf.readAUX()
+		return err
+	})
+	return level, err
+}
+
+func (inf BusPirateI2C) readAUX() (_ bool, err error) {
+	bp := inf.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+
+	if err := inf.check("i2c.ReadAUX"); err != nil {
+		return false, err
+	}
+	if err := bp.settle(); err != nil {
+		return false, err
+	}
+	if err := bp.supports("i2c.ReadAUX", func(c Capabilities) bool { return c.AUXRead }); err != nil {
+		return false, err
+	}
+
+	bp.stats.Commands++
+	var level bool
+	err = bp.pipe([]exch{
+		{op: "i2c.ReadAUX", out: []byte{wire.I2CAUX, wire.AUXHiZ, wire.I2CAUX}},
+		{op: "i2c.ReadAUX", out: []byte{wire.AUXRead}, check: func(in []byte) error {
+			if in[0] > 1 {
+				bp.suspicious()
+				return &ResponseError{Got: in[0], Want: 0x01}
+			}
+			level = in[0] == 1
+			return nil
+		}},
+	})
+	return level, err
+}
+
+// restoreI2CConfig sends conf to the bus pirate after I2C mode was
+// re-entered following a reset. The caller has to hold the lock.
+func (bp *BusPirate) restoreI2CConfig(conf i2cconfig) error {
+	if conf.speed != 0 {
+		if err := bp.exchangeByteAndExpect(wire.I2CSpeed|i2cspeeds[conf.speed], wire.OK); err != nil {
+			return err
+		}
+	}
+	if conf.pullup != 0 {
+		if err := bp.exchangeByteAndExpect(wire.I2CPullupVoltage|byte(conf.pullup), wire.OK); err != nil {
+			return err
+		}
+	}
+	if conf.periph != 0 {
+		if err := bp.exchangeByteAndExpect(wire.I2CPeripherals|byte(conf.periph), wire.OK); err != nil {
+			return err
+		}
+	}
+	bp.i2cconf = conf
+	return nil
+}
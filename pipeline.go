@@ -0,0 +1,350 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/distributed/bp/wire"
+)
+
+// Every byte of the I2C primitives, commands and data alike, is answered
+// with one byte. Waiting for each answer before sending the next byte
+// costs a USB round trip of 1-16ms per byte. Instead, commands are queued
+// and sent together, and the answers are checked in order once they are
+// in. The firmware has a receive FIFO of a few bytes and no flow control,
+// a byte arriving at a full FIFO is lost without notice. So only a
+// window of bytes is sent ahead of the answers.
+//
+// The firmware takes most commands off the FIFO as a whole before
+// carrying them out. The data of a bulk write is an exception, it takes
+// one byte, writes it to the bus and answers it before taking the next.
+// At low bus speeds, that is far slower than the serial link delivers
+// bytes, so the data bytes count as in flight until they are answered.
+
+// DefaultPipelineWindow is the number of bytes sent ahead of their
+// answers unless set otherwise with SetPipelineWindow. It is the depth of
+// the receive FIFO of the bus pirate's UART.
+const DefaultPipelineWindow = 4
+
+// SetPipelineWindow sets the number of bytes sent to the bus pirate ahead
+// of their answers, values below 1 mean DefaultPipelineWindow. Larger
+// windows save round trips, but may overrun the receive buffer of the
+// firmware, especially at low I2C speeds. A window of 1 makes every byte
+// wait for the answer to the previous one.
+func (bp *BusPirate) SetPipelineWindow(n int) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.window = n
+}
+
+// exch is a queued command. Unless answers is set, every byte of out is
+// answered with one byte, otherwise the command is answered with answers
+// bytes once all of out was sent. If short is set and returns true for
+// the first byte of the answer, the answer ends with it. check gets to
+// see the answer, a nil check requires every byte of it to be OK.
+type exch struct {
+	op      string
+	out     []byte
+	check   func(in []byte) error
+	answers int
+	short   func(first byte) bool
+}
+
+// answerLen returns the number of bytes c is answered with at most.
+func (c exch) answerLen() int {
+	if c.answers > 0 {
+		return c.answers
+	}
+	return len(c.out)
+}
+
+// pipe sends the commands, keeping at most the pipeline window of bytes
+// ahead of their answers, and checks the answers in order. Bytes count as
+// ahead if they follow the command that is carried out, which takes all
+// of its bytes off the receive buffer, or, for a command whose bytes are
+// answered one by one, if they follow the byte carried out. All checks
+// are run, as the commands were carried out on the device. The error of
+// the first failing command is returned. The caller has to hold the
+// lock.
+func (bp *BusPirate) pipe(cmds []exch) error {
+	window := bp.window
+	if window < 1 {
+		window = DefaultPipelineWindow
+	}
+
+	// ostart and oend hold the starts and ends of the commands in out
+	var out []byte
+	ostart := make([]int, len(cmds))
+	oend := make([]int, len(cmds))
+	for i, c := range cmds {
+		ostart[i] = len(out)
+		out = append(out, c.out...)
+		oend[i] = len(out)
+	}
+
+	// the answers are received into in and split up command by command,
+	// as their lengths may depend on their first bytes
+	var in []byte
+	answers := make([][]byte, len(cmds))
+	aend := make([]int, len(cmds))
+	sent, parsed := 0, 0
+	for cur := 0; cur < len(cmds); {
+		c := cmds[cur]
+		if avail := in[parsed:]; len(avail) > 0 {
+			n := c.answerLen()
+			if c.short != nil && c.short(avail[0]) {
+				n = 1
+			}
+			if len(avail) >= n {
+				answers[cur] = avail[:n]
+				parsed += n
+				aend[cur] = parsed
+				cur++
+				continue
+			}
+		}
+
+		limit := oend[cur] + window - 1
+		if c.answers == 0 {
+			// the bytes answered so far and the one carried out
+			// are off the receive buffer
+			limit = ostart[cur] + len(in) - parsed + window
+		}
+		if limit > len(out) {
+			limit = len(out)
+		}
+		if sent < limit {
+			if _, err := bp.c.Write(out[sent:limit]); err != nil {
+				k := sort.SearchInts(oend, sent+1)
+				return &OpError{cmds[k].op, bp.mode, nil, fmt.Errorf("write to bus pirate: %w", err)}
+			}
+			sent = limit
+			continue
+		}
+
+		// at most the answers of the commands sent completely are
+		// due, and those of the bytes sent of a command answering
+		// byte by byte
+		due := -(len(in) - parsed)
+		for k := cur; k < len(cmds) && ostart[k] < sent; k++ {
+			if oend[k] <= sent {
+				due += cmds[k].answerLen()
+				continue
+			}
+			if cmds[k].answers == 0 {
+				due += sent - ostart[k]
+			}
+			break
+		}
+		buf := make([]byte, due)
+
+		// empty reads are retried, the link reports a disconnect
+		// after too many of them. A read may time out after the
+		// answer of cur is in, when short answers were due.
+		n, err := bp.c.Read(buf)
+		in = append(in, buf[:n]...)
+		if err != nil && n == 0 {
+			return &OpError{c.op, bp.mode, nil, fmt.Errorf("read from bus pirate: %w", err)}
+		}
+	}
+
+	var first error
+	for i, c := range cmds {
+		ans := answers[i]
+
+		var err error
+		if c.check != nil {
+			err = c.check(ans)
+		} else {
+			for _, b := range ans {
+				if b != wire.OK {
+					bp.suspicious()
+					err = &ResponseError{Got: b, Want: wire.OK}
+					break
+				}
+			}
+		}
+		if err != nil && first == nil {
+			var rerr *ResponseError
+			if errors.As(err, &rerr) && rerr.Sent == nil && rerr.Received == nil {
+				// the bytes of the batch up to the answer
+				rerr.Sent = exchangeTail(out[:oend[i]])
+				rerr.Received = exchangeTail(in[:aend[i]])
+			}
+			first = &OpError{c.op, bp.mode, nil, err}
+		}
+	}
+	return first
+}
+
+// startExch returns the command for a start condition.
+func (bp *BusPirate) startExch() exch {
+	return exch{op: "i2c.Start", out: []byte{wire.I2CStart}, check: func(in []byte) error {
+		if in[0] != wire.OK {
+			bp.suspicious()
+			return &ResponseError{Got: in[0], Want: wire.OK}
+		}
+		if bp.txstart.IsZero() {
+			// a repeated start continues the transaction
+			bp.txstart = time.Now()
+		}
+		return nil
+	}}
+}
+
+// stopExch returns the command for a stop condition.
+func (bp *BusPirate) stopExch() exch {
+	return exch{op: "i2c.Stop", out: []byte{wire.I2CStop}, check: func(in []byte) error {
+		if in[0] != wire.OK {
+			bp.suspicious()
+			return &ResponseError{Got: in[0], Want: wire.OK}
+		}
+		bp.stats.Transactions++
+		bp.lasttx = time.Now()
+		if !bp.txstart.IsZero() {
+			bp.observe("i2c.Transaction", bp.txstart)
+			bp.txstart = time.Time{}
+		}
+		return nil
+	}}
+}
+
+// writeExchs returns the bulk write commands writing w, which is copied.
+func (bp *BusPirate) writeExchs(w []byte) []exch {
+	var cmds []exch
+	for len(w) > 0 {
+		n := len(w)
+		if n > wire.MaxBulkWrite {
+			n = wire.MaxBulkWrite
+		}
+		cmds = append(cmds,
+			exch{op: "i2c.WriteByte", out: []byte{wire.BulkWrite(n)}},
+			exch{op: "i2c.WriteByte", out: append([]byte(nil), w[:n]...), check: func(in []byte) error {
+				for _, ackb := range in {
+					if ackb != 0 {
+						bp.stats.NACKs++
+						return ErrNACK
+					}
+				}
+				return nil
+			}})
+		w = w[n:]
+	}
+	return cmds
+}
+
+// readExchs returns the commands reading len(r) bytes into r, all but
+// the last one acknowledged, the last one only if ack is set.
+func (bp *BusPirate) readExchs(r []byte, ack bool) []exch {
+	var cmds []exch
+	for i := range r {
+		i := i
+		cmds = append(cmds, exch{op: "i2c.ReadByte", out: []byte{wire.I2CRead}, check: func(in []byte) error {
+			r[i] = in[0]
+			return nil
+		}})
+		reply := byte(wire.I2CACK)
+		if i == len(r)-1 && !ack {
+			reply = wire.I2CNACK
+		}
+		cmds = append(cmds, exch{op: "i2c.ReadByte", out: []byte{reply}})
+	}
+	return cmds
+}
+
+// I2CPipeline queues I2C primitives to send them to the bus pirate in one
+// go, which saves a USB round trip for every byte. Its methods only queue,
+// Flush sends the queue and reports the outcome. Reads fill their buffers
+// during Flush.
+//
+// As nothing is known about the answers until Flush, the queue is carried
+// out even after a byte was not acknowledged, for example reading from a
+// device that NACKed its address returns 0xff. The error of the first
+// failing primitive is returned.
+//
+// An I2CPipeline is not safe for concurrent use, the traffic of one Flush
+// is not interleaved with other traffic of the bus pirate.
+type I2CPipeline struct {
+	inf       BusPirateI2C
+	cmds      []exch
+	commands  int  // primitives queued, for Stats
+	unstarted bool // a read or write was queued before the first start
+	started   bool
+}
+
+// Pipeline returns a new, empty pipeline for inf. The pipeline uses inf
+// when flushed, so it becomes stale along with it.
+func (inf BusPirateI2C) Pipeline() *I2CPipeline {
+	return &I2CPipeline{inf: inf}
+}
+
+// Len returns the number of primitives queued.
+func (p *I2CPipeline) Len() int {
+	return p.commands
+}
+
+// Start queues a start condition, or a repeated start condition in a
+// transaction.
+func (p *I2CPipeline) Start() {
+	p.started = true
+	p.commands++
+	p.cmds = append(p.cmds, p.inf.bp.startExch())
+}
+
+// Stop queues a stop condition.
+func (p *I2CPipeline) Stop() {
+	p.commands++
+	p.cmds = append(p.cmds, p.inf.bp.stopExch())
+}
+
+// Write queues writing the bytes of w. w is copied.
+func (p *I2CPipeline) Write(w ...byte) {
+	p.unstarted = p.unstarted || !p.started
+	p.commands += len(w)
+	p.cmds = append(p.cmds, p.inf.bp.writeExchs(w)...)
+}
+
+// Read queues reading len(r) bytes into r. All bytes but the last are
+// acknowledged, the last one only if ack is set. r is filled by Flush.
+func (p *I2CPipeline) Read(r []byte, ack bool) {
+	p.unstarted = p.unstarted || !p.started
+	p.commands += len(r)
+	p.cmds = append(p.cmds, p.inf.bp.readExchs(r, ack)...)
+}
+
+// Flush sends the queued primitives and empties the queue. The retry
+// policy applies to the queue as a whole.
+func (p *I2CPipeline) Flush() error {
+	cmds, commands, unstarted := p.cmds, p.commands, p.unstarted
+	p.cmds, p.commands, p.unstarted, p.started = nil, 0, false, false
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	inf := p.inf
+	return inf.bp.retry("i2c.Pipeline", func() (err error) {
+		bp := inf.bp
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+
+		if err := inf.check("i2c.Pipeline"); err != nil {
+			return err
+		}
+		if unstarted {
+			if err := inf.checkDryRun("i2c.Pipeline"); err != nil {
+				return err
+			}
+		}
+		inf.pace(bp.txstart.IsZero())
+		bp.stats.Commands += uint64(commands)
+
+		bp.logf(SubsysI2C, LogDebug, "pipeline of %d primitives", commands)
+		return bp.pipe(append(bp.pendingWrites(), cmds...))
+	})
+}
@@ -0,0 +1,206 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/distributed/bp"
+	"github.com/distributed/bp/bptest"
+)
+
+// openI2C is the traffic of Open and EnterI2CMode on a bus pirate
+// already in binary mode.
+const openI2C = `
+# Open
+> 00
+< 42 42 49 4f 31
+< timeout
+# EnterI2CMode
+> 02
+< 49 32 43 31
+`
+
+// i2cGolden returns a bus pirate in I2C mode talking to the transcript
+// openI2C followed by golden.
+func i2cGolden(t *testing.T, golden string) (*bp.BusPirate, bp.BusPirateI2C) {
+	t.Helper()
+	b := bptest.NewBusPirate(t, openI2C+golden)
+	if err := b.Open(); err != nil {
+		t.Fatal(err)
+	}
+	i, err := b.EnterI2CMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, i
+}
+
+// queueWriteRead queues writing two registers of the device at 0x50,
+// then reading two, on p.
+func queueWriteRead(p *bp.I2CPipeline, r []byte) {
+	p.Start()
+	p.Write(0xa0, 0x00, 0x11, 0x22)
+	p.Start()
+	p.Write(0xa1)
+	p.Read(r, false)
+	p.Stop()
+}
+
+func TestPipelineWindow(t *testing.T) {
+	for _, c := range []struct {
+		window int
+		golden string
+	}{
+		{1, `
+			# every byte waits for the answer to the one before
+			> 02
+			< 01
+			> 13
+			< 01
+			> a0
+			< 00
+			> 00
+			< 00
+			> 11
+			< 00
+			> 22
+			< 00
+			> 02
+			< 01
+			> 10
+			< 01
+			> a1
+			< 00
+			> 04
+			< 5a
+			> 06
+			< 01
+			> 04
+			< 5b
+			> 07
+			< 01
+			> 03
+			< 01
+		`},
+		{4, `
+			# the data of a bulk write is in flight until answered
+			> 02 13 a0 00
+			< 01 01 00 00
+			> 11 22 02 10
+			< 00 00 01 01
+			> a1 04 06 04
+			< 00 5a 01 5b
+			> 07 03
+			< 01 01
+		`},
+		{16, `
+			> 02 13 a0 00 11 22 02 10 a1 04 06 04 07 03
+			< 01 01 00 00 00 00 01 01 00 5a 01 5b 01 01
+		`},
+	} {
+		t.Run("", func(t *testing.T) {
+			b, i := i2cGolden(t, c.golden)
+			b.SetPipelineWindow(c.window)
+
+			r := make([]byte, 2)
+			p := i.Pipeline()
+			queueWriteRead(p, r)
+			if err := p.Flush(); err != nil {
+				t.Fatalf("window %d: %v", c.window, err)
+			}
+			if r[0] != 0x5a || r[1] != 0x5b {
+				t.Errorf("window %d: read % x, want 5a 5b", c.window, r)
+			}
+		})
+	}
+}
+
+func TestPipelineNACK(t *testing.T) {
+	b, i := i2cGolden(t, `
+		# 0x11 is NACKed, the rest of the batch is carried out
+		> 02 13 a0 00
+		< 01 01 00 00
+		> 11 22 02 10
+		< 01 00 01 01
+		> a1 04 06 04
+		< 00 5a 01 5b
+		> 07 03
+		< 01 01
+	`)
+	b.SetPipelineWindow(4)
+
+	r := make([]byte, 2)
+	p := i.Pipeline()
+	queueWriteRead(p, r)
+	err := p.Flush()
+	if !errors.Is(err, bp.ErrNACK) {
+		t.Fatalf("got %v, want a NACK", err)
+	}
+	var operr *bp.OpError
+	if !errors.As(err, &operr) || operr.Op != "i2c.WriteByte" {
+		t.Errorf("got %#v, want an OpError of i2c.WriteByte", err)
+	}
+	if r[0] != 0x5a || r[1] != 0x5b {
+		t.Errorf("read % x, want 5a 5b", r)
+	}
+	if st := b.Stats(); st.NACKs != 1 || st.Transactions != 1 {
+		t.Errorf("%d NACKs and %d transactions, want 1 each", st.NACKs, st.Transactions)
+	}
+}
+
+func TestPipelineResync(t *testing.T) {
+	b, i := i2cGolden(t, `
+		# the first start is answered with garbage
+		> 02 13 a0 00
+		< 00 01 00 00
+		> 11 22 02 10
+		< 00 00 01 01
+		> a1 04 06 04
+		< 00 5a 01 5b
+		> 07 03
+		< 01 01
+
+		# the check of the start resyncs
+		< timeout
+		> 00
+		< 42 42 49 4f 31
+		< timeout
+		> 02
+		< 49 32 43 31
+
+		# and the handle is usable afterwards
+		> 02
+		< 01
+		> 03
+		< 01
+	`)
+	b.SetPipelineWindow(4)
+	b.SetAutoResync(true)
+
+	r := make([]byte, 2)
+	p := i.Pipeline()
+	queueWriteRead(p, r)
+	err := p.Flush()
+	var rerr *bp.ResponseError
+	if !errors.As(err, &rerr) || rerr.Got != 0x00 || rerr.Want != 0x01 {
+		t.Fatalf("got %v, want a ResponseError for 00", err)
+	}
+	var operr *bp.OpError
+	if !errors.As(err, &operr) || operr.Op != "i2c.Start" {
+		t.Errorf("got %#v, want an OpError of i2c.Start", err)
+	}
+	if st := b.Stats(); st.Resyncs != 1 {
+		t.Errorf("%d resyncs, want 1", st.Resyncs)
+	}
+
+	if err := i.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
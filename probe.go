@@ -0,0 +1,141 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/distributed/bp/wire"
+)
+
+// ErrNoBusPirate is returned by Probe if the device on the other end of
+// the connection doesn't answer like a bus pirate.
+var ErrNoBusPirate = errors.New("no bus pirate found")
+
+// ProbeResult describes a bus pirate found by Probe.
+type ProbeResult struct {
+	// Terminal is true if the bus pirate was found in its user
+	// terminal, false if it was in binary mode.
+	Terminal bool
+
+	// Prompt is the mode shown by the terminal prompt, like "HiZ" or
+	// "I2C". Only set if Terminal is true.
+	Prompt string
+
+	// VersionInfo holds the versions reported by the 'i' command of the
+	// terminal. Only set if Terminal is true.
+	VersionInfo
+
+	// BBIO is the version of the binary bitbang protocol, like '1'. Only
+	// set if Terminal is false, the terminal doesn't tell.
+	BBIO byte
+}
+
+const (
+	probequiet = 100 * time.Millisecond // end of an answer
+	probemax   = 1024                   // maximum length of an answer
+)
+
+// Probe checks whether a bus pirate is connected via c and returns what
+// it could find out about it. It does not enter binary mode. In the
+// terminal, it only sends an empty line and the 'i' command. In binary
+// mode, it sends a single 0x00, which leaves a protocol mode for bitbang
+// mode, the only change made to the device's state. c is left open.
+func Probe(c Conn) (*ProbeResult, error) {
+	if err := c.SetReadParams(0, probequiet.Seconds()); err != nil {
+		return nil, err
+	}
+
+	// stale output
+	if _, err := readQuiet(c); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.Write([]byte("\n")); err != nil {
+		return nil, err
+	}
+	ans, err := readQuiet(c)
+	if err != nil {
+		return nil, err
+	}
+	if prompt, ok := parsePrompt(ans); ok {
+		return probeTerminal(c, prompt)
+	}
+
+	if _, err := c.Write([]byte{wire.Reset}); err != nil {
+		return nil, err
+	}
+	ans, err = readQuiet(c)
+	if err != nil {
+		return nil, err
+	}
+	var s bannerScanner
+	s.prefix = wire.BitbangBanner
+	for _, b := range ans {
+		if v, ok := s.feed(b); ok {
+			return &ProbeResult{BBIO: v}, nil
+		}
+	}
+
+	return nil, ErrNoBusPirate
+}
+
+func probeTerminal(c Conn, prompt string) (*ProbeResult, error) {
+	r := &ProbeResult{Terminal: true, Prompt: prompt}
+
+	if _, err := c.Write([]byte("i\n")); err != nil {
+		return nil, err
+	}
+	ans, err := readQuiet(c)
+	if err != nil {
+		return nil, err
+	}
+
+	r.VersionInfo = parseInfo(string(ans))
+
+	if r.Hardware == "" {
+		return nil, ErrNoBusPirate
+	}
+	return r, nil
+}
+
+// parsePrompt finds a terminal prompt like "HiZ>" at the end of ans.
+func parsePrompt(ans []byte) (string, bool) {
+	ans = bytes.TrimRight(ans, " ")
+	if !bytes.HasSuffix(ans, []byte(">")) {
+		return "", false
+	}
+	l := ans[:len(ans)-1]
+	if i := bytes.LastIndexAny(l, "\r\n"); i >= 0 {
+		l = l[i+1:]
+	}
+	return string(l), true
+}
+
+// readQuiet reads from c until it has been quiet for the read timeout or
+// probemax bytes have been read.
+func readQuiet(c Conn) ([]byte, error) {
+	var (
+		ans []byte
+		buf [64]byte
+	)
+	deadline := time.Now().Add(time.Second)
+	for len(ans) < probemax && time.Now().Before(deadline) {
+		n, err := c.Read(buf[:])
+		ans = append(ans, buf[:n]...)
+		if err != nil {
+			if isTimeout(err) {
+				break
+			}
+			return ans, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return ans, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+	"time"
+)
+
+// Progress tells how far a long operation, like ReadMem, DumpRange,
+// UpdateFirmware or the Send of a UART bridge in package sc16is7xx, got.
+type Progress struct {
+	Done    int64         // bytes transferred so far
+	Total   int64         // bytes to transfer in total
+	Elapsed time.Duration // since the operation started
+}
+
+// Rate returns the bytes transferred per second so far.
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Done) / p.Elapsed.Seconds()
+}
+
+// ETA returns the time the rest of the operation takes at the rate so
+// far, 0 if it is not known yet.
+func (p Progress) ETA() time.Duration {
+	rate := p.Rate()
+	if rate == 0 {
+		return 0
+	}
+	return time.Duration(float64(p.Total-p.Done) / rate * float64(time.Second))
+}
+
+func (p Progress) String() string {
+	s := fmt.Sprintf("%d/%d bytes", p.Done, p.Total)
+	if rate := p.Rate(); rate > 0 {
+		s += fmt.Sprintf(", %.0f bytes/s", rate)
+		if p.Done < p.Total {
+			s += fmt.Sprintf(", %v left", p.ETA().Round(time.Second))
+		}
+	}
+	return s
+}
+
+// ProgressFunc is called by long operations as they make progress. If it
+// returns an error, the operation is canceled and returns that error. A
+// ProgressFunc may be called on the I/O goroutine, so it must not call
+// methods of the BusPirate.
+type ProgressFunc func(Progress) error
+
+// progressMeter reports the progress of an operation of total bytes to
+// fn, which may be nil.
+type progressMeter struct {
+	fn    ProgressFunc
+	total int64
+	start time.Time
+}
+
+func newProgressMeter(fn ProgressFunc, total int64) progressMeter {
+	return progressMeter{fn: fn, total: total, start: time.Now()}
+}
+
+// report reports that done bytes are transferred and returns the error of
+// fn, if any.
+func (p progressMeter) report(done int64) error {
+	if p.fn == nil {
+		return nil
+	}
+	return p.fn(Progress{Done: done, Total: p.total, Elapsed: time.Since(p.start)})
+}
@@ -0,0 +1,77 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package prom exports the metrics of a bus pirate to Prometheus.
+//
+//	s := prom.New("buspirate", prometheus.Labels{"port": "/dev/ttyUSB0"})
+//	prometheus.MustRegister(s)
+//	b.SetMetrics(s)
+package prom
+
+import (
+	"time"
+
+	"github.com/distributed/bp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sink is a bp.MetricsSink and a prometheus.Collector. Every counter of
+// bp.CounterNames becomes a counter named namespace_name_total, the
+// durations of operations become the histogram
+// namespace_operation_duration_seconds with the label op.
+type Sink struct {
+	counters  map[string]prometheus.Counter
+	durations *prometheus.HistogramVec
+}
+
+// New returns a Sink with metrics in namespace. constLabels are added to
+// all metrics, they tell apart several bus pirates.
+func New(namespace string, constLabels prometheus.Labels) *Sink {
+	s := &Sink{counters: make(map[string]prometheus.Counter)}
+	for _, name := range bp.CounterNames {
+		s.counters[name] = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        name + "_total",
+			Help:        "Bus pirate " + name + ", see bp.Stats.",
+			ConstLabels: constLabels,
+		})
+	}
+	s.durations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   namespace,
+		Name:        "operation_duration_seconds",
+		Help:        "Duration of bus pirate operations including retries.",
+		ConstLabels: constLabels,
+		// 100µs to about 1.6s, a byte takes about 90µs at 115200 baud
+		Buckets: prometheus.ExponentialBuckets(100e-6, 2, 15),
+	}, []string{"op"})
+	return s
+}
+
+// Count implements bp.MetricsSink. Unknown names are ignored.
+func (s *Sink) Count(name string, delta uint64) {
+	if c, ok := s.counters[name]; ok {
+		c.Add(float64(delta))
+	}
+}
+
+// Observe implements bp.MetricsSink.
+func (s *Sink) Observe(op string, d time.Duration) {
+	s.durations.WithLabelValues(op).Observe(d.Seconds())
+}
+
+// Describe implements prometheus.Collector.
+func (s *Sink) Describe(ch chan<- *prometheus.Desc) {
+	for _, name := range bp.CounterNames {
+		s.counters[name].Describe(ch)
+	}
+	s.durations.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (s *Sink) Collect(ch chan<- prometheus.Metric) {
+	for _, name := range bp.CounterNames {
+		s.counters[name].Collect(ch)
+	}
+	s.durations.Collect(ch)
+}
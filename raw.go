@@ -0,0 +1,126 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"io"
+	"time"
+)
+
+// The raw functions give access to firmware commands this package doesn't
+// wrap. The package can't know what they did to the device, so they set
+// the mode to unknown, which makes all mode handles stale. Use Resync or
+// Open to get back into a known state afterwards.
+
+type rawTimeout struct{}
+
+func (rawTimeout) Error() string   { return "raw read timed out" }
+func (rawTimeout) Timeout() bool   { return true }
+func (rawTimeout) Temporary() bool { return true }
+
+// rawCheck returns an error if raw access isn't possible right now. The
+// caller has to hold the lock.
+func (bp *BusPirate) rawCheck(op string) error {
+	switch bp.mode {
+	case MODE_CLOSED:
+		return &OpError{op, bp.mode, nil, ErrNotOpen}
+	case MODE_I2C_SNIFF:
+		return &OpError{op, bp.mode, nil, ModeError("raw access while the sniffer is running")}
+	}
+	return bp.settle()
+}
+
+// raw runs fn for the raw access op on the I/O goroutine, holding the lock,
+// if raw access is possible.
+func (bp *BusPirate) raw(op string, fn func() ([]byte, error)) (b []byte, err error) {
+	err = bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		defer func() { bp.report(err) }()
+
+		if err := bp.rawCheck(op); err != nil {
+			return err
+		}
+		b, err = fn()
+		return err
+	})
+	return b, err
+}
+
+// RawWrite sends b to the bus pirate as is.
+func (bp *BusPirate) RawWrite(b []byte) error {
+	_, err := bp.raw("RawWrite", func() ([]byte, error) {
+		return nil, bp.rawWrite(b)
+	})
+	return err
+}
+
+func (bp *BusPirate) rawWrite(b []byte) error {
+	mode := bp.mode
+	bp.clearMode()
+	bp.logf(SubsysOpen, LogDebug, "raw write % x", b)
+	if _, err := bp.c.Write(b); err != nil {
+		return &OpError{"RawWrite", mode, nil, err}
+	}
+	if err := bp.link.flush(); err != nil {
+		return &OpError{"RawWrite", mode, nil, err}
+	}
+	return nil
+}
+
+// RawReadN reads n bytes from the bus pirate. It fails if they don't
+// arrive within timeout, the bytes read until then are returned.
+func (bp *BusPirate) RawReadN(n int, timeout time.Duration) ([]byte, error) {
+	return bp.raw("RawReadN", func() ([]byte, error) {
+		return bp.rawReadN(n, timeout)
+	})
+}
+
+func (bp *BusPirate) rawReadN(n int, timeout time.Duration) ([]byte, error) {
+	mode := bp.mode
+	bp.clearMode()
+
+	// the timeout is for these n bytes only, the operations after them
+	// get the read parameters they were set up with
+	if minread, t, ok := bp.link.readParams(); ok {
+		defer func() {
+			if err := bp.c.SetReadParams(minread, t); err != nil {
+				bp.logf(SubsysOpen, LogError, "restoring read parameters: %v", err)
+			}
+		}()
+	}
+	if err := bp.c.SetReadParams(0, timeout.Seconds()); err != nil {
+		return nil, &OpError{"RawReadN", mode, nil, err}
+	}
+
+	// a single read waits at most timeout, so keep track of the time
+	// for the whole of the n bytes
+	buf := make([]byte, n)
+	got := 0
+	deadline := time.Now().Add(timeout)
+	for got < n {
+		rn, err := io.ReadAtLeast(bp.c, buf[got:], 1)
+		got += rn
+		if err != nil {
+			return buf[:got], &OpError{"RawReadN", mode, nil, err}
+		}
+		if got < n && !time.Now().Before(deadline) {
+			return buf[:got], &OpError{"RawReadN", mode, nil, rawTimeout{}}
+		}
+	}
+	bp.logf(SubsysOpen, LogDebug, "raw read % x", buf)
+	return buf, nil
+}
+
+// RawExchange sends w to the bus pirate and reads n bytes of answer, like
+// RawWrite followed by RawReadN.
+func (bp *BusPirate) RawExchange(w []byte, n int, timeout time.Duration) ([]byte, error) {
+	return bp.raw("RawExchange", func() ([]byte, error) {
+		if err := bp.rawWrite(w); err != nil {
+			return nil, err
+		}
+		return bp.rawReadN(n, timeout)
+	})
+}
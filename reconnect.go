@@ -0,0 +1,248 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Dialer opens a new connection to the bus pirate. The connection has to
+// be configured like the one passed to NewBusPirate.
+type Dialer func() (Conn, error)
+
+// linkConn sits below everything else talking to the Conn passed to
+// NewBusPirate and remembers the first failure of the serial link.
+// Timeouts are part of normal operation and don't count. Errors meaning
+// that the device is gone are turned into disconnect errors.
+//
+// Writes are collected in a buffer, so that a command made of several
+// writes, like the header and the payload of a write then read, goes out
+// as a single USB packet. The buffer is flushed before every read and at
+// the end of every operation, see unlock. Errors of buffered writes are
+// returned by the flush.
+type linkConn struct {
+	Conn
+
+	mu     sync.Mutex
+	err    error
+	zeros  int
+	notify []chan<- error
+	last   time.Time // last time data was sent or received
+	buf    []byte    // written, not flushed yet
+
+	// the read parameters last set, see readParams
+	minread  int
+	timeout  float64
+	paramset bool
+
+	read, written uint64
+}
+
+func (lc *linkConn) Read(b []byte) (int, error) {
+	if err := lc.flush(); err != nil {
+		return 0, err
+	}
+	n, err := lc.Conn.Read(b)
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if n == 0 && err == nil && len(b) > 0 {
+		lc.zeros++
+		if lc.zeros >= maxzeroreads {
+			lc.zeros = 0
+			err = io.EOF
+		}
+	} else {
+		lc.zeros = 0
+	}
+	if n > 0 {
+		lc.last = time.Now()
+		lc.read += uint64(n)
+	}
+	return n, lc.record(err)
+}
+
+func (lc *linkConn) Write(b []byte) (int, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.buf = append(lc.buf, b...)
+	return len(b), nil
+}
+
+// flush writes the buffered bytes to the connection.
+func (lc *linkConn) flush() error {
+	lc.mu.Lock()
+	b := lc.buf
+	lc.buf = nil
+	lc.mu.Unlock()
+	if len(b) == 0 {
+		return nil
+	}
+
+	n, err := lc.Conn.Write(b)
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if n > 0 {
+		lc.last = time.Now()
+		lc.written += uint64(n)
+	}
+	return lc.record(err)
+}
+
+// SetReadParams sets the read parameters of the connection and remembers
+// them for readParams.
+func (lc *linkConn) SetReadParams(minread int, timeout float64) error {
+	if err := lc.Conn.SetReadParams(minread, timeout); err != nil {
+		return err
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.minread, lc.timeout, lc.paramset = minread, timeout, true
+	return nil
+}
+
+// readParams returns the read parameters last set, ok is false if none
+// were set.
+func (lc *linkConn) readParams() (minread int, timeout float64, ok bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.minread, lc.timeout, lc.paramset
+}
+
+// discard drops the buffered bytes, for a connection that is replaced.
+func (lc *linkConn) discard() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.buf = nil
+}
+
+// counts returns the number of bytes written and read.
+func (lc *linkConn) counts() (written, read uint64) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.written, lc.read
+}
+
+// idle returns the time since data was last sent or received.
+func (lc *linkConn) idle() time.Duration {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return time.Since(lc.last)
+}
+
+// record notes err and returns the error to pass on. The caller has to
+// hold lc.mu.
+func (lc *linkConn) record(err error) error {
+	if err == nil || isTimeout(err) {
+		return err
+	}
+	if isDisconnect(err) {
+		err = &disconnectError{err}
+		lc.disconnected(err)
+	}
+	if lc.err == nil {
+		lc.err = err
+	}
+	return err
+}
+
+// failed returns the recorded failure and forgets it.
+func (lc *linkConn) failed() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	err := lc.err
+	lc.err = nil
+	return err
+}
+
+// SetReconnect makes bp reestablish the connection with dial whenever the
+// serial link fails, for example because the USB cable was unplugged. The
+// failed operation still returns its error. Afterwards bp closes the old
+// connection, dials a new one, enters binary mode and re-enters the mode
+// that was active before, mode handles obtained before remain usable.
+// Passing nil turns reconnecting off.
+func (bp *BusPirate) SetReconnect(dial Dialer) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.dial = dial
+}
+
+// Reconnect closes the connection to the bus pirate, dials a new one with
+// the Dialer set by SetReconnect and restores the mode as described
+// there.
+func (bp *BusPirate) Reconnect() error {
+	return bp.do(func() error {
+		bp.mu.Lock()
+		defer bp.mu.Unlock()
+		defer bp.feedMetrics()
+		if bp.dial == nil {
+			return bp.report(&OpError{"Reconnect", bp.mode, nil, ModeError("no dialer set")})
+		}
+		return bp.report(bp.reconnect())
+	})
+}
+
+func (bp *BusPirate) reconnect() (err error) {
+	if bp.mode == MODE_CLOSED {
+		return &OpError{"Reconnect", bp.mode, nil, ErrNotOpen}
+	}
+	defer func() {
+		bp.emit(Event{Kind: EventReconnect, Mode: bp.mode, Err: err})
+	}()
+
+	prev := bp.mode
+	prevgen := bp.gen
+	bp.logf(SubsysOpen, LogInfo, "reconnecting, was in %s mode", prev)
+	bp.stats.Reconnects++
+
+	bp.abortSniffer()
+	bp.clearMode()
+	bp.link.discard()
+	if err := bp.link.Conn.Close(); err != nil {
+		bp.logf(SubsysOpen, LogDebug, "closing old connection: %v", err)
+	}
+
+	c, err := bp.dial()
+	if err != nil {
+		return &OpError{"Reconnect", prev, nil, err}
+	}
+	bp.link.Conn = c
+	bp.link.failed()
+	bp.version = nil
+	bp.baud = 0
+
+	if err := bp.enterBinary(); err != nil {
+		return err
+	}
+	return bp.restore(prev, prevgen)
+}
+
+// unlock releases the lock taken by an operation on the device, whose
+// error is at errp. The bytes still buffered are sent first, if that
+// fails, the failure becomes the error of the operation unless it failed
+// already. If the serial link failed during the operation and a Dialer
+// is set, the connection is reestablished before releasing the lock.
+func (bp *BusPirate) unlock(errp *error) {
+	defer bp.mu.Unlock()
+	defer bp.feedMetrics()
+
+	if err := bp.link.flush(); err != nil && *errp == nil {
+		*errp = bp.report(&OpError{"Flush", bp.mode, nil, fmt.Errorf("write to bus pirate: %w", err)})
+	}
+
+	err := bp.link.failed()
+	if err == nil || bp.dial == nil || bp.mode == MODE_CLOSED {
+		return
+	}
+	bp.logf(SubsysOpen, LogError, "serial link failed: %v", err)
+	if err := bp.reconnect(); err != nil {
+		bp.logf(SubsysOpen, LogError, "reconnect failed: %v", err)
+	}
+	bp.link.failed()
+}
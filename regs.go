@@ -0,0 +1,116 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp/wire"
+)
+
+// ReadReg reads len(r) bytes from register reg of the slave at addr with
+// a Transact8x8, for RegReadWriter.
+func (nsi NonStrictI2C) ReadReg(addr Addr, reg uint8, r []byte) error {
+	_, _, err := nsi.Transact8x8(addr, reg, nil, r)
+	return err
+}
+
+// WriteReg writes w to register reg of the slave at addr with a
+// Transact8x8, for RegReadWriter.
+func (nsi NonStrictI2C) WriteReg(addr Addr, reg uint8, w ...byte) error {
+	_, _, err := nsi.Transact8x8(addr, reg, w, nil)
+	return err
+}
+
+// ReadRegs reads n bytes from each of the registers regs of the device at
+// the 7 bit address addr, like a Transact8x8 without writes per register,
+// and returns them in the order of regs. Instead of waiting for the
+// answer of every write then read command before sending the next, all
+// commands are sent in one go within the pipeline window and the answers
+// are checked afterwards, see SetPipelineWindow. If the device does not
+// acknowledge, the remaining commands are carried out nonetheless and
+// ErrNoSuchDevice is returned.
+func (nsi NonStrictI2C) ReadRegs(addr Addr, regs []uint8, n int) (vals [][]byte, err error) {
+	err = nsi.bp.retry("i2c.ReadRegs", func() error {
+		vals, err = nsi.readRegs(addr, regs, n)
+		return err
+	})
+	return vals, err
+}
+
+func (nsi NonStrictI2C) readRegs(addr Addr, regs []uint8, n int) (_ [][]byte, err error) {
+	bp := nsi.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+
+	if err := nsi.check("i2c.ReadRegs"); err != nil {
+		return nil, err
+	}
+	if err := bp.settle(); err != nil {
+		return nil, err
+	}
+	if err := bp.supports("i2c.ReadRegs", func(c Capabilities) bool { return c.WriteThenRead }); err != nil {
+		return nil, err
+	}
+	if addr.GetAddrLen() != 7 {
+		return nil, &OpError{"i2c.ReadRegs", MODE_I2C, addr, errors.New("nonstrict I2C only supports 7 bit addressing")}
+	}
+	if n < 1 || n > wire.MaxWriteThenRead {
+		return nil, &OpError{"i2c.ReadRegs", MODE_I2C, addr, fmt.Errorf("read of %d bytes requested, 1 to %d supported", n, wire.MaxWriteThenRead)}
+	}
+	if len(regs) == 0 {
+		return nil, nil
+	}
+
+	bp.logf(SubsysI2C, LogDebug, "nonstrict ReadRegs addr %v %d registers of %d bytes", addr, len(regs), n)
+
+	nsi.pace(true)
+	bp.stats.Commands += uint64(len(regs))
+	bp.stats.Transactions += uint64(len(regs))
+	defer func() { bp.lasttx = time.Now() }()
+
+	// like Transact8x8, a write of the register address followed by a
+	// read for every register
+	wa := uint8(addr.GetBaseAddr()) << 1
+	vals := make([][]byte, len(regs))
+	var cmds []exch
+	for i, reg := range regs {
+		vals[i] = make([]byte, n)
+		cmds = append(cmds,
+			bp.writeThenReadExch("i2c.ReadRegs", []byte{wa, reg}, nil),
+			bp.writeThenReadExch("i2c.ReadRegs", []byte{wa | 1}, vals[i]))
+	}
+	if err := bp.pipe(cmds); err != nil {
+		if oe, ok := err.(*OpError); ok {
+			oe.Addr = addr
+		}
+		return nil, err
+	}
+	return vals, nil
+}
+
+// writeThenReadExch returns the write then read command writing w and
+// reading into r. It is answered with the outcome of the write, followed
+// by the bytes read if the write succeeded.
+func (bp *BusPirate) writeThenReadExch(op string, w, r []byte) exch {
+	header := wire.WriteThenRead(len(w), len(r))
+	return exch{
+		op:      op,
+		out:     append(header[:], w...),
+		answers: 1 + len(r),
+		short:   func(first byte) bool { return first != wire.OK },
+		check: func(in []byte) error {
+			// see writeThenRead on the answer
+			if in[0] != wire.OK {
+				bp.stats.NACKs++
+				return ErrNoSuchDevice
+			}
+			copy(r, in[1:])
+			return nil
+		},
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Unsigned are the types of the registers read and written by ReadReg and
+// WriteReg. The width of the type is the width of the register.
+type Unsigned interface {
+	~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// regSize returns the size of T in bytes.
+func regSize[T Unsigned]() int {
+	return bits.Len64(uint64(^T(0))) / 8
+}
+
+// ReadReg reads the register reg of the slave at addr, as wide as T, and
+// assembles its bytes in order, binary.BigEndian or binary.LittleEndian.
+// For example
+//
+//	v, err := bp.ReadReg[uint16](b.I2C(), bp.Addr7(0x40), 0x02, binary.BigEndian)
+//
+// reads a 16 bit register sent most significant byte first, in strict
+// I2C. A NonStrictI2C does the same with a Transact8x8.
+func ReadReg[T Unsigned](rw RegReadWriter, addr Addr, reg uint8, order binary.ByteOrder) (T, error) {
+	b := make([]byte, regSize[T]())
+	if err := rw.ReadReg(addr, reg, b); err != nil {
+		return 0, err
+	}
+	switch len(b) {
+	case 1:
+		return T(b[0]), nil
+	case 2:
+		return T(order.Uint16(b)), nil
+	case 4:
+		return T(order.Uint32(b)), nil
+	}
+	return T(order.Uint64(b)), nil
+}
+
+// WriteReg writes v to the register reg of the slave at addr, as wide as
+// T, its bytes in order.
+func WriteReg[T Unsigned](rw RegReadWriter, addr Addr, reg uint8, v T, order binary.ByteOrder) error {
+	b := make([]byte, regSize[T]())
+	switch len(b) {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		order.PutUint16(b, uint16(v))
+	case 4:
+		order.PutUint32(b, uint32(v))
+	default:
+		order.PutUint64(b, uint64(v))
+	}
+	return rw.WriteReg(addr, reg, b...)
+}
@@ -0,0 +1,47 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/distributed/bp/sim"
+)
+
+// checkReg writes v to reg with WriteReg, checks the bytes the device got
+// against want and reads v back with ReadReg.
+func checkReg[T Unsigned](t *testing.T, rw RegReadWriter, dev *sim.Registers, reg uint8, v T, order binary.ByteOrder, want []byte) {
+	t.Helper()
+	if err := WriteReg(rw, Addr7(0x50), reg, v, order); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.Regs[reg : int(reg)+len(want)]; !bytes.Equal(got, want) {
+		t.Errorf("%T %#x %v: wrote % x, want % x", v, v, order, got, want)
+	}
+	got, err := ReadReg[T](rw, Addr7(0x50), reg, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != v {
+		t.Errorf("%T %v: read %#x, want %#x", v, order, got, v)
+	}
+}
+
+func TestRegTyped(t *testing.T) {
+	dev := &sim.Registers{}
+	b, nsi := simI2C(t, 0x50, dev)
+	for _, rw := range []RegReadWriter{nsi, b.I2C()} {
+		checkReg(t, rw, dev, 0x10, uint8(0xa5), binary.BigEndian, []byte{0xa5})
+		checkReg(t, rw, dev, 0x10, uint8(0x5a), binary.LittleEndian, []byte{0x5a})
+		checkReg(t, rw, dev, 0x20, uint16(0x0102), binary.BigEndian, []byte{0x01, 0x02})
+		checkReg(t, rw, dev, 0x20, uint16(0x0102), binary.LittleEndian, []byte{0x02, 0x01})
+		checkReg(t, rw, dev, 0x30, uint32(0x01020304), binary.BigEndian, []byte{0x01, 0x02, 0x03, 0x04})
+		checkReg(t, rw, dev, 0x30, uint32(0x01020304), binary.LittleEndian, []byte{0x04, 0x03, 0x02, 0x01})
+		checkReg(t, rw, dev, 0x40, uint64(0x0102030405060708), binary.BigEndian, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+		checkReg(t, rw, dev, 0x40, uint64(0x0102030405060708), binary.LittleEndian, []byte{8, 7, 6, 5, 4, 3, 2, 1})
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+// Resync brings the bus pirate back into a known state after the
+// protocol got out of step, for example because a byte was corrupted on
+// the serial link. It discards all pending output of the device, enters
+// binary bitbang mode afresh and then re-enters the mode that was active
+// before. Mode handles obtained before remain usable if Resync succeeds.
+func (bp *BusPirate) Resync() error {
+	return bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		return bp.report(bp.resync())
+	})
+}
+
+func (bp *BusPirate) resync() (err error) {
+	if bp.mode == MODE_CLOSED {
+		return &OpError{"Resync", bp.mode, nil, ErrNotOpen}
+	}
+	defer func() {
+		bp.emit(Event{Kind: EventResync, Mode: bp.mode, Err: err})
+	}()
+
+	bp.resyncing = true
+	defer func() { bp.resyncing = false }()
+	bp.stats.Resyncs++
+
+	prev := bp.mode
+	prevgen := bp.gen
+	bp.logf(SubsysOpen, LogInfo, "resynchronizing, was in %s mode", prev)
+
+	bp.abortSniffer()
+
+	n, err := bp.drain()
+	if err != nil {
+		bp.clearMode()
+		return err
+	}
+	bp.logf(SubsysOpen, LogDebug, "resync: drained %d bytes", n)
+
+	bp.clearMode()
+	if err := bp.enterBinary(); err != nil {
+		return err
+	}
+	return bp.restore(prev, prevgen)
+}
+
+// restore re-enters mode prev from bitbang mode after the bus pirate was
+// reset, with the configuration it had. Handles of generation prevgen
+// become valid again.
+func (bp *BusPirate) restore(prev Mode, prevgen uint64) error {
+	switch prev {
+	case MODE_I2C, MODE_I2C_SNIFF:
+		// the sniffer is not restarted, its reader is gone
+		conf := bp.i2cconf
+		if _, err := bp.enterI2CMode(); err != nil {
+			return err
+		}
+		if err := bp.restoreI2CConfig(conf); err != nil {
+			bp.clearMode()
+			return &OpError{"i2c.Restore", MODE_I2C, nil, err}
+		}
+		bp.gen = prevgen
+	case MODE_SPI:
+		conf := bp.spiconf
+		if _, err := bp.enterSPIMode(); err != nil {
+			return err
+		}
+		if err := bp.restoreSPIConfig(conf); err != nil {
+			bp.clearMode()
+			return &OpError{"spi.Restore", MODE_SPI, nil, err}
+		}
+		bp.gen = prevgen
+	}
+
+	return nil
+}
+
+// SetAutoResync makes bp call Resync on its own whenever the bus pirate
+// answers a command with something unexpected. The failed operation still
+// returns its error, but the link is usable again afterwards.
+func (bp *BusPirate) SetAutoResync(on bool) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.autoresync = on
+}
+
+// suspicious is called when a response did not match the protocol.
+func (bp *BusPirate) suspicious() {
+	if !bp.autoresync || bp.resyncing {
+		return
+	}
+	if err := bp.resync(); err != nil {
+		bp.logf(SubsysOpen, LogError, "automatic resync failed: %v", err)
+	}
+}
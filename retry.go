@@ -0,0 +1,89 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"time"
+)
+
+// RetryPolicy says how often and when a failed operation is tried again.
+// It applies to the I2C primitives Start, Stop, ReadByteAck and
+// WriteByte as a whole and to Transact8x8 as a whole. The zero value tries once.
+//
+// Retrying a primitive after a timeout may repeat traffic on the bus if
+// the bus pirate carried out the command and only the answer got lost.
+// Only use retries if your devices tolerate that.
+type RetryPolicy struct {
+	// Attempts is the total number of tries, values below 1 mean 1.
+	Attempts int
+
+	// Backoff is the wait before the second try. It doubles for every
+	// further try, up to MaxBackoff if that is not zero.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Retryable decides whether an error is worth another try. If nil,
+	// errors whose Temporary method returns true are retried, which
+	// includes timeouts.
+	Retryable func(error) bool
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return isTemporary(err)
+}
+
+// SetRetryPolicy makes bp retry failing operations according to p.
+func (bp *BusPirate) SetRetryPolicy(p RetryPolicy) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.retrypolicy = p
+}
+
+// retry calls op on the I/O goroutine until it succeeds or the retry
+// policy gives up. op takes the lock itself, it is not held while
+// waiting. name is the name of the operation for the metrics.
+func (bp *BusPirate) retry(name string, op func() error) error {
+	return bp.retryDirect(name, func() error { return bp.do(op) })
+}
+
+// retryDirect is retry for callers on the I/O goroutine, op is called
+// directly. The I/O goroutine waits along with it.
+func (bp *BusPirate) retryDirect(name string, op func() error) error {
+	bp.mu.Lock()
+	p := bp.retrypolicy
+	bp.mu.Unlock()
+
+	start := time.Now()
+	wait := p.Backoff
+	for i := 1; ; i++ {
+		err := op()
+		if err == nil || i >= p.Attempts || !p.retryable(err) {
+			bp.mu.Lock()
+			defer bp.mu.Unlock()
+			bp.observe(name, start)
+			if bp.dryrun && err == nil {
+				// failures are logged with their event
+				bp.logf(SubsysDryRun, LogInfo, "%s ok", name)
+			}
+			err = bp.report(err)
+			bp.feedMetrics()
+			return err
+		}
+
+		bp.logf(SubsysI2C, LogDebug, "try %d of %d failed, retrying in %v: %v", i, p.Attempts, wait, err)
+		bp.mu.Lock()
+		bp.stats.Retries++
+		bp.mu.Unlock()
+		time.Sleep(wait)
+
+		wait *= 2
+		if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+			wait = p.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package sc16is7xx drives the SC16IS750 and SC16IS752 I2C and SPI to
+// UART bridges. A Dev is a UART of a bridge, an io.ReadWriter, reached
+// over the I2C mode of package bp or an SPI bus.
+//
+// The UARTs have 64 byte FIFOs in both directions. Write waits for room
+// in the transmit FIFO, Read for data in the receive FIFO, both by
+// polling the bridge. Send is Write with progress reports, for long
+// sends. The eight GPIOs of the bridge are shared by its
+// UARTs, they are available as bp.Pin.
+package sc16is7xx
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// BaseAddr is the I2C address of the bridge with A0 and A1 tied to VDD.
+// Other connections of the pins give addresses from 0x48 to 0x57.
+const BaseAddr = 0x48
+
+// Registers.
+const (
+	regRHR       = 0x00 // THR when written
+	regFCR       = 0x02 // IIR when read
+	regLCR       = 0x03
+	regTXLVL     = 0x08
+	regRXLVL     = 0x09
+	regIODir     = 0x0a
+	regIOState   = 0x0b
+	regIOControl = 0x0e
+
+	// with LCR set to lcrDivisor
+	regDLL = 0x00
+	regDLH = 0x01
+)
+
+const (
+	lcrDivisor = 0x80
+
+	fcrEnable  = 0x01
+	fcrResetRX = 0x02
+	fcrResetTX = 0x04
+
+	ioSoftReset = 0x08
+)
+
+// DefaultXtal is the frequency of the crystal of most bridge boards in
+// Hz.
+const DefaultXtal = 14745600
+
+// DefaultTimeout is the Timeout of a new Dev.
+const DefaultTimeout = time.Second
+
+// ErrTimeout is returned by Read when no data arrives within the timeout,
+// and by Write when the transmit FIFO doesn't drain.
+var ErrTimeout = errors.New("timed out")
+
+// Parity is the parity of a UART.
+type Parity byte
+
+const (
+	NoParity   Parity = 0x00
+	OddParity  Parity = 0x08
+	EvenParity Parity = 0x18
+)
+
+// Config is the configuration of a UART.
+type Config struct {
+	Baud     int
+	DataBits int // 5 to 8, 0 means 8
+	Parity   Parity
+	StopBits int // 1 or 2, 0 means 1
+}
+
+// bus reaches the registers of a channel of the bridge.
+type bus interface {
+	read(reg byte, r []byte) error
+	write(reg byte, w []byte) error
+}
+
+type i2cBus struct {
+	t    bp.I2CTransactor8x8
+	addr bp.Addr7
+	ch   byte
+}
+
+// sub returns the subaddress of reg, the register and the channel.
+func sub(reg, ch byte) byte {
+	return reg<<3 | ch<<1
+}
+
+func (b *i2cBus) read(reg byte, r []byte) error {
+	_, _, err := b.t.Transact8x8(b.addr, sub(reg, b.ch), nil, r)
+	return err
+}
+
+func (b *i2cBus) write(reg byte, w []byte) error {
+	_, _, err := b.t.Transact8x8(b.addr, sub(reg, b.ch), w, nil)
+	return err
+}
+
+type spiBus struct {
+	s  bp.SPIMaster
+	ch byte
+}
+
+func (b *spiBus) read(reg byte, r []byte) error {
+	buf := make([]byte, 1+len(r))
+	buf[0] = 0x80 | sub(reg, b.ch)
+	if err := bp.SPITransfer(b.s, buf, buf); err != nil {
+		return err
+	}
+	copy(r, buf[1:])
+	return nil
+}
+
+func (b *spiBus) write(reg byte, w []byte) error {
+	return bp.SPITransfer(b.s, append([]byte{sub(reg, b.ch)}, w...), nil)
+}
+
+// Dev is a UART of an SC16IS750 or SC16IS752.
+type Dev struct {
+	b    bus
+	name string
+
+	// Xtal is the frequency of the crystal of the bridge in Hz,
+	// DefaultXtal unless set otherwise.
+	Xtal int
+
+	// Timeout is the time Read waits for data and Write for room in the
+	// transmit FIFO. 0 means forever.
+	Timeout time.Duration
+}
+
+// NewI2C returns UART ch, 0 or 1 on the SC16IS752, of the bridge at the 7
+// bit address addr.
+func NewI2C(t bp.I2CTransactor8x8, addr uint8, ch int) *Dev {
+	return &Dev{
+		b:       &i2cBus{t: t, addr: bp.Addr7(addr), ch: byte(ch & 1)},
+		name:    fmt.Sprintf("sc16is7xx %v/%d", bp.Addr7(addr), ch),
+		Xtal:    DefaultXtal,
+		Timeout: DefaultTimeout,
+	}
+}
+
+// NewSPI returns UART ch, 0 or 1 on the SC16IS752, of the bridge on s.
+func NewSPI(s bp.SPIMaster, ch int) *Dev {
+	return &Dev{
+		b:       &spiBus{s: s, ch: byte(ch & 1)},
+		name:    fmt.Sprintf("sc16is7xx spi/%d", ch),
+		Xtal:    DefaultXtal,
+		Timeout: DefaultTimeout,
+	}
+}
+
+func (d *Dev) readReg(op string, reg byte) (byte, error) {
+	r := make([]byte, 1)
+	if err := d.b.read(reg, r); err != nil {
+		return 0, d.err(op, err)
+	}
+	return r[0], nil
+}
+
+func (d *Dev) writeReg(op string, reg byte, v ...byte) error {
+	if err := d.b.write(reg, v); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+// Reset resets the bridge, both UARTs and the GPIOs.
+func (d *Dev) Reset() error {
+	// the bridge may reset before acknowledging the write
+	err := d.b.write(regIOControl, []byte{ioSoftReset})
+	if err != nil && !errors.Is(err, bp.ErrNACK) {
+		return d.err("reset", err)
+	}
+	return nil
+}
+
+// Configure sets the line parameters of the UART and enables and clears
+// its FIFOs.
+func (d *Dev) Configure(c Config) error {
+	if c.Baud <= 0 {
+		return d.err("configure", fmt.Errorf("invalid baud rate %d", c.Baud))
+	}
+	div := (d.Xtal + 8*c.Baud) / (16 * c.Baud)
+	if div < 1 || div > 0xffff {
+		return d.err("configure", fmt.Errorf("baud rate %d out of range for a %d Hz crystal", c.Baud, d.Xtal))
+	}
+
+	bits := c.DataBits
+	if bits == 0 {
+		bits = 8
+	}
+	if bits < 5 || bits > 8 {
+		return d.err("configure", fmt.Errorf("invalid number of data bits %d", bits))
+	}
+	lcr := byte(bits-5) | byte(c.Parity)
+	switch c.StopBits {
+	case 0, 1:
+	case 2:
+		lcr |= 0x04
+	default:
+		return d.err("configure", fmt.Errorf("invalid number of stop bits %d", c.StopBits))
+	}
+
+	if err := d.writeReg("configure", regLCR, lcrDivisor); err != nil {
+		return err
+	}
+	if err := d.writeReg("configure", regDLL, byte(div), byte(div>>8)); err != nil {
+		return err
+	}
+	if err := d.writeReg("configure", regLCR, lcr); err != nil {
+		return err
+	}
+	return d.ResetFIFOs()
+}
+
+// ResetFIFOs enables the FIFOs and drops their contents.
+func (d *Dev) ResetFIFOs() error {
+	return d.writeReg("reset FIFOs", regFCR, fcrEnable|fcrResetRX|fcrResetTX)
+}
+
+// Buffered returns the number of bytes in the receive FIFO.
+func (d *Dev) Buffered() (int, error) {
+	n, err := d.readReg("read RXLVL", regRXLVL)
+	return int(n), err
+}
+
+// deadline returns the time d.Timeout from now, or the zero time if there
+// is no timeout.
+func (d *Dev) deadline() time.Time {
+	if d.Timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d.Timeout)
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+// Read reads the bytes in the receive FIFO, up to len(p). It waits up to
+// Timeout for the first byte.
+func (d *Dev) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	deadline := d.deadline()
+	for {
+		n, err := d.Buffered()
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			if n > len(p) {
+				n = len(p)
+			}
+			// reads of RHR don't advance the register address
+			if err := d.b.read(regRHR, p[:n]); err != nil {
+				return 0, d.err("read", err)
+			}
+			return n, nil
+		}
+		if expired(deadline) {
+			return 0, d.err("read", ErrTimeout)
+		}
+	}
+}
+
+// Write writes p to the transmit FIFO, waiting for room as needed, up to
+// Timeout at a time.
+func (d *Dev) Write(p []byte) (int, error) {
+	return d.Send(p, nil)
+}
+
+// Send writes p like Write, for sends that take a while at low baud
+// rates. After every chunk put into the transmit FIFO, the bytes put
+// there so far are reported to progress, which may be nil. If progress
+// returns an error, Send stops and returns it.
+func (d *Dev) Send(p []byte, progress bp.ProgressFunc) (int, error) {
+	n := 0
+	start := time.Now()
+	deadline := d.deadline()
+	for n < len(p) {
+		room, err := d.readReg("read TXLVL", regTXLVL)
+		if err != nil {
+			return n, err
+		}
+		if room == 0 {
+			if expired(deadline) {
+				return n, d.err("write", ErrTimeout)
+			}
+			continue
+		}
+		size := len(p) - n
+		if size > int(room) {
+			size = int(room)
+		}
+		if err := d.b.write(regRHR, p[n:n+size]); err != nil {
+			return n, d.err("write", err)
+		}
+		n += size
+		deadline = d.deadline()
+
+		if progress != nil {
+			pr := bp.Progress{Done: int64(n), Total: int64(len(p)), Elapsed: time.Since(start)}
+			if err := progress(pr); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// SetGPIODirection makes the GPIOs whose bits are set in outputs outputs,
+// the others inputs.
+func (d *Dev) SetGPIODirection(outputs byte) error {
+	return d.writeReg("set GPIO direction", regIODir, outputs)
+}
+
+// WriteGPIO sets the levels of the GPIOs that are outputs to the bits of
+// v.
+func (d *Dev) WriteGPIO(v byte) error {
+	return d.writeReg("write GPIO", regIOState, v)
+}
+
+// ReadGPIO returns the levels of the GPIOs, GPIO0 in bit 0.
+func (d *Dev) ReadGPIO() (byte, error) {
+	return d.readReg("read GPIO", regIOState)
+}
+
+// Pin returns GPIO n, 0 to 7. Pins change the direction and level of
+// their GPIO by reading the registers and writing them back.
+func (d *Dev) Pin(n int) (*Pin, error) {
+	if n < 0 || n > 7 {
+		return nil, d.err("pin", fmt.Errorf("no GPIO %d", n))
+	}
+	return &Pin{d: d, mask: 1 << uint(n)}, nil
+}
+
+// Pin is a GPIO of a bridge. It implements bp.Pin.
+type Pin struct {
+	d    *Dev
+	mask byte
+}
+
+var _ bp.Pin = (*Pin)(nil)
+
+// modify clears mask in reg and sets it if set is true.
+func (p *Pin) modify(op string, reg byte, set bool) error {
+	v, err := p.d.readReg(op, reg)
+	if err != nil {
+		return err
+	}
+	v &^= p.mask
+	if set {
+		v |= p.mask
+	}
+	return p.d.writeReg(op, reg, v)
+}
+
+// Out makes the GPIO an output driving level.
+func (p *Pin) Out(level bool) error {
+	if err := p.modify("pin out", regIOState, level); err != nil {
+		return err
+	}
+	return p.modify("pin out", regIODir, true)
+}
+
+// In makes the GPIO an input and reads its level.
+func (p *Pin) In() (bool, error) {
+	if err := p.modify("pin in", regIODir, false); err != nil {
+		return false, err
+	}
+	v, err := p.d.ReadGPIO()
+	if err != nil {
+		return false, err
+	}
+	return v&p.mask != 0, nil
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("%s: %s: %w", d.name, op, err)
+}
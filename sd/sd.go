@@ -0,0 +1,483 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package sd reads and writes SD and microSD cards in SPI mode, block by
+// block, enough to inspect card images and apply small fixes.
+//
+// Init brings a card from power up into SPI mode and finds out whether
+// it is a standard capacity card, addressed in bytes, or a high capacity
+// one, addressed in blocks. Blocks are always 512 bytes. MMC cards and
+// the multiple block commands are not supported.
+//
+// The card is reached through a bp.SPIMaster in SPI mode 0, on a bus
+// pirate the bp.BusPirateSPI of SPI mode with CS wired to the chip select
+// of the card. Its chip select is held low from a command to the end of
+// the data of the command. Cards take at most 400 kHz until Init is
+// done, set bp.SPI250kHz before and speed up afterwards, see
+// bp.BusPirateSPI.SetSpeed.
+package sd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// BlockSize is the size of a block in bytes.
+const BlockSize = 512
+
+// Commands.
+const (
+	cmdGoIdleState   = 0
+	cmdSendIfCond    = 8
+	cmdSendCSD       = 9
+	cmdSendStatus    = 13
+	cmdSetBlockLen   = 16
+	cmdReadSingle    = 17
+	cmdWriteBlock    = 24
+	cmdAppCmd        = 55
+	cmdReadOCR       = 58
+	acmdSDSendOpCond = 41
+)
+
+const (
+	argCheckPattern = 0x1aa // 2.7 to 3.6 V and the check pattern 0xaa
+	argHCS          = 1 << 30
+	ocrCCS          = 1 << 30
+
+	r1Idle           = 0x01
+	r1IllegalCommand = 0x04
+
+	tokenStartBlock  = 0xfe
+	dataResponseMask = 0x1f
+	dataAccepted     = 0x05
+
+	responseTries     = 8 // NCR, the bytes before the response of a command
+	powerUpClockBytes = 10
+)
+
+// Timeouts of the card, from the SD specification.
+const (
+	initTimeout  = time.Second
+	readTimeout  = 100 * time.Millisecond
+	writeTimeout = 500 * time.Millisecond
+)
+
+var (
+	// ErrTimeout is returned when the card doesn't answer, or doesn't
+	// finish initialization or a read or write in time.
+	ErrTimeout = errors.New("timed out")
+	// ErrCRC is returned when the CRC of a block read from the card
+	// doesn't match.
+	ErrCRC = errors.New("CRC mismatch")
+	// ErrUnsupported is returned by Init for cards it can't handle,
+	// like MMC cards and cards that don't take 3.3 V.
+	ErrUnsupported = errors.New("unsupported card")
+)
+
+// R1Error is the R1 response of a command with error bits set.
+type R1Error byte
+
+func (e R1Error) Error() string {
+	return fmt.Sprintf("R1 error %#02x", byte(e))
+}
+
+// Dev is a card.
+type Dev struct {
+	b  bp.SPIMaster
+	hc bool // high capacity, addressed in blocks
+}
+
+// New returns the card on b. It must be initialized with Init.
+func New(b bp.SPIMaster) *Dev {
+	return &Dev{b: b}
+}
+
+// HighCapacity reports whether Init found an SDHC or SDXC card.
+func (d *Dev) HighCapacity() bool {
+	return d.hc
+}
+
+// recv clocks in n bytes, clocking out 0xff.
+func (d *Dev) recv(n int) ([]byte, error) {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = 0xff
+	}
+	if err := d.b.Exchange(b, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// deselect deselects the card and gives it the clocks it needs to
+// release its data output.
+func (d *Dev) deselect() {
+	d.b.Select(false)
+	d.recv(1)
+}
+
+// command selects the card and sends command cmd with argument arg, and
+// returns the R1 response. The card stays selected for the rest of the
+// response and data, the caller deselects it.
+func (d *Dev) command(cmd byte, arg uint32) (byte, error) {
+	if err := d.b.Select(true); err != nil {
+		return 0, err
+	}
+	// a byte to let the card drive its data output
+	if _, err := d.recv(1); err != nil {
+		return 0, err
+	}
+	c := []byte{0x40 | cmd, byte(arg >> 24), byte(arg >> 16), byte(arg >> 8), byte(arg)}
+	c = append(c, crc7(c)<<1|1)
+	if err := d.b.Exchange(c, nil); err != nil {
+		return 0, err
+	}
+	for i := 0; i < responseTries; i++ {
+		b, err := d.recv(1)
+		if err != nil {
+			return 0, err
+		}
+		if b[0]&0x80 == 0 {
+			return b[0], nil
+		}
+	}
+	return 0, fmt.Errorf("CMD%d: %w", cmd, ErrTimeout)
+}
+
+// do sends command cmd, reads n bytes of response after R1 and deselects
+// the card. It returns an R1Error if R1 has error bits set, or the idle
+// bit unless idle is true.
+func (d *Dev) do(op string, cmd byte, arg uint32, n int, idle bool) (byte, []byte, error) {
+	defer d.deselect()
+	r1, err := d.command(cmd, arg)
+	if err != nil {
+		return 0, nil, d.err(op, err)
+	}
+	if r1&^r1Idle != 0 || !idle && r1&r1Idle != 0 {
+		return r1, nil, d.err(op, R1Error(r1))
+	}
+	var r []byte
+	if n > 0 {
+		if r, err = d.recv(n); err != nil {
+			return 0, nil, d.err(op, err)
+		}
+	}
+	return r1, r, nil
+}
+
+// Init initializes the card after power up. The bus should be clocked at
+// no more than 400 kHz for it, afterwards up to 25 MHz.
+func (d *Dev) Init() error {
+	// 74 clocks or more with the card deselected put it into native
+	// mode, ready for CMD0
+	if err := d.b.Select(false); err != nil {
+		return d.err("init", err)
+	}
+	if _, err := d.recv(powerUpClockBytes); err != nil {
+		return d.err("init", err)
+	}
+
+	// CMD0 with the chip select low enters SPI mode
+	if _, _, err := d.do("go idle", cmdGoIdleState, 0, 0, true); err != nil {
+		return err
+	}
+
+	// version 2.00 cards answer CMD8, older ones don't know it
+	v2 := true
+	r1, r7, err := d.do("send interface condition", cmdSendIfCond, argCheckPattern, 4, true)
+	var r1e R1Error
+	switch {
+	case errors.As(err, &r1e) && byte(r1e)&r1IllegalCommand != 0:
+		v2 = false
+	case err != nil:
+		return err
+	case r7[2]&0x0f != 0x01 || r7[3] != 0xaa:
+		return d.err("init", fmt.Errorf("%w: R7 %#02x % x", ErrUnsupported, r1, r7))
+	}
+
+	var arg uint32
+	if v2 {
+		arg = argHCS
+	}
+	deadline := time.Now().Add(initTimeout)
+	for {
+		if _, _, err := d.do("app command", cmdAppCmd, 0, 0, true); err != nil {
+			return err
+		}
+		r1, _, err := d.do("send op cond", acmdSDSendOpCond, arg, 0, true)
+		if err != nil {
+			// MMC cards don't know ACMD41
+			if errors.As(err, &r1e) && byte(r1e)&r1IllegalCommand != 0 {
+				return d.err("init", ErrUnsupported)
+			}
+			return err
+		}
+		if r1&r1Idle == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return d.err("init", ErrTimeout)
+		}
+	}
+
+	d.hc = false
+	if v2 {
+		_, ocr, err := d.do("read OCR", cmdReadOCR, 0, 4, false)
+		if err != nil {
+			return err
+		}
+		d.hc = ocr[0]&(ocrCCS>>24) != 0
+	}
+	if !d.hc {
+		// the block length of standard capacity cards may differ
+		if _, _, err := d.do("set block length", cmdSetBlockLen, BlockSize, 0, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addr returns the address argument of block n.
+func (d *Dev) addr(n uint32) uint32 {
+	if d.hc {
+		return n
+	}
+	return n * BlockSize
+}
+
+// readData waits for the start block token of a data block and reads the
+// block into p, checking its CRC. The card must be selected.
+func (d *Dev) readData(p []byte) error {
+	deadline := time.Now().Add(readTimeout)
+	for {
+		b, err := d.recv(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == tokenStartBlock {
+			break
+		}
+		if b[0] != 0xff {
+			// a data error token
+			return fmt.Errorf("data error token %#02x", b[0])
+		}
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+	}
+	b, err := d.recv(len(p) + 2)
+	if err != nil {
+		return err
+	}
+	copy(p, b)
+	if crc := uint16(b[len(p)])<<8 | uint16(b[len(p)+1]); crc != CRC16(p) {
+		return fmt.Errorf("%w: %#04x, computed %#04x", ErrCRC, crc, CRC16(p))
+	}
+	return nil
+}
+
+// ReadBlock reads block n into p, which must be BlockSize bytes.
+func (d *Dev) ReadBlock(n uint32, p []byte) error {
+	if len(p) != BlockSize {
+		return d.err("read block", fmt.Errorf("buffer of %d bytes, not %d", len(p), BlockSize))
+	}
+	defer d.deselect()
+	r1, err := d.command(cmdReadSingle, d.addr(n))
+	if err == nil && r1 != 0 {
+		err = R1Error(r1)
+	}
+	if err == nil {
+		err = d.readData(p)
+	}
+	if err != nil {
+		return d.err(fmt.Sprintf("read block %d", n), err)
+	}
+	return nil
+}
+
+// WriteBlock writes p, which must be BlockSize bytes, to block n and
+// waits for the card to finish programming it.
+func (d *Dev) WriteBlock(n uint32, p []byte) error {
+	if len(p) != BlockSize {
+		return d.err("write block", fmt.Errorf("buffer of %d bytes, not %d", len(p), BlockSize))
+	}
+	op := fmt.Sprintf("write block %d", n)
+	err := func() error {
+		defer d.deselect()
+		r1, err := d.command(cmdWriteBlock, d.addr(n))
+		if err != nil {
+			return err
+		}
+		if r1 != 0 {
+			return R1Error(r1)
+		}
+		crc := CRC16(p)
+		w := append([]byte{0xff, tokenStartBlock}, p...)
+		if err := d.b.Exchange(append(w, byte(crc>>8), byte(crc)), nil); err != nil {
+			return err
+		}
+		b, err := d.recv(1)
+		if err != nil {
+			return err
+		}
+		if b[0]&dataResponseMask != dataAccepted {
+			return fmt.Errorf("data rejected, response %#02x", b[0])
+		}
+		return d.waitBusy()
+	}()
+	if err != nil {
+		return d.err(op, err)
+	}
+
+	// errors while programming only show in the status
+	if _, st, err := d.do(op, cmdSendStatus, 0, 1, false); err != nil {
+		return err
+	} else if st[0] != 0 {
+		return d.err(op, fmt.Errorf("status %#02x after programming", st[0]))
+	}
+	return nil
+}
+
+// waitBusy waits for the card to release its data output, which it holds
+// low while programming.
+func (d *Dev) waitBusy() error {
+	deadline := time.Now().Add(writeTimeout)
+	for {
+		b, err := d.recv(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == 0xff {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+	}
+}
+
+// CSD reads the card specific data register of the card.
+func (d *Dev) CSD() (CSD, error) {
+	var raw [16]byte
+	err := func() error {
+		defer d.deselect()
+		r1, err := d.command(cmdSendCSD, 0)
+		if err != nil {
+			return err
+		}
+		if r1 != 0 {
+			return R1Error(r1)
+		}
+		return d.readData(raw[:])
+	}()
+	if err != nil {
+		return CSD{}, d.err("read CSD", err)
+	}
+	c, err := ParseCSD(raw)
+	if err != nil {
+		return CSD{}, d.err("read CSD", err)
+	}
+	return c, nil
+}
+
+// CSD is the card specific data register.
+type CSD struct {
+	Raw [16]byte
+
+	// Version is the structure version of the register, 1 for
+	// standard capacity cards, 2 for SDHC and SDXC cards.
+	Version int
+
+	Capacity int64 // bytes
+	MaxClock int   // maximum bus clock in Hz
+
+	// ReadBlockLen is the maximum read block length, 512 to 2048 on
+	// standard capacity cards. Init sets the block length to 512.
+	ReadBlockLen int
+
+	// WriteProtected tells whether the card is permanently or
+	// temporarily write protected.
+	WriteProtected bool
+}
+
+// bits returns the bits hi down to lo of the 128 bit register b.
+func bits(b [16]byte, hi, lo uint) uint64 {
+	var v uint64
+	for i := hi + 1; i > lo; i-- {
+		bit := i - 1
+		v = v<<1 | uint64(b[15-bit/8]>>(bit%8)&1)
+	}
+	return v
+}
+
+// ParseCSD parses the raw CSD register, most significant byte first.
+func ParseCSD(raw [16]byte) (CSD, error) {
+	c := CSD{Raw: raw, Version: int(bits(raw, 127, 126)) + 1}
+
+	// TRAN_SPEED: a rate unit and a multiplier in tenths
+	units := []int{100e3, 1e6, 10e6, 100e6}
+	mults := []int{0, 10, 12, 13, 15, 20, 25, 30, 35, 40, 45, 50, 55, 60, 70, 80}
+	ts := bits(raw, 103, 96)
+	if u := ts & 7; u < uint64(len(units)) {
+		c.MaxClock = units[u] * mults[ts>>3&0xf] / 10
+	}
+
+	c.ReadBlockLen = 1 << bits(raw, 83, 80)
+	switch c.Version {
+	case 1:
+		size := bits(raw, 73, 62)
+		mult := bits(raw, 49, 47)
+		c.Capacity = int64(size+1) << (mult + 2) * int64(c.ReadBlockLen)
+	case 2:
+		c.Capacity = int64(bits(raw, 69, 48)+1) * 512 * 1024
+	default:
+		return CSD{}, fmt.Errorf("unknown CSD structure version %d", c.Version)
+	}
+	c.WriteProtected = bits(raw, 13, 12) != 0
+	return c, nil
+}
+
+// Blocks returns the number of blocks of the card.
+func (c CSD) Blocks() int64 {
+	return c.Capacity / BlockSize
+}
+
+// crc7 returns the CRC-7 of a command, polynomial 0x09.
+func crc7(b []byte) byte {
+	var crc byte
+	for _, c := range b {
+		for i := 7; i >= 0; i-- {
+			fb := (crc>>6 ^ c>>uint(i)) & 1
+			crc = crc << 1 & 0x7f
+			if fb != 0 {
+				crc ^= 0x09
+			}
+		}
+	}
+	return crc
+}
+
+// CRC16 returns the CRC of a data block, CRC-16-CCITT with polynomial
+// 0x1021 and initial value 0.
+func CRC16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("sd: %s: %w", op, err)
+}
@@ -0,0 +1,76 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sd
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func csd(t *testing.T, s string) [16]byte {
+	t.Helper()
+	var raw [16]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(raw) {
+		t.Fatalf("bad register %q", s)
+	}
+	copy(raw[:], b)
+	// the register ends in its CRC-7 and a stop bit
+	if crc := crc7(raw[:15])<<1 | 1; raw[15] != crc {
+		t.Fatalf("register %s ends in %#02x, want %#02x", s, raw[15], crc)
+	}
+	return raw
+}
+
+func TestParseCSD(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		raw     string
+		version int
+		size    int64
+		blocks  int64
+		blen    int
+	}{
+		// standard capacity cards of 2 GB, C_SIZE 3751 and 3919,
+		// C_SIZE_MULT 7, READ_BL_LEN 10
+		{"2 GB", "002e00325b5a83a9ffffff8016800091", 1, 1967128576, 3842048, 1024},
+		{"2 GB", "007f00325b5a83d3f6dbff81968000e7", 1, 2055208960, 4014080, 1024},
+		// an SDHC card of 8 GB, C_SIZE 15159 in the fixed layout of
+		// version 2.0
+		{"8 GB SDHC", "400e00325b5900003b377f800a400067", 2, 7948206080, 15523840, 512},
+	} {
+		got, err := ParseCSD(csd(t, c.raw))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got.Version != c.version || got.Capacity != c.size || got.Blocks() != c.blocks ||
+			got.ReadBlockLen != c.blen || got.MaxClock != 25e6 || got.WriteProtected {
+			t.Errorf("%s: got %+v, %d blocks", c.name, got, got.Blocks())
+		}
+	}
+}
+
+func TestParseCSDWriteProtect(t *testing.T) {
+	raw := csd(t, "400e00325b5900003b377f800a400067")
+	// TMP_WRITE_PROTECT, bit 12
+	raw[14] |= 0x10
+	c, err := ParseCSD(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.WriteProtected {
+		t.Error("not write protected")
+	}
+}
+
+func TestParseCSDVersion(t *testing.T) {
+	raw := csd(t, "400e00325b5900003b377f800a400067")
+	// CSD_STRUCTURE 2, which this package doesn't know
+	raw[0] = 0x80
+	if c, err := ParseCSD(raw); err == nil {
+		t.Errorf("parsed as %+v", c)
+	}
+}
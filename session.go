@@ -0,0 +1,108 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Session describes a BusPirate which was opened and not closed yet,
+// found by the tracking turned on with TrackSessions.
+type Session struct {
+	ID   uint64
+	Mode Mode // current mode
+
+	// Opened is the stack trace of the call which opened the BusPirate,
+	// Entered that of the call which entered Mode.
+	Opened  string
+	Entered string
+}
+
+var sessions struct {
+	sync.Mutex
+	on     bool
+	leaked func(Session)
+	next   uint64
+	open   map[uint64]*Session
+}
+
+// TrackSessions turns on the tracking of open BusPirates, a debugging aid
+// for finding code that forgets to call Close and leaves bus pirates
+// stuck in binary mode. Tracking records stack traces on every change of
+// mode, so it is slow. Once on, it stays on. OpenSessions returns the
+// BusPirates opened since then and not closed yet. If leaked is not nil,
+// it is called with every such BusPirate that is garbage collected, from
+// the finalizer goroutine. See also bptest.VerifyClosed.
+func TrackSessions(leaked func(Session)) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	sessions.on = true
+	if leaked != nil {
+		sessions.leaked = leaked
+	}
+	if sessions.open == nil {
+		sessions.open = make(map[uint64]*Session)
+	}
+}
+
+// OpenSessions returns the BusPirates which are open, ordered by ID,
+// if TrackSessions was called.
+func OpenSessions() []Session {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	var ss []Session
+	for id := uint64(1); id <= sessions.next; id++ {
+		if s, ok := sessions.open[id]; ok {
+			ss = append(ss, *s)
+		}
+	}
+	return ss
+}
+
+// trackSession updates the session of bp after a change of mode. The
+// caller has to hold the lock of bp.
+func (bp *BusPirate) trackSession() {
+	sessions.Lock()
+	defer sessions.Unlock()
+	if !sessions.on {
+		return
+	}
+
+	switch {
+	case bp.mode == MODE_CLOSED:
+		delete(sessions.open, bp.session)
+		bp.session = 0
+	case bp.session == 0:
+		sessions.next++
+		bp.session = sessions.next
+		stack := string(debug.Stack())
+		sessions.open[bp.session] = &Session{ID: bp.session, Mode: bp.mode, Opened: stack, Entered: stack}
+		if !bp.finalized {
+			bp.finalized = true
+			runtime.SetFinalizer(bp, finalizeSession)
+		}
+	default:
+		if s, ok := sessions.open[bp.session]; ok {
+			s.Mode = bp.mode
+			s.Entered = string(debug.Stack())
+		}
+	}
+}
+
+func finalizeSession(bp *BusPirate) {
+	sessions.Lock()
+	s, ok := sessions.open[bp.session]
+	delete(sessions.open, bp.session)
+	leaked := sessions.leaked
+	sessions.Unlock()
+
+	if ok && leaked != nil {
+		leaked(*s)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package sht3x drives the SHT30, SHT31 and SHT35 humidity and
+// temperature sensors over the I2C mode of package bp.
+//
+// The sensors take 16 bit commands and protect every 16 bit word they
+// return with a CRC, which is checked. Measure does a single shot
+// measurement without clock stretching, which the bus pirate doesn't
+// support: it waits for the measurement to be done and polls the sensor,
+// which doesn't acknowledge its address while measuring.
+package sht3x
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// Addresses of the sensor, with ADDR tied low or high.
+const (
+	Addr    = 0x44
+	AddrAlt = 0x45
+)
+
+// Commands.
+const (
+	cmdMeasureHigh   = 0x2400 // single shot, no clock stretching
+	cmdMeasureMedium = 0x240b
+	cmdMeasureLow    = 0x2416
+	cmdHeaterOn      = 0x306d
+	cmdHeaterOff     = 0x3066
+	cmdReadStatus    = 0xf32d
+	cmdClearStatus   = 0x3041
+	cmdSoftReset     = 0x30a2
+)
+
+// Bits of the status register.
+const (
+	StatusAlert        = 0x8000
+	StatusHeater       = 0x2000
+	StatusHumAlert     = 0x0800
+	StatusTempAlert    = 0x0400
+	StatusReset        = 0x0010
+	StatusCommandError = 0x0002
+	StatusCRCError     = 0x0001
+)
+
+// ErrCRC is returned when the CRC of a word read from the sensor doesn't
+// match.
+var ErrCRC = errors.New("CRC mismatch")
+
+// Repeatability is the repeatability of a measurement, higher takes
+// longer.
+type Repeatability int
+
+const (
+	High Repeatability = iota
+	Medium
+	Low
+)
+
+// command returns the measurement command for r and the time it takes at
+// most.
+func (r Repeatability) command() (uint16, time.Duration, bool) {
+	switch r {
+	case High:
+		return cmdMeasureHigh, 15 * time.Millisecond, true
+	case Medium:
+		return cmdMeasureMedium, 6 * time.Millisecond, true
+	case Low:
+		return cmdMeasureLow, 4 * time.Millisecond, true
+	}
+	return 0, 0, false
+}
+
+// Measurement is a measurement of the sensor.
+type Measurement struct {
+	Temperature float64 // °C
+	Humidity    float64 // % relative humidity
+}
+
+func (m Measurement) String() string {
+	return fmt.Sprintf("%.2f °C, %.1f %%RH", m.Temperature, m.Humidity)
+}
+
+// Dev is an SHT3x.
+type Dev struct {
+	m    bp.I2CMaster
+	addr uint8
+}
+
+// New returns the sensor at the 7 bit address addr on m.
+func New(m bp.I2CMaster, addr uint8) *Dev {
+	return &Dev{m: m, addr: addr}
+}
+
+// CRC returns the CRC of the sensor over b: CRC-8 with polynomial 0x31
+// and initial value 0xff.
+func CRC(b []byte) byte {
+	crc := byte(0xff)
+	for _, c := range b {
+		crc ^= c
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x31
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// command sends the command cmd.
+func (d *Dev) command(op string, cmd uint16) error {
+	if err := d.m.Start(); err != nil {
+		return d.err(op, err)
+	}
+	for _, b := range []byte{d.addr << 1, byte(cmd >> 8), byte(cmd)} {
+		if err := d.m.WriteByte(b); err != nil {
+			d.m.Stop()
+			return d.err(op, err)
+		}
+	}
+	if err := d.m.Stop(); err != nil {
+		return d.err(op, err)
+	}
+	return nil
+}
+
+// readWords reads n words with their CRCs and checks them.
+func (d *Dev) readWords(op string, n int) ([]uint16, error) {
+	if err := d.m.Start(); err != nil {
+		return nil, d.err(op, err)
+	}
+	if err := d.m.WriteByte(d.addr<<1 | 1); err != nil {
+		d.m.Stop()
+		return nil, d.err(op, err)
+	}
+	b := make([]byte, 3*n)
+	for i := range b {
+		v, err := d.m.ReadByteAck(i < len(b)-1)
+		if err != nil {
+			d.m.Stop()
+			return nil, d.err(op, err)
+		}
+		b[i] = v
+	}
+	if err := d.m.Stop(); err != nil {
+		return nil, d.err(op, err)
+	}
+
+	words := make([]uint16, n)
+	for i := range words {
+		w := b[3*i : 3*i+3]
+		if CRC(w[:2]) != w[2] {
+			return nil, d.err(op, fmt.Errorf("%w: word % x, CRC %#02x", ErrCRC, w[:2], w[2]))
+		}
+		words[i] = uint16(w[0])<<8 | uint16(w[1])
+	}
+	return words, nil
+}
+
+// Measure does a single shot measurement with repeatability r.
+func (d *Dev) Measure(r Repeatability) (Measurement, error) {
+	cmd, dur, ok := r.command()
+	if !ok {
+		return Measurement{}, d.err("measure", fmt.Errorf("invalid repeatability %d", r))
+	}
+	if err := d.command("measure", cmd); err != nil {
+		return Measurement{}, err
+	}
+	time.Sleep(dur)
+
+	// the sensor NACKs its address until the measurement is done
+	deadline := time.Now().Add(dur + 50*time.Millisecond)
+	for {
+		w, err := d.readWords("measure", 2)
+		if err == nil {
+			return Measurement{
+				Temperature: -45 + 175*float64(w[0])/65535,
+				Humidity:    100 * float64(w[1]) / 65535,
+			}, nil
+		}
+		if !errors.Is(err, bp.ErrNACK) || time.Now().After(deadline) {
+			return Measurement{}, err
+		}
+	}
+}
+
+// SetHeater turns the internal heater on or off. Heating drives off
+// condensation and checks the sensor, it raises the temperature by a few
+// degrees.
+func (d *Dev) SetHeater(on bool) error {
+	if on {
+		return d.command("set heater", cmdHeaterOn)
+	}
+	return d.command("set heater", cmdHeaterOff)
+}
+
+// Status returns the status register, see the Status constants.
+func (d *Dev) Status() (uint16, error) {
+	if err := d.command("read status", cmdReadStatus); err != nil {
+		return 0, err
+	}
+	w, err := d.readWords("read status", 1)
+	if err != nil {
+		return 0, err
+	}
+	return w[0], nil
+}
+
+// ClearStatus clears the alert and reset flags of the status register.
+func (d *Dev) ClearStatus() error {
+	return d.command("clear status", cmdClearStatus)
+}
+
+// Reset resets the sensor.
+func (d *Dev) Reset() error {
+	if err := d.command("reset", cmdSoftReset); err != nil {
+		return err
+	}
+	time.Sleep(2 * time.Millisecond)
+	return nil
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("sht3x %v: %s: %w", bp.Addr7(d.addr), op, err)
+}
@@ -0,0 +1,95 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"github.com/distributed/bp/ds30"
+)
+
+// agreeMode waits for the answer to "Are you sure?" after the '$'
+// command, 'y' starts the bootloader.
+type agreeMode struct{}
+
+func (agreeMode) input(s *Sim, b byte) {
+	if b != 'y' {
+		s.respond([]byte("\r\nHiZ>")...)
+		s.setMode(textMode{})
+		return
+	}
+	s.respond([]byte("y\r\nBOOTLOADER\r\n")...)
+	s.setMode(&bootMode{})
+}
+
+// bootMode is the bootloader of a bus pirate v3 with bootloader v4.4.
+// It only leaves when the simulator is reset with New.
+type bootMode struct {
+	pkt []byte
+}
+
+func (m *bootMode) input(s *Sim, b byte) {
+	if len(m.pkt) == 0 && b == 0xc1 {
+		s.respond(ds30.DevicePIC24FJ64GA002, 4, 4, 'K')
+		return
+	}
+
+	m.pkt = append(m.pkt, b)
+	if len(m.pkt) < 5 || len(m.pkt) < 5+int(m.pkt[4]) {
+		return
+	}
+	pkt := m.pkt
+	m.pkt = nil
+
+	var sum byte
+	for _, x := range pkt {
+		sum += x
+	}
+	if sum != 0 {
+		s.respond('N')
+		return
+	}
+
+	if s.flash == nil {
+		s.flash = make([]byte, ds30.FlashSize)
+		for i := range s.flash {
+			s.flash[i] = 0xff
+		}
+	}
+
+	// program memory address to image offset
+	off := int(pkt[0])<<16 | int(pkt[1])<<8 | int(pkt[2])
+	off = off / 2 * ds30.WordSize
+	data := pkt[5 : len(pkt)-1]
+	switch pkt[3] {
+	case 0x01:
+		if off%ds30.PageSize != 0 || off >= len(s.flash) {
+			s.respond('N')
+			return
+		}
+		for i := off; i < off+ds30.PageSize; i++ {
+			s.flash[i] = 0xff
+		}
+	case 0x02:
+		if off+len(data) > len(s.flash) {
+			s.respond('N')
+			return
+		}
+		copy(s.flash[off:], data)
+	default:
+		s.respond('N')
+		return
+	}
+	s.respond('K')
+}
+
+// Flash returns a copy of the flash written through the bootloader, laid
+// out like ds30.Image.Data, or nil if nothing was written.
+func (s *Sim) Flash() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flash == nil {
+		return nil
+	}
+	return append([]byte(nil), s.flash...)
+}
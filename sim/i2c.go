@@ -0,0 +1,289 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"github.com/distributed/bp/wire"
+)
+
+// Device is a simulated I2C slave.
+type Device interface {
+	// Start is called when the device is addressed after a (repeated)
+	// start condition, read is the direction bit.
+	Start(read bool)
+	// Write is called for every byte written to the device and returns
+	// whether the device ACKs it.
+	Write(b byte) bool
+	// Read returns the next byte read from the device.
+	Read() byte
+	// Stop is called on a stop condition ending a transaction with the
+	// device.
+	Stop()
+}
+
+// Registers is a device with 8 bit register addresses and an auto
+// incrementing register pointer, like most sensors and small EEPROMs.
+// The first byte written sets the pointer, following bytes are stored
+// into consecutive registers.
+type Registers struct {
+	Regs [256]byte
+	ptr  byte
+	set  bool
+}
+
+func (r *Registers) Start(read bool) {
+	r.set = false
+}
+
+func (r *Registers) Write(b byte) bool {
+	if !r.set {
+		r.ptr = b
+		r.set = true
+		return true
+	}
+	r.Regs[r.ptr] = b
+	r.ptr++
+	return true
+}
+
+func (r *Registers) Read() byte {
+	b := r.Regs[r.ptr]
+	r.ptr++
+	return b
+}
+
+func (r *Registers) Stop() {}
+
+// i2c bus state
+type i2cMode struct {
+	// collects multi byte commands
+	cmd  []byte
+	need int
+
+	started  bool
+	addrnext bool
+	dev      Device
+	lastread byte
+}
+
+// Tap wires the I2C bus of s to that of t, whose sniffer then sees the
+// traffic s drives, like a second bus pirate sniffing the bus of the
+// first. Only t sees traffic, what t drives doesn't reach s.
+func (s *Sim) Tap(t *Sim) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.taps = append(s.taps, t)
+}
+
+// bus passes the sniffer output for traffic on the bus of s to the taps.
+func (s *Sim) bus(b ...byte) {
+	for _, t := range s.taps {
+		t.sniffed(b)
+	}
+}
+
+// sniffed outputs b if the sniffer of s is running.
+func (s *Sim) sniffed(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.mode.(*sniffMode); !ok {
+		return
+	}
+	s.respond(b...)
+	s.cond.Broadcast()
+}
+
+// sniffByte returns the sniffer output for a byte and its ACK.
+func sniffByte(b byte, ack bool) []byte {
+	if ack {
+		return []byte{wire.SniffEscape, b, wire.SniffACK}
+	}
+	return []byte{wire.SniffEscape, b, wire.SniffNACK}
+}
+
+func (m *i2cMode) start(s *Sim) {
+	s.bus(wire.SniffStart)
+	m.started = true
+	m.addrnext = true
+	m.dev = nil
+}
+
+func (m *i2cMode) stop(s *Sim) {
+	if m.started {
+		s.bus(wire.SniffStop)
+	}
+	if m.dev != nil {
+		m.dev.Stop()
+	}
+	m.started = false
+	m.addrnext = false
+	m.dev = nil
+}
+
+// write puts b onto the bus and reports whether it was ACKed.
+func (m *i2cMode) write(s *Sim, b byte) bool {
+	if !m.started {
+		return false
+	}
+	ack := m.put(s, b)
+	s.bus(sniffByte(b, ack)...)
+	return ack
+}
+
+func (m *i2cMode) put(s *Sim, b byte) bool {
+	if m.addrnext {
+		m.addrnext = false
+		if m.dev != nil {
+			m.dev.Stop()
+		}
+		m.dev = s.device(b >> 1)
+		if m.dev == nil {
+			return false
+		}
+		m.dev.Start(b&1 == 1)
+		return true
+	}
+	if m.dev == nil {
+		return false
+	}
+	return m.dev.Write(b)
+}
+
+func (m *i2cMode) read(s *Sim) byte {
+	m.lastread = 0xff
+	if m.dev != nil {
+		m.lastread = m.dev.Read()
+	}
+	// otherwise nobody drives the bus, the pull-ups win
+	return m.lastread
+}
+
+func (m *i2cMode) input(s *Sim, b byte) {
+	if m.need > 0 && m.cmd[0]&0xf0 == wire.I2CBulkWrite {
+		// like the firmware, write and answer every byte as it
+		// arrives
+		if m.write(s, b) {
+			s.respond(0x00)
+		} else {
+			s.respond(0x01)
+		}
+		m.need--
+		if m.need == 0 {
+			m.cmd = nil
+		}
+		return
+	}
+	if m.need > 0 {
+		m.cmd = append(m.cmd, b)
+		m.need--
+		if m.need == 0 {
+			m.complete(s)
+		}
+		return
+	}
+
+	switch {
+	case b == wire.I2CExit:
+		m.stop(s)
+		s.setMode(bitbangMode{})
+		s.respond([]byte(wire.BitbangBanner + "1")...)
+	case b == wire.I2CVersion:
+		s.respond([]byte(wire.I2CBanner + "1")...)
+	case b == wire.I2CStart:
+		m.start(s)
+		s.respond(wire.OK)
+	case b == wire.I2CStop:
+		m.stop(s)
+		s.respond(wire.OK)
+	case b == wire.I2CRead:
+		s.respond(m.read(s))
+	case b == wire.I2CACK || b == wire.I2CNACK:
+		// ACK/NACK of the last byte read
+		s.bus(sniffByte(m.lastread, b == wire.I2CACK)...)
+		s.respond(wire.OK)
+	case b == wire.I2CWriteThenRead:
+		// write then read, header follows
+		m.cmd = []byte{b}
+		m.need = 4
+	case b == wire.I2CAUX:
+		m.cmd = []byte{b}
+		m.need = 1
+		s.respond(wire.OK)
+	case b == wire.I2CSniff:
+		s.setMode(&sniffMode{i2c: m})
+		s.respond(wire.OK)
+	case b&0xf0 == wire.I2CBulkWrite:
+		// bulk write of 1-16 bytes
+		m.cmd = []byte{b}
+		m.need = int(b&0x0f) + 1
+		s.respond(wire.OK)
+	case b&0xf0 == wire.I2CPeripherals || b&0xf0 == wire.I2CPullupVoltage || b&0xf0 == wire.I2CSpeed:
+		s.respond(wire.OK)
+	}
+}
+
+// complete executes a multi byte command once all bytes are in.
+func (m *i2cMode) complete(s *Sim) {
+	cmd := m.cmd
+	switch {
+	case cmd[0] == wire.I2CWriteThenRead && len(cmd) == 5:
+		wn := int(cmd[1])<<8 | int(cmd[2])
+		rn := int(cmd[3])<<8 | int(cmd[4])
+		if wn > wire.MaxWriteThenRead || rn > wire.MaxWriteThenRead {
+			s.respond(wire.Fail)
+			m.cmd = nil
+			return
+		}
+		if wn == 0 {
+			m.wnr(s, cmd[1:5], nil)
+			return
+		}
+		m.need = wn
+	case cmd[0] == wire.I2CWriteThenRead:
+		m.wnr(s, cmd[1:5], cmd[5:])
+	case cmd[0] == wire.I2CAUX:
+		m.cmd = nil
+		if cmd[1] != wire.AUXRead {
+			s.respond(wire.OK)
+		} else if s.aux {
+			s.respond(0x01)
+		} else {
+			s.respond(0x00)
+		}
+	}
+}
+
+// wnr performs a write then read command: start, write all bytes, read
+// the requested number of bytes, stop.
+func (m *i2cMode) wnr(s *Sim, hdr []byte, w []byte) {
+	rn := int(hdr[2])<<8 | int(hdr[3])
+	m.cmd = nil
+
+	m.start(s)
+	for _, b := range w {
+		if !m.write(s, b) {
+			m.stop(s)
+			s.respond(wire.Fail)
+			return
+		}
+	}
+	s.respond(wire.OK)
+	for i := 0; i < rn; i++ {
+		s.respond(m.read(s))
+		s.bus(sniffByte(m.lastread, i < rn-1)...)
+	}
+	m.stop(s)
+}
+
+// sniffMode is the I2C sniffer. It outputs the traffic of the simulators
+// tapped with Tap, and ends with any byte sent to it.
+type sniffMode struct {
+	i2c *i2cMode
+}
+
+func (m *sniffMode) input(s *Sim, b byte) {
+	s.setMode(m.i2c)
+	s.respond(wire.OK)
+}
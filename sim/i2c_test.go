@@ -0,0 +1,141 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/distributed/bp/wire"
+)
+
+// exchange writes w to s and returns everything s answers within a short
+// time.
+func exchange(t *testing.T, s *Sim, w ...byte) []byte {
+	t.Helper()
+	if _, err := s.Write(w); err != nil {
+		t.Fatal(err)
+	}
+	s.SetReadParams(0, 0.01)
+	var got []byte
+	buf := make([]byte, 64)
+	for {
+		n, err := s.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == ErrTimeout {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expect(t *testing.T, s *Sim, w []byte, want ...byte) {
+	t.Helper()
+	if got := exchange(t, s, w...); !bytes.Equal(got, want) {
+		t.Errorf("% x answered with % x, want % x", w, got, want)
+	}
+}
+
+func b(v ...byte) []byte { return v }
+
+func newI2C(t *testing.T) (*Sim, *Registers) {
+	t.Helper()
+	s := New()
+	s.StartInBinary()
+	regs := &Registers{}
+	s.Attach(0x50, regs)
+	expect(t, s, b(wire.EnterI2C), []byte(wire.I2CBanner+"1")...)
+	return s, regs
+}
+
+func TestI2CPrimitives(t *testing.T) {
+	s, regs := newI2C(t)
+
+	// write two registers from 0x10
+	expect(t, s, b(wire.I2CStart), wire.OK)
+	expect(t, s, b(wire.BulkWrite(4), 0xa0, 0x10, 0x11, 0x22), wire.OK, 0, 0, 0, 0)
+	expect(t, s, b(wire.I2CStop), wire.OK)
+	if regs.Regs[0x10] != 0x11 || regs.Regs[0x11] != 0x22 {
+		t.Fatalf("registers % x, want 11 22", regs.Regs[0x10:0x12])
+	}
+
+	// and read them back with a repeated start
+	expect(t, s, b(wire.I2CStart, wire.BulkWrite(2), 0xa0, 0x10), wire.OK, wire.OK, 0, 0)
+	expect(t, s, b(wire.I2CStart, wire.BulkWrite(1), 0xa1), wire.OK, wire.OK, 0)
+	expect(t, s, b(wire.I2CRead, wire.I2CACK, wire.I2CRead, wire.I2CNACK), 0x11, wire.OK, 0x22, wire.OK)
+	expect(t, s, b(wire.I2CStop), wire.OK)
+
+	// nobody at 0x51, the pull-ups win when reading
+	expect(t, s, b(wire.I2CStart, wire.BulkWrite(2), 0xa2, 0x00), wire.OK, wire.OK, 1, 1)
+	expect(t, s, b(wire.I2CRead, wire.I2CNACK, wire.I2CStop), 0xff, wire.OK, wire.OK)
+
+	// writes without a start condition aren't ACKed
+	expect(t, s, b(wire.BulkWrite(1), 0xa0), wire.OK, 1)
+
+	expect(t, s, b(wire.I2CVersion), []byte(wire.I2CBanner+"1")...)
+	expect(t, s, b(wire.I2CPeripherals|wire.PeriphPower, wire.I2CSpeed|wire.Speed400kHz), wire.OK, wire.OK)
+	expect(t, s, b(wire.I2CExit), []byte(wire.BitbangBanner+"1")...)
+}
+
+func TestI2CWriteThenRead(t *testing.T) {
+	s, regs := newI2C(t)
+	copy(regs.Regs[0x20:], []byte{0xde, 0xad, 0xbe, 0xef})
+
+	hdr := wire.WriteThenRead(2, 3)
+	expect(t, s, append(hdr[:], 0xa0, 0x20), wire.OK, 0xde, 0xad, 0xbe)
+	// the register pointer is left behind the bytes read
+	hdr = wire.WriteThenRead(1, 1)
+	expect(t, s, append(hdr[:], 0xa1), wire.OK, 0xef)
+
+	// a NACK ends the command
+	hdr = wire.WriteThenRead(2, 1)
+	expect(t, s, append(hdr[:], 0xa4, 0x00), wire.Fail)
+
+	// counts beyond the limit are refused
+	expect(t, s, b(wire.I2CWriteThenRead, 0x10, 0x01, 0x00, 0x00), wire.Fail)
+
+	// the bus is idle afterwards
+	expect(t, s, b(wire.I2CStart, wire.BulkWrite(1), 0xa0, wire.I2CStop), wire.OK, wire.OK, 0, wire.OK)
+}
+
+func TestI2CAUX(t *testing.T) {
+	s, _ := newI2C(t)
+	expect(t, s, b(wire.I2CAUX, wire.AUXRead), wire.OK, 0x01)
+	s.SetAUX(false)
+	expect(t, s, b(wire.I2CAUX, wire.AUXRead), wire.OK, 0x00)
+	expect(t, s, b(wire.I2CAUX, wire.AUXHiZ), wire.OK, wire.OK)
+}
+
+func TestTap(t *testing.T) {
+	s, _ := newI2C(t)
+	sn := New()
+	sn.StartInBinary()
+	s.Tap(sn)
+	expect(t, sn, b(wire.EnterI2C), []byte(wire.I2CBanner+"1")...)
+
+	// nothing is seen before the sniffer runs
+	expect(t, s, b(wire.I2CStart, wire.I2CStop), wire.OK, wire.OK)
+	expect(t, sn, b(wire.I2CSniff), wire.OK)
+
+	exchange(t, s, wire.I2CStart, wire.BulkWrite(2), 0xa0, 0x00, wire.I2CStart, wire.BulkWrite(1), 0xa1,
+		wire.I2CRead, wire.I2CNACK, wire.I2CStop)
+	hdr := wire.WriteThenRead(1, 2)
+	exchange(t, s, append(hdr[:], 0xa3)...)
+
+	want := []byte(`[\` + "\xa0" + `+\` + "\x00" + `+[\` + "\xa1" + `+\` + "\x00" + `-]` +
+		`[\` + "\xa3" + `-]`)
+	if got := exchange(t, sn); !bytes.Equal(got, want) {
+		t.Errorf("sniffed %q, want %q", got, want)
+	}
+
+	// any byte ends the sniffer
+	expect(t, sn, b(0xff), wire.OK)
+	expect(t, s, b(wire.I2CStart, wire.I2CStop), wire.OK, wire.OK)
+	if got := exchange(t, sn); len(got) != 0 {
+		t.Errorf("sniffed %q after the sniffer ended", got)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package sim simulates a bus pirate, so that code built on package bp
+// can be tested without hardware. A Sim is a bp.Conn speaking the binary
+// bitbang protocol (BBIO1), binary I2C mode (I2C1) to an I2C bus with
+// simulated slave devices attached and binary SPI mode (SPI1) to an SPI
+// device on the CS pin.
+package sim
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/distributed/bp/wire"
+)
+
+// ErrTimeout is returned by Read when no data arrived within the read
+// timeout. Its Timeout method returns true.
+var ErrTimeout error = timeout{}
+
+type timeout struct{}
+
+func (timeout) Error() string   { return "sim: read timeout" }
+func (timeout) Timeout() bool   { return true }
+func (timeout) Temporary() bool { return true }
+
+// a mode consumes the bytes sent to the simulator while it is active.
+type mode interface {
+	input(s *Sim, b byte)
+}
+
+// Sim is a simulated bus pirate. It starts out in the text terminal, like
+// a freshly connected bus pirate, unless StartInBinary is called.
+type Sim struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	out  []byte
+
+	minread int
+	timeout time.Duration
+	closed  bool
+
+	mode  mode
+	zeros int
+	line  []byte
+	pins  byte
+	flash []byte
+
+	devices  map[uint8]Device
+	fallback Device
+	spidev   SPIDevice
+	aux      bool
+	taps     []*Sim
+}
+
+// New returns a simulated bus pirate with no devices attached.
+func New() *Sim {
+	s := &Sim{
+		minread: 1,
+		mode:    textMode{},
+		devices: make(map[uint8]Device),
+		aux:     true,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// StartInBinary puts the simulator into binary bitbang mode, as if the
+// 20 0x00 bytes needed to enter it had already been sent.
+func (s *Sim) StartInBinary() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mode = bitbangMode{}
+}
+
+// StartInMacro puts the simulator into a running terminal macro. Like a
+// real bus pirate, it ignores everything but ESC, which ends the macro.
+func (s *Sim) StartInMacro() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mode = macroMode{}
+}
+
+// Attach connects d to the simulated I2C bus at the 7 bit address addr.
+func (s *Sim) Attach(addr uint8, d Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[addr] = d
+}
+
+// AttachDefault makes d answer on all addresses without a device attached
+// with Attach. Passing nil leaves them unanswered again.
+func (s *Sim) AttachDefault(d Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = d
+}
+
+// SetAUX sets the level of the AUX pin read in I2C and SPI mode, like that
+// of an interrupt output wired to it. It is high unless set otherwise.
+func (s *Sim) SetAUX(level bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aux = level
+}
+
+// device returns the device at the 7 bit address addr, nil if there is
+// none.
+func (s *Sim) device(addr uint8) Device {
+	if d, ok := s.devices[addr]; ok {
+		return d
+	}
+	return s.fallback
+}
+
+func (s *Sim) respond(b ...byte) {
+	s.out = append(s.out, b...)
+}
+
+func (s *Sim) setMode(m mode) {
+	s.mode = m
+}
+
+func (s *Sim) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	for _, c := range b {
+		s.mode.input(s, c)
+	}
+	s.cond.Broadcast()
+
+	return len(b), nil
+}
+
+// Read behaves like a serial port configured with SetReadParams: it waits
+// for minread bytes or, if minread is 0, for the timeout to expire.
+func (s *Sim) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	want := s.minread
+	if want < 1 {
+		want = 1
+	}
+	if want > len(b) {
+		want = len(b)
+	}
+
+	var deadline time.Time
+	if s.timeout > 0 {
+		deadline = time.Now().Add(s.timeout)
+		timer := time.AfterFunc(s.timeout, func() {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	for len(s.out) < want && !s.closed {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			break
+		}
+		s.cond.Wait()
+	}
+
+	if s.closed {
+		return 0, io.EOF
+	}
+
+	n := copy(b, s.out)
+	s.out = s.out[n:]
+	if n == 0 {
+		return 0, ErrTimeout
+	}
+	return n, nil
+}
+
+// SetReadParams sets the minimum number of bytes a read waits for and the
+// read timeout in seconds. A timeout of 0 means reads wait forever.
+func (s *Sim) SetReadParams(minread int, timeout float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.minread = minread
+	s.timeout = time.Duration(timeout * float64(time.Second))
+	return nil
+}
+
+func (s *Sim) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
+
+// Info is the answer of the simulated terminal to the 'i' command.
+const Info = "Bus Pirate v3.5\r\n" +
+	"Firmware v6.1 r1676  Bootloader v4.4\r\n" +
+	"DEVID:0x0447 REVID:0x3046 (24FJ64GA002 B8)\r\n" +
+	"http://dangerousprototypes.com\r\n"
+
+// textMode is the user terminal. Apart from entering binary mode, for
+// which 20 consecutive 0x00 bytes are needed, only the 'i', '#' and '$'
+// commands are simulated. Input is echoed.
+type textMode struct{}
+
+func (textMode) input(s *Sim, b byte) {
+	if b != 0x00 {
+		s.zeros = 0
+		s.line = append(s.line, b)
+		switch b {
+		case '\r', '\n':
+			s.command()
+		default:
+			s.respond(b)
+		}
+		return
+	}
+	s.zeros++
+	if s.zeros >= 20 {
+		s.zeros = 0
+		s.line = nil
+		s.setMode(bitbangMode{})
+		s.respond([]byte(wire.BitbangBanner + "1")...)
+	}
+}
+
+// command executes the line typed into the terminal.
+func (s *Sim) command() {
+	cmd := string(s.line[:len(s.line)-1])
+	s.line = nil
+
+	s.respond('\r', '\n')
+	switch cmd {
+	case "":
+	case "i":
+		s.respond([]byte(Info)...)
+	case "#":
+		s.respond([]byte("RESET\r\n\r\n" + Info)...)
+	case "$":
+		s.respond([]byte("Are you sure? ")...)
+		s.setMode(agreeMode{})
+		return
+	default:
+		s.respond([]byte("Syntax error\r\n")...)
+	}
+	s.respond([]byte("HiZ>")...)
+}
+
+// macroMode is a macro running in the user terminal, ESC stops it.
+type macroMode struct{}
+
+func (macroMode) input(s *Sim, b byte) {
+	if b == 0x1b {
+		s.zeros = 0
+		s.line = nil
+		s.setMode(textMode{})
+	}
+}
+
+// bitbangMode is binary bitbang mode, the hub from which the protocol
+// modes are entered.
+type bitbangMode struct{}
+
+func (bitbangMode) input(s *Sim, b byte) {
+	switch {
+	case b == wire.Reset:
+		s.respond([]byte(wire.BitbangBanner + "1")...)
+	case b == wire.EnterI2C:
+		s.setMode(&i2cMode{})
+		s.respond([]byte(wire.I2CBanner + "1")...)
+	case b == wire.EnterSPI:
+		s.setMode(&spiMode{})
+		s.respond([]byte(wire.SPIBanner + "1")...)
+	case b == wire.ResetTerminal:
+		// resets the bus pirate, which greets with its versions
+		s.setMode(textMode{})
+		s.respond(wire.OK)
+		s.respond([]byte("\r\n" + Info + "HiZ>")...)
+	case b&0xe0 == wire.PinDirection:
+		// pin direction, answers with the pin state
+		s.respond(s.pins)
+	case b&0x80 == wire.PinState:
+		// pin state, answers with the pin state
+		s.pins = b & 0x7f
+		s.respond(s.pins)
+	}
+}
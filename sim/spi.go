@@ -0,0 +1,95 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"github.com/distributed/bp/wire"
+)
+
+// SPIDevice is a simulated SPI slave on the CS pin.
+type SPIDevice interface {
+	// Select is called when CS goes low, with active set, and when it
+	// goes high again.
+	Select(active bool)
+	// Exchange is called for every byte clocked while the device is
+	// selected, with the byte on MOSI. It returns the byte on MISO.
+	Exchange(b byte) byte
+}
+
+// AttachSPI connects d to the CS pin of the simulated SPI bus. Passing
+// nil leaves the bus without a device, MISO then reads high.
+func (s *Sim) AttachSPI(d SPIDevice) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spidev = d
+}
+
+// spiMode is binary SPI mode, CS starts high.
+type spiMode struct {
+	need     int // bytes of a bulk transfer still to come
+	selected bool
+}
+
+// selectDev drives CS, active low.
+func (m *spiMode) selectDev(s *Sim, active bool) {
+	if active != m.selected && s.spidev != nil {
+		s.spidev.Select(active)
+	}
+	m.selected = active
+}
+
+// exchange clocks b out and returns the byte clocked in.
+func (m *spiMode) exchange(s *Sim, b byte) byte {
+	if !m.selected || s.spidev == nil {
+		return 0xff
+	}
+	return s.spidev.Exchange(b)
+}
+
+func (m *spiMode) input(s *Sim, b byte) {
+	if m.need > 0 {
+		// like the firmware, clock and answer every byte as it
+		// arrives
+		s.respond(m.exchange(s, b))
+		m.need--
+		return
+	}
+	if m.need < 0 {
+		// the value of an AUX command
+		m.need = 0
+		if b != wire.AUXRead {
+			s.respond(wire.OK)
+		} else if s.aux {
+			s.respond(0x01)
+		} else {
+			s.respond(0x00)
+		}
+		return
+	}
+
+	switch {
+	case b == wire.SPIExit:
+		m.selectDev(s, false)
+		s.setMode(bitbangMode{})
+		s.respond([]byte(wire.BitbangBanner + "1")...)
+	case b == wire.SPIVersion:
+		s.respond([]byte(wire.SPIBanner + "1")...)
+	case b == wire.SPICSLow || b == wire.SPICSHigh:
+		m.selectDev(s, b == wire.SPICSLow)
+		s.respond(wire.OK)
+	case b == wire.SPIAUX:
+		m.need = -1
+		s.respond(wire.OK)
+	case b&0xf0 == wire.SPIBulkTransfer:
+		m.need = int(b&0x0f) + 1
+		s.respond(wire.OK)
+	case b&0xf0 == wire.SPIPeripherals:
+		// the CS bit drives the pin like the CS commands
+		m.selectDev(s, b&wire.PeriphCS == 0)
+		s.respond(wire.OK)
+	case b&0xf8 == wire.SPISpeed || b&0xf0 == wire.SPIConfig:
+		s.respond(wire.OK)
+	}
+}
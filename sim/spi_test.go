@@ -0,0 +1,70 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"testing"
+
+	"github.com/distributed/bp/wire"
+)
+
+// echo is an SPI device answering with the byte clocked in before.
+type echo struct {
+	last     byte
+	selects  int
+	selected bool
+}
+
+func (d *echo) Select(active bool) {
+	d.selected = active
+	if active {
+		d.selects++
+	}
+}
+
+func (d *echo) Exchange(b byte) byte {
+	prev := d.last
+	d.last = b
+	return prev
+}
+
+func TestSPI(t *testing.T) {
+	s := New()
+	s.StartInBinary()
+	dev := &echo{}
+	s.AttachSPI(dev)
+	expect(t, s, b(wire.EnterSPI), []byte(wire.SPIBanner+"1")...)
+	expect(t, s, b(wire.SPIVersion), []byte(wire.SPIBanner+"1")...)
+
+	// MISO floats high while CS is high
+	expect(t, s, b(wire.BulkTransfer(2), 0x11, 0x22), wire.OK, 0xff, 0xff)
+
+	expect(t, s, b(wire.SPICSLow), wire.OK)
+	expect(t, s, b(wire.BulkTransfer(3), 0x11, 0x22, 0x33), wire.OK, 0x00, 0x11, 0x22)
+	expect(t, s, b(wire.BulkTransfer(1)), wire.OK)
+	expect(t, s, b(0x44), 0x33)
+	expect(t, s, b(wire.SPICSHigh), wire.OK)
+	if dev.selects != 1 || dev.selected {
+		t.Errorf("selected %d times, selected now %v", dev.selects, dev.selected)
+	}
+
+	// the CS bit of the peripherals drives CS as well
+	expect(t, s, b(wire.SPIPeripherals|wire.PeriphPower), wire.OK)
+	if !dev.selected {
+		t.Error("not selected with the CS bit clear")
+	}
+	expect(t, s, b(wire.SPIPeripherals|wire.PeriphPower|wire.PeriphCS), wire.OK)
+
+	expect(t, s, b(wire.SPIAUX, wire.AUXRead), wire.OK, 0x01)
+	s.SetAUX(false)
+	expect(t, s, b(wire.SPIAUX, wire.AUXRead), wire.OK, 0x00)
+	expect(t, s, b(wire.SPIAUX, wire.AUXHiZ), wire.OK, wire.OK)
+
+	expect(t, s, b(wire.SPISpeed|wire.SPISpeed8MHz, wire.SPIConfig|wire.SPIConfigOutput3V3), wire.OK, wire.OK)
+	expect(t, s, b(wire.SPICSLow, wire.SPIExit), append([]byte{wire.OK}, wire.BitbangBanner+"1"...)...)
+	if dev.selected {
+		t.Error("still selected after leaving SPI mode")
+	}
+}
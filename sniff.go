@@ -0,0 +1,423 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/distributed/bp/wire"
+)
+
+// SniffEventType describes what happened on the bus.
+type SniffEventType int
+
+const (
+	SniffStart SniffEventType = iota
+	SniffStop
+	SniffByte
+)
+
+func (t SniffEventType) String() string {
+	switch t {
+	case SniffStart:
+		return "start"
+	case SniffStop:
+		return "stop"
+	case SniffByte:
+		return "byte"
+	}
+	return fmt.Sprintf("SniffEventType(%d)", int(t))
+}
+
+// SniffEvent is a single event observed by the I2C sniffer. Byte and ACK
+// are only meaningful for events of type SniffByte. Time is the host
+// time at which the event was received from the bus pirate, it carries a
+// monotonic clock reading. Elapsed is the monotonic time since the
+// sniffer was started, it survives serialization of the event.
+type SniffEvent struct {
+	Type    SniffEventType
+	Byte    byte
+	ACK     bool
+	Time    time.Time
+	Elapsed time.Duration
+}
+
+// I2CSniffer is a running I2C bus sniffer. While the sniffer is active the
+// bus pirate does not accept any other commands, the BusPirateI2C it was
+// started from must not be used until the sniffer is stopped.
+type I2CSniffer struct {
+	bp      *BusPirate
+	c       Conn
+	started time.Time
+	filter  *AddrFilter
+	fn      func(SniffEvent) error
+	events  chan SniffEvent
+	done    chan struct{}
+	abort   chan struct{}
+	err     error
+	fnerr   error
+
+	exitonce sync.Once
+	exiterr  error
+}
+
+// Sniff puts the bus pirate into I2C sniffer mode. Events observed on the
+// bus are delivered on the channel returned by *I2CSniffer.Events(). If
+// addresses are given, only transactions with one of these 7 bit
+// addresses are delivered. Call Stop to leave sniffer mode and return to
+// I2C mode.
+func (inf BusPirateI2C) Sniff(addrs ...uint8) (*I2CSniffer, error) {
+	return inf.sniff(nil, addrs)
+}
+
+// SniffFunc is like Sniff, but instead of delivering events on a channel
+// it calls fn for every event, from the goroutine reading from the bus
+// pirate. While fn runs, no further data is read, so a slow fn exerts
+// backpressure all the way to the device. If fn returns an error, the
+// sniffer leaves sniffer mode on its own and Stop returns that error.
+// Events() is unused for sniffers started with SniffFunc. fn must not
+// call methods of the BusPirate the sniffer runs on.
+func (inf BusPirateI2C) SniffFunc(fn func(SniffEvent) error, addrs ...uint8) (*I2CSniffer, error) {
+	return inf.sniff(fn, addrs)
+}
+
+func (inf BusPirateI2C) sniff(fn func(SniffEvent) error, addrs []uint8) (s *I2CSniffer, err error) {
+	err = inf.bp.do(func() error {
+		s, err = inf.startSniffer(fn, addrs)
+		return err
+	})
+	return s, err
+}
+
+func (inf BusPirateI2C) startSniffer(fn func(SniffEvent) error, addrs []uint8) (_ *I2CSniffer, err error) {
+	bp := inf.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+	defer func() { bp.report(err) }()
+
+	if err := inf.check("i2c.Sniff"); err != nil {
+		return nil, err
+	}
+	if err := bp.settle(); err != nil {
+		return nil, err
+	}
+	if err := bp.supports("i2c.Sniff", func(c Capabilities) bool { return c.Sniffer }); err != nil {
+		return nil, err
+	}
+
+	bp.stats.Commands++
+	if err := bp.exchangeByteAndExpect(wire.I2CSniff, wire.OK); err != nil {
+		bp.clearMode()
+		return nil, &OpError{"i2c.Sniff", MODE_I2C, nil, err}
+	}
+
+	// the sniffer only talks when there is traffic on the bus, so reads
+	// have to time out regularly.
+	if err := bp.c.SetReadParams(0, 100e-3); err != nil {
+		bp.clearMode()
+		return nil, &OpError{"i2c.Sniff", MODE_I2C, nil, err}
+	}
+
+	// the sniffer is part of I2C mode, the handle stays valid
+	bp.mode = MODE_I2C_SNIFF
+	bp.modeChanged(MODE_I2C)
+	bp.logf(SubsysSniffer, LogInfo, "started")
+
+	s := &I2CSniffer{
+		bp:      bp,
+		c:       bp.c,
+		started: time.Now(),
+		fn:      fn,
+		events:  make(chan SniffEvent, 256),
+		done:    make(chan struct{}),
+		abort:   make(chan struct{}),
+	}
+	if len(addrs) > 0 {
+		s.filter = NewAddrFilter(addrs...)
+	}
+	bp.sniffer = s
+	go s.run()
+
+	return s, nil
+}
+
+// Events returns the channel on which sniffed events are delivered. The
+// channel is closed when the sniffer terminates.
+func (s *I2CSniffer) Events() <-chan SniffEvent {
+	return s.events
+}
+
+// Started returns the host time at which the sniffer was started. It is
+// the reference for SniffEvent.Elapsed.
+func (s *I2CSniffer) Started() time.Time {
+	return s.started
+}
+
+// Err returns the error that terminated the sniffer, if any. It is only
+// valid after the events channel has been closed.
+func (s *I2CSniffer) Err() error {
+	if s.fnerr != nil {
+		return s.fnerr
+	}
+	return s.err
+}
+
+// exit asks the firmware to leave sniffer mode. Any byte ends sniffer
+// mode, the firmware acknowledges with 0x01. It has to be called on the
+// I/O goroutine.
+func (s *I2CSniffer) exit() error {
+	s.exitonce.Do(func() {
+		// no read follows that would flush the byte
+		if _, s.exiterr = s.c.Write([]byte{wire.Reset}); s.exiterr == nil {
+			s.exiterr = s.bp.link.flush()
+		}
+	})
+	return s.exiterr
+}
+
+// Stop leaves sniffer mode. The bus pirate is back in I2C mode afterwards
+// and the BusPirateI2C used to start the sniffer may be used again.
+func (s *I2CSniffer) Stop() error {
+	bp := s.bp
+	stopping := false
+	err := bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		defer func() { bp.report(err) }()
+
+		if bp.sniffer != s {
+			// already stopped, or aborted by a reset
+			return nil
+		}
+		bp.sniffer = nil
+
+		if err := s.exit(); err != nil {
+			bp.clearMode()
+			return &OpError{"i2c.StopSniff", MODE_I2C_SNIFF, nil, err}
+		}
+		stopping = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the sniffer reads the answer to exit, or notices that it was
+	// aborted, on the I/O goroutine, so it is waited for here. Once it
+	// is aborted, it ends with its next read or event, its errors are
+	// only read after that.
+	timeout := false
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		timeout = true
+		if stopping {
+			close(s.abort)
+			<-s.done
+		}
+	}
+
+	return bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		defer func() { bp.report(err) }()
+
+		if !stopping {
+			if timeout {
+				return &OpError{"i2c.StopSniff", bp.mode, nil, fmt.Errorf("%w: sniffer did not terminate", ErrUnexpectedResponse)}
+			}
+			if s.err != nil {
+				return &OpError{"i2c.StopSniff", bp.mode, nil, s.err}
+			}
+			return s.fnerr
+		}
+		if timeout {
+			bp.clearMode()
+			return &OpError{"i2c.StopSniff", MODE_I2C_SNIFF, nil, fmt.Errorf("%w: sniffer did not terminate", ErrUnexpectedResponse)}
+		}
+		if s.err != nil {
+			bp.clearMode()
+			return &OpError{"i2c.StopSniff", MODE_I2C_SNIFF, nil, s.err}
+		}
+
+		bp.mode = MODE_I2C
+		bp.modeChanged(MODE_I2C_SNIFF)
+		bp.logf(SubsysSniffer, LogInfo, "stopped")
+		return s.fnerr
+	})
+}
+
+var errSnifferAborted = ModeError("sniffer aborted, the bus pirate was reset")
+
+// abortSniffer ends a running sniffer without telling the bus pirate, it
+// is going to be reset anyway. The caller has to hold the lock and run on
+// the I/O goroutine, so the sniffer is not reading and won't read again.
+func (bp *BusPirate) abortSniffer() {
+	s := bp.sniffer
+	if s == nil {
+		return
+	}
+	bp.sniffer = nil
+	close(s.abort)
+}
+
+func (s *I2CSniffer) run() {
+	defer close(s.done)
+	defer close(s.events)
+
+	var (
+		buf [64]byte
+		dec sniffDecoder
+	)
+
+	for {
+		// reads take turns with the other jobs of the I/O goroutine
+		var (
+			n       int
+			err     error
+			aborted bool
+		)
+		s.bp.do(func() error {
+			select {
+			case <-s.abort:
+				aborted = true
+			default:
+				n, err = s.c.Read(buf[:])
+			}
+			return nil
+		})
+		if aborted {
+			s.err = errSnifferAborted
+			return
+		}
+		now := time.Now()
+		elapsed := now.Sub(s.started)
+
+		for _, b := range buf[:n] {
+			ev, ok, exit, bad := dec.feed(b)
+			if bad {
+				s.bp.logf(SubsysSniffer, LogDebug, "dropping unexpected byte %#02x", b)
+			}
+			if exit {
+				// answer to the byte sent by exit
+				return
+			}
+			if ok {
+				ev.Time = now
+				ev.Elapsed = elapsed
+				s.deliver(ev)
+			}
+		}
+
+		if s.err != nil {
+			// leaving sniffer mode after an error of fn failed
+			return
+		}
+
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			s.bp.logf(SubsysSniffer, LogError, "read failed: %v", err)
+			s.err = err
+			return
+		}
+	}
+}
+
+func (s *I2CSniffer) deliver(ev SniffEvent) {
+	s.bp.logf(SubsysSniffer, LogTrace, "%v %#02x ack %v", ev.Type, ev.Byte, ev.ACK)
+
+	evs := []SniffEvent{ev}
+	if s.filter != nil {
+		evs = s.filter.Add(ev)
+	}
+
+	for _, ev := range evs {
+		if s.fn == nil {
+			// a reader that is gone must not keep Stop from
+			// ending the sniffer
+			select {
+			case s.events <- ev:
+			case <-s.abort:
+				return
+			}
+			continue
+		}
+
+		// after an error of fn, events are dropped until the firmware
+		// acknowledges the end of sniffer mode.
+		if s.fnerr != nil {
+			return
+		}
+		if err := s.fn(ev); err != nil {
+			s.fnerr = err
+			if err := s.bp.do(s.exit); err != nil {
+				s.err = err
+			}
+			return
+		}
+	}
+}
+
+// I2CTransaction is a sequence of sniffed bytes framed by a start
+// condition and a (repeated) start or stop condition. Addr is the 7 bit
+// address taken from the first byte, Read is the direction bit.
+type I2CTransaction struct {
+	Addr    uint8
+	Read    bool
+	AddrACK bool
+	Data    []byte
+	ACKs    []bool
+	Start   time.Time
+	End     time.Time
+}
+
+// TransactionAssembler groups sniffer events into transactions.
+type TransactionAssembler struct {
+	cur      *I2CTransaction
+	haveaddr bool
+}
+
+// Add feeds one event into the assembler. When the event completes a
+// transaction, it is returned.
+func (a *TransactionAssembler) Add(ev SniffEvent) *I2CTransaction {
+	switch ev.Type {
+	case SniffStart:
+		done := a.finish(ev.Time)
+		a.cur = &I2CTransaction{Start: ev.Time}
+		a.haveaddr = false
+		return done
+	case SniffStop:
+		return a.finish(ev.Time)
+	case SniffByte:
+		if a.cur == nil {
+			// bytes without a preceding start, we joined mid transaction
+			return nil
+		}
+		if !a.haveaddr {
+			a.cur.Addr = ev.Byte >> 1
+			a.cur.Read = ev.Byte&1 == 1
+			a.cur.AddrACK = ev.ACK
+			a.haveaddr = true
+			return nil
+		}
+		a.cur.Data = append(a.cur.Data, ev.Byte)
+		a.cur.ACKs = append(a.cur.ACKs, ev.ACK)
+	}
+	return nil
+}
+
+func (a *TransactionAssembler) finish(t time.Time) *I2CTransaction {
+	tr := a.cur
+	a.cur = nil
+	if tr == nil || !a.haveaddr {
+		return nil
+	}
+	tr.End = t
+	return tr
+}
@@ -0,0 +1,107 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package soak
+
+import (
+	"fmt"
+
+	"github.com/distributed/bp"
+)
+
+// i2c returns the I2C handle of b, entering I2C mode if a previous
+// operation or a resync left it.
+func i2c(b *bp.BusPirate) (bp.BusPirateI2C, error) {
+	h, err := b.EnterMode(bp.MODE_I2C)
+	if err != nil {
+		return bp.BusPirateI2C{}, err
+	}
+	return h.(bp.BusPirateI2C), nil
+}
+
+// Transact reads n registers starting at reg from the device at the 7
+// bit address addr with a single write then read command.
+func Transact(addr, reg uint8, n int) Op {
+	return Op{
+		Name: fmt.Sprintf("transact %#02x", addr),
+		Run: func(b *bp.BusPirate) error {
+			h, err := i2c(b)
+			if err != nil {
+				return err
+			}
+			r := make([]byte, n)
+			_, _, err = bp.NonStrictI2C{BusPirateI2C: h}.Transact8x8(bp.Addr7(addr), reg, nil, r)
+			return err
+		},
+	}
+}
+
+// ReadRegs reads n registers starting at reg from the device at the 7 bit
+// address addr like Transact does, but built from the I2C primitives, so
+// it takes a round trip per byte.
+func ReadRegs(addr, reg uint8, n int) Op {
+	return Op{
+		Name: fmt.Sprintf("read %#02x", addr),
+		Run: func(b *bp.BusPirate) error {
+			h, err := i2c(b)
+			if err != nil {
+				return err
+			}
+			return readRegs(h, addr, reg, n)
+		},
+	}
+}
+
+func readRegs(h bp.BusPirateI2C, addr, reg uint8, n int) error {
+	if err := h.Start(); err != nil {
+		return err
+	}
+	if err := h.WriteByte(addr << 1); err != nil {
+		h.Stop()
+		return err
+	}
+	if err := h.WriteByte(reg); err != nil {
+		h.Stop()
+		return err
+	}
+	if err := h.Start(); err != nil {
+		return err
+	}
+	if err := h.WriteByte(addr<<1 | 1); err != nil {
+		h.Stop()
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if _, err := h.ReadByteAck(i < n-1); err != nil {
+			h.Stop()
+			return err
+		}
+	}
+	return h.Stop()
+}
+
+// ModeCycle leaves I2C mode for bitbang mode and enters it again, which
+// exercises the mode changes and resets the peripherals.
+func ModeCycle() Op {
+	return Op{
+		Name: "mode cycle",
+		Run: func(b *bp.BusPirate) error {
+			if _, err := b.EnterMode(bp.MODE_BITBANG); err != nil {
+				return err
+			}
+			_, err := b.EnterMode(bp.MODE_I2C)
+			return err
+		},
+	}
+}
+
+// Resync brings the bus pirate back into a known state with Resync.
+func Resync() Op {
+	return Op{
+		Name: "resync",
+		Run: func(b *bp.BusPirate) error {
+			return b.Resync()
+		},
+	}
+}
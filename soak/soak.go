@@ -0,0 +1,213 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package soak runs a mix of operations against a bus pirate for hours
+// and records how it fares: error rates, resyncs, reconnects and latency
+// percentiles, per reporting interval and for the whole run. Use it to
+// qualify cables, USB hubs and firmware versions.
+//
+// Failed operations are counted and the run goes on. To see how well the
+// link recovers, turn on SetAutoResync and SetReconnect on the bus pirate
+// before starting the run.
+package soak
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/distributed/bp"
+)
+
+// Op is an operation of the mix.
+type Op struct {
+	Name string
+
+	// Weight is the relative frequency of the operation in the mix,
+	// values below 1 mean 1.
+	Weight int
+
+	// Run carries out the operation once.
+	Run func(b *bp.BusPirate) error
+}
+
+// Config describes a soak run.
+type Config struct {
+	Ops []Op
+
+	// Duration is the length of the run. If zero, it runs until the
+	// context is done.
+	Duration time.Duration
+
+	// Interval is the length of the reporting intervals, a minute if
+	// zero.
+	Interval time.Duration
+
+	// Pause is the time waited between operations.
+	Pause time.Duration
+
+	// Seed seeds the choice of operations, a zero seed is taken from
+	// the clock.
+	Seed int64
+
+	// Report, if not nil, is called with the report of every interval
+	// when it ends, including the last, possibly shorter one.
+	Report func(Report)
+}
+
+// OpReport summarizes the runs of an operation.
+type OpReport struct {
+	Runs    uint64
+	Errors  uint64
+	Latency bp.LatencyHistogram
+
+	// LastError is the last error the operation failed with.
+	LastError error
+}
+
+// ErrorRate returns the fraction of runs that failed.
+func (r OpReport) ErrorRate() float64 {
+	if r.Runs == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Runs)
+}
+
+func (r *OpReport) add(d time.Duration, err error) {
+	r.Runs++
+	r.Latency.Add(d)
+	if err != nil {
+		r.Errors++
+		r.LastError = err
+	}
+}
+
+// Report covers the operations run between Start and End.
+type Report struct {
+	Start, End time.Time
+
+	Ops   map[string]OpReport // by operation name
+	Total OpReport            // all operations
+
+	// Stats is the change of the bus pirate's counters, which tells
+	// about the retries, resyncs and reconnects it took.
+	Stats bp.Stats
+}
+
+// ErrNoOps is returned by Run when the mix is empty.
+var ErrNoOps = errors.New("soak: no operations")
+
+// Run runs the operations of c against b, chosen at random according to
+// their weights, until c.Duration has passed or ctx is done. It returns
+// the report of the whole run. The only errors returned are those about
+// c, failing operations are part of the report.
+func Run(ctx context.Context, b *bp.BusPirate, c Config) (Report, error) {
+	if len(c.Ops) == 0 {
+		return Report{}, ErrNoOps
+	}
+	if c.Interval <= 0 {
+		c.Interval = time.Minute
+	}
+	if c.Seed == 0 {
+		c.Seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(c.Seed))
+
+	weights := 0
+	for _, op := range c.Ops {
+		weights += weight(op)
+	}
+
+	if c.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Duration)
+		defer cancel()
+	}
+
+	start := time.Now()
+	stats := b.Stats()
+	total := newReport(start, stats)
+	interval := newReport(start, stats)
+
+	for ctx.Err() == nil {
+		op := pick(c.Ops, rnd.Intn(weights))
+
+		t := time.Now()
+		err := op.Run(b)
+		d := time.Since(t)
+		total.add(op.Name, d, err)
+		interval.add(op.Name, d, err)
+
+		if now := time.Now(); now.Sub(interval.Start) >= c.Interval {
+			interval.end(now, b.Stats())
+			if c.Report != nil {
+				c.Report(interval)
+			}
+			interval = newReport(now, b.Stats())
+		}
+
+		if c.Pause > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.Pause):
+			}
+		}
+	}
+
+	now := time.Now()
+	if interval.Total.Runs > 0 && c.Report != nil {
+		interval.end(now, b.Stats())
+		c.Report(interval)
+	}
+	total.end(now, b.Stats())
+	return total, nil
+}
+
+func weight(op Op) int {
+	if op.Weight < 1 {
+		return 1
+	}
+	return op.Weight
+}
+
+// pick returns the operation n falls on, 0 <= n < sum of weights.
+func pick(ops []Op, n int) Op {
+	for _, op := range ops {
+		n -= weight(op)
+		if n < 0 {
+			return op
+		}
+	}
+	return ops[len(ops)-1]
+}
+
+// newReport starts a report at start. Until it ends, Stats holds the
+// counters at the start.
+func newReport(start time.Time, stats bp.Stats) Report {
+	return Report{Start: start, Ops: map[string]OpReport{}, Stats: stats}
+}
+
+func (r *Report) add(name string, d time.Duration, err error) {
+	o := r.Ops[name]
+	o.add(d, err)
+	r.Ops[name] = o
+	r.Total.add(d, err)
+}
+
+// end ends the report at end, with the counters at the end.
+func (r *Report) end(end time.Time, stats bp.Stats) {
+	r.End = end
+	r.Stats = bp.Stats{
+		BytesWritten: stats.BytesWritten - r.Stats.BytesWritten,
+		BytesRead:    stats.BytesRead - r.Stats.BytesRead,
+		Commands:     stats.Commands - r.Stats.Commands,
+		Transactions: stats.Transactions - r.Stats.Transactions,
+		NACKs:        stats.NACKs - r.Stats.NACKs,
+		Retries:      stats.Retries - r.Stats.Retries,
+		Resyncs:      stats.Resyncs - r.Stats.Resyncs,
+		Reconnects:   stats.Reconnects - r.Stats.Reconnects,
+		Errors:       stats.Errors - r.Stats.Errors,
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+
+	"github.com/distributed/bp/wire"
+)
+
+// BusPirateSPI represents a bus pirate in SPI mode. It implements
+// SPIMaster with the CS pin as the chip select, so the SPI device drivers
+// of this module run on it. Obtain a BusPirateSPI with
+// *BusPirate.EnterSPIMode. Like the other mode handles, it becomes stale
+// when the bus pirate changes modes.
+//
+// The firmware starts SPI mode at 30kHz with open drain outputs, see
+// SetSpeed and SetConfig.
+type BusPirateSPI struct {
+	bp  *BusPirate
+	gen uint64
+}
+
+// SPIConfig is the configuration of the SPI clock and outputs, see
+// BusPirateSPI.SetConfig.
+type SPIConfig byte
+
+const (
+	SPISampleEnd    SPIConfig = wire.SPIConfigSampleEnd    // sample the input at the end of the bit
+	SPIActiveToIdle SPIConfig = wire.SPIConfigActiveToIdle // output changes on the active to idle clock edge
+	SPIIdleHigh     SPIConfig = wire.SPIConfigIdleHigh     // the clock idles high
+	SPIOutput3V3    SPIConfig = wire.SPIConfigOutput3V3    // drive the outputs to 3.3V, open drain otherwise
+
+	// SPIMode0 is SPI mode 0, with the clock idling low and the input
+	// sampled on the rising edge, and the configuration the firmware
+	// starts with. Most SPI devices use it.
+	SPIMode0 = SPIActiveToIdle
+)
+
+// spiconfig is the configuration of SPI mode set by the user. The
+// firmware forgets it when leaving the mode.
+type spiconfig struct {
+	speed  int // Hz, 0 for the firmware default
+	config SPIConfig
+	periph Peripherals
+}
+
+// EnterSPIMode makes the bus pirate enter SPI mode and returns a
+// BusPirateSPI offering the SPI functionality of the device. SPI mode can
+// only be entered from bitbang mode, see EnterMode for the way there from
+// other modes.
+func (bp *BusPirate) EnterSPIMode() (m BusPirateSPI, err error) {
+	err = bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		m, err = bp.enterSPIMode()
+		return bp.report(err)
+	})
+	return m, err
+}
+
+func (bp *BusPirate) enterSPIMode() (BusPirateSPI, error) {
+	var sp BusPirateSPI
+
+	mode := bp.mode
+	if mode != MODE_BITBANG {
+		return sp, &OpError{"EnterSPIMode", mode, nil, ModeError("SPI mode can only be entered from raw bitbang mode")}
+	}
+
+	bp.stats.Commands++
+	if err := bp.writeByte(wire.EnterSPI); err != nil {
+		bp.clearMode()
+		return sp, &OpError{"EnterSPIMode", mode, nil, err}
+	}
+
+	v, err := bp.readBanner(wire.EnterSPI, wire.SPIBanner)
+	if err != nil {
+		bp.clearMode()
+		if isProtocolError(err) {
+			bp.suspicious()
+		}
+		return sp, &OpError{"EnterSPIMode", mode, nil, err}
+	}
+
+	ver, err := bp.checkVersion("SPI", v)
+	if err != nil {
+		bp.clearMode()
+		bp.suspicious()
+		return sp, &OpError{"EnterSPIMode", mode, nil, err}
+	}
+
+	bp.setMode(MODE_SPI, ver)
+	// the firmware starts with CS high
+	bp.spiconf = spiconfig{config: SPIMode0, periph: PeriphCS}
+
+	sp.bp = bp
+	sp.gen = bp.gen
+	return sp, nil
+}
+
+// check returns an error if the handle can't be used right now. The
+// caller has to hold the lock.
+func (sp BusPirateSPI) check(op string) error {
+	if sp.gen != sp.bp.gen {
+		return &OpError{op, sp.bp.mode, nil, ErrStaleHandle}
+	}
+	if sp.bp.mode != MODE_SPI {
+		return &OpError{op, sp.bp.mode, nil, ErrNotSPIMode}
+	}
+	return nil
+}
+
+// command sends the command byte b, which is answered with OK, and calls
+// done if it was.
+func (sp BusPirateSPI) command(op string, b byte, done func()) (err error) {
+	bp := sp.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+
+	if err := sp.check(op); err != nil {
+		return err
+	}
+	bp.stats.Commands++
+	if err := bp.exchangeByteAndExpect(b, wire.OK); err != nil {
+		return &OpError{op, MODE_SPI, nil, err}
+	}
+	if done != nil {
+		done()
+	}
+	return nil
+}
+
+// set is command for the settings, which are not retried.
+func (sp BusPirateSPI) set(op string, b byte, done func()) error {
+	return sp.bp.do(func() (err error) {
+		defer func() {
+			sp.bp.mu.Lock()
+			sp.bp.report(err)
+			sp.bp.mu.Unlock()
+		}()
+		return sp.command(op, b, done)
+	})
+}
+
+// Select drives the CS pin low if active is set, which selects the
+// device, and high otherwise.
+func (sp BusPirateSPI) Select(active bool) error {
+	b := byte(wire.SPICSHigh)
+	if active {
+		b = wire.SPICSLow
+	}
+	return sp.bp.retry("spi.Select", func() error {
+		return sp.command("spi.Select", b, func() {
+			// CS is the CS peripheral as well
+			sp.bp.spiconf.periph |= PeriphCS
+			if active {
+				sp.bp.spiconf.periph &^= PeriphCS
+			}
+		})
+	})
+}
+
+// Exchange clocks out w while clocking in as many bytes into r, unless r
+// is nil, leaving CS as it is. r has to be at least as long as w. There
+// is no limit on the length, the bulk transfers needed go out in one
+// pipelined batch, see SetPipelineWindow.
+func (sp BusPirateSPI) Exchange(w, r []byte) error {
+	if r != nil && len(r) < len(w) {
+		return &OpError{"spi.Exchange", MODE_SPI, nil, fmt.Errorf("%d bytes to write, but only room for reading %d", len(w), len(r))}
+	}
+	return sp.bp.retry("spi.Exchange", func() error {
+		return sp.exchange(w, r)
+	})
+}
+
+func (sp BusPirateSPI) exchange(w, r []byte) (err error) {
+	bp := sp.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+
+	if err := sp.check("spi.Exchange"); err != nil {
+		return err
+	}
+	bp.stats.Commands++
+	return bp.pipe(bp.transferExchs(w, r))
+}
+
+// transferExchs returns the bulk transfer commands clocking out w, which
+// is copied, and clocking the answers into r unless it is nil.
+func (bp *BusPirate) transferExchs(w, r []byte) []exch {
+	var cmds []exch
+	for off := 0; off < len(w); {
+		n := len(w) - off
+		if n > wire.MaxBulkTransfer {
+			n = wire.MaxBulkTransfer
+		}
+		var dst []byte
+		if r != nil {
+			dst = r[off : off+n]
+		}
+		cmds = append(cmds,
+			exch{op: "spi.Exchange", out: []byte{wire.BulkTransfer(n)}},
+			exch{op: "spi.Exchange", out: append([]byte(nil), w[off:off+n]...), check: func(in []byte) error {
+				copy(dst, in)
+				return nil
+			}})
+		off += n
+	}
+	return cmds
+}
+
+// SetSpeed sets the SPI clock to hz, one of the SPISpeed values. The
+// speeds are approximate.
+func (sp BusPirateSPI) SetSpeed(hz int) error {
+	bits, ok := spispeeds[hz]
+	if !ok {
+		return &OpError{"spi.SetSpeed", MODE_SPI, nil, fmt.Errorf("unsupported speed %d Hz", hz)}
+	}
+	return sp.set("spi.SetSpeed", wire.SPISpeed|bits, func() { sp.bp.spiconf.speed = hz })
+}
+
+// SetConfig sets the clock polarity and phase, the sampling point and the
+// output type. Devices powered from the bus pirate usually want
+// SPIOutput3V3, unless the pull-ups are on.
+func (sp BusPirateSPI) SetConfig(c SPIConfig) error {
+	if c&^(SPISampleEnd|SPIActiveToIdle|SPIIdleHigh|SPIOutput3V3) != 0 {
+		return &OpError{"spi.SetConfig", MODE_SPI, nil, fmt.Errorf("invalid configuration %#02x", byte(c))}
+	}
+	return sp.set("spi.SetConfig", wire.SPIConfig|byte(c), func() { sp.bp.spiconf.config = c })
+}
+
+// SetPeripherals switches the peripherals in p on and all others off.
+// PeriphCS is the level of the CS pin, which Select drives as well, so
+// leaving it out selects the device.
+func (sp BusPirateSPI) SetPeripherals(p Peripherals) error {
+	if p&^(PeriphPower|PeriphPullups|PeriphAUX|PeriphCS) != 0 {
+		return &OpError{"spi.SetPeripherals", MODE_SPI, nil, fmt.Errorf("invalid peripherals %#02x", byte(p))}
+	}
+	return sp.set("spi.SetPeripherals", wire.SPIPeripherals|byte(p), func() { sp.bp.spiconf.periph = p })
+}
+
+// ReadAUX reads the level of the AUX pin, for example the interrupt
+// output of a device. The pin is floated for that, it stays floating
+// until SetPeripherals drives it again.
+func (sp BusPirateSPI) ReadAUX() (level bool, err error) {
+	err = sp.bp.retry("spi.ReadAUX", func() error {
+		level, err = sp.readAUX()
+		return err
+	})
+	return level, err
+}
+
+func (sp BusPirateSPI) readAUX() (_ bool, err error) {
+	bp := sp.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+
+	if err := sp.check("spi.ReadAUX"); err != nil {
+		return false, err
+	}
+	if err := bp.supports("spi.ReadAUX", func(c Capabilities) bool { return c.AUXRead }); err != nil {
+		return false, err
+	}
+
+	bp.stats.Commands++
+	var level bool
+	err = bp.pipe([]exch{
+		{op: "spi.ReadAUX", out: []byte{wire.SPIAUX, wire.AUXHiZ, wire.SPIAUX}},
+		{op: "spi.ReadAUX", out: []byte{wire.AUXRead}, check: func(in []byte) error {
+			if in[0] > 1 {
+				bp.suspicious()
+				return &ResponseError{Got: in[0], Want: 0x01}
+			}
+			level = in[0] == 1
+			return nil
+		}},
+	})
+	return level, err
+}
+
+// restoreSPIConfig sends conf to the bus pirate after SPI mode was
+// re-entered following a reset. The caller has to hold the lock.
+func (bp *BusPirate) restoreSPIConfig(conf spiconfig) error {
+	if conf.speed != 0 {
+		if err := bp.exchangeByteAndExpect(wire.SPISpeed|spispeeds[conf.speed], wire.OK); err != nil {
+			return err
+		}
+	}
+	if conf.config != SPIMode0 {
+		if err := bp.exchangeByteAndExpect(wire.SPIConfig|byte(conf.config), wire.OK); err != nil {
+			return err
+		}
+	}
+	if conf.periph != PeriphCS {
+		if err := bp.exchangeByteAndExpect(wire.SPIPeripherals|byte(conf.periph), wire.OK); err != nil {
+			return err
+		}
+	}
+	bp.spiconf = conf
+	return nil
+}
+
+var _ SPIMaster = BusPirateSPI{}
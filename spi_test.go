@@ -0,0 +1,262 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/distributed/bp"
+	"github.com/distributed/bp/bptest"
+	"github.com/distributed/bp/sim"
+)
+
+func TestSPIGolden(t *testing.T) {
+	b := bptest.NewBusPirate(t, `
+		# Open
+		> 00
+		< 42 42 49 4f 31
+		< timeout
+		# EnterSPIMode
+		> 01
+		< 53 50 49 31
+		# SetSpeed, SetConfig and SetPeripherals
+		> 63
+		< 01
+		> 8a
+		< 01
+		> 49
+		< 01
+		# Select
+		> 02
+		< 01
+		# Exchange, 16 bytes and 2 bytes
+		> 1f 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 0d 0e 0f 11 10 11
+		< 01 f0 f1 f2 f3 f4 f5 f6 f7 f8 f9 fa fb fc fd fe ff 01 e0 e1
+		# Select
+		> 03
+		< 01
+		# ReadAUX
+		> 09 02 09 03
+		< 01 01 01 00
+		# Close
+		> 00
+		< 42 42 49 4f 31
+	`)
+	b.SetPipelineWindow(64)
+	if err := b.Open(); err != nil {
+		t.Fatal(err)
+	}
+	sp, err := b.EnterSPIMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.SetSpeed(int(bp.SPI1MHz)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.SetConfig(bp.SPIMode0 | bp.SPIOutput3V3); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.SetPeripherals(bp.PeriphPower | bp.PeriphCS); err != nil {
+		t.Fatal(err)
+	}
+
+	w := make([]byte, 18)
+	for i := range w {
+		w[i] = byte(i)
+	}
+	r := make([]byte, len(w))
+	if err := bp.SPITransfer(sp, w, r); err != nil {
+		t.Fatal(err)
+	}
+	if r[0] != 0xf0 || r[15] != 0xff || r[16] != 0xe0 || r[17] != 0xe1 {
+		t.Errorf("read % x", r)
+	}
+
+	level, err := sp.ReadAUX()
+	if err != nil || level {
+		t.Errorf("ReadAUX: %v, %v, want low", level, err)
+	}
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// spiLog is an SPI device answering every byte with its complement and
+// logging the transfers, one per selection.
+type spiLog struct {
+	transfers [][]byte
+	selected  bool
+}
+
+func (d *spiLog) Select(active bool) {
+	if active {
+		d.transfers = append(d.transfers, nil)
+	}
+	d.selected = active
+}
+
+func (d *spiLog) Exchange(b byte) byte {
+	n := len(d.transfers) - 1
+	d.transfers[n] = append(d.transfers[n], b)
+	return ^b
+}
+
+func simSPI(t *testing.T) (*bp.BusPirate, *sim.Sim, *spiLog) {
+	t.Helper()
+	s := sim.New()
+	s.StartInBinary()
+	dev := &spiLog{}
+	s.AttachSPI(dev)
+	b := bp.NewBusPirate(s)
+	if err := b.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b, s, dev
+}
+
+func TestSPISim(t *testing.T) {
+	b, s, dev := simSPI(t)
+
+	// from I2C mode through bitbang mode
+	if _, err := b.EnterMode(bp.MODE_I2C); err != nil {
+		t.Fatal(err)
+	}
+	h, err := b.EnterMode(bp.MODE_SPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := h.(bp.BusPirateSPI)
+
+	w := bytes.Repeat([]byte{0x5a, 0x0f, 0x33}, 20)
+	r := make([]byte, len(w))
+	if err := bp.SPITransfer(sp, w, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := bp.SPITransfer(sp, []byte{0x9f}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(dev.transfers) != 2 || !bytes.Equal(dev.transfers[0], w) || !bytes.Equal(dev.transfers[1], []byte{0x9f}) {
+		t.Errorf("device saw % x", dev.transfers)
+	}
+	for i := range w {
+		if r[i] != ^w[i] {
+			t.Fatalf("read % x for % x", r, w)
+		}
+	}
+	if dev.selected {
+		t.Error("device left selected")
+	}
+
+	// nothing answers while the device is not selected
+	r = make([]byte, 2)
+	if err := sp.Exchange([]byte{0x01, 0x02}, r); err != nil {
+		t.Fatal(err)
+	}
+	if r[0] != 0xff || r[1] != 0xff {
+		t.Errorf("read % x from a deselected device", r)
+	}
+	if err := sp.Exchange([]byte{1, 2}, make([]byte, 1)); err == nil {
+		t.Error("no error for a short read buffer")
+	}
+
+	s.SetAUX(false)
+	if level, err := sp.ReadAUX(); err != nil || level {
+		t.Errorf("ReadAUX: %v, %v, want low", level, err)
+	}
+	if err := sp.SetSpeed(12345); err == nil {
+		t.Error("no error for an unsupported speed")
+	}
+
+	if st := b.Status(); st.Mode != bp.MODE_SPI || st.SPIConfig != bp.SPIMode0 {
+		t.Errorf("status %+v", st)
+	}
+
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Select(true); !errors.Is(err, bp.ErrStaleHandle) {
+		t.Errorf("got %v for a stale handle", err)
+	}
+}
+
+func TestSPIResync(t *testing.T) {
+	b, _, dev := simSPI(t)
+	h, err := b.EnterMode(bp.MODE_SPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := h.(bp.BusPirateSPI)
+	if err := sp.SetSpeed(int(bp.SPI8MHz)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the handle and the configuration survive a resync
+	if err := b.Resync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bp.SPITransfer(sp, []byte{0x42}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(dev.transfers) != 1 {
+		t.Errorf("device saw % x", dev.transfers)
+	}
+	if st := b.Status(); st.SPISpeed != int(bp.SPI8MHz) {
+		t.Errorf("speed %d after resync", st.SPISpeed)
+	}
+}
+
+func TestSPITx(t *testing.T) {
+	b, _, dev := simSPI(t)
+	r := make([]byte, 3)
+	if err := b.SPI().Tx([]byte{0x9f}, r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r, []byte{0xff, 0xff, 0xff}) {
+		t.Errorf("read % x", r)
+	}
+
+	// from another mode, the transfer enters SPI mode again
+	if _, err := b.EnterMode(bp.MODE_I2C); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SPI().Write(0x06); err != nil {
+		t.Fatal(err)
+	}
+	if len(dev.transfers) != 2 || !bytes.Equal(dev.transfers[0], []byte{0x9f, 0, 0, 0}) || !bytes.Equal(dev.transfers[1], []byte{0x06}) {
+		t.Errorf("device saw % x", dev.transfers)
+	}
+	if dev.selected {
+		t.Error("device left selected")
+	}
+	if st := b.Status(); st.Mode != bp.MODE_SPI {
+		t.Errorf("mode %v after Tx", st.Mode)
+	}
+}
+
+func TestWithSPI(t *testing.T) {
+	b, _, dev := simSPI(t)
+	fail := errors.New("fail")
+	err := b.WithSPI(func(sp bp.BusPirateSPI) error {
+		if err := sp.SetPeripherals(bp.PeriphPower); err != nil {
+			return err
+		}
+		if err := bp.SPITransfer(sp, []byte{0x42}, nil); err != nil {
+			return err
+		}
+		return fail
+	})
+	if err != fail {
+		t.Errorf("got %v, want the error of fn", err)
+	}
+	if st := b.Status(); st.Mode != bp.MODE_BITBANG {
+		t.Errorf("mode %v after WithSPI", st.Mode)
+	}
+	if len(dev.transfers) != 1 || dev.selected {
+		t.Errorf("device saw % x, selected %v", dev.transfers, dev.selected)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package spiflash reads SPI NOR flash chips, like the W25Q series, over
+// an SPI bus, and discovers their parameters from the chips themselves.
+// On a bus pirate, the bus is the bp.BusPirateSPI of SPI mode, with CS
+// wired to the chip select of the chip.
+//
+// Most flash chips made since about 2011 carry a JESD216 Serial Flash
+// Discoverable Parameters (SFDP) table. SFDP reads and parses its basic
+// flash parameter table: the size of the chip, its erase sizes and
+// instructions and the fast read modes it supports. Unlike a lookup
+// table of JEDEC IDs it works with chips nobody listed.
+package spiflash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/distributed/bp"
+)
+
+// Instructions.
+const (
+	cmdRead     = 0x03
+	cmdReadSFDP = 0x5a
+	cmdJEDECID  = 0x9f
+)
+
+// sfdpSignature is "SFDP" read as a little endian 32 bit word.
+const sfdpSignature = 0x50444653
+
+// bfptID is the parameter ID of the basic flash parameter table.
+const bfptID = 0xff00
+
+// ErrNoSFDP is returned by SFDP if the chip has no SFDP table.
+var ErrNoSFDP = errors.New("no SFDP table")
+
+// JEDECID is the identification of a chip as read with instruction 0x9f.
+type JEDECID struct {
+	Manufacturer byte // 0xef for Winbond
+	Type         byte
+	Capacity     byte // log2 of the size in bytes on most chips
+}
+
+func (id JEDECID) String() string {
+	return fmt.Sprintf("%02x %02x %02x", id.Manufacturer, id.Type, id.Capacity)
+}
+
+// EraseType is an erase granularity of a chip.
+type EraseType struct {
+	Size   int  // bytes
+	Opcode byte // instruction
+}
+
+// FastRead is a fast read mode of a chip.
+type FastRead struct {
+	// Mode is the number of lines the instruction, the address and the
+	// data are sent on, like "1-1-4".
+	Mode       string
+	Opcode     byte
+	Dummy      int // wait states, in clocks
+	ModeClocks int // mode bits, in clocks
+}
+
+// Params are the parameters of a chip from its basic flash parameter
+// table.
+type Params struct {
+	Major, Minor int // revision of the table
+
+	Size     int64 // bytes
+	PageSize int   // program page size in bytes, 256 if not in the table
+
+	// Addr3 and Addr4 tell whether the chip takes 3 byte and 4 byte
+	// addresses. Chips larger than 16 MB need 4 byte addresses for
+	// their upper part.
+	Addr3, Addr4 bool
+
+	// Erase are the erase types of the chip, smallest first, without
+	// the chip erase.
+	Erase []EraseType
+
+	// FastReads are the fast read modes of the chip besides the plain
+	// 1-1-1 fast read 0x0b, which all chips have.
+	FastReads []FastRead
+}
+
+// Dev is a flash chip.
+type Dev struct {
+	s bp.SPIMaster
+}
+
+// New returns the chip on s.
+func New(s bp.SPIMaster) *Dev {
+	return &Dev{s: s}
+}
+
+// transfer sends w, then clocks in len(r) bytes into r.
+func (d *Dev) transfer(op string, w, r []byte) error {
+	buf := make([]byte, len(w)+len(r))
+	copy(buf, w)
+	if err := bp.SPITransfer(d.s, buf, buf); err != nil {
+		return fmt.Errorf("spiflash: %s: %w", op, err)
+	}
+	copy(r, buf[len(w):])
+	return nil
+}
+
+// JEDECID reads the identification of the chip.
+func (d *Dev) JEDECID() (JEDECID, error) {
+	b := make([]byte, 3)
+	if err := d.transfer("read JEDEC ID", []byte{cmdJEDECID}, b); err != nil {
+		return JEDECID{}, err
+	}
+	return JEDECID{b[0], b[1], b[2]}, nil
+}
+
+// Read reads len(p) bytes from off on with the plain read instruction and
+// 3 byte addresses.
+func (d *Dev) Read(off int, p []byte) error {
+	if off < 0 || off > 0xffffff {
+		return fmt.Errorf("spiflash: read: offset %#x beyond 3 byte addresses", off)
+	}
+	return d.transfer("read", []byte{cmdRead, byte(off >> 16), byte(off >> 8), byte(off)}, p)
+}
+
+// ReadSFDP reads len(p) bytes of the SFDP area from addr on.
+func (d *Dev) ReadSFDP(addr int, p []byte) error {
+	// 3 address bytes and 8 dummy clocks
+	w := []byte{cmdReadSFDP, byte(addr >> 16), byte(addr >> 8), byte(addr), 0}
+	return d.transfer("read SFDP", w, p)
+}
+
+// SFDP reads and parses the basic flash parameter table of the chip. It
+// returns an error matching ErrNoSFDP if the chip has none.
+func (d *Dev) SFDP() (Params, error) {
+	hdr := make([]byte, 8)
+	if err := d.ReadSFDP(0, hdr); err != nil {
+		return Params{}, err
+	}
+	if binary.LittleEndian.Uint32(hdr) != sfdpSignature {
+		return Params{}, fmt.Errorf("spiflash: %w: header % x", ErrNoSFDP, hdr)
+	}
+	nph := int(hdr[6]) + 1
+
+	// the first parameter header is the one of the basic table,
+	// later ones may be newer revisions of it
+	phs := make([]byte, 8*nph)
+	if err := d.ReadSFDP(8, phs); err != nil {
+		return Params{}, err
+	}
+	var best []byte
+	for i := 0; i < nph; i++ {
+		ph := phs[8*i : 8*i+8]
+		id := uint16(ph[7])<<8 | uint16(ph[0])
+		if id != bfptID {
+			continue
+		}
+		if best == nil || ph[2] > best[2] || ph[2] == best[2] && ph[1] > best[1] {
+			best = ph
+		}
+	}
+	if best == nil {
+		return Params{}, fmt.Errorf("spiflash: %w: no basic flash parameter table", ErrNoSFDP)
+	}
+
+	ptp := int(best[4]) | int(best[5])<<8 | int(best[6])<<16
+	t := make([]byte, 4*int(best[3]))
+	if err := d.ReadSFDP(ptp, t); err != nil {
+		return Params{}, err
+	}
+	p, err := ParseBFPT(t)
+	if err != nil {
+		return Params{}, fmt.Errorf("spiflash: %w", err)
+	}
+	p.Major, p.Minor = int(best[2]), int(best[1])
+	return p, nil
+}
+
+// ParseBFPT parses a basic flash parameter table, a sequence of little
+// endian 32 bit words.
+func ParseBFPT(t []byte) (Params, error) {
+	if len(t) < 4*9 {
+		return Params{}, fmt.Errorf("basic flash parameter table of %d bytes too short", len(t))
+	}
+	dw := make([]uint32, len(t)/4)
+	for i := range dw {
+		dw[i] = binary.LittleEndian.Uint32(t[4*i:])
+	}
+	var p Params
+
+	switch dw[0] >> 17 & 3 {
+	case 0:
+		p.Addr3 = true
+	case 1:
+		p.Addr3, p.Addr4 = true, true
+	case 2:
+		p.Addr4 = true
+	default:
+		return Params{}, fmt.Errorf("invalid address bytes in word 1 %#08x", dw[0])
+	}
+
+	// the density in bits, either the largest bit address or a power
+	// of two
+	if d := dw[1]; d&0x80000000 == 0 {
+		p.Size = (int64(d) + 1) / 8
+	} else if n := d &^ 0x80000000; n >= 3 && n < 63 {
+		p.Size = 1 << (n - 3)
+	} else {
+		return Params{}, fmt.Errorf("invalid density %#08x", d)
+	}
+
+	// erase types 1 to 4, sizes as powers of two, 0 if not present
+	for _, e := range []uint32{dw[7], dw[7] >> 16, dw[8], dw[8] >> 16} {
+		if n := e & 0xff; n != 0 {
+			p.Erase = append(p.Erase, EraseType{Size: 1 << n, Opcode: byte(e >> 8)})
+		}
+	}
+	sort.Slice(p.Erase, func(i, j int) bool { return p.Erase[i].Size < p.Erase[j].Size })
+
+	fast := func(mode string, supported bool, w uint32) {
+		if supported {
+			p.FastReads = append(p.FastReads, FastRead{
+				Mode:       mode,
+				Opcode:     byte(w >> 8),
+				Dummy:      int(w & 0x1f),
+				ModeClocks: int(w >> 5 & 7),
+			})
+		}
+	}
+	fast("1-1-2", dw[0]&(1<<16) != 0, dw[3])
+	fast("1-2-2", dw[0]&(1<<20) != 0, dw[3]>>16)
+	fast("2-2-2", dw[4]&(1<<0) != 0, dw[5]>>16)
+	fast("1-1-4", dw[0]&(1<<22) != 0, dw[2]>>16)
+	fast("1-4-4", dw[0]&(1<<21) != 0, dw[2])
+	fast("4-4-4", dw[4]&(1<<4) != 0, dw[6]>>16)
+
+	p.PageSize = 256
+	if len(dw) >= 11 {
+		// JESD216A and later
+		p.PageSize = 1 << (dw[10] >> 4 & 0xf)
+	}
+	return p, nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package spiflash
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/distributed/bp"
+	"github.com/distributed/bp/sim"
+)
+
+// w25q64fv is the basic flash parameter table of a Winbond W25Q64FV,
+// JESD216 revision 1.0 with 9 words.
+var w25q64fv = []byte{
+	0xe5, 0x20, 0xf1, 0xff, 0xff, 0xff, 0xff, 0x03,
+	0x44, 0xeb, 0x08, 0x6b, 0x08, 0x3b, 0x42, 0xbb,
+	0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00,
+	0xff, 0xff, 0x44, 0xeb, 0x0c, 0x20, 0x0f, 0x52,
+	0x10, 0xd8, 0x00, 0xff,
+}
+
+// w25q128jv is the basic flash parameter table of a Winbond W25Q128JV,
+// JESD216B with 16 words.
+var w25q128jv = []byte{
+	0xe5, 0x20, 0xf9, 0xff, 0xff, 0xff, 0xff, 0x07,
+	0x44, 0xeb, 0x08, 0x6b, 0x08, 0x3b, 0x42, 0xbb,
+	0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00,
+	0xff, 0xff, 0x40, 0xeb, 0x0c, 0x20, 0x0f, 0x52,
+	0x10, 0xd8, 0x00, 0x00, 0x36, 0x02, 0xa6, 0x00,
+	0x82, 0xea, 0x14, 0xc9, 0xe9, 0x63, 0x76, 0x33,
+	0x7a, 0x75, 0x7a, 0x75, 0xf7, 0xa2, 0xd5, 0x5c,
+	0x19, 0xf7, 0x4d, 0xff, 0xe9, 0x30, 0xf8, 0x80,
+}
+
+// winbondErase are the erase types of both Winbond chips.
+var winbondErase = []EraseType{{4096, 0x20}, {32768, 0x52}, {65536, 0xd8}}
+
+// winbondReads returns the fast reads of both Winbond chips, with qpi
+// for 4-4-4, which differs.
+func winbondReads(qpi FastRead) []FastRead {
+	return []FastRead{
+		{"1-1-2", 0x3b, 8, 0},
+		{"1-2-2", 0xbb, 2, 2},
+		{"1-1-4", 0x6b, 8, 0},
+		{"1-4-4", 0xeb, 4, 2},
+		qpi,
+	}
+}
+
+// table returns a table of words, with the fields not set by the test
+// not supported.
+func table(words ...uint32) []byte {
+	t := make([]byte, 4*len(words))
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(t[4*i:], w)
+	}
+	return t
+}
+
+func TestParseBFPT(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		t    []byte
+		want Params
+	}{
+		{"W25Q64FV", w25q64fv, Params{
+			Size:      8 << 20,
+			PageSize:  256,
+			Addr3:     true,
+			Erase:     winbondErase,
+			FastReads: winbondReads(FastRead{"4-4-4", 0xeb, 4, 2}),
+		}},
+		{"W25Q128JV", w25q128jv, Params{
+			Size:      16 << 20,
+			PageSize:  256,
+			Addr3:     true,
+			Erase:     winbondErase,
+			FastReads: winbondReads(FastRead{"4-4-4", 0xeb, 0, 2}),
+		}},
+		{"4Gbit and more", table(0x000400e5, 0x80000021, 0, 0, 0, 0, 0, 0xff00ff00, 0xff00ff00), Params{
+			Size:     1 << 30,
+			PageSize: 256,
+			Addr4:    true,
+		}},
+		{"3 or 4 byte addresses", table(0x000200e5, 0x1fffffff, 0, 0, 0, 0, 0, 0x0000dc10, 0x210c0000), Params{
+			Size:     64 << 20,
+			PageSize: 256,
+			Addr3:    true,
+			Addr4:    true,
+			// sorted by size, whatever their slots
+			Erase: []EraseType{{4096, 0x21}, {65536, 0xdc}},
+		}},
+	} {
+		got, err := ParseBFPT(c.t)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got\n%+v\nwant\n%+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseBFPTErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		t    []byte
+	}{
+		{"short", w25q64fv[:32]},
+		{"address bytes", table(0x000600e5, 0x03ffffff, 0, 0, 0, 0, 0, 0, 0)},
+		{"density exponent too small", table(0xfff120e5, 0x80000002, 0, 0, 0, 0, 0, 0, 0)},
+		{"density exponent too large", table(0xfff120e5, 0x8000003f, 0, 0, 0, 0, 0, 0, 0)},
+	} {
+		if p, err := ParseBFPT(c.t); err == nil {
+			t.Errorf("%s: parsed as %+v", c.name, p)
+		}
+	}
+}
+
+// chip is a simulated flash chip answering the JEDEC ID and SFDP read
+// instructions.
+type chip struct {
+	id   [3]byte
+	sfdp []byte
+
+	n    int // bytes clocked since the chip was selected
+	cmd  byte
+	addr int
+}
+
+func (c *chip) Select(active bool) { c.n, c.addr = 0, 0 }
+
+func (c *chip) Exchange(b byte) byte {
+	n := c.n
+	c.n++
+	if n == 0 {
+		c.cmd = b
+		return 0xff
+	}
+	switch c.cmd {
+	case cmdJEDECID:
+		if n <= 3 {
+			return c.id[n-1]
+		}
+	case cmdReadSFDP:
+		switch {
+		case n <= 3:
+			c.addr = c.addr<<8 | int(b)
+		case n > 4:
+			// after 8 dummy clocks
+			a := c.addr
+			c.addr++
+			if a < len(c.sfdp) {
+				return c.sfdp[a]
+			}
+		}
+	}
+	return 0xff
+}
+
+func TestSFDP(t *testing.T) {
+	// an SFDP header with two parameter headers, the basic table at
+	// 0x80 and one of another vendor after it
+	area := make([]byte, 0x80+len(w25q64fv))
+	copy(area, []byte{
+		'S', 'F', 'D', 'P', 0x00, 0x01, 0x01, 0xff,
+		0x00, 0x00, 0x01, 0x09, 0x80, 0x00, 0x00, 0xff,
+		0x84, 0x00, 0x01, 0x02, 0xa0, 0x00, 0x00, 0xff,
+	})
+	copy(area[0x80:], w25q64fv)
+
+	s := sim.New()
+	s.StartInBinary()
+	s.AttachSPI(&chip{id: [3]byte{0xef, 0x40, 0x17}, sfdp: area})
+	b := bp.NewBusPirate(s)
+	if err := b.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	sp, err := b.EnterSPIMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(sp)
+
+	id, err := d.JEDECID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != (JEDECID{0xef, 0x40, 0x17}) {
+		t.Errorf("JEDEC ID %v", id)
+	}
+
+	p, err := d.SFDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Major != 1 || p.Minor != 0 || p.Size != 8<<20 || len(p.Erase) != 3 {
+		t.Errorf("parameters %+v", p)
+	}
+
+	// a chip without SFDP answers all ones
+	s.AttachSPI(&chip{})
+	if _, err := d.SFDP(); !errors.Is(err, ErrNoSFDP) {
+		t.Errorf("got %v without SFDP, want ErrNoSFDP", err)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package ssd1306 drives monochrome OLED displays with an SSD1306
+// controller, the common 128x64 and 128x32 modules, over the I2C mode of
+// package bp.
+//
+// Drawing happens in a framebuffer in memory, Flush sends it to the
+// display in a single transaction. The framebuffer has the layout of the
+// display memory: a byte per column of 8 pixels, the top pixel in bit 0,
+// and a row of width bytes per page of 8 pixel rows.
+package ssd1306
+
+import (
+	"fmt"
+
+	"github.com/distributed/bp"
+)
+
+// Addresses of the display, the second selected with the D/C pin.
+const (
+	Addr    = 0x3c
+	AddrAlt = 0x3d
+)
+
+// Control bytes preceding commands and display data.
+const (
+	controlCommand = 0x00
+	controlData    = 0x40
+)
+
+// Commands of the controller used by Dev.
+const (
+	cmdSetContrast      = 0x81
+	cmdResume           = 0xa4
+	cmdNormal           = 0xa6
+	cmdInvert           = 0xa7
+	cmdDisplayOff       = 0xae
+	cmdDisplayOn        = 0xaf
+	cmdSetClock         = 0xd5
+	cmdSetMultiplex     = 0xa8
+	cmdSetOffset        = 0xd3
+	cmdSetStartLine     = 0x40
+	cmdChargePump       = 0x8d
+	cmdMemoryMode       = 0x20
+	cmdSegRemap         = 0xa1
+	cmdCOMScanDec       = 0xc8
+	cmdSetCOMPins       = 0xda
+	cmdSetPrecharge     = 0xd9
+	cmdSetVCOMDeselect  = 0xdb
+	cmdDeactivateScroll = 0x2e
+	cmdColumnAddr       = 0x21
+	cmdPageAddr         = 0x22
+)
+
+// DefaultContrast is the contrast set by Init.
+const DefaultContrast = 0xcf
+
+// Dev is an SSD1306 display.
+type Dev struct {
+	t      bp.I2CTransactor8x8
+	addr   bp.Addr7
+	width  int
+	height int
+
+	// Buf is the framebuffer, sent to the display by Flush.
+	Buf []byte
+}
+
+// New returns the display of width by height pixels at the 7 bit address
+// addr. The height has to be a multiple of 8, up to 64, the width up to
+// 128.
+func New(t bp.I2CTransactor8x8, addr uint8, width, height int) (*Dev, error) {
+	if width <= 0 || width > 128 || height <= 0 || height > 64 || height%8 != 0 {
+		return nil, fmt.Errorf("ssd1306 %v: unsupported size %dx%d", bp.Addr7(addr), width, height)
+	}
+	return &Dev{
+		t:      t,
+		addr:   bp.Addr7(addr),
+		width:  width,
+		height: height,
+		Buf:    make([]byte, width*height/8),
+	}, nil
+}
+
+// Bounds returns the size of the display in pixels.
+func (d *Dev) Bounds() (width, height int) {
+	return d.width, d.height
+}
+
+// Init initializes the controller for a module powered by its internal
+// charge pump and turns the display on. It doesn't clear the display
+// memory, Flush a cleared framebuffer for that.
+func (d *Dev) Init() error {
+	compins := byte(0x12)
+	if d.height <= 32 {
+		compins = 0x02
+	}
+	return d.Command(
+		cmdDisplayOff,
+		cmdSetClock, 0x80,
+		cmdSetMultiplex, byte(d.height-1),
+		cmdSetOffset, 0x00,
+		cmdSetStartLine|0,
+		cmdChargePump, 0x14,
+		cmdMemoryMode, 0x00, // horizontal addressing
+		cmdSegRemap,
+		cmdCOMScanDec,
+		cmdSetCOMPins, compins,
+		cmdSetContrast, DefaultContrast,
+		cmdSetPrecharge, 0xf1,
+		cmdSetVCOMDeselect, 0x40,
+		cmdResume,
+		cmdNormal,
+		cmdDeactivateScroll,
+		cmdDisplayOn,
+	)
+}
+
+// Command sends the command bytes cmds to the controller.
+func (d *Dev) Command(cmds ...byte) error {
+	if _, _, err := d.t.Transact8x8(d.addr, controlCommand, cmds, nil); err != nil {
+		return d.err("command", err)
+	}
+	return nil
+}
+
+// SetContrast sets the contrast, the brightness of lit pixels.
+func (d *Dev) SetContrast(c byte) error {
+	return d.Command(cmdSetContrast, c)
+}
+
+// SetDisplay turns the display on or off. The display memory is kept
+// while it is off.
+func (d *Dev) SetDisplay(on bool) error {
+	if on {
+		return d.Command(cmdDisplayOn)
+	}
+	return d.Command(cmdDisplayOff)
+}
+
+// SetInvert shows lit pixels dark and dark pixels lit if on is true.
+func (d *Dev) SetInvert(on bool) error {
+	if on {
+		return d.Command(cmdInvert)
+	}
+	return d.Command(cmdNormal)
+}
+
+// Clear clears the framebuffer.
+func (d *Dev) Clear() {
+	for i := range d.Buf {
+		d.Buf[i] = 0
+	}
+}
+
+// SetPixel lights the pixel at x, y in the framebuffer, counted from the
+// top left, or darkens it. Pixels outside of the display are ignored.
+func (d *Dev) SetPixel(x, y int, on bool) {
+	if x < 0 || x >= d.width || y < 0 || y >= d.height {
+		return
+	}
+	i := x + y/8*d.width
+	if on {
+		d.Buf[i] |= 1 << uint(y%8)
+	} else {
+		d.Buf[i] &^= 1 << uint(y%8)
+	}
+}
+
+// Pixel reports whether the pixel at x, y in the framebuffer is lit.
+func (d *Dev) Pixel(x, y int) bool {
+	if x < 0 || x >= d.width || y < 0 || y >= d.height {
+		return false
+	}
+	return d.Buf[x+y/8*d.width]&(1<<uint(y%8)) != 0
+}
+
+// Flush sends the framebuffer to the display.
+func (d *Dev) Flush() error {
+	err := d.Command(
+		cmdColumnAddr, 0, byte(d.width-1),
+		cmdPageAddr, 0, byte(d.height/8-1),
+	)
+	if err != nil {
+		return err
+	}
+	if _, _, err := d.t.Transact8x8(d.addr, controlData, d.Buf, nil); err != nil {
+		return d.err("flush", err)
+	}
+	return nil
+}
+
+func (d *Dev) err(op string, err error) error {
+	return fmt.Errorf("ssd1306 %v: %s: %w", d.addr, op, err)
+}
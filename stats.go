@@ -0,0 +1,34 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+// Stats are cumulative counters of a BusPirate, for monitoring the health
+// of the link. They are never reset.
+type Stats struct {
+	BytesWritten uint64 // bytes sent to the bus pirate
+	BytesRead    uint64 // bytes received from the bus pirate, including sniffer output
+
+	// Commands counts operations carried out on the device, like I2C
+	// start conditions, byte reads and writes and mode changes. Retried
+	// operations count once per try.
+	Commands uint64
+
+	// Transactions counts I2C transactions, ended by a stop condition or
+	// done by Transact8x8.
+	Transactions uint64
+
+	NACKs      uint64 // bytes not acknowledged, including addresses
+	Retries    uint64 // tries repeated according to the retry policy
+	Resyncs    uint64 // resyncs, automatic or through Resync
+	Reconnects uint64 // reconnects, automatic or through Reconnect
+	Errors     uint64 // operations that failed, see EventError
+}
+
+// Stats returns the counters of bp.
+func (bp *BusPirate) Stats() Stats {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.currentStats()
+}
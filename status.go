@@ -0,0 +1,172 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Status is a snapshot of the state of a BusPirate, for debug output and
+// bug reports.
+type Status struct {
+	Mode        Mode
+	ModeVersion int
+
+	// Version is nil if the versions were not queried yet, see Version.
+	Version *VersionInfo
+
+	// configuration of I2C mode, zero if not set
+	I2CSpeed      int // Hz
+	Peripherals   Peripherals
+	PullupVoltage PullupVoltage
+
+	// configuration of SPI mode, Peripherals is that of SPI mode while
+	// in it
+	SPISpeed  int // Hz, zero if not set
+	SPIConfig SPIConfig
+
+	// health of the connection
+	Idle       time.Duration // since data was last sent or received
+	Wedged     error         // see SetWatchdog
+	AutoResync bool
+	Reconnect  bool // a Dialer is set
+	BaudRate   int  // of the serial link, see SetBaudRate
+
+	// banner parsing, see SetLenientBanners. Banners holds the banners
+	// last received, as received, by their prefix like "BBIO".
+	LenientBanners bool
+	Banners        map[string]string
+
+	// WriteCoalescing is set by SetWriteCoalescing, PendingWrites is the
+	// number of bytes queued.
+	WriteCoalescing bool
+	PendingWrites   int
+
+	// Unchecked is set by SetUnchecked, Deferred is the number of
+	// commands queued.
+	Unchecked bool
+	Deferred  int
+
+	DryRun bool
+	Stats  Stats
+}
+
+// Status returns the current status of bp. It does not talk to the
+// device.
+func (bp *BusPirate) Status() Status {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	st := Status{
+		Mode:            bp.mode,
+		ModeVersion:     bp.modeversion,
+		I2CSpeed:        bp.i2cconf.speed,
+		Peripherals:     bp.i2cconf.periph,
+		PullupVoltage:   bp.i2cconf.pullup,
+		SPISpeed:        bp.spiconf.speed,
+		SPIConfig:       bp.spiconf.config,
+		Idle:            bp.link.idle(),
+		Wedged:          bp.wedged,
+		AutoResync:      bp.autoresync,
+		LenientBanners:  bp.lenient,
+		WriteCoalescing: bp.coalesce,
+		PendingWrites:   len(bp.wpending),
+		Unchecked:       bp.unchecked,
+		Deferred:        len(bp.deferred),
+		Reconnect:       bp.dial != nil,
+		BaudRate:        DefaultBaudRate,
+		DryRun:          bp.dryrun,
+		Stats:           bp.currentStats(),
+	}
+	if bp.mode == MODE_SPI {
+		st.Peripherals = bp.spiconf.periph
+	}
+	if bp.baud != 0 {
+		st.BaudRate = bp.baud
+	}
+	if bp.version != nil {
+		v := *bp.version
+		st.Version = &v
+	}
+	if bp.banners != nil {
+		st.Banners = make(map[string]string, len(bp.banners))
+		for prefix, banner := range bp.banners {
+			st.Banners[prefix] = banner
+		}
+	}
+	return st
+}
+
+// String formats s as lines of the form "name: value".
+func (s Status) String() string {
+	var sb strings.Builder
+	line := func(name, format string, v ...interface{}) {
+		fmt.Fprintf(&sb, "%s: "+format+"\n", append([]interface{}{name}, v...)...)
+	}
+
+	line("mode", "%v %d", s.Mode, s.ModeVersion)
+	if s.Version != nil {
+		line("hardware", "%s", s.Version.Hardware)
+		line("firmware", "%s", s.Version.Firmware)
+		line("bootloader", "%s", s.Version.Bootloader)
+	} else {
+		line("versions", "not queried")
+	}
+	if s.Mode == MODE_I2C || s.Mode == MODE_I2C_SNIFF {
+		if s.I2CSpeed != 0 {
+			line("i2c speed", "%d Hz", s.I2CSpeed)
+		} else {
+			line("i2c speed", "firmware default")
+		}
+		line("peripherals", "%v", s.Peripherals)
+		if s.PullupVoltage != 0 {
+			line("pull-up voltage", "%v", s.PullupVoltage)
+		}
+	}
+	if s.Mode == MODE_SPI {
+		if s.SPISpeed != 0 {
+			line("spi speed", "%d Hz", s.SPISpeed)
+		} else {
+			line("spi speed", "firmware default")
+		}
+		line("spi config", "%#02x", byte(s.SPIConfig))
+		line("peripherals", "%v", s.Peripherals)
+	}
+	line("idle", "%v", s.Idle.Round(time.Millisecond))
+	if s.Wedged != nil {
+		line("wedged", "%v", s.Wedged)
+	}
+	if len(s.Banners) > 0 {
+		var banners []string
+		for _, banner := range s.Banners {
+			banners = append(banners, fmt.Sprintf("%q", banner))
+		}
+		sort.Strings(banners)
+		line("banners", "%s", strings.Join(banners, " "))
+	}
+	if s.LenientBanners {
+		line("lenient banners", "%v", s.LenientBanners)
+	}
+	if s.WriteCoalescing {
+		line("write coalescing", "%v, %d bytes queued", s.WriteCoalescing, s.PendingWrites)
+	}
+	if s.Unchecked {
+		line("unchecked", "%v, %d commands queued", s.Unchecked, s.Deferred)
+	}
+	line("auto resync", "%v", s.AutoResync)
+	line("reconnect", "%v", s.Reconnect)
+	line("baud rate", "%d", s.BaudRate)
+	if s.DryRun {
+		line("dry run", "%v", s.DryRun)
+	}
+	st := s.Stats
+	line("traffic", "%d bytes written, %d bytes read", st.BytesWritten, st.BytesRead)
+	line("operations", "%d commands, %d transactions, %d NACKs", st.Commands, st.Transactions, st.NACKs)
+	line("trouble", "%d errors, %d retries, %d resyncs, %d reconnects", st.Errors, st.Retries, st.Resyncs, st.Reconnects)
+	return sb.String()
+}
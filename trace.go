@@ -0,0 +1,76 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// traceConn copies all bytes going over a Conn to a writer.
+type traceConn struct {
+	Conn
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (tc *traceConn) Read(b []byte) (int, error) {
+	n, err := tc.Conn.Read(b)
+	if n > 0 {
+		tc.dump("<", b[:n])
+	}
+	return n, err
+}
+
+func (tc *traceConn) Write(b []byte) (int, error) {
+	n, err := tc.Conn.Write(b)
+	if n > 0 {
+		tc.dump(">", b[:n])
+	}
+	return n, err
+}
+
+// dump writes b as lines of at most 16 hex bytes, prefixed with the time
+// and dir.
+func (tc *traceConn) dump(dir string, b []byte) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	ts := time.Now().Format("15:04:05.000000")
+	for len(b) > 0 {
+		n := len(b)
+		if n > 16 {
+			n = 16
+		}
+		fmt.Fprintf(tc.w, "%s %s % x\n", ts, dir, b[:n])
+		b = b[n:]
+	}
+}
+
+// SetTrace makes bp write every byte sent to and received from the bus
+// pirate to w, as lines of the form
+//
+//	15:04:05.000000 > 02
+//	15:04:05.001234 < 49 32 43 31
+//
+// where > marks bytes sent and < bytes received. Passing nil turns
+// tracing off.
+func (bp *BusPirate) SetTrace(w io.Writer) {
+	// the connection is swapped between two jobs of the I/O goroutine
+	bp.do(func() error {
+		bp.mu.Lock()
+		defer bp.mu.Unlock()
+
+		if tc, ok := bp.c.(*traceConn); ok {
+			bp.c = tc.Conn
+		}
+		if w != nil {
+			bp.c = &traceConn{Conn: bp.c, w: w}
+		}
+		return nil
+	})
+}
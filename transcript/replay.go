@@ -0,0 +1,167 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package transcript
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned by Replay for reads recorded as timed out. Its
+// Timeout method returns true.
+var ErrTimeout error = timeout{}
+
+type timeout struct{}
+
+func (timeout) Error() string   { return "transcript: read timeout" }
+func (timeout) Timeout() bool   { return true }
+func (timeout) Temporary() bool { return true }
+
+// MismatchError is returned by Replay when the bytes written differ from
+// the transcript.
+type MismatchError struct {
+	Line int // line of the transcript, 0 if the transcript was exhausted
+	Want []byte
+	Got  []byte
+}
+
+func (e *MismatchError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("transcript: unexpected write % x after end of transcript", e.Got)
+	}
+	return fmt.Sprintf("transcript:%d: wrote % x, want % x", e.Line, e.Got, e.Want)
+}
+
+// Replay is a bp.Conn playing the role of the bus pirate from a
+// transcript. Reads are served from the recorded responses and writes are
+// checked against the recorded commands.
+//
+// A read at a point where the transcript expects a write times out, just
+// like a real bus pirate waiting for a command would, after a short
+// delay.
+type Replay struct {
+	mu      sync.Mutex
+	entries []entry
+	pos     int // current entry
+	off     int // offset into the data of the current entry
+	err     error
+}
+
+// NewReplay parses the transcript read from r.
+func NewReplay(r io.Reader) (*Replay, error) {
+	entries, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Replay{entries: entries}, nil
+}
+
+func (r *Replay) advance(n int) {
+	r.off += n
+	if r.off >= len(r.entries[r.pos].data) {
+		r.pos++
+		r.off = 0
+	}
+}
+
+func (r *Replay) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	for i := 0; i < len(b); {
+		if r.pos >= len(r.entries) {
+			r.err = &MismatchError{Got: b[i:]}
+			return i, r.err
+		}
+
+		e := r.entries[r.pos]
+		if !e.write {
+			r.err = &MismatchError{Line: e.line, Got: b[i:]}
+			return i, r.err
+		}
+
+		n := len(e.data) - r.off
+		if n > len(b)-i {
+			n = len(b) - i
+		}
+		want := e.data[r.off : r.off+n]
+		if string(want) != string(b[i:i+n]) {
+			r.err = &MismatchError{Line: e.line, Want: want, Got: b[i : i+n]}
+			return i, r.err
+		}
+		r.advance(n)
+		i += n
+	}
+
+	return len(b), nil
+}
+
+func (r *Replay) Read(b []byte) (int, error) {
+	r.mu.Lock()
+
+	if r.err != nil {
+		r.mu.Unlock()
+		return 0, r.err
+	}
+
+	if r.pos >= len(r.entries) {
+		r.mu.Unlock()
+		return 0, io.EOF
+	}
+
+	e := r.entries[r.pos]
+	if e.write {
+		r.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return 0, ErrTimeout
+	}
+
+	if e.timeout {
+		r.pos++
+		r.off = 0
+		r.mu.Unlock()
+		return 0, ErrTimeout
+	}
+
+	n := copy(b, e.data[r.off:])
+	r.advance(n)
+	r.mu.Unlock()
+	return n, nil
+}
+
+// SetReadParams is a no-op, timeouts happen where the transcript says so.
+func (r *Replay) SetReadParams(minread int, timeout float64) error {
+	return nil
+}
+
+func (r *Replay) Close() error {
+	return nil
+}
+
+// Done returns nil if the whole transcript was played back without a
+// mismatch. Otherwise it returns the mismatch or an error describing the
+// first part of the transcript that was not played back.
+func (r *Replay) Done() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	if r.pos < len(r.entries) {
+		e := r.entries[r.pos]
+		if e.write {
+			return fmt.Errorf("transcript:%d: expected write of % x was not performed", e.line, e.data[r.off:])
+		}
+		return fmt.Errorf("transcript:%d: recorded response was not read", e.line)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package transcript
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func newReplay(t *testing.T, tr string) *Replay {
+	t.Helper()
+	r, err := NewReplay(strings.NewReader(tr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func write(t *testing.T, r *Replay, b ...byte) {
+	t.Helper()
+	if n, err := r.Write(b); n != len(b) || err != nil {
+		t.Fatalf("write % x: %d, %v", b, n, err)
+	}
+}
+
+func read(t *testing.T, r *Replay, n int, want ...byte) {
+	t.Helper()
+	buf := make([]byte, n)
+	got, err := r.Read(buf)
+	if err != nil || !bytes.Equal(buf[:got], want) {
+		t.Fatalf("read %d: % x, %v, want % x", n, buf[:got], err, want)
+	}
+}
+
+func TestReplayChunking(t *testing.T) {
+	r := newReplay(t, `
+		# chunking of the lines is not significant
+		> 01 02
+		> 03
+		< 04 05 06
+		< timeout
+		> 07
+	`)
+	write(t, r, 0x01)
+	write(t, r, 0x02, 0x03)
+	read(t, r, 2, 0x04, 0x05)
+	read(t, r, 8, 0x06)
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != ErrTimeout {
+		t.Fatalf("got %d, %v, want a timeout", n, err)
+	}
+	// a read where a write is due times out too
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != ErrTimeout {
+		t.Fatalf("got %d, %v, want a timeout", n, err)
+	}
+	if err := r.Done(); err == nil {
+		t.Fatal("Done with a write left")
+	}
+	write(t, r, 0x07)
+	if err := r.Done(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("got %d, %v, want EOF after the transcript", n, err)
+	}
+}
+
+func TestReplayWriteBoundary(t *testing.T) {
+	r := newReplay(t, `
+		> 01 02
+		< 03
+		> 04
+	`)
+	// the write runs into the answer, which has not been read
+	n, err := r.Write([]byte{0x01, 0x02, 0x04})
+	var merr *MismatchError
+	if !errors.As(err, &merr) {
+		t.Fatalf("got %v, want a mismatch", err)
+	}
+	if n != 2 || merr.Line != 3 || !bytes.Equal(merr.Got, []byte{0x04}) {
+		t.Errorf("got %d, %+v, want 2 bytes written and a mismatch on line 3", n, merr)
+	}
+
+	// the mismatch sticks
+	if _, err := r.Read(make([]byte, 1)); err != merr {
+		t.Errorf("read after the mismatch: %v", err)
+	}
+	if err := r.Done(); err != merr {
+		t.Errorf("Done: %v", err)
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	for _, c := range []struct {
+		writes [][]byte
+		n      int // bytes accepted by the last write
+		want   MismatchError
+	}{
+		// in the middle of merged lines
+		{[][]byte{{0x01}, {0x02, 0x0f}}, 0, MismatchError{Line: 1, Want: []byte{0x02, 0x03}, Got: []byte{0x02, 0x0f}}},
+		// beyond the end of the transcript
+		{[][]byte{{0x01, 0x02, 0x03}, {}, {0x05}}, 0, MismatchError{Line: 0, Got: []byte{0x05}}},
+	} {
+		r := newReplay(t, "> 01 02\n> 03\n")
+		var (
+			n   int
+			err error
+		)
+		for _, w := range c.writes {
+			if n, err = r.Write(w); err != nil {
+				break
+			}
+		}
+		var merr *MismatchError
+		if !errors.As(err, &merr) {
+			t.Fatalf("writes % x: got %v, want a mismatch", c.writes, err)
+		}
+		if n != c.n || merr.Line != c.want.Line || !bytes.Equal(merr.Want, c.want.Want) || !bytes.Equal(merr.Got, c.want.Got) {
+			t.Errorf("writes % x: got %d, %+v, want %d, %+v", c.writes, n, merr, c.n, c.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tr := range []string{
+		"01 02\n",
+		"> timeout\n",
+		"< 0g\n",
+		"> 1\n",
+	} {
+		if _, err := NewReplay(strings.NewReader(tr)); err == nil {
+			t.Errorf("%q parsed", tr)
+		}
+	}
+}
+
+func TestRecorderCanonical(t *testing.T) {
+	const tr = `
+		> 00
+		< 42 42
+		< 49 4f 31
+		< timeout
+		> 02 03
+	`
+	var out bytes.Buffer
+	rec := NewRecorder(newReplay(t, tr), &out)
+	rec.Write([]byte{0x00})
+	buf := make([]byte, 5)
+	n, _ := io.ReadFull(rec, buf)
+	if n != 5 {
+		t.Fatalf("read %d bytes", n)
+	}
+	if _, err := rec.Read(buf); err != ErrTimeout {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	rec.Write([]byte{0x02})
+	rec.Write([]byte{0x03})
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := Canonical(strings.NewReader(tr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Canonical(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("recorded\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package transcript records the bytes exchanged with a bus pirate and
+// replays them later, so code built on package bp can be tested without
+// hardware.
+//
+// A transcript is a text file with one line per I/O operation:
+//
+//	> 00 0f
+//	< 01
+//	< timeout
+//
+// Lines starting with > hold bytes written to the bus pirate, lines
+// starting with < bytes read from it. A read that timed out is recorded
+// as "< timeout". Empty lines and lines starting with # are ignored.
+package transcript
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/distributed/bp"
+)
+
+type timeoutError interface {
+	error
+	Timeout() bool
+}
+
+func isTimeout(err error) bool {
+	if terr, ok := err.(timeoutError); ok {
+		return terr.Timeout()
+	}
+	return false
+}
+
+// Recorder is a bp.Conn writing a transcript of all traffic on the
+// wrapped Conn.
+type Recorder struct {
+	c  bp.Conn
+	mu sync.Mutex
+	w  *bufio.Writer
+	// first write error on w
+	err error
+}
+
+// NewRecorder returns a Recorder passing all I/O on to c and recording it
+// to w. Call Flush or Close to make sure all data reaches w.
+func NewRecorder(c bp.Conn, w io.Writer) *Recorder {
+	return &Recorder{c: c, w: bufio.NewWriter(w)}
+}
+
+func (r *Recorder) record(dir string, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	_, r.err = fmt.Fprintf(r.w, "%s % x\n", dir, b)
+}
+
+func (r *Recorder) Read(b []byte) (int, error) {
+	n, err := r.c.Read(b)
+	if n > 0 {
+		r.record("<", b[:n])
+	}
+	if n == 0 && isTimeout(err) {
+		r.mu.Lock()
+		if r.err == nil {
+			_, r.err = fmt.Fprintf(r.w, "< timeout\n")
+		}
+		r.mu.Unlock()
+	}
+	return n, err
+}
+
+func (r *Recorder) Write(b []byte) (int, error) {
+	n, err := r.c.Write(b)
+	if n > 0 {
+		r.record(">", b[:n])
+	}
+	return n, err
+}
+
+func (r *Recorder) SetReadParams(minread int, timeout float64) error {
+	return r.c.SetReadParams(minread, timeout)
+}
+
+// Flush writes buffered transcript data to the underlying writer. It
+// returns the first error encountered while writing the transcript.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.err = r.w.Flush()
+	return r.err
+}
+
+// Close flushes the transcript and closes the wrapped Conn.
+func (r *Recorder) Close() error {
+	ferr := r.Flush()
+	if err := r.c.Close(); err != nil {
+		return err
+	}
+	return ferr
+}
+
+type entry struct {
+	write   bool
+	timeout bool
+	data    []byte
+	line    int
+}
+
+// parse reads a transcript. Consecutive lines with data in the same
+// direction are merged, as the chunking of the data is not significant.
+func parse(r io.Reader) ([]entry, error) {
+	var entries []entry
+
+	sc := bufio.NewScanner(r)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var e entry
+		e.line = lineno
+		switch line[0] {
+		case '>':
+			e.write = true
+		case '<':
+		default:
+			return nil, fmt.Errorf("transcript:%d: line must start with > or <", lineno)
+		}
+
+		rest := strings.TrimSpace(line[1:])
+		if rest == "timeout" {
+			if e.write {
+				return nil, fmt.Errorf("transcript:%d: only reads can time out", lineno)
+			}
+			e.timeout = true
+			entries = append(entries, e)
+			continue
+		}
+
+		data, err := hex.DecodeString(strings.Join(strings.Fields(rest), ""))
+		if err != nil {
+			return nil, fmt.Errorf("transcript:%d: %v", lineno, err)
+		}
+		e.data = data
+
+		if n := len(entries); n > 0 && entries[n-1].write == e.write && !entries[n-1].timeout {
+			entries[n-1].data = append(entries[n-1].data, e.data...)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, sc.Err()
+}
+
+// Canonical returns the transcript read from r in canonical form, one
+// line per run of bytes in the same direction and one line per timeout.
+// Transcripts describing the same exchange have the same canonical form.
+func Canonical(r io.Reader) ([]string, error) {
+	entries, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		switch {
+		case e.timeout:
+			lines = append(lines, "< timeout")
+		case e.write:
+			lines = append(lines, fmt.Sprintf("> % x", e.data))
+		default:
+			lines = append(lines, fmt.Sprintf("< % x", e.data))
+		}
+	}
+	return lines, nil
+}
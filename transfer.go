@@ -0,0 +1,214 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/distributed/bp/wire"
+)
+
+// ChunkTime is the time a chunk of a large transfer should take. A write
+// then read command is answered only when it is complete, so a chunk
+// taking much longer would run into the read timeouts of the link, while
+// small chunks waste a USB round trip each. Chunks are sized from the
+// throughput observed so far to take about ChunkTime.
+const ChunkTime = 100 * time.Millisecond
+
+// minChunk is the size of the first chunk, before the throughput is
+// known, and the smallest chunk.
+const minChunk = 16
+
+// readahead is the number of chunks of a read handed to the bus pirate in
+// one go. The command of the next chunk is sent while the answer of the
+// previous one is still coming in, as far as the pipeline window allows,
+// and the rest of it as soon as that answer is complete, so the device
+// doesn't sit idle for a USB round trip between the chunks. A retry
+// starts over with all of them.
+const readahead = 2
+
+// chunkSize returns the size of the next chunk of a transfer with rest
+// bytes left. The caller has to hold the lock.
+func (bp *BusPirate) chunkSize(rest int) int {
+	max := wire.MaxWriteThenRead
+	if bp.version != nil {
+		max = CapabilitiesFor(*bp.version).MaxWriteThenRead
+	}
+
+	n := minChunk
+	if bp.xferrate > 0 {
+		n = int(bp.xferrate * ChunkTime.Seconds())
+	}
+	if n < minChunk {
+		n = minChunk
+	}
+	if n > max {
+		n = max
+	}
+	if n > rest {
+		n = rest
+	}
+	return n
+}
+
+// observeChunk updates the throughput estimate with a chunk of n bytes
+// that took d. The caller has to hold the lock.
+func (bp *BusPirate) observeChunk(n int, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	rate := float64(n) / d.Seconds()
+	if bp.xferrate == 0 {
+		bp.xferrate = rate
+		return
+	}
+	bp.xferrate = (bp.xferrate + rate) / 2
+}
+
+// ReadMem reads len(r) bytes starting at off from the memory of the
+// device at the 7 bit address addr, like an EEPROM. The memory address is
+// sent with alen bytes, 1 or 2, most significant byte first. The read is
+// split into chunks, each a write of the memory address followed by a
+// read, see ChunkTime on their size. Two chunks are in flight at a time,
+// other calls may be carried out between the pairs. progress, if not
+// nil, is called after every pair, returning an error cancels the read.
+// ReadMem returns the number of bytes read, which is less than len(r)
+// only with an error.
+func (nsi NonStrictI2C) ReadMem(addr Addr, off uint, alen int, r []byte, progress ProgressFunc) (n int, err error) {
+	if err := checkMemRange("i2c.ReadMem", addr, off, alen, len(r)); err != nil {
+		return 0, err
+	}
+
+	pm := newProgressMeter(progress, int64(len(r)))
+	for n < len(r) {
+		var got int
+		err = nsi.bp.retry("i2c.ReadMem", func() error {
+			got, err = nsi.readMemChunks("i2c.ReadMem", addr, off+uint(n), alen, r[n:])
+			return err
+		})
+		n += got
+		if err != nil {
+			return n, err
+		}
+		if err := pm.report(int64(n)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// DumpRange is like ReadMem, but streams the length bytes from off on to
+// dst chunk by chunk as they come in, instead of reading them into
+// memory, so images of any size can go to a file, a hash or the network.
+// It returns the number of bytes written to dst. An error of dst ends the
+// dump and is returned as is, like one of progress.
+func (nsi NonStrictI2C) DumpRange(dst io.Writer, addr Addr, off uint, alen int, length int, progress ProgressFunc) (n int64, err error) {
+	if err := checkMemRange("i2c.DumpRange", addr, off, alen, length); err != nil {
+		return 0, err
+	}
+
+	pm := newProgressMeter(progress, int64(length))
+
+	// room for the chunks read in one go
+	buf := make([]byte, readahead*wire.MaxWriteThenRead)
+	for n < int64(length) {
+		r := buf
+		if rest := int64(length) - n; rest < int64(len(r)) {
+			r = r[:rest]
+		}
+
+		var got int
+		err = nsi.bp.retry("i2c.DumpRange", func() error {
+			got, err = nsi.readMemChunks("i2c.DumpRange", addr, off+uint(n), alen, r)
+			return err
+		})
+		if got > 0 {
+			wn, werr := dst.Write(r[:got])
+			n += int64(wn)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := pm.report(n); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// checkMemRange returns an error if n bytes from off on can't be
+// addressed with alen bytes.
+func checkMemRange(op string, addr Addr, off uint, alen int, n int) error {
+	if alen < 1 || alen > 2 {
+		return &OpError{op, MODE_I2C, addr, fmt.Errorf("invalid memory address length %d", alen)}
+	}
+	if end := off + uint(n); end > 1<<(8*alen) {
+		return &OpError{op, MODE_I2C, addr, fmt.Errorf("read up to %#x beyond %d byte addresses", end, alen)}
+	}
+	return nil
+}
+
+// readMemChunks reads the next readahead chunks of r from off on for op and
+// returns their total size.
+func (nsi NonStrictI2C) readMemChunks(op string, addr Addr, off uint, alen int, r []byte) (_ int, err error) {
+	bp := nsi.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+
+	if err := nsi.check(op); err != nil {
+		return 0, err
+	}
+	if err := bp.settle(); err != nil {
+		return 0, err
+	}
+	if err := bp.supports(op, func(c Capabilities) bool { return c.WriteThenRead }); err != nil {
+		return 0, err
+	}
+	if addr.GetAddrLen() != 7 {
+		return 0, &OpError{op, MODE_I2C, addr, errors.New("nonstrict I2C only supports 7 bit addressing")}
+	}
+
+	wa := uint8(addr.GetBaseAddr()) << 1
+	var (
+		cmds []exch
+		n    int
+	)
+	for k := 0; k < readahead && n < len(r); k++ {
+		size := bp.chunkSize(len(r) - n)
+		bp.logf(SubsysI2C, LogDebug, "nonstrict %s addr %v off %#x chunk of %d bytes", op, addr, off+uint(n), size)
+
+		w := []byte{wa}
+		for i := alen - 1; i >= 0; i-- {
+			w = append(w, byte((off+uint(n))>>(8*i)))
+		}
+		cmds = append(cmds,
+			bp.writeThenReadExch(op, w, nil),
+			bp.writeThenReadExch(op, []byte{wa | 1}, r[n:n+size]))
+		n += size
+
+		bp.stats.Commands++
+		bp.stats.Transactions++
+	}
+
+	nsi.pace(true)
+	defer func() { bp.lasttx = time.Now() }()
+
+	start := time.Now()
+	err = bp.pipe(cmds)
+	if err != nil {
+		if oe, ok := err.(*OpError); ok {
+			oe.Addr = addr
+		}
+		return 0, err
+	}
+	bp.observeChunk(n, time.Since(start))
+	return n, nil
+}
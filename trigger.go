@@ -0,0 +1,158 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"bytes"
+)
+
+// A Trigger decides whether a sniffed transaction starts a capture.
+type Trigger func(tr *I2CTransaction) bool
+
+// TriggerAddr triggers on any transaction with the 7 bit address addr.
+func TriggerAddr(addr uint8) Trigger {
+	return func(tr *I2CTransaction) bool {
+		return tr.Addr == addr
+	}
+}
+
+// TriggerData triggers on transactions whose data contains pattern.
+func TriggerData(pattern []byte) Trigger {
+	return func(tr *I2CTransaction) bool {
+		return bytes.Contains(tr.Data, pattern)
+	}
+}
+
+type captured struct {
+	tr     *I2CTransaction
+	events []SniffEvent
+}
+
+// Capture records sniffed transactions into a ring buffer of bounded
+// size. Until the trigger fires, the ring holds the most recent
+// transactions as pre-trigger history. After the trigger fired, the
+// capture completes after the given number of transactions (including
+// the triggering one) or never, if that number is 0. If the ring is
+// full, the oldest transactions are dropped.
+type Capture struct {
+	trig  Trigger
+	post  int
+	ring  []captured
+	start int
+	n     int
+
+	asm     TransactionAssembler
+	pending []SniffEvent
+
+	triggered bool
+	seen      int
+}
+
+// NewCapture returns a capture holding at most size transactions. A nil
+// trigger fires on the first transaction.
+func NewCapture(size int, trig Trigger, post int) *Capture {
+	if size < 1 {
+		size = 1
+	}
+	return &Capture{
+		trig: trig,
+		post: post,
+		ring: make([]captured, size),
+	}
+}
+
+// Add feeds a sniffer event into the capture. It returns true once the
+// capture is complete, further events are ignored.
+func (c *Capture) Add(ev SniffEvent) bool {
+	if c.Done() {
+		return true
+	}
+
+	tr := c.asm.Add(ev)
+	if tr == nil {
+		switch ev.Type {
+		case SniffStart:
+			c.pending = []SniffEvent{ev}
+		case SniffStop:
+			c.pending = nil
+		default:
+			if c.pending != nil {
+				c.pending = append(c.pending, ev)
+			}
+		}
+		return false
+	}
+
+	var evs []SniffEvent
+	if ev.Type == SniffStart {
+		// repeated start, the event belongs to the next transaction
+		evs = c.pending
+		c.pending = []SniffEvent{ev}
+	} else {
+		evs = append(c.pending, ev)
+		c.pending = nil
+	}
+
+	if !c.triggered && (c.trig == nil || c.trig(tr)) {
+		c.triggered = true
+	}
+
+	c.push(captured{tr, evs})
+	if c.triggered {
+		c.seen++
+	}
+
+	return c.Done()
+}
+
+func (c *Capture) push(e captured) {
+	if c.n < len(c.ring) {
+		c.ring[(c.start+c.n)%len(c.ring)] = e
+		c.n++
+		return
+	}
+	c.ring[c.start] = e
+	c.start = (c.start + 1) % len(c.ring)
+}
+
+// Triggered reports whether the trigger has fired.
+func (c *Capture) Triggered() bool {
+	return c.triggered
+}
+
+// Done reports whether the capture is complete.
+func (c *Capture) Done() bool {
+	return c.triggered && c.post > 0 && c.seen >= c.post
+}
+
+// Transactions returns the captured transactions, oldest first.
+func (c *Capture) Transactions() []*I2CTransaction {
+	trs := make([]*I2CTransaction, 0, c.n)
+	for i := 0; i < c.n; i++ {
+		trs = append(trs, c.ring[(c.start+i)%len(c.ring)].tr)
+	}
+	return trs
+}
+
+// Events returns the events making up the captured transactions, oldest
+// first, for use with the exporters in package capture.
+func (c *Capture) Events() []SniffEvent {
+	var evs []SniffEvent
+	for i := 0; i < c.n; i++ {
+		evs = append(evs, c.ring[(c.start+i)%len(c.ring)].events...)
+	}
+	return evs
+}
+
+// Run feeds the events of a running sniffer into c until the capture is
+// complete or the sniffer terminates. The sniffer is not stopped.
+func (c *Capture) Run(s *I2CSniffer) error {
+	for ev := range s.Events() {
+		if c.Add(ev) {
+			return nil
+		}
+	}
+	return s.Err()
+}
@@ -0,0 +1,121 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+)
+
+// I2CTx does whole I2C transactions in one call each, for programs that
+// don't want to juggle mode handles and primitives. It enters I2C mode
+// whenever the bus pirate is not in it, so it keeps working across
+// changes of mode by other code. SPITx is the same for SPI.
+type I2CTx struct {
+	bp *BusPirate
+}
+
+// I2C returns the one call transactions of bp. bp must be open.
+func (bp *BusPirate) I2C() I2CTx {
+	return I2CTx{bp}
+}
+
+// Tx writes w to the slave at addr, then reads len(r) bytes from it into
+// r, in one transaction with a repeated start in between. With r empty
+// the transaction only writes, with w empty it only reads, with both
+// empty it only addresses the slave, which tells whether it is there.
+// There is no limit on the lengths, the transaction goes through an
+// I2CPipeline. Errors are *OpErrors for the op i2c.Tx with Addr set, a
+// slave not acknowledging matches ErrNACK.
+func (t I2CTx) Tx(addr Addr, w, r []byte) error {
+	const op = "i2c.Tx"
+	if addr.GetAddrLen() != 7 {
+		return &OpError{op, MODE_I2C, addr, errors.New("only 7 bit addresses are supported")}
+	}
+
+	h, err := t.bp.EnterMode(MODE_I2C)
+	if err != nil {
+		return txError(op, MODE_I2C, addr, err)
+	}
+	pl := h.(BusPirateI2C).Pipeline()
+	a := uint8(addr.GetBaseAddr()) << 1
+	if len(w) > 0 || len(r) == 0 {
+		pl.Start()
+		pl.Write(a)
+		pl.Write(w...)
+	}
+	if len(r) > 0 {
+		pl.Start()
+		pl.Write(a | 1)
+		pl.Read(r, false)
+	}
+	pl.Stop()
+	if err := pl.Flush(); err != nil {
+		return txError(op, MODE_I2C, addr, err)
+	}
+	return nil
+}
+
+// Write writes w to the slave at addr in one transaction, see Tx.
+func (t I2CTx) Write(addr Addr, w ...byte) error {
+	return t.Tx(addr, w, nil)
+}
+
+// ReadReg reads len(r) bytes from register reg of the slave at addr, for
+// the common slaves that take a register address and read from there
+// after a repeated start, see Tx.
+func (t I2CTx) ReadReg(addr Addr, reg uint8, r []byte) error {
+	return t.Tx(addr, []byte{reg}, r)
+}
+
+// WriteReg writes w to register reg of the slave at addr, see Tx.
+func (t I2CTx) WriteReg(addr Addr, reg uint8, w ...byte) error {
+	return t.Tx(addr, append([]byte{reg}, w...), nil)
+}
+
+// SPITx does whole SPI transfers in one call each, entering SPI mode
+// whenever the bus pirate is not in it, like I2CTx.
+type SPITx struct {
+	bp *BusPirate
+}
+
+// SPI returns the one call transfers of bp. bp must be open.
+func (bp *BusPirate) SPI() SPITx {
+	return SPITx{bp}
+}
+
+// Tx selects the device, writes w, then clocks in len(r) bytes into r and
+// deselects the device, the shape of the register and memory reads of
+// most devices. What the device sends while w is written is dropped, use
+// SPITransfer on the BusPirateSPI for full duplex transfers. There is no
+// limit on the lengths. Errors are *OpErrors for the op spi.Tx.
+func (t SPITx) Tx(w, r []byte) error {
+	const op = "spi.Tx"
+	h, err := t.bp.EnterMode(MODE_SPI)
+	if err != nil {
+		return txError(op, MODE_SPI, nil, err)
+	}
+	buf := make([]byte, len(w)+len(r))
+	copy(buf, w)
+	if err := SPITransfer(h.(BusPirateSPI), buf, buf); err != nil {
+		return txError(op, MODE_SPI, nil, err)
+	}
+	copy(r, buf[len(w):])
+	return nil
+}
+
+// Write selects the device, writes w and deselects it, see Tx.
+func (t SPITx) Write(w ...byte) error {
+	return t.Tx(w, nil)
+}
+
+// txError returns err as an *OpError for op and addr, replacing the op of
+// the primitive that failed. mode is the mode of errors that are not
+// *OpErrors.
+func txError(op string, mode Mode, addr Addr, err error) error {
+	if oe, ok := err.(*OpError); ok {
+		return &OpError{op, oe.Mode, addr, oe.Err}
+	}
+	return &OpError{op, mode, addr, err}
+}
@@ -0,0 +1,63 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+// maxDeferred is the number of commands queued in unchecked mode before
+// they are sent on their own.
+const maxDeferred = 64
+
+// SetUnchecked turns unchecked mode on or off. In unchecked mode, Start,
+// Stop and WriteByte on the I2C handles of bp don't wait for the bus
+// pirate to acknowledge them: they queue their commands and return nil.
+// The queue is sent in one go and the answers are verified in bulk when
+// an answer is needed, by ReadByteAck or any other operation, when Flush
+// is called, or when maxDeferred commands are queued. A long sequence of
+// primitives then costs a few USB round trips instead of one per
+// primitive.
+//
+// The price is error locality, like with SetWriteCoalescing, which
+// unchecked mode extends to Start and Stop. A failure of a queued
+// command, like a NACK, is returned by the operation sending the queue,
+// its OpError names the command that failed. Queued commands are carried
+// out nonetheless. Operations other than ReadByteAck and I2CPipeline.Flush
+// are not carried out if sending the queue fails.
+//
+// Queued commands are dropped when the bus pirate changes modes or is
+// reset. Turning unchecked mode off sends the queue.
+func (bp *BusPirate) SetUnchecked(on bool) error {
+	return bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		defer func() { bp.report(err) }()
+
+		bp.unchecked = on
+		if !on {
+			return bp.settle()
+		}
+		return nil
+	})
+}
+
+// Flush sends the commands queued by unchecked mode and write coalescing
+// and verifies their answers. It returns the error of the first queued
+// command that failed.
+func (bp *BusPirate) Flush() error {
+	return bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		defer func() { bp.report(err) }()
+		return bp.settle()
+	})
+}
+
+// deferExch queues cmds in unchecked mode, behind the queued writes. The
+// queue is sent once it is full. The caller has to hold the lock.
+func (bp *BusPirate) deferExch(cmds ...exch) error {
+	bp.deferred = append(bp.pendingWrites(), cmds...)
+	if len(bp.deferred) < maxDeferred {
+		return nil
+	}
+	return bp.settle()
+}
@@ -0,0 +1,235 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/distributed/bp/wire"
+)
+
+// The types in this file are the settings a program takes from its
+// users, with parsers for flags and config files. They are flag.Values
+// and encoding.TextUnmarshalers, and take JSON numbers as well as
+// strings, so config files can say 400000 or "400k".
+
+// I2CSpeed is an I2C bus speed in Hz, see BusPirateI2C.SetSpeed.
+type I2CSpeed int
+
+const (
+	I2C5kHz   I2CSpeed = 5000
+	I2C50kHz  I2CSpeed = 50000
+	I2C100kHz I2CSpeed = 100000
+	I2C400kHz I2CSpeed = 400000
+)
+
+// ParseI2CSpeed parses a speed like "400k", "400kHz" or "400000", which
+// has to be one of the I2C speeds of the firmware.
+func ParseI2CSpeed(s string) (I2CSpeed, error) {
+	v, err := parseRate(s, "Hz")
+	if err == nil {
+		if _, ok := i2cspeeds[v]; !ok {
+			err = fmt.Errorf("not one of %s", rateList(i2cspeeds))
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("bp: invalid I2C speed %q: %v", s, err)
+	}
+	return I2CSpeed(v), nil
+}
+
+// String returns the speed like "400kHz".
+func (s I2CSpeed) String() string { return formatRate(int(s)) + "Hz" }
+
+func (s *I2CSpeed) Set(v string) (err error) {
+	*s, err = ParseI2CSpeed(v)
+	return err
+}
+
+func (s *I2CSpeed) UnmarshalText(b []byte) error { return s.Set(string(b)) }
+func (s *I2CSpeed) UnmarshalJSON(b []byte) error { return unmarshalJSON(b, s) }
+
+// SPISpeed is an SPI clock in Hz, see BusPirateSPI.SetSpeed.
+type SPISpeed int
+
+const (
+	SPI30kHz  SPISpeed = 30000
+	SPI125kHz SPISpeed = 125000
+	SPI250kHz SPISpeed = 250000
+	SPI1MHz   SPISpeed = 1000000
+	SPI2MHz   SPISpeed = 2000000
+	SPI2_6MHz SPISpeed = 2600000
+	SPI4MHz   SPISpeed = 4000000
+	SPI8MHz   SPISpeed = 8000000
+)
+
+// spispeeds maps the SPI speeds of the firmware to their command bits.
+var spispeeds = map[int]byte{
+	int(SPI30kHz):  wire.SPISpeed30kHz,
+	int(SPI125kHz): wire.SPISpeed125kHz,
+	int(SPI250kHz): wire.SPISpeed250kHz,
+	int(SPI1MHz):   wire.SPISpeed1MHz,
+	int(SPI2MHz):   wire.SPISpeed2MHz,
+	int(SPI2_6MHz): wire.SPISpeed2_6MHz,
+	int(SPI4MHz):   wire.SPISpeed4MHz,
+	int(SPI8MHz):   wire.SPISpeed8MHz,
+}
+
+// ParseSPISpeed parses a speed like "2.6M", "250kHz" or "1000000", which
+// has to be one of the SPI speeds of the firmware.
+func ParseSPISpeed(s string) (SPISpeed, error) {
+	v, err := parseRate(s, "Hz")
+	if err == nil {
+		if _, ok := spispeeds[v]; !ok {
+			err = fmt.Errorf("not one of %s", rateList(spispeeds))
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("bp: invalid SPI speed %q: %v", s, err)
+	}
+	return SPISpeed(v), nil
+}
+
+// String returns the speed like "2.6MHz".
+func (s SPISpeed) String() string { return formatRate(int(s)) + "Hz" }
+
+func (s *SPISpeed) Set(v string) (err error) {
+	*s, err = ParseSPISpeed(v)
+	return err
+}
+
+func (s *SPISpeed) UnmarshalText(b []byte) error { return s.Set(string(b)) }
+func (s *SPISpeed) UnmarshalJSON(b []byte) error { return unmarshalJSON(b, s) }
+
+// UARTBaud is the baud rate of a serial line, like the link to the bus
+// pirate, see SetBaudRate. Which rates work depends on the line, any
+// positive rate parses.
+type UARTBaud int
+
+// ParseUARTBaud parses a rate like "115200", "250k" or "1M".
+func ParseUARTBaud(s string) (UARTBaud, error) {
+	v, err := parseRate(s, "baud")
+	if err != nil {
+		return 0, fmt.Errorf("bp: invalid baud rate %q: %v", s, err)
+	}
+	return UARTBaud(v), nil
+}
+
+// String returns the rate in decimal, like "115200".
+func (b UARTBaud) String() string { return strconv.Itoa(int(b)) }
+
+func (b *UARTBaud) Set(v string) (err error) {
+	*b, err = ParseUARTBaud(v)
+	return err
+}
+
+func (b *UARTBaud) UnmarshalText(t []byte) error { return b.Set(string(t)) }
+func (b *UARTBaud) UnmarshalJSON(t []byte) error { return unmarshalJSON(t, b) }
+
+// ParsePeripherals parses peripherals as returned by Peripherals.String,
+// names separated by "|" or ",", like "power|pullups", or "none".
+func ParsePeripherals(s string) (Peripherals, error) {
+	var p Peripherals
+	s = strings.TrimSpace(s)
+	if s == "" || s == "none" {
+		return 0, nil
+	}
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == '|' || r == ',' }) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		found := false
+		for _, n := range periphnames {
+			if n.name == name {
+				p |= n.p
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("bp: invalid peripherals %q: unknown peripheral %q", s, name)
+		}
+	}
+	return p, nil
+}
+
+func (p *Peripherals) Set(v string) (err error) {
+	*p, err = ParsePeripherals(v)
+	return err
+}
+
+func (p *Peripherals) UnmarshalText(b []byte) error { return p.Set(string(b)) }
+
+// parseRate parses a positive rate with an optional k or M multiplier and
+// an optional unit, like "2.6MHz" with unit "Hz".
+func parseRate(s, unit string) (int, error) {
+	t := strings.TrimSpace(s)
+	if len(t) >= len(unit) && strings.EqualFold(t[len(t)-len(unit):], unit) {
+		t = strings.TrimSpace(t[:len(t)-len(unit)])
+	}
+	mult := 1.0
+	if n := len(t); n > 0 {
+		switch t[n-1] {
+		case 'k', 'K':
+			mult, t = 1e3, t[:n-1]
+		case 'M':
+			mult, t = 1e6, t[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(t, 64)
+	if err != nil {
+		return 0, fmt.Errorf("not a number")
+	}
+	v := math.Round(f * mult)
+	if v <= 0 || v > math.MaxInt32 || math.Abs(v-f*mult) > 1e-6*v {
+		return 0, fmt.Errorf("out of range")
+	}
+	return int(v), nil
+}
+
+// formatRate returns v with a k or M multiplier if that is exact, like
+// "2.6M".
+func formatRate(v int) string {
+	switch {
+	case v >= 1e6 && v%1e5 == 0:
+		return strconv.FormatFloat(float64(v)/1e6, 'f', -1, 64) + "M"
+	case v >= 1e3 && v%100 == 0:
+		return strconv.FormatFloat(float64(v)/1e3, 'f', -1, 64) + "k"
+	}
+	return strconv.Itoa(v)
+}
+
+// rateList returns the rates in m in ascending order, like "5k, 50k".
+func rateList(m map[int]byte) string {
+	var rates []int
+	for r := range m {
+		rates = append(rates, r)
+	}
+	sort.Ints(rates)
+	s := make([]string, len(rates))
+	for i, r := range rates {
+		s[i] = formatRate(r)
+	}
+	return strings.Join(s, ", ")
+}
+
+// unmarshalJSON unmarshals a JSON number or string into t.
+func unmarshalJSON(b []byte, t interface{ Set(string) error }) error {
+	var s string
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	} else {
+		var n json.Number
+		if err := json.Unmarshal(b, &n); err != nil {
+			return err
+		}
+		s = n.String()
+	}
+	return t.Set(s)
+}
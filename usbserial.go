@@ -0,0 +1,69 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// USBSerial returns the serial number of the USB device behind the serial
+// port at path, like the serial number of a bus pirate's FTDI chip. It is
+// only supported on Linux, where it is read from sysfs.
+func USBSerial(path string) (string, error) {
+	if runtime.GOOS != "linux" {
+		return "", fmt.Errorf("bp: reading USB serial numbers: %w", ErrNotSupported)
+	}
+
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	// the tty's device is the USB interface, or for usb-serial
+	// adapters a child of it. the serial number is a property of the
+	// USB device above the interface.
+	dir, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", filepath.Base(real), "device"))
+	if err != nil {
+		return "", fmt.Errorf("bp: %s is not a USB serial port", path)
+	}
+	for i := 0; i < 3; i++ {
+		b, err := os.ReadFile(filepath.Join(dir, "serial"))
+		if err == nil {
+			return strings.TrimSpace(string(b)), nil
+		}
+		dir = filepath.Dir(dir)
+	}
+	return "", fmt.Errorf("bp: USB device of %s has no serial number", path)
+}
+
+// FindSerial returns the serial port of the USB device with the serial
+// number serial, see USBSerial. If there is none, ErrNoBusPirate is
+// returned. Unlike FindBusPirates, it does not send anything to the ports.
+func FindSerial(serial string) (string, error) {
+	if runtime.GOOS != "linux" {
+		return "", fmt.Errorf("bp: finding USB serial numbers: %w", ErrNotSupported)
+	}
+
+	for _, path := range candidatePorts() {
+		if s, err := USBSerial(path); err == nil && s == serial {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%w with USB serial number %q", ErrNoBusPirate, serial)
+}
+
+// OpenSerial opens the bus pirate with the USB serial number serial with
+// OpenPath.
+func OpenSerial(serial string) (*BusPirate, error) {
+	path, err := FindSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+	return OpenPath(path)
+}
@@ -0,0 +1,76 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"fmt"
+
+	"github.com/distributed/bp/wire"
+)
+
+// The bus pirate v4 speaks the same binary protocol as the v3. It is a
+// USB CDC device, so the baud rate doesn't matter and it shows up as
+// /dev/ttyACMx on Linux. Its additions are only available through
+// commands v3 firmware doesn't know, they are guarded by capability
+// checks.
+
+// PullupVoltage is the voltage the on-board pull-up resistors of a bus
+// pirate v4 are connected to.
+type PullupVoltage byte
+
+const (
+	Pullup3V3 PullupVoltage = wire.PullupVoltage3V3
+	Pullup5V  PullupVoltage = wire.PullupVoltage5V
+)
+
+func (v PullupVoltage) String() string {
+	switch v {
+	case Pullup3V3:
+		return "3.3V"
+	case Pullup5V:
+		return "5V"
+	}
+	return fmt.Sprintf("PullupVoltage(%#02x)", byte(v))
+}
+
+// SetPullupVoltage selects the voltage of the on-board pull-up resistors.
+// Only the bus pirate v4 supports this, on other hardware ErrNotSupported
+// is returned. If the versions of the bus pirate are not known yet, they
+// are queried first, see Version.
+func (inf BusPirateI2C) SetPullupVoltage(v PullupVoltage) error {
+	return inf.bp.do(func() error { return inf.setPullupVoltage(v) })
+}
+
+func (inf BusPirateI2C) setPullupVoltage(v PullupVoltage) (err error) {
+	bp := inf.bp
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+	defer func() { bp.report(err) }()
+
+	if err := inf.check("i2c.SetPullupVoltage"); err != nil {
+		return err
+	}
+	if err := bp.settle(); err != nil {
+		return err
+	}
+
+	if v != Pullup3V3 && v != Pullup5V {
+		return &OpError{"i2c.SetPullupVoltage", MODE_I2C, nil, fmt.Errorf("invalid pull-up voltage %#02x", byte(v))}
+	}
+
+	if _, err := bp.queryVersion(); err != nil {
+		return err
+	}
+	if err := bp.supports("i2c.SetPullupVoltage", func(c Capabilities) bool { return c.PullupVoltage }); err != nil {
+		return err
+	}
+
+	bp.stats.Commands++
+	if err := bp.exchangeByteAndExpect(wire.I2CPullupVoltage|byte(v), wire.OK); err != nil {
+		return &OpError{"i2c.SetPullupVoltage", MODE_I2C, nil, err}
+	}
+	bp.i2cconf.pullup = v
+	return nil
+}
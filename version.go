@@ -0,0 +1,168 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/distributed/bp/wire"
+)
+
+// VersionInfo holds the versions a bus pirate reports about itself.
+type VersionInfo struct {
+	// Hardware, Firmware and Bootloader are the versions as reported,
+	// like "v3.5", "v6.1 r1676" and "v4.4".
+	Hardware   string
+	Firmware   string
+	Bootloader string
+
+	// FirmwareMajor, FirmwareMinor and FirmwareRevision are parsed from
+	// Firmware. FirmwareRevision is the SVN revision, 0 if unknown.
+	FirmwareMajor    int
+	FirmwareMinor    int
+	FirmwareRevision int
+
+	// Info is the complete version information as printed by the
+	// terminal.
+	Info string
+}
+
+// HardwareMajor returns the major hardware version, like 3 for "v3.5", 4
+// for "v4" or 5 for "5 REV10", and 0 if it is not known.
+func (v VersionInfo) HardwareMajor() int {
+	m := hwversionre.FindStringSubmatch(v.Hardware)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+// FirmwareAtLeast reports whether the firmware version is at least
+// major.minor.
+func (v VersionInfo) FirmwareAtLeast(major, minor int) bool {
+	if v.FirmwareMajor != major {
+		return v.FirmwareMajor > major
+	}
+	return v.FirmwareMinor >= minor
+}
+
+var (
+	fwversionre  = regexp.MustCompile(`v(\d+)\.(\d+)`)
+	fwrevisionre = regexp.MustCompile(`\br(\d+)\b`)
+	hwversionre  = regexp.MustCompile(`^v?(\d+)`)
+)
+
+// parseInfo parses the output of the terminal's 'i' command, which is
+// also printed when the bus pirate resets. Lines not belonging to the
+// version information, like echoed input and prompts, are skipped.
+func parseInfo(text string) VersionInfo {
+	var (
+		v    VersionInfo
+		info []string
+	)
+	for _, l := range strings.Split(text, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || len(l) == 1 || strings.HasSuffix(l, ">") {
+			// echo and prompt
+			continue
+		}
+		switch {
+		case strings.HasPrefix(l, "Bus Pirate "):
+			v.Hardware = strings.TrimPrefix(l, "Bus Pirate ")
+		case strings.Contains(l, "Firmware "):
+			// "Firmware v6.1 r1676  Bootloader v4.4", community
+			// firmware says "Community Firmware v7.1 - ..."
+			fw := l[strings.Index(l, "Firmware ")+len("Firmware "):]
+			if i := strings.Index(fw, "Bootloader "); i >= 0 {
+				v.Bootloader = strings.TrimSpace(fw[i+len("Bootloader "):])
+				fw = fw[:i]
+			}
+			v.Firmware = strings.TrimSpace(fw)
+			if m := fwversionre.FindStringSubmatch(v.Firmware); m != nil {
+				v.FirmwareMajor, _ = strconv.Atoi(m[1])
+				v.FirmwareMinor, _ = strconv.Atoi(m[2])
+			}
+			if m := fwrevisionre.FindStringSubmatch(v.Firmware); m != nil {
+				v.FirmwareRevision, _ = strconv.Atoi(m[1])
+			}
+		}
+		info = append(info, l)
+	}
+	v.Info = strings.Join(info, "\n")
+	return v
+}
+
+// Version queries the versions of the bus pirate. There is no binary
+// command for that, so the bus pirate is reset into its terminal, which
+// prints the versions, and then brought back into binary mode and the
+// mode that was active before. Mode handles remain usable. The result is
+// cached, later calls don't talk to the device.
+func (bp *BusPirate) Version() (v VersionInfo, err error) {
+	err = bp.do(func() (err error) {
+		bp.mu.Lock()
+		defer bp.unlock(&err)
+		v, err = bp.queryVersion()
+		return bp.report(err)
+	})
+	return v, err
+}
+
+func (bp *BusPirate) queryVersion() (VersionInfo, error) {
+	if bp.version != nil {
+		return *bp.version, nil
+	}
+
+	mode := bp.mode
+	switch mode {
+	case MODE_CLOSED:
+		return VersionInfo{}, &OpError{"Version", mode, nil, ErrNotOpen}
+	case MODE_UNKNOWN, MODE_I2C_SNIFF:
+		return VersionInfo{}, &OpError{"Version", mode, nil, ModeError("can't query version in " + mode.String() + " mode")}
+	}
+
+	prevgen := bp.gen
+	if mode != MODE_BITBANG {
+		if err := bp.enterBitbangMode(); err != nil {
+			return VersionInfo{}, &OpError{"Version", mode, nil, err}
+		}
+	}
+
+	// resets the bus pirate, it prints its versions like 'i' does
+	if err := bp.exchangeByteAndExpect(wire.ResetTerminal, wire.OK); err != nil {
+		bp.clearMode()
+		return VersionInfo{}, &OpError{"Version", mode, nil, err}
+	}
+	bp.clearMode()
+	if err := bp.resetBaud(); err != nil {
+		return VersionInfo{}, &OpError{"Version", mode, nil, err}
+	}
+
+	// give the firmware time to reboot
+	if err := bp.c.SetReadParams(0, 0.5); err != nil {
+		return VersionInfo{}, &OpError{"Version", mode, nil, err}
+	}
+	text, err := readQuiet(bp.c)
+	if err != nil {
+		return VersionInfo{}, &OpError{"Version", mode, nil, err}
+	}
+	v := parseInfo(string(text))
+	bp.logf(SubsysOpen, LogDebug, "version: hardware %s firmware %s bootloader %s", v.Hardware, v.Firmware, v.Bootloader)
+
+	if err := bp.enterBinary(); err != nil {
+		return VersionInfo{}, err
+	}
+	if err := bp.restore(mode, prevgen); err != nil {
+		return VersionInfo{}, err
+	}
+
+	if v.Hardware == "" {
+		return VersionInfo{}, &OpError{"Version", mode, nil, ErrNoBusPirate}
+	}
+	bp.version = &v
+	return v, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package bp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distributed/bp/wire"
+)
+
+// ErrWedged is matched by the errors the watchdog reports when the bus
+// pirate stopped answering, see SetWatchdog.
+var ErrWedged = errors.New("bus pirate stopped responding")
+
+type wedgedError struct {
+	err error
+}
+
+func (e *wedgedError) Error() string {
+	return ErrWedged.Error() + ": " + e.err.Error()
+}
+
+func (e *wedgedError) Unwrap() error {
+	return e.err
+}
+
+func (e *wedgedError) Is(target error) bool {
+	return target == ErrWedged
+}
+
+func (e *wedgedError) Timeout() bool   { return false }
+func (e *wedgedError) Temporary() bool { return false }
+
+type watchdog struct {
+	interval time.Duration
+	ch       chan<- error
+	stop     chan struct{}
+}
+
+// SetWatchdog makes bp check that the bus pirate still responds whenever
+// the link has been idle for interval. The check asks for the version of
+// the current mode, which changes no state of the device, and is only
+// done in bitbang and I2C mode. If the bus pirate does not answer
+// properly, it is flagged as wedged: Wedged returns the error, which
+// matches ErrWedged, and the error is sent on ch if ch is not nil. bp does
+// not block sending on ch. The flag is cleared when a later check
+// succeeds. Automatic resync and reconnect apply to the check like to any
+// other operation. An interval of 0 stops the watchdog, so does Close.
+func (bp *BusPirate) SetWatchdog(interval time.Duration, ch chan<- error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	bp.stopWatchdog()
+	if interval <= 0 {
+		return
+	}
+	w := &watchdog{interval: interval, ch: ch, stop: make(chan struct{})}
+	bp.watchdog = w
+	go bp.runWatchdog(w)
+}
+
+// Wedged returns the error of the last failed watchdog check, nil if the
+// bus pirate answered the last check or no check failed yet.
+func (bp *BusPirate) Wedged() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.wedged
+}
+
+// stopWatchdog stops the running watchdog, if any. The caller has to hold
+// the lock.
+func (bp *BusPirate) stopWatchdog() {
+	if bp.watchdog == nil {
+		return
+	}
+	close(bp.watchdog.stop)
+	bp.watchdog = nil
+	bp.wedged = nil
+}
+
+func (bp *BusPirate) runWatchdog(w *watchdog) {
+	for {
+		wait := w.interval - bp.link.idle()
+		if wait <= 0 {
+			bp.do(func() error {
+				bp.watchdogCheck(w)
+				return nil
+			})
+			wait = w.interval
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (bp *BusPirate) watchdogCheck(w *watchdog) {
+	var err error
+	bp.mu.Lock()
+	defer bp.unlock(&err)
+
+	// the watchdog may have been replaced or traffic may have happened
+	// while waiting for the lock
+	if bp.watchdog != w || bp.link.idle() < w.interval {
+		return
+	}
+	// a transaction with queued commands is running, see
+	// SetWriteCoalescing and SetUnchecked
+	if len(bp.wpending) > 0 || len(bp.deferred) > 0 {
+		return
+	}
+
+	mode := bp.mode
+	switch mode {
+	case MODE_BITBANG:
+		err = bp.ping(wire.Reset, wire.BitbangBanner)
+	case MODE_I2C:
+		err = bp.ping(wire.I2CVersion, wire.I2CBanner)
+	case MODE_SPI:
+		err = bp.ping(wire.SPIVersion, wire.SPIBanner)
+	default:
+		return
+	}
+
+	if err != nil {
+		werr := &OpError{"Watchdog", mode, nil, &wedgedError{err}}
+		bp.logf(SubsysOpen, LogError, "%v", werr)
+		bp.wedged = werr
+		if w.ch != nil {
+			select {
+			case w.ch <- werr:
+			default:
+			}
+		}
+		return
+	}
+	if bp.wedged != nil {
+		bp.logf(SubsysOpen, LogInfo, "watchdog: bus pirate responds again")
+		bp.wedged = nil
+	}
+}
+
+// ping sends cmd, which has to be answered with the banner of the current
+// mode and its version.
+func (bp *BusPirate) ping(cmd byte, prefix string) error {
+	if err := bp.writeByte(cmd); err != nil {
+		return err
+	}
+	v, err := bp.readBanner(cmd, prefix)
+	if err != nil {
+		if isProtocolError(err) {
+			bp.suspicious()
+		}
+		return err
+	}
+	if int(v-'0') != bp.modeversion {
+		bp.suspicious()
+		return fmt.Errorf("%w: mode version %q, want %d", ErrUnexpectedResponse, v, bp.modeversion)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2012 Michael Meier. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package wire describes the binary protocol of the bus pirate: the
+// command bytes, the answers and the framing of the commands that take
+// more than one byte. It is the single source of truth for package bp,
+// its simulator and external tools like fuzzers or dissectors.
+//
+// The bus pirate starts in its text terminal. Twenty 0x00 bytes in a row
+// switch it into binary bitbang mode, which answers with the banner
+// "BBIO1". From bitbang mode, the protocol modes are entered with a
+// single command byte, each answers with its own banner and version, like
+// "I2C1". A 0x00 sent in a protocol mode leads back to bitbang mode,
+// which again answers "BBIO1".
+//
+// Most commands are answered with OK, a few with data. Banners are
+// followed by a single version character, the banner constants in this
+// package don't include it.
+package wire
+
+// Answers shared by the modes.
+const (
+	OK   = 0x01 // command accepted, or all bytes written were ACKed
+	Fail = 0x00 // command failed, or a byte written was NACKed
+)
+
+// Bitbang mode commands.
+const (
+	Reset     = 0x00 // (re)enter bitbang mode, answered with BitbangBanner
+	EnterSPI  = 0x01 // answered with SPIBanner
+	EnterI2C  = 0x02 // answered with I2CBanner
+	EnterUART = 0x03 // answered with UARTBanner
+	Enter1W   = 0x04 // answered with OneWireBanner
+	EnterRaw  = 0x05 // answered with RawBanner
+
+	// ResetTerminal leaves binary mode. It is answered with OK, after
+	// which the bus pirate resets and prints its version information in
+	// the text terminal.
+	ResetTerminal = 0x0f
+
+	// PinDirection, or'ed with 5 bits, sets the direction of the AUX,
+	// MOSI, CLK, MISO and CS pins, 1 for input. PinState, or'ed with 7
+	// bits, sets the power, pull-up, AUX, MOSI, CLK, MISO and CS pins.
+	// Both are answered with the state of the pins.
+	PinDirection = 0x40
+	PinState     = 0x80
+)
+
+// Banners, without the version character.
+const (
+	BitbangBanner = "BBIO"
+	SPIBanner     = "SPI"
+	I2CBanner     = "I2C"
+	UARTBanner    = "ART"
+	OneWireBanner = "1W0"
+	RawBanner     = "RAW"
+)
+
+// I2C mode commands. All of them are answered with OK unless noted
+// otherwise.
+const (
+	I2CExit    = Reset // back to bitbang mode, answered with BitbangBanner
+	I2CVersion = 0x01  // answered with I2CBanner and the version
+	I2CStart   = 0x02
+	I2CStop    = 0x03
+	I2CRead    = 0x04 // answered with the byte read
+	I2CACK     = 0x06 // ACK the byte read
+	I2CNACK    = 0x07 // NACK the byte read
+
+	// I2CWriteThenRead is followed by a header of the write and read
+	// counts, see WriteThenRead.
+	I2CWriteThenRead = 0x08
+
+	// I2CAUX is followed by one of the AUX values, both bytes are
+	// answered with OK, except for AUXRead, which is answered with the
+	// level of the pin, 0x00 or 0x01. Firmware v6.1 and later.
+	I2CAUX = 0x09
+
+	// I2CSniff starts the sniffer, see the Sniff constants. Any byte
+	// ends it, which is answered with OK.
+	I2CSniff = 0x0f
+
+	// I2CBulkWrite is or'ed with the number of bytes to write minus
+	// one, see BulkWrite. The bytes follow the command, each is
+	// answered with 0x00 for ACK or 0x01 for NACK.
+	I2CBulkWrite = 0x10
+
+	// I2CPeripherals is or'ed with the Periph bits.
+	I2CPeripherals = 0x40
+
+	// I2CPullupVoltage is or'ed with PullupVoltage3V3 or
+	// PullupVoltage5V. Only v4 hardware knows it.
+	I2CPullupVoltage = 0x50
+
+	// I2CSpeed is or'ed with one of the Speed values.
+	I2CSpeed = 0x60
+)
+
+// Bits for I2CPeripherals.
+const (
+	PeriphCS      = 0x01
+	PeriphAUX     = 0x02
+	PeriphPullups = 0x04
+	PeriphPower   = 0x08
+)
+
+// Values for I2CAUX. AUXUseAUX and AUXUseCS select the pin the others
+// act on, AUX unless told otherwise.
+const (
+	AUXLow    = 0x00
+	AUXHigh   = 0x01
+	AUXHiZ    = 0x02
+	AUXRead   = 0x03
+	AUXUseAUX = 0x10
+	AUXUseCS  = 0x20
+)
+
+// Values for I2CPullupVoltage.
+const (
+	PullupVoltage3V3 = 0x01
+	PullupVoltage5V  = 0x02
+)
+
+// Values for I2CSpeed.
+const (
+	Speed5kHz   = 0x00
+	Speed50kHz  = 0x01
+	Speed100kHz = 0x02
+	Speed400kHz = 0x03
+)
+
+// Limits of the multi byte I2C commands.
+const (
+	MaxBulkWrite     = 16
+	MaxWriteThenRead = 4096 // for both the write and the read count
+)
+
+// BulkWrite returns the command byte for writing n bytes, 1 <= n <=
+// MaxBulkWrite.
+func BulkWrite(n int) byte {
+	if n < 1 || n > MaxBulkWrite {
+		panic("wire: bulk write count out of range")
+	}
+	return I2CBulkWrite | byte(n-1)
+}
+
+// WriteThenRead returns the command for a write then read of w bytes
+// written and r bytes read: the command byte followed by both counts as
+// big endian 16 bit numbers. The bytes to write follow it. The bus pirate
+// answers with OK if all bytes were ACKed, followed by the r bytes read,
+// or with Fail as soon as a byte was NACKed. Start and stop conditions
+// are part of the command.
+func WriteThenRead(w, r int) [5]byte {
+	if w < 0 || w > MaxWriteThenRead || r < 0 || r > MaxWriteThenRead {
+		panic("wire: write then read count out of range")
+	}
+	return [5]byte{I2CWriteThenRead, byte(w >> 8), byte(w), byte(r >> 8), byte(r)}
+}
+
+// SPI mode commands. All of them are answered with OK unless noted
+// otherwise.
+const (
+	SPIExit    = Reset // back to bitbang mode, answered with BitbangBanner
+	SPIVersion = 0x01  // answered with SPIBanner and the version
+	SPICSLow   = 0x02  // chip select low, which selects the device
+	SPICSHigh  = 0x03
+
+	// SPIAUX is I2CAUX for SPI mode, with the same values.
+	SPIAUX = 0x09
+
+	// SPIBulkTransfer is or'ed with the number of bytes to transfer
+	// minus one, see BulkTransfer. The bytes follow the command, each
+	// is answered with the byte clocked in while it was clocked out.
+	SPIBulkTransfer = 0x10
+
+	// SPIPeripherals is or'ed with the Periph bits.
+	SPIPeripherals = 0x40
+
+	// SPISpeed is or'ed with one of the SPISpeed values.
+	SPISpeed = 0x60
+
+	// SPIConfig is or'ed with the SPIConfig bits.
+	SPIConfig = 0x80
+)
+
+// Values for SPISpeed.
+const (
+	SPISpeed30kHz  = 0x00
+	SPISpeed125kHz = 0x01
+	SPISpeed250kHz = 0x02
+	SPISpeed1MHz   = 0x03
+	SPISpeed2MHz   = 0x04
+	SPISpeed2_6MHz = 0x05
+	SPISpeed4MHz   = 0x06
+	SPISpeed8MHz   = 0x07
+)
+
+// Bits for SPIConfig. Entering SPI mode sets SPIConfigActiveToIdle, an
+// idle low clock and open drain outputs, which is SPI mode 0.
+const (
+	SPIConfigSampleEnd    = 0x01 // sample the input at the end of the bit
+	SPIConfigActiveToIdle = 0x02 // output changes on the active to idle clock edge
+	SPIConfigIdleHigh     = 0x04 // the clock idles high
+	SPIConfigOutput3V3    = 0x08 // drive the outputs to 3.3V, open drain otherwise
+)
+
+// MaxBulkTransfer is the most bytes transferred by one SPI bulk
+// transfer.
+const MaxBulkTransfer = 16
+
+// BulkTransfer returns the command byte for transferring n bytes, 1 <= n
+// <= MaxBulkTransfer.
+func BulkTransfer(n int) byte {
+	if n < 1 || n > MaxBulkTransfer {
+		panic("wire: bulk transfer count out of range")
+	}
+	return SPIBulkTransfer | byte(n-1)
+}
+
+// The sniffer reports the traffic on the bus as a stream of these bytes.
+// Each byte on the bus is sent as SniffEscape, the byte and SniffACK or
+// SniffNACK.
+const (
+	SniffStart  = '['
+	SniffStop   = ']'
+	SniffEscape = '\\'
+	SniffACK    = '+'
+	SniffNACK   = '-'
+)